@@ -0,0 +1,105 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/neilalexander/yggmail/internal/archive"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+func export(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	format := fs.String("format", archive.FormatMaildir, "Format to export to, either \"mbox\" or \"maildir\"")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail export [options] <directory> [mailbox ...]")
+		fmt.Println()
+		fmt.Println("All mailboxes apart from the Outbox are exported if none are given.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+	if err := unlockStorage(log, storage, ""); err != nil {
+		log.Println("Failed to unlock the database:", err)
+		os.Exit(1)
+	}
+
+	logs, _ := logging.New(log.Writer(), logging.FormatText)
+	if err := archive.Export(logs.For(logging.Storage), storage, fs.Arg(0), *format, fs.Args()[1:]); err != nil {
+		log.Println("Failed to export:", err)
+		os.Exit(1)
+	}
+}
+
+func importArchive(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	prefix := fs.String("into", "", "Import below this mailbox rather than at the top level")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail import [options] <mbox file or directory> [mailbox ...]")
+		fmt.Println()
+		fmt.Println("The path can be an mbox file, a Maildir, or a directory of either. All")
+		fmt.Println("mailboxes found are imported if none are given. Mail that has already")
+		fmt.Println("been imported is skipped, so it is safe to import again.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+	if err := unlockStorage(log, storage, ""); err != nil {
+		log.Println("Failed to unlock the database:", err)
+		os.Exit(1)
+	}
+
+	logs, _ := logging.New(log.Writer(), logging.FormatText)
+	importer := &archive.Importer{
+		Log:     logs.For(logging.Storage),
+		Storage: storage,
+		Prefix:  *prefix,
+	}
+	err = importer.Import(fs.Arg(0), fs.Args()[1:])
+	log.Printf("Imported %d mails, skipped %d that were already there\n", importer.Imported, importer.Skipped)
+	if err != nil {
+		log.Println("Failed to import:", err)
+		os.Exit(1)
+	}
+}
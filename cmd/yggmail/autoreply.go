@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+func autoreply(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("autoreply", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	subject := fs.String("subject", "", "Subject of the automatic reply (defaults to \"Auto: \" and the original subject)")
+	body := fs.String("message", "", "Text of the automatic reply")
+	days := fs.Int("days", 0, "Minimum number of days between replies to the same sender")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail autoreply [options] status")
+		fmt.Println("  yggmail autoreply [options] on")
+		fmt.Println("  yggmail autoreply [options] off")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	a, err := config.LoadAutoReply(storage)
+	if err != nil {
+		log.Println("Failed to load auto-reply settings:", err)
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "subject":
+			a.Subject = *subject
+		case "message":
+			a.Body = *body
+		case "days":
+			a.Days = *days
+		}
+	})
+
+	switch fs.Arg(0) {
+	case "status":
+		if a.Enabled {
+			fmt.Println("Enabled: yes")
+		} else {
+			fmt.Println("Enabled: no")
+		}
+		fmt.Printf("Days: %d\n", a.Days)
+		fmt.Printf("Subject: %s\n", a.Subject)
+		fmt.Println()
+		fmt.Println(a.Body)
+		return
+
+	case "on":
+		if a.Body == "" {
+			log.Println("An auto-reply message must be given with -message")
+			os.Exit(1)
+		}
+		a.Enabled = true
+
+	case "off":
+		a.Enabled = false
+
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := a.Save(storage); err != nil {
+		log.Println("Failed to save auto-reply settings:", err)
+		os.Exit(1)
+	}
+	if a.Enabled {
+		log.Printf("Auto-reply is enabled, replying to each sender at most once every %d days\n", a.Days)
+	} else {
+		log.Println("Auto-reply is disabled")
+	}
+}
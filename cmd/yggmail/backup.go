@@ -0,0 +1,117 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/neilalexander/yggmail/internal/backup"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+// backupPassphraseEnv is where the passphrase for encrypted backups is taken
+// from when it shouldn't be prompted for, i.e. for scheduled backups.
+const backupPassphraseEnv = "YGGMAIL_BACKUP_PASSPHRASE"
+
+func backupDatabase(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the backup with a passphrase, taken from $"+backupPassphraseEnv+" if set")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail backup [options] <file>")
+		fmt.Println()
+		fmt.Println("The backup can be taken while Yggmail is running.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*database); err != nil {
+		log.Println("Failed to open the database:", err)
+		os.Exit(1)
+	}
+
+	passphrase := ""
+	if *encrypt {
+		passphrase = readPassphrase(log, true)
+	}
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	if err := backup.Create(storage, *database, fs.Arg(0), passphrase); err != nil {
+		log.Println("Failed to back up the database:", err)
+		os.Exit(1)
+	}
+	log.Printf("Backed up %q to %q\n", *database, fs.Arg(0))
+}
+
+func restoreDatabase(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	force := fs.Bool("force", false, "Replace the database if it already exists")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail restore [options] <file>")
+		fmt.Println()
+		fmt.Println("Yggmail must not be running while the database is restored.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*database); err == nil && !*force {
+		log.Printf("The database %q already exists, use -force to replace it\n", *database)
+		os.Exit(1)
+	}
+
+	encrypted, err := backup.IsEncrypted(fs.Arg(0))
+	if err != nil {
+		log.Println("Failed to open the backup:", err)
+		os.Exit(1)
+	}
+	passphrase := ""
+	if encrypted {
+		passphrase = readPassphrase(log, false)
+	}
+
+	if err := backup.Restore(fs.Arg(0), *database, passphrase); err != nil {
+		log.Println("Failed to restore the database:", err)
+		os.Exit(1)
+	}
+	log.Printf("Restored %q from %q\n", *database, fs.Arg(0))
+}
+
+// readPassphrase takes the backup passphrase from the environment, or asks
+// for it if it isn't set there. A new passphrase is asked for twice.
+func readPassphrase(log *log.Logger, confirm bool) string {
+	if passphrase := os.Getenv(backupPassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+	return promptPassphrase(log, "backup passphrase", confirm)
+}
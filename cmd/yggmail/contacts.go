@@ -0,0 +1,97 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+func contacts(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("contacts", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail contacts [options] list")
+		fmt.Println("  yggmail contacts [options] add <name> <key> [display name]")
+		fmt.Println("  yggmail contacts [options] remove <name>")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	switch fs.Arg(0) {
+	case "list":
+		contacts, err := storage.ContactList()
+		if err != nil {
+			log.Println("Failed to list contacts:", err)
+			os.Exit(1)
+		}
+		for _, contact := range contacts {
+			fmt.Printf("%s\t%s@%s\t%s\n", contact.Name, contact.Key, utils.Domain, contact.DisplayName)
+		}
+
+	case "add":
+		if fs.NArg() < 3 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		name, key := fs.Arg(1), fs.Arg(2)
+		if strings.Contains(name, "@") {
+			log.Println("The contact name should not contain an '@'")
+			os.Exit(1)
+		}
+		pk, err := utils.ParseKey(strings.TrimSuffix(key, "@"+utils.Domain))
+		if err != nil {
+			log.Printf("The key %q is not valid: %s\n", fs.Arg(2), err)
+			os.Exit(1)
+		}
+		display := strings.Join(fs.Args()[3:], " ")
+		if err := storage.ContactSet(name, utils.EncodeKey(pk), display); err != nil {
+			log.Println("Failed to add contact:", err)
+			os.Exit(1)
+		}
+		log.Printf("Contact %q can now be reached at %s@%s\n", name, name, utils.Domain)
+
+	case "remove":
+		if fs.NArg() < 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		deleted, err := storage.ContactDelete(fs.Arg(1))
+		if err != nil {
+			log.Println("Failed to remove contact:", err)
+			os.Exit(1)
+		}
+		if deleted == 0 {
+			log.Printf("There is no contact called %q\n", fs.Arg(1))
+			os.Exit(1)
+		}
+		log.Printf("Contact %q has been removed\n", fs.Arg(1))
+
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
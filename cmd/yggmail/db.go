@@ -0,0 +1,77 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+func databaseCommand(log *log.Logger, args []string) {
+	usage := func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail db version [-database=yggmail.db]")
+		fmt.Println("  yggmail db migrate [-database=yggmail.db] [-dry-run]")
+		fmt.Println()
+		fmt.Println("Yggmail migrates the database when it starts, so this is only needed")
+		fmt.Println("to see what would change, or to migrate without starting Yggmail. A")
+		fmt.Println("backup of the database is taken before it is migrated.")
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	dryRun := fs.Bool("dry-run", false, "Show the migrations that would be applied without applying them")
+	fs.Usage = usage
+	_ = fs.Parse(args[1:])
+	if _, err := os.Stat(*database); err != nil {
+		log.Println("Failed to open the database:", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "version":
+		version, err := sqlite3.DatabaseVersion(*database)
+		if err != nil {
+			log.Println("Failed to read the schema version:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Database schema version: %d\n", version)
+		fmt.Printf("Supported schema version: %d\n", sqlite3.SchemaVersion)
+
+	case "migrate":
+		migrations, err := sqlite3.Migrate(*database, *dryRun)
+		if err != nil {
+			log.Println("Failed to migrate the database:", err)
+			os.Exit(1)
+		}
+		if len(migrations) == 0 {
+			log.Println("The database is already up to date")
+			return
+		}
+		for _, m := range migrations {
+			if *dryRun {
+				log.Printf("Would apply migration %d: %s\n", m.Version, m.Description)
+			} else {
+				log.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+			}
+		}
+
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+// The passphrase for an encrypted database can be given in the environment,
+// either directly or in a keyfile, so that Yggmail can start unattended.
+// A new passphrase can also be given in the environment when encryption is
+// enabled or the passphrase is changed.
+const (
+	passphraseEnv    = "YGGMAIL_PASSPHRASE"
+	keyfileEnv       = "YGGMAIL_KEYFILE"
+	newPassphraseEnv = "YGGMAIL_NEW_PASSPHRASE"
+)
+
+func encryption(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("encryption", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	keyfile := fs.String("keyfile", "", "File containing the current passphrase, rather than asking for it")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail encryption [options] status")
+		fmt.Println("  yggmail encryption [options] enable")
+		fmt.Println("  yggmail encryption [options] disable")
+		fmt.Println("  yggmail encryption [options] passphrase")
+		fmt.Println("  yggmail encryption [options] rotate")
+		fmt.Println()
+		fmt.Println("Yggmail must not be running while encryption is changed.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	command := fs.Arg(0)
+	switch command {
+	case "status":
+		if storage.EncryptionEnabled() {
+			fmt.Println("The database is encrypted")
+		} else {
+			fmt.Println("The database is not encrypted")
+		}
+		return
+
+	case "enable":
+		if storage.EncryptionEnabled() {
+			log.Println("The database is already encrypted")
+			os.Exit(1)
+		}
+		passphrase := newStoragePassphrase(log)
+		if err := storage.EnableEncryption(passphrase); err != nil {
+			log.Println("Failed to encrypt the database:", err)
+			os.Exit(1)
+		}
+		log.Println("The database is now encrypted")
+		removeOldBackups(log, *database)
+		return
+
+	case "disable", "passphrase", "rotate":
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if !storage.EncryptionEnabled() {
+		log.Println("The database is not encrypted")
+		os.Exit(1)
+	}
+	current, err := readStoragePassphrase(log, *keyfile, "current passphrase")
+	if err != nil {
+		log.Println("Failed to read the passphrase:", err)
+		os.Exit(1)
+	}
+	if err := storage.Unlock(current); err != nil {
+		log.Println("Failed to unlock the database:", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "disable":
+		err = storage.DisableEncryption()
+	case "passphrase":
+		err = storage.ChangePassphrase(current, newStoragePassphrase(log))
+	case "rotate":
+		err = storage.RotateKey(current)
+	}
+	if err != nil {
+		log.Printf("Failed to %s: %s\n", command, err)
+		os.Exit(1)
+	}
+	switch command {
+	case "disable":
+		log.Println("The database is no longer encrypted")
+	case "passphrase":
+		log.Println("The passphrase has been changed")
+	case "rotate":
+		log.Println("The database has been encrypted with a new key")
+	}
+	if command != "disable" {
+		removeOldBackups(log, *database)
+	}
+}
+
+// removeOldBackups offers to delete the backups that were taken before the
+// database was migrated, which are either not encrypted or encrypted with
+// the old key, and so would give away what encrypting was meant to protect.
+func removeOldBackups(log *log.Logger, database string) {
+	backups, err := filepath.Glob(database + ".v*.bak")
+	if err != nil || len(backups) == 0 {
+		return
+	}
+	log.Println("These backups were taken before the database was migrated, and are not protected by the new key:")
+	for _, backup := range backups {
+		log.Println("  " + backup)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Println("Delete them, or move them somewhere safe, so that they can't be read")
+		return
+	}
+	log.Println("Delete them now? [y/N]")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+		log.Println("Keeping them, so delete them or move them somewhere safe yourself")
+		return
+	}
+	for _, backup := range backups {
+		if err := os.Remove(backup); err != nil {
+			log.Println("Failed to delete backup:", err)
+			continue
+		}
+		log.Println("Deleted", backup)
+	}
+}
+
+// lockedStorage is implemented by storage backends that can be encrypted.
+type lockedStorage interface {
+	EncryptionEnabled() bool
+	Unlock(passphrase string) error
+}
+
+// unlockStorage unlocks an encrypted database, if it is encrypted, with the
+// passphrase from the keyfile, the environment or the terminal. Backends
+// that can't be encrypted are left alone.
+func unlockStorage(log *log.Logger, s interface{}, keyfile string) error {
+	storage, ok := s.(lockedStorage)
+	if !ok || !storage.EncryptionEnabled() {
+		return nil
+	}
+	passphrase, err := readStoragePassphrase(log, keyfile, "database passphrase")
+	if err != nil {
+		return err
+	}
+	if err := storage.Unlock(passphrase); err != nil {
+		return fmt.Errorf("storage.Unlock: %w", err)
+	}
+	return nil
+}
+
+func readStoragePassphrase(log *log.Logger, keyfile, what string) (string, error) {
+	if keyfile == "" {
+		keyfile = os.Getenv(keyfileEnv)
+	}
+	if keyfile != "" {
+		contents, err := os.ReadFile(keyfile)
+		if err != nil {
+			return "", fmt.Errorf("os.ReadFile: %w", err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("the database is encrypted but no passphrase was given")
+	}
+	return promptPassphrase(log, what, false), nil
+}
+
+func newStoragePassphrase(log *log.Logger) string {
+	if passphrase := os.Getenv(newPassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+	return promptPassphrase(log, "new passphrase", true)
+}
+
+func promptPassphrase(log *log.Logger, what string, confirm bool) string {
+	log.Printf("Please enter the %s:\n", what)
+	passphrase1, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println()
+	if confirm {
+		log.Printf("Please enter the %s again:\n", what)
+		passphrase2, err := term.ReadPassword(int(os.Stdin.Fd()))
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println()
+		if !bytes.Equal(passphrase1, passphrase2) {
+			log.Println("The supplied passphrases do not match")
+			os.Exit(1)
+		}
+	}
+	if len(passphrase1) == 0 {
+		log.Println("The passphrase cannot be blank")
+		os.Exit(1)
+	}
+	return string(passphrase1)
+}
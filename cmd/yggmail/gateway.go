@@ -0,0 +1,93 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+func gateway(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail gateway [options] list")
+		fmt.Println("  yggmail gateway [options] map <internet address> <key>")
+		fmt.Println("  yggmail gateway [options] unmap <internet address>")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	switch fs.Arg(0) {
+	case "list":
+		mappings, err := storage.GatewayList()
+		if err != nil {
+			log.Println("Failed to list gateway addresses:", err)
+			os.Exit(1)
+		}
+		for _, mapping := range mappings {
+			fmt.Printf("%s\t%s@%s\n", mapping.Address, mapping.Key, utils.Domain)
+		}
+
+	case "map":
+		if fs.NArg() < 3 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		addr, err := mail.ParseAddress(fs.Arg(1))
+		if err != nil || !smtpsender.IsInternetAddress(addr.Address) {
+			log.Printf("The Internet address %q is not valid\n", fs.Arg(1))
+			os.Exit(1)
+		}
+		pk, err := utils.ParseKey(strings.TrimSuffix(fs.Arg(2), "@"+utils.Domain))
+		if err != nil {
+			log.Printf("The key %q is not valid: %s\n", fs.Arg(2), err)
+			os.Exit(1)
+		}
+		if err := storage.GatewaySet(addr.Address, utils.EncodeKey(pk)); err != nil {
+			log.Println("Failed to map gateway address:", err)
+			os.Exit(1)
+		}
+		log.Printf("Mail for %s will be delivered to %s\n", addr.Address, utils.CreateAddress(pk))
+
+	case "unmap":
+		if fs.NArg() < 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		if err := storage.GatewayDelete(fs.Arg(1)); err != nil {
+			log.Println("Failed to unmap gateway address:", err)
+			os.Exit(1)
+		}
+		log.Printf("Gateway address %s has been removed\n", fs.Arg(1))
+
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/listserver"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/smtpserver"
+	storagepkg "github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+	"github.com/neilalexander/yggmail/internal/transport"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// identity loads the private key from the database, generating a new one
+// if there isn't one yet.
+func identity(storage config.ConfigStore) (ed25519.PrivateKey, bool, error) {
+	skStr, err := storage.ConfigGet("private_key")
+	if err != nil {
+		return nil, false, fmt.Errorf("storage.ConfigGet: %w", err)
+	}
+	if skStr == "" {
+		_, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("ed25519.GenerateKey: %w", err)
+		}
+		if err := storage.ConfigSet("private_key", hex.EncodeToString(sk)); err != nil {
+			return nil, false, fmt.Errorf("storage.ConfigSet: %w", err)
+		}
+		return sk, true, nil
+	}
+	skBytes, err := hex.DecodeString(skStr)
+	if err != nil {
+		return nil, false, fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	sk := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+	copy(sk, skBytes)
+	return sk, false, nil
+}
+
+// startList runs the mailing list from the given database alongside our
+// own identity. The list has its own key, so it needs its own Yggdrasil
+// node and SMTP listener too. It uses the same sub-address separator as we
+// do, which must not be empty.
+func startList(log *log.Logger, logs *logging.Logging, database, keyfile, subaddress string, peers []string, mcast bool, mcastregexp string) error {
+	storage, err := storagepkg.Open(database)
+	if err != nil {
+		return fmt.Errorf("storage.Open: %w", err)
+	}
+	if err := unlockStorage(log, storage, keyfile); err != nil {
+		return fmt.Errorf("unlockStorage: %w", err)
+	}
+	sk, _, err := identity(storage)
+	if err != nil {
+		return fmt.Errorf("identity: %w", err)
+	}
+	pk := sk.Public().(ed25519.PublicKey)
+	cfg := &config.Config{
+		PublicKey:           pk,
+		PrivateKey:          sk,
+		SubaddressSeparator: subaddress,
+	}
+	settings, err := config.LoadList(storage)
+	if err != nil {
+		return fmt.Errorf("config.LoadList: %w", err)
+	}
+
+	// Everything that the list logs says which list it was.
+	name := slog.String("list", settings.Name)
+	transport, err := transport.NewYggdrasilTransport(logs.For(logging.Transport).With(name), sk, pk, peers, mcast, mcastregexp)
+	if err != nil {
+		return fmt.Errorf("transport.NewYggdrasilTransport: %w", err)
+	}
+	listLog := logs.For(logging.Main).With(name)
+	list := &listserver.List{
+		Config:  cfg,
+		Log:     listLog,
+		Storage: storage,
+		Queues:  smtpsender.NewQueues(cfg, logs.For(logging.Queue).With(name), transport, storage),
+	}
+	if err := list.Setup(); err != nil {
+		return fmt.Errorf("list.Setup: %w", err)
+	}
+
+	smtpLog := logs.For(logging.SMTP).With(name)
+	listBackend := &smtpserver.Backend{
+		Log:     smtpLog,
+		Mode:    smtpserver.BackendModeExternal,
+		Config:  cfg,
+		Storage: storage,
+		Queues:  list.Queues,
+		List:    list,
+	}
+	listServer := smtp.NewServer(listBackend)
+	listServer.Domain = hex.EncodeToString(pk)
+	listServer.MaxMessageBytes = 1024 * 1024 * 32
+	listServer.MaxRecipients = 50
+	listServer.AuthDisabled = true
+
+	go func() {
+		if err := listServer.Serve(transport.Listener()); err != nil {
+			smtpLog.Error("Failed to serve SMTP over Yggdrasil", logging.Err(err))
+			os.Exit(1)
+		}
+	}()
+	listLog.Info("Serving mailing list", "address", list.Address(""))
+	return nil
+}
+
+func lists(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	database := fs.String("database", "list.db", "SQLite database file for the mailing list")
+	name := fs.String("name", "", "Name of the list, which is used as a prefix in the subject of posts")
+	description := fs.String("description", "", "Description of the list")
+	posting := fs.String("posting", config.ListPostingMembers, "Who can post without moderation, either \"members\", \"moderated\" (only owners) or \"open\"")
+	subscribe := fs.String("subscribe", config.ListSubscribeOpen, "Whether anyone can subscribe by mail, either \"open\" or \"closed\"")
+	subaddress := fs.String("subaddress", "+", "Sub-address separator for the addresses of the list, which must match the -subaddress that the list is run with")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail list [options] create")
+		fmt.Println("  yggmail list [options] info")
+		fmt.Println("  yggmail list [options] members")
+		fmt.Println("  yggmail list [options] add <key> [owner]")
+		fmt.Println("  yggmail list [options] remove <key>")
+		fmt.Println("  yggmail list [options] pending")
+		fmt.Println("  yggmail list [options] approve <id>")
+		fmt.Println("  yggmail list [options] discard <id>")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if len(*subaddress) != 1 || !strings.Contains(utils.SubaddressSeparators, *subaddress) {
+		log.Println("The sub-address separator must be one of", strings.Split(utils.SubaddressSeparators, ""))
+		os.Exit(1)
+	}
+
+	storage, err := sqlite3.NewSQLite3StorageStorage(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+	if err := unlockStorage(log, storage, ""); err != nil {
+		log.Println("Failed to unlock the database:", err)
+		os.Exit(1)
+	}
+
+	sk, generated, err := identity(storage)
+	if err != nil {
+		log.Println("Failed to load list identity:", err)
+		os.Exit(1)
+	}
+	pk := sk.Public().(ed25519.PublicKey)
+	cfg := &config.Config{
+		PublicKey:           pk,
+		PrivateKey:          sk,
+		SubaddressSeparator: *subaddress,
+	}
+	logs, _ := logging.New(log.Writer(), logging.FormatText)
+	list := &listserver.List{
+		Config:  cfg,
+		Log:     logs.For(logging.Main),
+		Storage: storage,
+		// There is no transport here, so any mail that we send is only
+		// queued until the list is next run with -list.
+		Queues: smtpsender.NewQueues(cfg, logs.For(logging.Queue), nil, storage),
+	}
+	if err := list.Setup(); err != nil {
+		log.Println("Failed to set up list:", err)
+		os.Exit(1)
+	}
+	settings, err := config.LoadList(storage)
+	if err != nil {
+		log.Println("Failed to load list settings:", err)
+		os.Exit(1)
+	}
+
+	switch fs.Arg(0) {
+	case "create":
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				settings.Name = *name
+			case "description":
+				settings.Description = *description
+			case "posting":
+				settings.Posting = *posting
+			case "subscribe":
+				settings.Subscribe = *subscribe
+			}
+		})
+		if err := settings.Save(storage); err != nil {
+			log.Println("Failed to save list settings:", err)
+			os.Exit(1)
+		}
+		if generated {
+			log.Println("Generated new list identity")
+		}
+		log.Printf("List address: %s\n", list.Address(""))
+		log.Printf("Run the list with: yggmail -list=%s ...\n", *database)
+
+	case "info":
+		fmt.Printf("Address: %s\n", list.Address(""))
+		fmt.Printf("Requests: %s\n", list.Address("request"))
+		fmt.Printf("Name: %s\n", settings.Name)
+		fmt.Printf("Description: %s\n", settings.Description)
+		fmt.Printf("Posting: %s\n", settings.Posting)
+		fmt.Printf("Subscribe: %s\n", settings.Subscribe)
+
+	case "members":
+		members, err := storage.ListMemberList()
+		if err != nil {
+			log.Println("Failed to list members:", err)
+			os.Exit(1)
+		}
+		for _, member := range members {
+			role := "member"
+			if member.Owner {
+				role = "owner"
+			}
+			fmt.Printf("%s@%s\t%s\t%s\n", member.Key, utils.Domain, role, member.Joined.Format("2006-01-02"))
+		}
+
+	case "add", "remove":
+		if fs.NArg() < 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		key, err := utils.ParseKey(strings.TrimSuffix(fs.Arg(1), "@"+utils.Domain))
+		if err != nil {
+			log.Printf("The key %q is not valid: %s\n", fs.Arg(1), err)
+			os.Exit(1)
+		}
+		if fs.Arg(0) == "remove" {
+			if err := storage.ListMemberDelete(utils.EncodeKey(key)); err != nil {
+				log.Println("Failed to remove member:", err)
+				os.Exit(1)
+			}
+			log.Printf("Removed %s from the list\n", utils.CreateAddress(key))
+			break
+		}
+		owner := fs.Arg(2) == "owner"
+		if err := storage.ListMemberSet(utils.EncodeKey(key), owner); err != nil {
+			log.Println("Failed to add member:", err)
+			os.Exit(1)
+		}
+		log.Printf("Added %s to the list\n", utils.CreateAddress(key))
+
+	case "pending":
+		posts, err := list.Pending()
+		if err != nil {
+			log.Println("Failed to list pending posts:", err)
+			os.Exit(1)
+		}
+		for _, post := range posts {
+			fmt.Printf("%d\t%s\t%s\n", post.ID, post.From, post.Subject)
+		}
+
+	case "approve", "discard":
+		if fs.NArg() < 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		id, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			log.Printf("The post ID %q is not valid\n", fs.Arg(1))
+			os.Exit(1)
+		}
+		if fs.Arg(0) == "approve" {
+			if err := list.Approve(id); err != nil {
+				log.Println("Failed to approve post:", err)
+				os.Exit(1)
+			}
+			log.Printf("Post %d has been approved and will be sent when the list is next running\n", id)
+		} else {
+			if err := list.Discard(id); err != nil {
+				log.Println("Failed to discard post:", err)
+				os.Exit(1)
+			}
+			log.Printf("Post %d has been discarded\n", id)
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
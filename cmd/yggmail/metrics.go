@@ -0,0 +1,74 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/metrics"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/transport"
+)
+
+var (
+	mailboxMessages = metrics.NewGauge("yggmail_mailbox_messages", "Mails in each mailbox.", "mailbox")
+	mailboxBytes    = metrics.NewGauge("yggmail_mailbox_bytes", "Size of the mail in each mailbox.", "mailbox")
+)
+
+// startMetrics serves the metrics for Prometheus to scrape on /metrics. The
+// listener is opened before returning, so that a bad address is reported
+// straight away.
+func startMetrics(log *slog.Logger, addr string, storage storage.Storage, queues *smtpsender.Queues, transport *transport.YggdrasilTransport) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen: %w", err)
+	}
+
+	metrics.Collect(func() {
+		collectStorageMetrics(log, storage)
+	})
+	// The database size is only known for SQLite databases.
+	if s, ok := storage.(interface{ CollectMetrics() }); ok {
+		metrics.Collect(s.CollectMetrics)
+	}
+	metrics.Collect(queues.CollectMetrics)
+	metrics.Collect(transport.CollectMetrics)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Error("Metrics listener stopped", logging.Err(err))
+		}
+	}()
+	return nil
+}
+
+func collectStorageMetrics(log *slog.Logger, storage storage.Storage) {
+	mailboxMessages.Reset()
+	mailboxBytes.Reset()
+	mailboxes, err := storage.MailboxList(false)
+	if err != nil {
+		log.Error("Failed to collect mailbox metrics", logging.Err(err))
+		return
+	}
+	for _, mailbox := range mailboxes {
+		if count, err := storage.MailCount(mailbox); err == nil {
+			mailboxMessages.Set(float64(count), mailbox)
+		}
+		if size, err := storage.MailboxUsage(mailbox); err == nil {
+			mailboxBytes.Set(float64(size), mailbox)
+		}
+	}
+}
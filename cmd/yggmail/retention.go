@@ -0,0 +1,145 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/retention"
+	storagepkg "github.com/neilalexander/yggmail/internal/storage"
+)
+
+func retentionCommand(log *log.Logger, args []string) {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	database := fs.String("database", "yggmail.db", "SQLite database file, or a storage URI")
+	keyfile := fs.String("keyfile", "", "File containing the passphrase for an encrypted database, rather than asking for it")
+	deleteAfter := fs.Int("delete", 0, "Delete mail older than this many days (disabled if 0)")
+	archiveAfter := fs.Int("archive", 0, "Archive mail older than this many days into a folder for the year (disabled if 0)")
+	archiveTo := fs.String("archiveto", retention.DefaultArchive, "Mailbox that the folders for each year are created under")
+	maxMails := fs.Int("keep", 0, "Delete the oldest mail beyond this many mails (disabled if 0)")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmail retention [options] list")
+		fmt.Println("  yggmail retention [options] set <mailbox>")
+		fmt.Println("  yggmail retention [options] remove <mailbox>")
+		fmt.Println("  yggmail retention [options] report")
+		fmt.Println()
+		fmt.Println("The report shows what the rules would do if they were applied now,")
+		fmt.Println("without changing anything.")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	storage, err := storagepkg.Open(*database)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	rules, err := retention.LoadRules(storage)
+	if err != nil {
+		log.Println("Failed to load retention rules:", err)
+		os.Exit(1)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		for _, rule := range rules {
+			fmt.Printf("%s\t%s\n", rule.Mailbox, rule.String())
+		}
+		return
+
+	case "set":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		rule := retention.Rule{
+			Mailbox:      fs.Arg(1),
+			DeleteAfter:  *deleteAfter,
+			ArchiveAfter: *archiveAfter,
+			MaxMails:     *maxMails,
+		}
+		if *archiveTo != retention.DefaultArchive {
+			rule.ArchiveTo = *archiveTo
+		}
+		switch {
+		case rule.Mailbox == "Outbox":
+			log.Println("The Outbox can't have a retention rule")
+			os.Exit(1)
+		case rule.DeleteAfter < 0 || rule.ArchiveAfter < 0 || rule.MaxMails < 0:
+			log.Println("The number of days and mails must not be negative")
+			os.Exit(1)
+		case rule.DeleteAfter == 0 && rule.ArchiveAfter == 0 && rule.MaxMails == 0:
+			log.Println("A retention rule needs at least one of -delete, -archive or -keep")
+			os.Exit(1)
+		}
+		rules = withoutRule(rules, rule.Mailbox)
+		rules = append(rules, rule)
+		if err := retention.SaveRules(storage, rules); err != nil {
+			log.Println("Failed to save retention rules:", err)
+			os.Exit(1)
+		}
+		log.Printf("Retention rule for %q: %s\n", rule.Mailbox, rule.String())
+
+	case "remove":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		if err := retention.SaveRules(storage, withoutRule(rules, fs.Arg(1))); err != nil {
+			log.Println("Failed to save retention rules:", err)
+			os.Exit(1)
+		}
+		log.Printf("Removed the retention rule for %q\n", fs.Arg(1))
+
+	case "report":
+		if err := unlockStorage(log, storage, *keyfile); err != nil {
+			log.Println("Failed to unlock the database:", err)
+			os.Exit(1)
+		}
+		actions, err := retention.Plan(storage, rules, time.Now())
+		if err != nil {
+			log.Println("Failed to work out what the retention rules would do:", err)
+			os.Exit(1)
+		}
+		var deleted, archived int
+		for _, action := range actions {
+			fmt.Println(action.String())
+			if action.Archive == "" {
+				deleted++
+			} else {
+				archived++
+			}
+		}
+		fmt.Printf("%d mails would be deleted and %d archived\n", deleted, archived)
+
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+func withoutRule(rules []retention.Rule, mailbox string) []retention.Rule {
+	kept := rules[:0]
+	for _, rule := range rules {
+		if rule.Mailbox != mailbox {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
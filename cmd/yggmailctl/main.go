@@ -0,0 +1,248 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/neilalexander/yggmail/internal/admin"
+)
+
+func main() {
+	socket := flag.String("socket", admin.DefaultSocket, "Admin socket of the running Yggmail, as given to yggmail -admin")
+	asJSON := flag.Bool("json", false, "Print the response as JSON rather than as a table")
+	flag.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Println("  yggmailctl [options] <request> [key=value ...]")
+		fmt.Println()
+		fmt.Println("Run \"yggmailctl list\" for the requests that Yggmail understands, i.e.")
+		fmt.Println()
+		fmt.Println("  yggmailctl getSelf")
+		fmt.Println("  yggmailctl setLogLevel level=debug subsystem=queue")
+		fmt.Println("  yggmailctl setPassword")
+		fmt.Println()
+		fmt.Println("Available options:")
+		fmt.Println()
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	name := flag.Arg(0)
+	args := map[string]string{}
+	for _, arg := range flag.Args()[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Argument %q should be key=value\n", arg)
+			os.Exit(1)
+		}
+		args[key] = value
+	}
+	// Passwords on the command line end up in the shell history and can
+	// be seen by others in the process list, so ask for one instead.
+	if strings.EqualFold(name, "setPassword") && len(args) == 0 {
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		args["password"] = password
+	}
+
+	var res json.RawMessage
+	if err := admin.Call(*socket, name, args, &res); err != nil {
+		fmt.Fprintln(os.Stderr, "Request failed:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		var b bytes.Buffer
+		_ = json.Indent(&b, res, "", "  ")
+		fmt.Println(b.String())
+		return
+	}
+	if err := printResponse(strings.ToLower(name), res); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read the response:", err)
+		os.Exit(1)
+	}
+}
+
+func readPassword() (string, error) {
+	fmt.Println("Please enter your new password:")
+	password1, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("term.ReadPassword: %w", err)
+	}
+	fmt.Println("Please enter your new password again:")
+	password2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("term.ReadPassword: %w", err)
+	}
+	if !bytes.Equal(password1, password2) {
+		return "", fmt.Errorf("the supplied passwords do not match")
+	}
+	return string(password1), nil
+}
+
+// printResponse prints the responses that we know about as tables, and
+// any others as JSON.
+func printResponse(name string, res json.RawMessage) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer table.Flush()
+	switch name {
+	case "list":
+		var list admin.ListResponse
+		if err := json.Unmarshal(res, &list); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "Command\tArguments\tDescription")
+		for _, entry := range list.List {
+			fmt.Fprintf(table, "%s\t%s\t%s\n", entry.Command, strings.Join(entry.Fields, ", "), entry.Description)
+		}
+
+	case "getstatus":
+		var status admin.GetStatusResponse
+		if err := json.Unmarshal(res, &status); err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "Version:\t%s (%s)\n", status.Version, status.GoVersion)
+		fmt.Fprintf(table, "Uptime:\t%s\n", (time.Duration(status.Uptime) * time.Second).String())
+		fmt.Fprintf(table, "Database:\t%s\n", status.Database)
+		for _, name := range []string{"smtp", "imap", "managesieve", "carddav", "gatewaysmtp"} {
+			if addr, ok := status.Listeners[name]; ok {
+				fmt.Fprintf(table, "Listening for %s:\t%s\n", name, addr)
+			}
+		}
+		fmt.Fprintf(table, "Queued deliveries:\t%d\n", status.Queued)
+
+	case "getself":
+		var self admin.GetSelfResponse
+		if err := json.Unmarshal(res, &self); err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "Mail address:\t%s\n", self.Address)
+		fmt.Fprintf(table, "Short mail address:\t%s\n", self.ShortAddress)
+		fmt.Fprintf(table, "Public key:\t%s\n", self.Key)
+		fmt.Fprintf(table, "IPv6 address:\t%s\n", self.IPAddress)
+		fmt.Fprintf(table, "IPv6 subnet:\t%s\n", self.Subnet)
+
+	case "getpeers":
+		var peers admin.GetPeersResponse
+		if err := json.Unmarshal(res, &peers); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "URI\tState\tDir\tKey\tUptime\tLatency\tRX\tTX\tLast error")
+		for _, peer := range peers.Peers {
+			state, dir := "Down", "Out"
+			if peer.Up {
+				state = "Up"
+			}
+			if peer.Inbound {
+				dir = "In"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%.1fms\t%d\t%d\t%s\n",
+				peer.URI, state, dir, peer.Key,
+				(time.Duration(peer.Uptime) * time.Second).String(), peer.Latency,
+				peer.RXBytes, peer.TXBytes, peer.LastError,
+			)
+		}
+
+	case "getqueue":
+		var queue admin.GetQueueResponse
+		if err := json.Unmarshal(res, &queue); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "Destination\tID\tFrom\tTo")
+		for _, entry := range queue.Queue {
+			fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", entry.Destination, entry.ID, entry.From, entry.Rcpt)
+		}
+
+	case "flushqueue":
+		var flushed admin.FlushQueueResponse
+		if err := json.Unmarshal(res, &flushed); err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "Sending now to %d destinations\n", len(flushed.Destinations))
+
+	case "getmailboxes":
+		var mailboxes admin.GetMailboxesResponse
+		if err := json.Unmarshal(res, &mailboxes); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "Mailbox\tMessages\tUnseen\tSize\tSubscribed")
+		for _, mailbox := range mailboxes.Mailboxes {
+			fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%v\n", mailbox.Name, mailbox.Messages, mailbox.Unseen, mailbox.Size, mailbox.Subscribed)
+		}
+
+	case "getuser":
+		var user admin.GetUserResponse
+		if err := json.Unmarshal(res, &user); err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "Username:\t%s\n", user.Username)
+		fmt.Fprintf(table, "Address:\t%s\n", user.Address)
+		fmt.Fprintf(table, "Password set:\t%v\n", user.PasswordSet)
+
+	case "setpassword":
+		fmt.Fprintln(table, "Password for IMAP and SMTP has been updated!")
+
+	case "getloglevel", "setloglevel":
+		var level admin.GetLogLevelResponse
+		if err := json.Unmarshal(res, &level); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "Subsystem\tLevel")
+		for _, subsystem := range level.Subsystems {
+			fmt.Fprintf(table, "%s\t%s\n", subsystem, level.Levels[subsystem])
+		}
+		fmt.Fprintf(table, "\nLevels are one of %s\n", strings.Join(level.Available, ", "))
+
+	case "getbans":
+		var bans admin.GetBansResponse
+		if err := json.Unmarshal(res, &bans); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, "Source\tFailures\tLast failure\tBanned for")
+		for _, ban := range bans.Bans {
+			banned := "-"
+			if ban.Banned {
+				banned = (time.Duration(ban.Expires) * time.Second).String()
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", ban.Source, ban.Failures, ban.Last.Format(time.RFC3339), banned)
+		}
+		fmt.Fprintf(table, "\nFailed logins from all sources: %d\n", bans.Failures)
+
+	case "clearbans":
+		var cleared admin.ClearBansResponse
+		if err := json.Unmarshal(res, &cleared); err != nil {
+			return err
+		}
+		fmt.Fprintf(table, "Cleared the failed logins from %d sources\n", cleared.Cleared)
+
+	default:
+		var b bytes.Buffer
+		if err := json.Indent(&b, res, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintln(table, b.String())
+	}
+	return nil
+}
@@ -9,8 +9,11 @@ require (
 	github.com/emersion/go-message v0.17.0
 	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead
 	github.com/emersion/go-smtp v0.15.0
+	github.com/emersion/go-vcard v0.0.0-20230815062825-8fda7d206ec9
+	github.com/emersion/go-webdav v0.6.0
 	github.com/fatih/color v1.18.0
 	github.com/gologme/log v1.3.0
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/yggdrasil-network/yggdrasil-go v0.5.13-0.20251124092915-ae405adf7c4c
 	github.com/yggdrasil-network/yggquic v0.0.0-20251128173046-40cea64eaa96
@@ -0,0 +1,231 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package admin is a JSON interface to a running Yggmail over a Unix
+// socket, in the style of the Yggdrasil admin socket, so that it can be
+// scripted or controlled with yggmailctl. Each connection sends requests
+// like {"request": "getSelf", "arguments": {...}} and gets a response for
+// each, and is closed after the first unless the request has "keepalive".
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/logging"
+)
+
+// DefaultSocket is where yggmailctl looks for the admin socket if not told
+// otherwise, which is where "yggmail -admin=yggmail.sock" puts it. The
+// admin socket is only opened when asked for, so that Yggmail doesn't
+// leave a socket in whichever directory it was started from.
+const DefaultSocket = "yggmail.sock"
+
+// HandlerFunc handles a request with its JSON arguments, returning what
+// will be marshalled into the response.
+type HandlerFunc func(json.RawMessage) (interface{}, error)
+
+type AdminSocket struct {
+	log      *slog.Logger
+	path     string
+	listener net.Listener
+	mutex    sync.RWMutex
+	handlers map[string]handler
+	done     chan struct{}
+}
+
+type AdminSocketRequest struct {
+	Name      string          `json:"request"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	KeepAlive bool            `json:"keepalive,omitempty"`
+}
+
+type AdminSocketResponse struct {
+	Status   string             `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Request  AdminSocketRequest `json:"request"`
+	Response json.RawMessage    `json:"response"`
+}
+
+type handler struct {
+	desc    string   // what the request does
+	args    []string // the names of its arguments
+	handler HandlerFunc
+}
+
+type ListResponse struct {
+	List []ListEntry `json:"list"`
+}
+
+type ListEntry struct {
+	Command     string   `json:"command"`
+	Description string   `json:"description"`
+	Fields      []string `json:"fields,omitempty"`
+}
+
+// New listens on the Unix socket at path, which is created with the given
+// permissions. A socket that is left over from before is replaced, but not
+// one that another Yggmail is still listening on.
+func New(log *slog.Logger, path string, perm os.FileMode) (*AdminSocket, error) {
+	a := &AdminSocket{
+		log:      log,
+		path:     path,
+		handlers: map[string]handler{},
+		done:     make(chan struct{}),
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q already exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, 2*time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket %q is already in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+	// The socket is created with the umask, so it is only made available
+	// to others once the permissions have been changed.
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("os.Chmod: %w", err)
+	}
+	a.listener = listener
+
+	_ = a.AddHandler("list", "List available commands", []string{}, func(_ json.RawMessage) (interface{}, error) {
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		res := &ListResponse{}
+		for name, handler := range a.handlers {
+			res.List = append(res.List, ListEntry{
+				Command:     name,
+				Description: handler.desc,
+				Fields:      handler.args,
+			})
+		}
+		sort.SliceStable(res.List, func(i, j int) bool {
+			return res.List[i].Command < res.List[j].Command
+		})
+		return res, nil
+	})
+	go a.listen()
+	return a, nil
+}
+
+// AddHandler adds a request to the admin socket. Requests are matched
+// without regard to case.
+func (a *AdminSocket) AddHandler(name, desc string, args []string, handlerfunc HandlerFunc) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.handlers[strings.ToLower(name)]; ok {
+		return errors.New("handler already exists")
+	}
+	a.handlers[strings.ToLower(name)] = handler{
+		desc:    desc,
+		args:    args,
+		handler: handlerfunc,
+	}
+	return nil
+}
+
+// Stop closes the admin socket and removes it.
+func (a *AdminSocket) Stop() error {
+	if a == nil {
+		return nil
+	}
+	select {
+	case <-a.done:
+		return nil
+	default:
+		close(a.done)
+	}
+	err := a.listener.Close()
+	_ = os.Remove(a.path)
+	return err
+}
+
+func (a *AdminSocket) listen() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+				a.log.Error("Failed to accept admin connection", logging.Err(err))
+				time.Sleep(time.Second)
+				continue
+			}
+		}
+		go a.handleRequest(conn)
+	}
+}
+
+func (a *AdminSocket) handleRequest(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	encoder.SetIndent("", "  ")
+
+	for {
+		var req AdminSocketRequest
+		var resp AdminSocketResponse
+		if err := decoder.Decode(&req); err != nil {
+			// The other end has gone away, or isn't speaking JSON.
+			return
+		}
+		if len(req.Arguments) == 0 || string(req.Arguments) == "null" {
+			req.Arguments = []byte("{}")
+		}
+		// The arguments aren't sent back, since they may have a password
+		// in them.
+		resp.Request = AdminSocketRequest{Name: req.Name, KeepAlive: req.KeepAlive}
+		if err := func() error {
+			if req.Name == "" {
+				return fmt.Errorf("no request specified")
+			}
+			a.mutex.RLock()
+			handler, ok := a.handlers[strings.ToLower(req.Name)]
+			a.mutex.RUnlock()
+			if !ok {
+				return fmt.Errorf("unknown request %q, try \"list\" for help", req.Name)
+			}
+			res, err := handler.handler(req.Arguments)
+			if err != nil {
+				return err
+			}
+			if resp.Response, err = json.Marshal(res); err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+			resp.Status = "success"
+			return nil
+		}(); err != nil {
+			resp.Status = "error"
+			resp.Error = err.Error()
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+		if !req.KeepAlive {
+			return
+		}
+	}
+}
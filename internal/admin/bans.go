@@ -0,0 +1,62 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"time"
+)
+
+type GetBansRequest struct{}
+
+type GetBansResponse struct {
+	Bans     []BanEntry `json:"bans"`
+	Failures int        `json:"failures"` // from all sources together
+}
+
+type BanEntry struct {
+	Source   string    `json:"source"`
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`    // of the last failure
+	Banned   bool      `json:"banned"`  // or only delayed
+	Until    time.Time `json:"until"`   // zero if not banned
+	Expires  float64   `json:"expires"` // in seconds, until the ban is lifted
+}
+
+func (n *Node) getBansHandler(req *GetBansRequest, res *GetBansResponse) error {
+	res.Bans = []BanEntry{}
+	bans, failures := n.Lockout.Bans()
+	for _, ban := range bans {
+		entry := BanEntry{
+			Source:   ban.Source,
+			Failures: ban.Failures,
+			Last:     ban.Last,
+		}
+		if !ban.Until.IsZero() {
+			entry.Banned = true
+			entry.Until = ban.Until
+			entry.Expires = time.Until(ban.Until).Seconds()
+		}
+		res.Bans = append(res.Bans, entry)
+	}
+	res.Failures = failures
+	return nil
+}
+
+type ClearBansRequest struct {
+	Source string `json:"source"` // or all of them if empty
+}
+
+type ClearBansResponse struct {
+	Cleared int `json:"cleared"`
+}
+
+func (n *Node) clearBansHandler(req *ClearBansRequest, res *ClearBansResponse) error {
+	res.Cleared = n.Lockout.Clear(req.Source)
+	return nil
+}
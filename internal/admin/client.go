@@ -0,0 +1,51 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Call sends a request with the given arguments, which may be nil, to the
+// admin socket at path and unmarshals the response into res, if it isn't
+// nil. An error response from Yggmail is returned as an error.
+func Call(path, name string, args, res interface{}) error {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("net.DialTimeout: %w", err)
+	}
+	defer conn.Close()
+	req := AdminSocketRequest{Name: name}
+	if args != nil {
+		if req.Arguments, err = json.Marshal(args); err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("json.Encode: %w", err)
+	}
+	var resp AdminSocketResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("json.Decode: %w", err)
+	}
+	if resp.Status != "success" {
+		return errors.New(resp.Error)
+	}
+	if res == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Response, res); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/transport"
+)
+
+// Node is the running Yggmail that the requests are about.
+type Node struct {
+	Config    *config.Config
+	Storage   storage.Storage
+	Queues    *smtpsender.Queues
+	Transport *transport.YggdrasilTransport
+	Logging   *logging.Logging
+	Lockout   *lockout.Lockout
+	Database  string
+	Listeners map[string]string // i.e. "imap" to "localhost:1143"
+	Started   time.Time
+}
+
+// SetupHandlers adds the requests about the node to the admin socket.
+func (a *AdminSocket) SetupHandlers(n *Node) {
+	_ = a.AddHandler(
+		"getStatus", "Show the version of Yggmail and what it is doing", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetStatusRequest{}
+			res := &GetStatusResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getStatusHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getSelf", "Show the identity and addresses of this node", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetSelfRequest{}
+			res := &GetSelfResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getSelfHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getPeers", "Show the Yggdrasil peers and their state", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetPeersRequest{}
+			res := &GetPeersResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getPeersHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getQueue", "Show the mail waiting to be sent", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetQueueRequest{}
+			res := &GetQueueResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getQueueHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"flushQueue", "Try to send the mail waiting to be sent now", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &FlushQueueRequest{}
+			res := &FlushQueueResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.flushQueueHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getMailboxes", "Show how much mail is in each mailbox", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetMailboxesRequest{}
+			res := &GetMailboxesResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getMailboxesHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getUser", "Show the user that IMAP and SMTP clients log in as", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetUserRequest{}
+			res := &GetUserResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getUserHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"setPassword", "Set the password for IMAP and SMTP, or its bcrypt hash", []string{"password", "hash"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &SetPasswordRequest{}
+			res := &SetPasswordResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.setPasswordHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getLogLevel", "Show how verbose the log is", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetLogLevelRequest{}
+			res := &GetLogLevelResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getLogLevelHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"setLogLevel", "Change how verbose the log is, for one subsystem or all of them", []string{"level", "subsystem"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &SetLogLevelRequest{}
+			res := &GetLogLevelResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.setLogLevelHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getBans", "Show the sources of recent failed logins and which are banned", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetBansRequest{}
+			res := &GetBansResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.getBansHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"clearBans", "Forget the failed logins from a source, or from all of them", []string{"source"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &ClearBansRequest{}
+			res := &ClearBansResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := n.clearBansHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
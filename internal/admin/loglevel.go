@@ -0,0 +1,49 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"errors"
+
+	"github.com/neilalexander/yggmail/internal/logging"
+)
+
+type GetLogLevelRequest struct{}
+
+// GetLogLevelResponse is the response to both getLogLevel and setLogLevel.
+type GetLogLevelResponse struct {
+	Levels     map[string]string `json:"levels"` // by subsystem
+	Subsystems []string          `json:"subsystems"`
+	Available  []string          `json:"available"`
+}
+
+func (n *Node) getLogLevelHandler(req *GetLogLevelRequest, res *GetLogLevelResponse) error {
+	if n.Logging == nil {
+		return errors.New("the log levels can't be changed")
+	}
+	res.Levels = n.Logging.Levels()
+	res.Subsystems = logging.Subsystems
+	res.Available = logging.Levels
+	return nil
+}
+
+type SetLogLevelRequest struct {
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem"` // or all of them if empty
+}
+
+func (n *Node) setLogLevelHandler(req *SetLogLevelRequest, res *GetLogLevelResponse) error {
+	if n.Logging == nil {
+		return errors.New("the log levels can't be changed")
+	}
+	if err := n.Logging.SetLevel(req.Subsystem, req.Level); err != nil {
+		return err
+	}
+	return n.getLogLevelHandler(&GetLogLevelRequest{}, res)
+}
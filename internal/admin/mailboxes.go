@@ -0,0 +1,59 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"fmt"
+	"sort"
+)
+
+type GetMailboxesRequest struct{}
+
+type GetMailboxesResponse struct {
+	Mailboxes []MailboxEntry `json:"mailboxes"`
+}
+
+type MailboxEntry struct {
+	Name       string `json:"name"`
+	Messages   int    `json:"messages"`
+	Unseen     int    `json:"unseen"`
+	Size       int64  `json:"size"` // in bytes
+	Subscribed bool   `json:"subscribed"`
+}
+
+func (n *Node) getMailboxesHandler(req *GetMailboxesRequest, res *GetMailboxesResponse) error {
+	res.Mailboxes = []MailboxEntry{}
+	mailboxes, err := n.Storage.MailboxList(false)
+	if err != nil {
+		return fmt.Errorf("n.Storage.MailboxList: %w", err)
+	}
+	subscribed, err := n.Storage.MailboxList(true)
+	if err != nil {
+		return fmt.Errorf("n.Storage.MailboxList: %w", err)
+	}
+	isSubscribed := map[string]bool{}
+	for _, name := range subscribed {
+		isSubscribed[name] = true
+	}
+	sort.Strings(mailboxes)
+	for _, name := range mailboxes {
+		mailbox := MailboxEntry{Name: name, Subscribed: isSubscribed[name]}
+		if mailbox.Messages, err = n.Storage.MailCount(name); err != nil {
+			return fmt.Errorf("n.Storage.MailCount: %w", err)
+		}
+		if mailbox.Unseen, err = n.Storage.MailUnseen(name); err != nil {
+			return fmt.Errorf("n.Storage.MailUnseen: %w", err)
+		}
+		if mailbox.Size, err = n.Storage.MailboxUsage(name); err != nil {
+			return fmt.Errorf("n.Storage.MailboxUsage: %w", err)
+		}
+		res.Mailboxes = append(res.Mailboxes, mailbox)
+	}
+	return nil
+}
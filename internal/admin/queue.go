@@ -0,0 +1,67 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"fmt"
+	"sort"
+)
+
+type GetQueueRequest struct{}
+
+type GetQueueResponse struct {
+	Queue []QueueEntry `json:"queue"`
+}
+
+type QueueEntry struct {
+	Destination string `json:"destination"`
+	ID          int    `json:"id"` // in the Outbox
+	From        string `json:"from"`
+	Rcpt        string `json:"rcpt"`
+}
+
+func (n *Node) getQueueHandler(req *GetQueueRequest, res *GetQueueResponse) error {
+	res.Queue = []QueueEntry{}
+	destinations, err := n.Storage.QueueListDestinations()
+	if err != nil {
+		return fmt.Errorf("n.Storage.QueueListDestinations: %w", err)
+	}
+	sort.Strings(destinations)
+	for _, destination := range destinations {
+		refs, err := n.Storage.QueueMailIDsForDestination(destination)
+		if err != nil {
+			return fmt.Errorf("n.Storage.QueueMailIDsForDestination: %w", err)
+		}
+		for _, ref := range refs {
+			res.Queue = append(res.Queue, QueueEntry{
+				Destination: destination,
+				ID:          ref.ID,
+				From:        ref.From,
+				Rcpt:        ref.Rcpt,
+			})
+		}
+	}
+	return nil
+}
+
+type FlushQueueRequest struct{}
+
+type FlushQueueResponse struct {
+	Destinations []string `json:"destinations"`
+}
+
+func (n *Node) flushQueueHandler(req *FlushQueueRequest, res *FlushQueueResponse) error {
+	destinations, err := n.Queues.Flush()
+	if err != nil {
+		return fmt.Errorf("n.Queues.Flush: %w", err)
+	}
+	sort.Strings(destinations)
+	res.Destinations = append([]string{}, destinations...)
+	return nil
+}
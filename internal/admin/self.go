@@ -0,0 +1,121 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+type GetStatusRequest struct{}
+
+type GetStatusResponse struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Started   time.Time         `json:"started"`
+	Uptime    float64           `json:"uptime"` // in seconds
+	Database  string            `json:"database"`
+	Listeners map[string]string `json:"listeners"`
+	Queued    int               `json:"queued"` // deliveries waiting to be sent
+}
+
+func (n *Node) getStatusHandler(req *GetStatusRequest, res *GetStatusResponse) error {
+	res.Version = "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		res.Version = info.Main.Version
+	}
+	res.GoVersion = runtime.Version()
+	res.Started = n.Started
+	res.Uptime = time.Since(n.Started).Seconds()
+	res.Database = n.Database
+	res.Listeners = n.Listeners
+	destinations, err := n.Storage.QueueListDestinations()
+	if err != nil {
+		return fmt.Errorf("n.Storage.QueueListDestinations: %w", err)
+	}
+	for _, destination := range destinations {
+		refs, err := n.Storage.QueueMailIDsForDestination(destination)
+		if err != nil {
+			return fmt.Errorf("n.Storage.QueueMailIDsForDestination: %w", err)
+		}
+		res.Queued += len(refs)
+	}
+	return nil
+}
+
+type GetSelfRequest struct{}
+
+type GetSelfResponse struct {
+	Key          string `json:"key"`
+	Address      string `json:"address"`
+	ShortAddress string `json:"short_address"`
+	IPAddress    string `json:"ip_address"` // on the Yggdrasil network
+	Subnet       string `json:"subnet"`
+}
+
+func (n *Node) getSelfHandler(req *GetSelfRequest, res *GetSelfResponse) error {
+	res.Key = hex.EncodeToString(n.Config.PublicKey)
+	res.Address = utils.CreateAddress(n.Config.PublicKey)
+	res.ShortAddress = utils.CreateShortAddress(n.Config.PublicKey)
+	if n.Transport != nil {
+		subnet := n.Transport.Subnet()
+		res.IPAddress = n.Transport.Address().String()
+		res.Subnet = subnet.String()
+	}
+	return nil
+}
+
+type GetPeersRequest struct{}
+
+type GetPeersResponse struct {
+	Peers []PeerEntry `json:"peers"`
+}
+
+type PeerEntry struct {
+	URI       string  `json:"uri"`
+	Up        bool    `json:"up"`
+	Inbound   bool    `json:"inbound"`
+	Key       string  `json:"key,omitempty"`
+	Uptime    float64 `json:"uptime,omitempty"`  // in seconds
+	Latency   float64 `json:"latency,omitempty"` // in milliseconds
+	RXBytes   uint64  `json:"bytes_recvd,omitempty"`
+	TXBytes   uint64  `json:"bytes_sent,omitempty"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+func (n *Node) getPeersHandler(req *GetPeersRequest, res *GetPeersResponse) error {
+	res.Peers = []PeerEntry{}
+	if n.Transport == nil {
+		return nil
+	}
+	for _, p := range n.Transport.Peers() {
+		peer := PeerEntry{
+			URI:     p.URI,
+			Up:      p.Up,
+			Inbound: p.Inbound,
+			Uptime:  p.Uptime.Seconds(),
+			Latency: float64(p.Latency) / float64(time.Millisecond),
+			RXBytes: p.RXBytes,
+			TXBytes: p.TXBytes,
+		}
+		if p.Key != nil {
+			peer.Key = hex.EncodeToString(p.Key)
+		}
+		if p.LastError != nil {
+			peer.LastError = p.LastError.Error()
+		}
+		res.Peers = append(res.Peers, peer)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package admin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type GetUserRequest struct{}
+
+type GetUserResponse struct {
+	Username    string `json:"username"`
+	Address     string `json:"address"`
+	PasswordSet bool   `json:"password_set"`
+}
+
+// Yggmail only has the one user, who logs in with the key or the address
+// of the node and the password.
+func (n *Node) getUserHandler(req *GetUserRequest, res *GetUserResponse) error {
+	hash, err := n.Storage.ConfigGet("password")
+	if err != nil {
+		return fmt.Errorf("n.Storage.ConfigGet: %w", err)
+	}
+	res.Username = hex.EncodeToString(n.Config.PublicKey)
+	res.Address = utils.CreateAddress(n.Config.PublicKey)
+	res.PasswordSet = hash != ""
+	return nil
+}
+
+type SetPasswordRequest struct {
+	Password string `json:"password,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+type SetPasswordResponse struct {
+	Updated bool `json:"updated"`
+}
+
+func (n *Node) setPasswordHandler(req *SetPasswordRequest, res *SetPasswordResponse) error {
+	password, hash := strings.TrimSpace(req.Password), strings.TrimSpace(req.Hash)
+	switch {
+	case password != "" && hash != "":
+		return errors.New("give either a password or a hash, not both")
+	case password != "":
+		generated, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("bcrypt.GenerateFromPassword: %w", err)
+		}
+		hash = string(generated)
+	case hash != "":
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("the hash is not valid: %w", err)
+		}
+	default:
+		return errors.New("the password must not be blank")
+	}
+	if err := n.Storage.ConfigSetPassword(hash); err != nil {
+		return fmt.Errorf("n.Storage.ConfigSetPassword: %w", err)
+	}
+	res.Updated = true
+	return nil
+}
@@ -0,0 +1,370 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package archive moves mail between the Yggmail store and the mbox and
+// Maildir formats used by other mail software.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage"
+)
+
+const (
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+// Message is a single mail along with its internal date and flags.
+type Message struct {
+	Data     []byte
+	Date     time.Time
+	Seen     bool
+	Answered bool
+	Flagged  bool
+	Deleted  bool
+}
+
+// mboxExtension is added to mailbox names to get the mbox filename.
+const mboxExtension = ".mbox"
+
+// Export writes the given mailboxes, or all of them apart from the Outbox
+// if none are given, into the directory in the given format.
+func Export(log *slog.Logger, store storage.Storage, dir, format string, mailboxes []string) error {
+	if len(mailboxes) == 0 {
+		all, err := store.MailboxList(false)
+		if err != nil {
+			return fmt.Errorf("store.MailboxList: %w", err)
+		}
+		for _, name := range all {
+			if name != "Outbox" {
+				mailboxes = append(mailboxes, name)
+			}
+		}
+	}
+	for _, name := range mailboxes {
+		if ok, err := store.MailboxSelect(name); err != nil {
+			return fmt.Errorf("store.MailboxSelect: %w", err)
+		} else if !ok {
+			return fmt.Errorf("mailbox %q does not exist", name)
+		}
+		path, err := mailboxPath(dir, name)
+		if err != nil {
+			return err
+		}
+		count, err := exportMailbox(store, name, path, format)
+		if err != nil {
+			return fmt.Errorf("exporting %q: %w", name, err)
+		}
+		log.Info("Exported mails", "count", count, logging.Mailbox(name))
+	}
+	return nil
+}
+
+func exportMailbox(store storage.Storage, name, path, format string) (int, error) {
+	var write func(*Message) error
+	switch format {
+	case FormatMbox:
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return 0, fmt.Errorf("os.MkdirAll: %w", err)
+		}
+		f, err := os.OpenFile(path+mboxExtension, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("os.OpenFile: %w", err)
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		write = func(msg *Message) error {
+			return WriteMbox(w, msg)
+		}
+
+	case FormatMaildir:
+		write = func(msg *Message) error {
+			return WriteMaildir(path, msg)
+		}
+
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	ids, err := store.MailSearch(name)
+	if err != nil {
+		return 0, fmt.Errorf("store.MailSearch: %w", err)
+	}
+	for _, id := range ids {
+		_, mail, err := store.MailSelect(name, int(id))
+		if err != nil {
+			return 0, fmt.Errorf("store.MailSelect: %w", err)
+		}
+		if err := write(&Message{
+			Data:     mail.Mail,
+			Date:     mail.Date,
+			Seen:     mail.Seen,
+			Answered: mail.Answered,
+			Flagged:  mail.Flagged,
+			Deleted:  mail.Deleted,
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if format == FormatMaildir && len(ids) == 0 {
+		// Still create the Maildir so that the hierarchy is kept.
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(path, sub), 0700); err != nil {
+				return 0, fmt.Errorf("os.MkdirAll: %w", err)
+			}
+		}
+	}
+	return len(ids), nil
+}
+
+// mailboxPath returns the path for the mailbox below the directory, making
+// sure that it can't point outside of it.
+func mailboxPath(dir, name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("mailbox %q cannot be exported safely", name)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// Importer stores mail from mbox files or Maildirs. Mail that is already
+// in the mailbox, by Message-ID or by content if there isn't one, is
+// skipped so that importing the same archive twice is harmless.
+type Importer struct {
+	Log      *slog.Logger
+	Storage  storage.Storage
+	Prefix   string // parent mailbox to import into, if any
+	Imported int
+	Skipped  int
+	seen     map[string]map[string]struct{}
+}
+
+// Import imports a single mbox file, a Maildir, or a directory of either.
+// If only wants some mailboxes then the others are skipped.
+func (im *Importer) Import(path string, only []string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+	sources := map[string]func() error{}
+	switch {
+	case !info.IsDir():
+		name := strings.TrimSuffix(filepath.Base(path), mboxExtension)
+		sources[name] = func() error { return im.importMbox(name, path) }
+
+	case IsMaildir(path) || hasMaildirs(path):
+		maildirs, err := FindMaildirs(path)
+		if err != nil {
+			return fmt.Errorf("FindMaildirs: %w", err)
+		}
+		for name, dir := range maildirs {
+			name, dir := name, dir
+			sources[name] = func() error { return im.importMaildir(name, dir) }
+		}
+
+	default:
+		err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(file, mboxExtension) {
+				return err
+			}
+			rel, err := filepath.Rel(path, file)
+			if err != nil {
+				return err
+			}
+			name := strings.TrimSuffix(filepath.ToSlash(rel), mboxExtension)
+			sources[name] = func() error { return im.importMbox(name, file) }
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("filepath.WalkDir: %w", err)
+		}
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no mbox files or Maildirs found in %q", path)
+	}
+	for name, source := range sources {
+		if len(only) > 0 && !contains(only, name) {
+			continue
+		}
+		if err := source(); err != nil {
+			return fmt.Errorf("importing %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func hasMaildirs(dir string) bool {
+	maildirs, err := FindMaildirs(dir)
+	return err == nil && len(maildirs) > 0
+}
+
+func (im *Importer) importMbox(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	mailbox, err := im.mailbox(name)
+	if err != nil {
+		return err
+	}
+	r := NewMboxReader(f)
+	for {
+		msg, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("r.Next: %w", err)
+		}
+		if err := im.store(mailbox, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (im *Importer) importMaildir(name, dir string) error {
+	mailbox, err := im.mailbox(name)
+	if err != nil {
+		return err
+	}
+	return ReadMaildir(dir, func(msg *Message) error {
+		return im.store(mailbox, msg)
+	})
+}
+
+// mailbox works out the name of the mailbox to import into and creates
+// it, along with any parents so that the hierarchy is visible.
+func (im *Importer) mailbox(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") && im.Prefix == "" {
+		name = "INBOX"
+	}
+	if im.Prefix != "" {
+		name = strings.TrimSuffix(im.Prefix, "/") + "/" + name
+	}
+	if name == "Outbox" {
+		return "", fmt.Errorf("cannot import into the Outbox")
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parent := strings.Join(parts[:i+1], "/")
+		if ok, err := im.Storage.MailboxSelect(parent); err != nil {
+			return "", fmt.Errorf("im.Storage.MailboxSelect: %w", err)
+		} else if ok {
+			continue
+		}
+		if err := im.Storage.MailboxCreate(parent); err != nil {
+			return "", fmt.Errorf("im.Storage.MailboxCreate: %w", err)
+		}
+	}
+	return name, nil
+}
+
+func (im *Importer) store(mailbox string, msg *Message) error {
+	seen, err := im.existing(mailbox)
+	if err != nil {
+		return err
+	}
+	key := messageKey(msg.Data)
+	if _, ok := seen[key]; ok {
+		im.Skipped++
+		return nil
+	}
+	if msg.Date.IsZero() {
+		msg.Date = time.Now()
+	}
+	if _, err := im.Storage.MailImport(
+		mailbox, msg.Data, msg.Date, msg.Seen, msg.Answered, msg.Flagged, msg.Deleted,
+	); err != nil {
+		return fmt.Errorf("im.Storage.MailImport: %w", err)
+	}
+	seen[key] = struct{}{}
+	im.Imported++
+	if im.Imported%1000 == 0 {
+		im.Log.Info("Imported mails so far", "count", im.Imported)
+	}
+	return nil
+}
+
+// existing returns the keys of the mail already in the mailbox, which are
+// loaded the first time that the mailbox is imported into.
+func (im *Importer) existing(mailbox string) (map[string]struct{}, error) {
+	if im.seen == nil {
+		im.seen = map[string]map[string]struct{}{}
+	}
+	if seen, ok := im.seen[mailbox]; ok {
+		return seen, nil
+	}
+	seen := map[string]struct{}{}
+	ids, err := im.Storage.MailSearch(mailbox)
+	if err != nil {
+		return nil, fmt.Errorf("im.Storage.MailSearch: %w", err)
+	}
+	for _, id := range ids {
+		_, mail, err := im.Storage.MailSelect(mailbox, int(id))
+		if err != nil {
+			return nil, fmt.Errorf("im.Storage.MailSelect: %w", err)
+		}
+		seen[messageKey(mail.Mail)] = struct{}{}
+	}
+	im.seen[mailbox] = seen
+	return seen, nil
+}
+
+// messageKey identifies a message by its Message-ID, or by a hash of the
+// content if it doesn't have one.
+func messageKey(data []byte) string {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err == nil {
+		if id := strings.TrimSpace(hdr.Get("Message-Id")); id != "" {
+			return "id:" + id
+		}
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// headerDate returns the date from the Date header, or the zero time if
+// there isn't a valid one.
+func headerDate(data []byte) time.Time {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return time.Time{}
+	}
+	if date, err := mail.ParseDate(hdr.Get("Date")); err == nil {
+		return date
+	}
+	return time.Time{}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mailboxes are written as nested Maildirs, i.e. the mailbox "Work/Projects"
+// is the Maildir at Work/Projects, like Dovecot's LAYOUT=fs. Maildir++
+// folders like .Work.Projects are also understood when importing.
+
+var maildirCounter atomic.Uint64
+
+// IsMaildir returns true if the directory looks like a Maildir.
+func IsMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteMaildir stores a single message in the Maildir, creating it if it
+// doesn't exist yet.
+func WriteMaildir(dir string, msg *Message) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("os.MkdirAll: %w", err)
+		}
+	}
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		msg.Date.Unix(), time.Now().UnixNano()%1e6, os.Getpid(), maildirCounter.Add(1), hostname,
+	)
+	tmp := filepath.Join(dir, "tmp", name)
+	data := bytes.ReplaceAll(msg.Data, []byte("\r\n"), []byte("\n"))
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	if err := os.Chtimes(tmp, msg.Date, msg.Date); err != nil {
+		return fmt.Errorf("os.Chtimes: %w", err)
+	}
+	cur := filepath.Join(dir, "cur", name+":2,"+msg.maildirFlags())
+	if err := os.Rename(tmp, cur); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+// maildirFlags returns the flags in the info part of the filename, which
+// must be in ASCII order.
+func (msg *Message) maildirFlags() string {
+	flags := ""
+	if msg.Flagged {
+		flags += "F"
+	}
+	if msg.Answered {
+		flags += "R"
+	}
+	if msg.Seen {
+		flags += "S"
+	}
+	if msg.Deleted {
+		flags += "T"
+	}
+	return flags
+}
+
+// ReadMaildir calls the function for every message in the Maildir, reading
+// them one at a time and in delivery order.
+func ReadMaildir(dir string, fn func(*Message) error) error {
+	var files []string
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return fmt.Errorf("os.ReadDir: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(sub, entry.Name()))
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile: %w", err)
+		}
+		msg := &Message{Data: normaliseLineEndings(data)}
+		if info, err := os.Stat(path); err == nil {
+			msg.Date = info.ModTime()
+		}
+		base := filepath.Base(file)
+		if i := strings.LastIndexAny(base, ":;"); i >= 0 && strings.HasPrefix(base[i+1:], "2,") {
+			flags := base[i+3:]
+			msg.Flagged = strings.Contains(flags, "F")
+			msg.Answered = strings.Contains(flags, "R")
+			msg.Seen = strings.Contains(flags, "S")
+			msg.Deleted = strings.Contains(flags, "T")
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMaildirs returns the mailbox names of all of the Maildirs below the
+// root, mapped to their paths.
+func FindMaildirs(root string) (map[string]string, error) {
+	found := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			if path != root {
+				return fs.SkipDir
+			}
+		}
+		if !IsMaildir(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		found[maildirMailboxName(rel)] = path
+		return nil
+	})
+	return found, err
+}
+
+func maildirMailboxName(rel string) string {
+	if rel == "." {
+		return "INBOX"
+	}
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(rel, "/") && strings.HasPrefix(rel, ".") {
+		// A Maildir++ folder, where the hierarchy is separated by dots.
+		rel = strings.ReplaceAll(strings.TrimPrefix(rel, "."), ".", "/")
+	}
+	return rel
+}
+
+func normaliseLineEndings(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,216 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The mbox files that we write are in the mboxrd format, so any line in
+// the body that looks like a separator is escaped with an extra ">". The
+// flags are kept in the Status and X-Status headers, like mutt does.
+
+var mboxSeparator = []byte("From ")
+
+// WriteMbox appends a single message to an mbox file.
+func WriteMbox(w io.Writer, msg *Message) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From MAILER-DAEMON %s\n", msg.Date.UTC().Format(time.ANSIC))
+
+	status, xstatus := "O", ""
+	if msg.Seen {
+		status = "RO"
+	}
+	if msg.Answered {
+		xstatus += "A"
+	}
+	if msg.Flagged {
+		xstatus += "F"
+	}
+	if msg.Deleted {
+		xstatus += "D"
+	}
+
+	inHeader := true
+	skipping := false
+	scanner := newLineScanner(bytes.NewReader(msg.Data))
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r\n")
+		if inHeader {
+			if len(line) == 0 {
+				inHeader = false
+				fmt.Fprintf(bw, "Status: %s\n", status)
+				if xstatus != "" {
+					fmt.Fprintf(bw, "X-Status: %s\n", xstatus)
+				}
+			} else if line[0] == ' ' || line[0] == '\t' {
+				if skipping {
+					continue
+				}
+			} else {
+				skipping = isStatusHeader(line)
+				if skipping {
+					continue
+				}
+			}
+		} else if bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxSeparator) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner.Err: %w", err)
+	}
+	if inHeader {
+		// The message had no body, so we never saw the end of the header.
+		fmt.Fprintf(bw, "Status: %s\n\n", status)
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// MboxReader reads messages one at a time from an mbox file, so that
+// large archives don't need to fit into memory.
+type MboxReader struct {
+	scanner *bufio.Scanner
+	next    []byte // the separator line of the next message
+	done    bool
+}
+
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{scanner: newLineScanner(r)}
+}
+
+// Next returns the next message from the mbox file, or io.EOF if there
+// are no more.
+func (r *MboxReader) Next() (*Message, error) {
+	if r.next == nil {
+		// Skip anything before the first separator.
+		for {
+			if !r.scanner.Scan() {
+				if err := r.scanner.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			if line := r.scanner.Bytes(); bytes.HasPrefix(line, mboxSeparator) {
+				r.next = append([]byte{}, line...)
+				break
+			}
+		}
+	}
+	if r.done {
+		return nil, io.EOF
+	}
+
+	msg := &Message{Date: parseSeparatorDate(string(r.next))}
+	var data bytes.Buffer
+	inHeader := true
+	skipping := false
+	r.next = nil
+	for r.scanner.Scan() {
+		line := bytes.TrimRight(r.scanner.Bytes(), "\r\n")
+		if bytes.HasPrefix(line, mboxSeparator) {
+			r.next = append([]byte{}, line...)
+			break
+		}
+		if inHeader {
+			if len(line) == 0 {
+				inHeader = false
+			} else if line[0] == ' ' || line[0] == '\t' {
+				if skipping {
+					continue
+				}
+			} else if skipping = isStatusHeader(line); skipping {
+				msg.parseStatus(string(line))
+				continue
+			}
+		} else if bytes.HasPrefix(line, []byte(">")) && bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxSeparator) {
+			line = line[1:]
+		}
+		data.Write(line)
+		data.WriteString("\r\n")
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if r.next == nil {
+		r.done = true
+	}
+	// The blank line before the next separator isn't part of the message.
+	msg.Data = bytes.TrimSuffix(data.Bytes(), []byte("\r\n"))
+	if !bytes.HasSuffix(msg.Data, []byte("\r\n")) {
+		msg.Data = append(msg.Data, '\r', '\n')
+	}
+	if msg.Date.IsZero() {
+		msg.Date = headerDate(msg.Data)
+	}
+	return msg, nil
+}
+
+func isStatusHeader(line []byte) bool {
+	lower := strings.ToLower(string(line))
+	return strings.HasPrefix(lower, "status:") || strings.HasPrefix(lower, "x-status:")
+}
+
+func (msg *Message) parseStatus(line string) {
+	name, value, _ := strings.Cut(line, ":")
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(name, "Status") {
+		msg.Seen = strings.Contains(value, "R")
+		return
+	}
+	msg.Answered = strings.Contains(value, "A")
+	msg.Flagged = strings.Contains(value, "F")
+	msg.Deleted = strings.Contains(value, "D")
+}
+
+// parseSeparatorDate parses the date from a line like:
+// From alice@example.com Mon Jan  2 15:04:05 2006
+func parseSeparatorDate(line string) time.Time {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[len(fields)-5:], " ")
+	if t, err := time.Parse("Mon Jan 2 15:04:05 2006", date); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// Lines in mail should be short, but we have to cope with those that
+	// aren't, i.e. long lines of base64 from broken mail clients.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	scanner.Split(scanLines)
+	return scanner
+}
+
+// scanLines splits on LF but keeps it, unlike bufio.ScanLines, so that a
+// lone CR is preserved.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
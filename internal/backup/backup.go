@@ -0,0 +1,168 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package backup takes consistent copies of the database, which holds the
+// private key and therefore the mail address, and restores them again.
+// Backups are plain SQLite databases unless a passphrase is given, in which
+// case they are encrypted.
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+// ErrPassphraseRequired is returned when restoring an encrypted backup
+// without a passphrase.
+var ErrPassphraseRequired = errors.New("backup is encrypted and needs a passphrase")
+
+// Snapshotter is the part of the storage that backups are taken from.
+type Snapshotter interface {
+	Snapshot(filename string) error
+}
+
+// Create writes a backup of the database to the given file. The snapshot
+// is taken next to the database, so that an unencrypted copy never ends
+// up alongside the backup, and is checked before it is written out.
+func Create(store Snapshotter, database, filename, passphrase string) error {
+	snapshot, err := tempFile(filepath.Dir(database))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(snapshot)
+	if err := store.Snapshot(snapshot); err != nil {
+		return fmt.Errorf("store.Snapshot: %w", err)
+	}
+	if err := sqlite3.Verify(snapshot); err != nil {
+		return fmt.Errorf("sqlite3.Verify: %w", err)
+	}
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	return writeFile(filename, func(w io.Writer) error {
+		if passphrase == "" {
+			_, err := io.Copy(w, f)
+			return err
+		}
+		return encrypt(w, f, passphrase)
+	})
+}
+
+// IsEncrypted returns true if the given backup is encrypted.
+func IsEncrypted(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(header, magic), nil
+}
+
+// Restore replaces the database with the given backup, after checking that
+// the backup is intact. Yggmail must not be running on the database.
+func Restore(filename, database, passphrase string) error {
+	encrypted, err := IsEncrypted(filename)
+	if err != nil {
+		return err
+	}
+	if encrypted && passphrase == "" {
+		return ErrPassphraseRequired
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	restored, err := tempFile(filepath.Dir(database))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(restored)
+	out, err := os.OpenFile(restored, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	if encrypted {
+		err = decrypt(out, f, passphrase)
+	} else {
+		_, err = io.Copy(out, f)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("out.Close: %w", err)
+	}
+	if err := sqlite3.Verify(restored); err != nil {
+		return fmt.Errorf("sqlite3.Verify: %w", err)
+	}
+
+	// A journal left over from the old database would be applied to the
+	// restored one the next time that it is opened, so remove them first.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(database + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+	if err := os.Rename(restored, database); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+func tempFile(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".yggmail-backup-*")
+	if err != nil {
+		return "", fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("f.Close: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// writeFile writes a file through a temporary file, so that there is never
+// a partly written backup under the real name.
+func writeFile(filename string, fn func(w io.Writer) error) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer os.Remove(tmp)
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("f.Sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// An encrypted backup starts with a header containing the magic bytes,
+// the salt and the Argon2id parameters used to derive the key from the
+// passphrase. The database then follows in chunks, each of which is sealed
+// with XChaCha20-Poly1305 and prefixed with its length. The nonce of each
+// chunk is its sequence number, with the last byte set on the final chunk
+// so that a truncated backup can't be mistaken for a complete one. The
+// header is authenticated along with every chunk.
+var magic = []byte("YGGBAK\x00\x01")
+
+const (
+	saltSize  = 16
+	chunkSize = 64 * 1024
+
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+const headerSize = 8 + saltSize + 4 + 4 + 1
+
+// ErrWrongPassphrase is returned when an encrypted backup can't be opened,
+// either because the passphrase is wrong or because it has been altered.
+var ErrWrongPassphrase = errors.New("wrong passphrase or damaged backup")
+
+func deriveKey(passphrase string, salt []byte, time, memory uint32, threads uint8) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, time, memory, threads, chacha20poly1305.KeySize)
+}
+
+func chunkNonce(seq uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	binary.BigEndian.PutUint64(nonce, seq)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func encrypt(w io.Writer, r io.Reader, passphrase string) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	salt := header[8 : 8+saltSize]
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("rand.Read: %w", err)
+	}
+	binary.BigEndian.PutUint32(header[8+saltSize:], argonTime)
+	binary.BigEndian.PutUint32(header[8+saltSize+4:], argonMemory)
+	header[headerSize-1] = argonThreads
+
+	aead, err := chacha20poly1305.NewX(deriveKey(passphrase, salt, argonTime, argonMemory, argonThreads))
+	if err != nil {
+		return fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("w.Write: %w", err)
+	}
+
+	// Read one chunk ahead, so that we know which chunk is the final one.
+	buf, next := make([]byte, chunkSize), make([]byte, chunkSize)
+	n, err := io.ReadFull(r, buf)
+	for seq := uint64(0); ; seq++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("io.ReadFull: %w", err)
+		}
+		final := err != nil
+		var m int
+		if !final {
+			m, err = io.ReadFull(r, next)
+			final = m == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF)
+		}
+		sealed := aead.Seal(nil, chunkNonce(seq, final), buf[:n], header)
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+		if _, err := w.Write(length[:]); err != nil {
+			return fmt.Errorf("w.Write: %w", err)
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return fmt.Errorf("w.Write: %w", err)
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+func decrypt(w io.Writer, r io.Reader, passphrase string) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if !bytes.Equal(header[:8], magic) {
+		return errors.New("not an encrypted backup")
+	}
+	salt := header[8 : 8+saltSize]
+	time := binary.BigEndian.Uint32(header[8+saltSize:])
+	memory := binary.BigEndian.Uint32(header[8+saltSize+4:])
+	threads := header[headerSize-1]
+	if time == 0 || memory == 0 || threads == 0 || memory > 4*1024*1024 {
+		return errors.New("backup has invalid key derivation parameters")
+	}
+	aead, err := chacha20poly1305.NewX(deriveKey(passphrase, salt, time, memory, threads))
+	if err != nil {
+		return fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+
+	var length [4]byte
+	for seq := uint64(0); ; seq++ {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			// Running out before the final chunk means that the backup
+			// has been truncated.
+			return ErrWrongPassphrase
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > chunkSize+uint32(aead.Overhead()) {
+			return ErrWrongPassphrase
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return ErrWrongPassphrase
+		}
+		final := false
+		plain, err := aead.Open(nil, chunkNonce(seq, false), sealed, header)
+		if err != nil {
+			if plain, err = aead.Open(nil, chunkNonce(seq, true), sealed, header); err != nil {
+				return ErrWrongPassphrase
+			}
+			final = true
+		}
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("w.Write: %w", err)
+		}
+		if final {
+			if n, _ := r.Read(length[:1]); n != 0 {
+				return ErrWrongPassphrase
+			}
+			return nil
+		}
+	}
+}
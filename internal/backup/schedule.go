@@ -0,0 +1,118 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/logging"
+)
+
+// The names of scheduled backups sort in the order that they were taken.
+const (
+	schedulePrefix     = "yggmail-"
+	scheduleTimeFormat = "20060102-150405"
+	scheduleExtension  = ".db"
+	encryptedExtension = ".db.enc"
+)
+
+// Schedule takes a backup into a directory at a regular interval and keeps
+// only the most recent ones.
+type Schedule struct {
+	Log        *slog.Logger
+	Storage    Snapshotter
+	Database   string
+	Directory  string
+	Interval   time.Duration
+	Keep       int // zero keeps every backup
+	Passphrase string
+}
+
+// Run takes backups until the process exits. If a backup was taken less
+// than an interval ago, i.e. before a restart, then the next one waits
+// until the interval has passed.
+func (s *Schedule) Run() {
+	if err := os.MkdirAll(s.Directory, 0700); err != nil {
+		s.Log.Error("Failed to create the backup directory", logging.Err(err))
+		return
+	}
+	wait := time.Duration(0)
+	if backups, err := s.backups(); err == nil && len(backups) > 0 {
+		if fi, err := os.Stat(backups[len(backups)-1]); err == nil {
+			wait = time.Until(fi.ModTime().Add(s.Interval))
+		}
+	}
+	for {
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		filename, err := s.backup()
+		if err != nil {
+			s.Log.Error("Failed to back up the database", logging.Err(err))
+		} else {
+			s.Log.Info("Backed up the database", "file", filename)
+		}
+		wait = s.Interval
+	}
+}
+
+func (s *Schedule) backup() (string, error) {
+	extension := scheduleExtension
+	if s.Passphrase != "" {
+		extension = encryptedExtension
+	}
+	name := schedulePrefix + time.Now().UTC().Format(scheduleTimeFormat) + extension
+	filename := filepath.Join(s.Directory, name)
+	if err := Create(s.Storage, s.Database, filename, s.Passphrase); err != nil {
+		return "", err
+	}
+	if err := s.prune(); err != nil {
+		return "", fmt.Errorf("s.prune: %w", err)
+	}
+	return filename, nil
+}
+
+// backups returns the scheduled backups in the directory, oldest first.
+func (s *Schedule) backups() ([]string, error) {
+	var backups []string
+	for _, extension := range []string{scheduleExtension, encryptedExtension} {
+		matches, err := filepath.Glob(filepath.Join(s.Directory, schedulePrefix+"*"+extension))
+		if err != nil {
+			return nil, fmt.Errorf("filepath.Glob: %w", err)
+		}
+		backups = append(backups, matches...)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return filepath.Base(backups[i]) < filepath.Base(backups[j])
+	})
+	return backups, nil
+}
+
+func (s *Schedule) prune() error {
+	if s.Keep <= 0 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.Keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("os.Remove: %w", err)
+		}
+		s.Log.Info("Removed old backup", "file", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package carddavserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// The address book is read-only, so there is only ever one of them
+// and it lives at a fixed path.
+const (
+	principalPath   = "/"
+	homeSetPath     = "/contacts/"
+	addressBookPath = "/contacts/default/"
+)
+
+var errReadOnly = webdav.NewHTTPError(http.StatusForbidden, errors.New("the address book is read-only"))
+
+func (b *Backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return principalPath, nil
+}
+
+func (b *Backend) AddressBookHomeSetPath(ctx context.Context) (string, error) {
+	return homeSetPath, nil
+}
+
+func (b *Backend) addressBook() carddav.AddressBook {
+	return carddav.AddressBook{
+		Path:        addressBookPath,
+		Name:        "Yggmail",
+		Description: "Yggmail address book",
+		SupportedAddressData: []carddav.AddressDataType{
+			{ContentType: vcard.MIMEType, Version: "3.0"},
+		},
+	}
+}
+
+func (b *Backend) ListAddressBooks(ctx context.Context) ([]carddav.AddressBook, error) {
+	return []carddav.AddressBook{b.addressBook()}, nil
+}
+
+func (b *Backend) GetAddressBook(ctx context.Context, p string) (*carddav.AddressBook, error) {
+	if p != addressBookPath {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("address book %q not found", p))
+	}
+	ab := b.addressBook()
+	return &ab, nil
+}
+
+func (b *Backend) CreateAddressBook(ctx context.Context, addressBook *carddav.AddressBook) error {
+	return errReadOnly
+}
+
+func (b *Backend) DeleteAddressBook(ctx context.Context, path string) error {
+	return errReadOnly
+}
+
+func (b *Backend) GetAddressObject(ctx context.Context, p string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	name := strings.TrimSuffix(path.Base(p), ".vcf")
+	contact, err := b.Storage.ContactSelect(name)
+	if err != nil {
+		return nil, fmt.Errorf("b.Storage.ContactSelect: %w", err)
+	}
+	if contact == nil || path.Dir(p)+"/" != addressBookPath {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("contact %q not found", p))
+	}
+	ao := addressObject(contact)
+	return &ao, nil
+}
+
+func (b *Backend) ListAddressObjects(ctx context.Context, p string, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	if p != addressBookPath {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("address book %q not found", p))
+	}
+	contacts, err := b.Storage.ContactList()
+	if err != nil {
+		return nil, fmt.Errorf("b.Storage.ContactList: %w", err)
+	}
+	aos := make([]carddav.AddressObject, 0, len(contacts))
+	for i := range contacts {
+		aos = append(aos, addressObject(&contacts[i]))
+	}
+	return aos, nil
+}
+
+func (b *Backend) QueryAddressObjects(ctx context.Context, p string, query *carddav.AddressBookQuery) ([]carddav.AddressObject, error) {
+	aos, err := b.ListAddressObjects(ctx, p, &query.DataRequest)
+	if err != nil {
+		return nil, err
+	}
+	return carddav.Filter(query, aos)
+}
+
+func (b *Backend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *carddav.PutAddressObjectOptions) (*carddav.AddressObject, error) {
+	return nil, errReadOnly
+}
+
+func (b *Backend) DeleteAddressObject(ctx context.Context, path string) error {
+	return errReadOnly
+}
+
+func addressObject(contact *types.Contact) carddav.AddressObject {
+	fn := contact.DisplayName
+	if fn == "" {
+		fn = contact.Name
+	}
+	card := vcard.Card{}
+	card.SetValue(vcard.FieldVersion, "3.0")
+	card.SetValue(vcard.FieldUID, contact.Key)
+	card.SetValue(vcard.FieldFormattedName, fn)
+	card.SetValue(vcard.FieldNickname, contact.Name)
+	card.SetValue(vcard.FieldEmail, contact.Key+"@"+utils.Domain)
+
+	etag := sha256.Sum256([]byte(contact.Name + "\x00" + contact.Key + "\x00" + contact.DisplayName))
+	return carddav.AddressObject{
+		Path: addressBookPath + contact.Name + ".vcf",
+		ETag: hex.EncodeToString(etag[:8]),
+		Card: card,
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package carddavserver
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+type CardDAVServer struct {
+	server  *http.Server
+	backend *Backend
+}
+
+func NewCardDAVServer(backend *Backend, addr string) (*CardDAVServer, error) {
+	s := &CardDAVServer{
+		backend: backend,
+	}
+	s.server = &http.Server{
+		Addr:    addr,
+		Handler: s.authenticate(&carddav.Handler{Backend: backend}),
+	}
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil {
+			backend.Log.Error("Failed to serve CardDAV", logging.Err(err))
+			os.Exit(1)
+		}
+	}()
+	return s, nil
+}
+
+// authenticate wraps the CardDAV handler in HTTP basic authentication,
+// using the same credentials as IMAP and SMTP.
+func (s *CardDAVServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if ok {
+			// Clients often try without credentials first, which isn't
+			// counted as a failed login.
+			source, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if err := s.backend.Lockout.Check(source); err != nil {
+				s.backend.Log.Warn("Refused CardDAV login from banned source", "remote", source)
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			// If our username is email-like, then take just the localpart
+			if pk, err := utils.ParseAddress(username, s.backend.Config.SubaddressSeparator); err == nil && !pk.Equal(s.backend.Config.PublicKey) {
+				ok = false
+			}
+			if ok {
+				ok, _ = s.backend.Storage.ConfigTryPassword(password)
+			}
+			if ok {
+				s.backend.Lockout.Succeeded(source)
+			} else {
+				s.backend.Log.Warn("Failed to authenticate CardDAV user", "remote", source, "username", username)
+				s.backend.Lockout.Failed(source)
+			}
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Yggmail"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Backend struct {
+	Config  *config.Config
+	Log     *slog.Logger
+	Storage storage.Storage
+	Lockout *lockout.Lockout // shared with the other listeners that check the password
+}
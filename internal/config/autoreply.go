@@ -0,0 +1,87 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The keys that the auto-reply settings are stored under in the config
+// table of the database.
+const (
+	AutoReplyEnabledKey = "autoreply_enabled"
+	AutoReplySubjectKey = "autoreply_subject"
+	AutoReplyBodyKey    = "autoreply_body"
+	AutoReplyDaysKey    = "autoreply_days"
+)
+
+// AutoReplyDefaultDays is how often we reply to the same sender if no
+// other interval has been configured.
+const AutoReplyDefaultDays = 7
+
+// AutoReply is the configuration of the automatic responder, which
+// answers incoming mail while we are away.
+type AutoReply struct {
+	Enabled bool
+	Subject string
+	Body    string
+	Days    int
+}
+
+// ConfigStore is the part of the storage that the auto-reply settings
+// are loaded from and saved to.
+type ConfigStore interface {
+	ConfigGet(key string) (string, error)
+	ConfigSet(key, value string) error
+}
+
+func LoadAutoReply(store ConfigStore) (*AutoReply, error) {
+	a := &AutoReply{Days: AutoReplyDefaultDays}
+	enabled, err := store.ConfigGet(AutoReplyEnabledKey)
+	if err != nil {
+		return nil, fmt.Errorf("store.ConfigGet: %w", err)
+	}
+	a.Enabled = enabled == "1"
+	if a.Subject, err = store.ConfigGet(AutoReplySubjectKey); err != nil {
+		return nil, fmt.Errorf("store.ConfigGet: %w", err)
+	}
+	if a.Body, err = store.ConfigGet(AutoReplyBodyKey); err != nil {
+		return nil, fmt.Errorf("store.ConfigGet: %w", err)
+	}
+	days, err := store.ConfigGet(AutoReplyDaysKey)
+	if err != nil {
+		return nil, fmt.Errorf("store.ConfigGet: %w", err)
+	}
+	if d, err := strconv.Atoi(days); err == nil && d > 0 {
+		a.Days = d
+	}
+	return a, nil
+}
+
+func (a *AutoReply) Save(store ConfigStore) error {
+	enabled := "0"
+	if a.Enabled {
+		enabled = "1"
+	}
+	if a.Days < 1 {
+		a.Days = AutoReplyDefaultDays
+	}
+	for key, value := range map[string]string{
+		AutoReplyEnabledKey: enabled,
+		AutoReplySubjectKey: a.Subject,
+		AutoReplyBodyKey:    a.Body,
+		AutoReplyDaysKey:    strconv.Itoa(a.Days),
+	} {
+		if err := store.ConfigSet(key, value); err != nil {
+			return fmt.Errorf("store.ConfigSet: %w", err)
+		}
+	}
+	return nil
+}
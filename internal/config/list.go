@@ -0,0 +1,102 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package config
+
+import "fmt"
+
+// The keys that the mailing list settings are stored under in the config
+// table of the list's database.
+const (
+	ListNameKey        = "list_name"
+	ListDescriptionKey = "list_description"
+	ListPostingKey     = "list_posting"
+	ListSubscribeKey   = "list_subscribe"
+)
+
+// Posting policies for mailing lists.
+const (
+	// ListPostingMembers distributes posts from members straight away and
+	// holds posts from anyone else for moderation.
+	ListPostingMembers = "members"
+	// ListPostingModerated holds all posts for moderation, except for
+	// those from owners.
+	ListPostingModerated = "moderated"
+	// ListPostingOpen distributes posts from anyone.
+	ListPostingOpen = "open"
+)
+
+// Subscription policies for mailing lists.
+const (
+	// ListSubscribeOpen allows anyone to subscribe by command mail.
+	ListSubscribeOpen = "open"
+	// ListSubscribeClosed only allows owners to add members.
+	ListSubscribeClosed = "closed"
+)
+
+// List is the configuration of a mailing list. A mailing list has its own
+// identity and database, separate from those of the user.
+type List struct {
+	Name        string
+	Description string
+	Posting     string
+	Subscribe   string
+}
+
+func LoadList(store ConfigStore) (*List, error) {
+	l := &List{}
+	for key, value := range map[string]*string{
+		ListNameKey:        &l.Name,
+		ListDescriptionKey: &l.Description,
+		ListPostingKey:     &l.Posting,
+		ListSubscribeKey:   &l.Subscribe,
+	} {
+		var err error
+		if *value, err = store.ConfigGet(key); err != nil {
+			return nil, fmt.Errorf("store.ConfigGet: %w", err)
+		}
+	}
+	if l.Posting == "" {
+		l.Posting = ListPostingMembers
+	}
+	if l.Subscribe == "" {
+		l.Subscribe = ListSubscribeOpen
+	}
+	return l, nil
+}
+
+func (l *List) Validate() error {
+	switch l.Posting {
+	case ListPostingMembers, ListPostingModerated, ListPostingOpen:
+	default:
+		return fmt.Errorf("unknown posting policy %q", l.Posting)
+	}
+	switch l.Subscribe {
+	case ListSubscribeOpen, ListSubscribeClosed:
+	default:
+		return fmt.Errorf("unknown subscription policy %q", l.Subscribe)
+	}
+	return nil
+}
+
+func (l *List) Save(store ConfigStore) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	for key, value := range map[string]string{
+		ListNameKey:        l.Name,
+		ListDescriptionKey: l.Description,
+		ListPostingKey:     l.Posting,
+		ListSubscribeKey:   l.Subscribe,
+	} {
+		if err := store.ConfigSet(key, value); err != nil {
+			return fmt.Errorf("store.ConfigSet: %w", err)
+		}
+	}
+	return nil
+}
@@ -11,47 +11,81 @@ package imapserver
 import (
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/logging"
 	"github.com/neilalexander/yggmail/internal/storage"
 	"github.com/neilalexander/yggmail/internal/utils"
 )
 
 type Backend struct {
 	Config  *config.Config
-	Log     *log.Logger
+	Log     *slog.Logger
 	Storage storage.Storage
 	Server  *IMAPServer
+	Lockout *lockout.Lockout // shared with the other listeners that check the password
 }
 
 func (b *Backend) Login(conn *imap.ConnInfo, username, password string) (backend.User, error) {
+	log := b.Log.With("remote", remoteAddr(conn), "username", username)
+	var source string
+	if conn != nil {
+		source = lockout.Source(conn.RemoteAddr)
+	}
+	if err := b.Lockout.Check(source); err != nil {
+		log.Warn("Refused IMAP login from banned source")
+		imapAuthFailures.Inc()
+		return nil, err
+	}
 	// If our username is email-like, then take just the localpart
-	if pk, err := utils.ParseAddress(username); err == nil {
+	if pk, err := utils.ParseAddress(username, b.Config.SubaddressSeparator); err == nil {
 		if !pk.Equal(b.Config.PublicKey) {
-			b.Log.Println("Failed to authenticate IMAP user due to wrong domain", pk, b.Config.PublicKey)
+			log.Warn("Failed to authenticate IMAP user due to wrong domain", logging.Peer(pk))
+			imapAuthFailures.Inc()
+			b.Lockout.Failed(source)
 			return nil, fmt.Errorf("failed to authenticate: wrong domain in username")
 		}
 	}
 	username = hex.EncodeToString(b.Config.PublicKey)
 	if authed, err := b.Storage.ConfigTryPassword(password); err != nil {
-		b.Log.Printf("Failed to authenticate IMAP user %q due to error: %s", username, err)
+		log.Warn("Failed to authenticate IMAP user", logging.Err(err))
+		imapAuthFailures.Inc()
+		// A wrong password is also an error from bcrypt.
+		b.Lockout.Failed(source)
 		return nil, fmt.Errorf("failed to authenticate: %w", err)
 	} else if !authed {
-		b.Log.Printf("Failed to authenticate IMAP user %q\n", username)
+		log.Warn("Failed to authenticate IMAP user")
+		imapAuthFailures.Inc()
+		b.Lockout.Failed(source)
 		return nil, backend.ErrInvalidCredentials
 	}
-	defer b.Log.Printf("Authenticated IMAP user from %s as %q\n", conn.RemoteAddr.String(), username)
+	b.Lockout.Succeeded(source)
+	log = b.Log.With(logging.Session(logging.NewSessionID()), "remote", remoteAddr(conn))
+	log.Info("Authenticated IMAP user")
 	user := &User{
 		backend:  b,
+		log:      log,
 		username: username,
 		conn:     conn,
 	}
+	imapSessions.Inc()
+	imapSessionsOpen.Add(1)
 	return user, nil
 }
 
+// remoteAddr is where the connection came from, which is only known when
+// there is a connection.
+func remoteAddr(conn *imap.ConnInfo) string {
+	if conn == nil || conn.RemoteAddr == nil {
+		return ""
+	}
+	return conn.RemoteAddr.String()
+}
+
 /*
 func (b *Backend) NotifyNew(id int) error {
 	b.Server.server.ForEachConn(func(conn server.Conn) {
@@ -9,12 +9,14 @@
 package imapserver
 
 import (
-	"log"
+	"os"
 
+	"github.com/emersion/go-imap"
 	idle "github.com/emersion/go-imap-idle"
 	move "github.com/emersion/go-imap-move"
 	"github.com/emersion/go-imap/server"
 	"github.com/emersion/go-sasl"
+	"github.com/neilalexander/yggmail/internal/logging"
 )
 
 type IMAPServer struct {
@@ -34,16 +36,29 @@ func NewIMAPServer(backend *Backend, addr string, insecure bool) (*IMAPServer, *
 	//s.server.Debug = os.Stdout
 	s.server.Enable(idle.NewExtension())
 	s.server.Enable(move.NewExtension())
+	s.server.Enable(&metadataExtension{backend: backend})
+	s.server.Enable(&quotaExtension{backend: backend})
 	// s.server.Enable(s.notify)
 	s.server.EnableAuth(sasl.Login, func(conn server.Conn) sasl.Server {
 		return sasl.NewLoginServer(func(username, password string) error {
-			_, err := s.backend.Login(nil, username, password)
-			return err
+			// The connection info carries the remote address, so that
+			// failed logins count against where they came from.
+			user, err := s.backend.Login(conn.Info(), username, password)
+			if err != nil {
+				return err
+			}
+			// This is a real session, as with PLAIN, so that the user is
+			// logged in and logged out again when the connection closes.
+			ctx := conn.Context()
+			ctx.State = imap.AuthenticatedState
+			ctx.User = user
+			return nil
 		})
 	})
 	go func() {
 		if err := s.server.ListenAndServe(); err != nil {
-			log.Fatal(err)
+			backend.Log.Error("Failed to serve IMAP", logging.Err(err))
+			os.Exit(1)
 		}
 	}()
 	return s, s.notify, nil
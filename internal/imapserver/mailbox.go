@@ -27,29 +27,19 @@ type Mailbox struct {
 	user    *User
 }
 
-func (mbox *Mailbox) getIDsFromSeqSet(uid bool, seqSet *imap.SeqSet) ([]int32, error) {
-	var ids []int32
+// getIDsFromSeqSet resolves a sequence set into the mails that it refers to,
+// with a single range query for each range in the set, so that sparse IDs
+// and large mailboxes don't turn into a query per number.
+func (mbox *Mailbox) getIDsFromSeqSet(uid bool, seqSet *imap.SeqSet) ([]types.MailSeq, error) {
+	var mails []types.MailSeq
 	for _, set := range seqSet.Set {
-		if set.Stop == 0 {
-			next, err := mbox.backend.Storage.MailNextID(mbox.name)
-			if err != nil {
-				return nil, fmt.Errorf("mbox.backend.Storage.MailNextID: %w", err)
-			}
-			set.Stop = uint32(next - 1)
-		}
-		for i := set.Start; i <= set.Stop; i++ {
-			if !uid {
-				pid, err := mbox.backend.Storage.MailIDForSeq(mbox.name, int(i))
-				if err != nil {
-					return nil, fmt.Errorf("mbox.backend.Storage.MailIDForSeq: %w", err)
-				}
-				ids = append(ids, int32(pid))
-			} else {
-				ids = append(ids, int32(i))
-			}
+		r, err := mbox.backend.Storage.MailRange(mbox.name, uid, int(set.Start), int(set.Stop))
+		if err != nil {
+			return nil, fmt.Errorf("mbox.backend.Storage.MailRange: %w", err)
 		}
+		mails = append(mails, r...)
 	}
-	return ids, nil
+	return mails, nil
 }
 
 func (mbox *Mailbox) Name() string {
@@ -70,7 +60,13 @@ func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error
 	status.PermanentFlags = []string{
 		"\\Seen", "\\Answered", "\\Flagged", "\\Deleted",
 	}
-	status.Flags = status.PermanentFlags
+	// Mails with a lifetime have a keyword that can't be set or removed.
+	status.Flags = []string{
+		"\\Seen", "\\Answered", "\\Flagged", "\\Deleted", types.ExpiresKeyword,
+	}
+	if mbox.backend.Config.DeliveryReceipts {
+		status.Flags = append(status.Flags, types.DeliveredKeyword)
+	}
 
 	for _, name := range items {
 		switch name {
@@ -122,45 +118,28 @@ func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 		return fmt.Errorf("mbox.getIDsFromSeqSet: %w", err)
 	}
 
-	for _, id := range ids {
-		mseq, mail, err := mbox.backend.Storage.MailSelect(mbox.name, int(id))
+	for _, m := range ids {
+		mail, err := mbox.backend.Storage.MailSelectMeta(mbox.name, m.ID)
 		if err != nil {
 			continue
 		}
 
-		fetched := imap.NewMessage(uint32(id), items)
-		fetched.SeqNum = uint32(mseq)
+		fetched := imap.NewMessage(uint32(m.Seq), items)
 		fetched.Uid = uint32(mail.ID)
 
-		get := func() (io.Reader, textproto.Header, error) {
-			bodyreader := bufio.NewReader(bytes.NewReader(mail.Mail))
-			hdr, err := textproto.ReadHeader(bodyreader)
-			if err != nil {
-				return nil, textproto.Header{}, fmt.Errorf("textproto.ReadHeader: %w", err)
-			}
-			return bodyreader, hdr, err
-		}
-
 		for _, item := range items {
 			switch item {
 			case imap.FetchEnvelope:
-				_, hdr, err := get()
-				if err != nil {
-					continue
-				}
-				if fetched.Envelope, err = backendutil.FetchEnvelope(hdr); err != nil {
-					continue
-				}
+				fetched.Envelope = mail.Meta.Envelope
 
-			case imap.FetchBody, imap.FetchBodyStructure:
-				bodyreader, hdr, err := get()
-				if err != nil {
-					continue
-				}
-				if fetched.BodyStructure, err = backendutil.FetchBodyStructure(hdr, bodyreader, item == imap.FetchBodyStructure); err != nil {
-					continue
+			case imap.FetchBody:
+				if mail.Meta.BodyStructure != nil {
+					fetched.BodyStructure = basicBodyStructure(mail.Meta.BodyStructure)
 				}
 
+			case imap.FetchBodyStructure:
+				fetched.BodyStructure = mail.Meta.BodyStructure
+
 			case imap.FetchFlags:
 				fetched.Flags = []string{}
 				if mail.Seen {
@@ -175,26 +154,28 @@ func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 				if mail.Deleted {
 					fetched.Flags = append(fetched.Flags, "\\Deleted")
 				}
+				if _, ok := mail.Meta.Expires(); ok {
+					fetched.Flags = append(fetched.Flags, types.ExpiresKeyword)
+				}
+				if mbox.delivered(mail) {
+					fetched.Flags = append(fetched.Flags, types.DeliveredKeyword)
+				}
 
 			case imap.FetchInternalDate:
 				fetched.InternalDate = mail.Date
 
 			case imap.FetchRFC822Size:
-				fetched.Size = uint32(len(mail.Mail))
+				fetched.Size = uint32(mail.Meta.Size)
 
 			case imap.FetchUid:
-				fetched.Uid = uint32(id)
+				fetched.Uid = uint32(mail.ID)
 
 			default:
 				section, err := imap.ParseBodySectionName(item)
 				if err != nil {
 					continue
 				}
-				bodyreader, hdr, err := get()
-				if err != nil {
-					continue
-				}
-				l, err := backendutil.FetchBodySection(hdr, bodyreader, section)
+				l, err := mbox.fetchBodySection(mail, section)
 				if err != nil {
 					continue
 				}
@@ -208,6 +189,60 @@ func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 	return nil
 }
 
+// delivered returns true if delivery receipts are on and the mail, i.e. the
+// copy that the mail client saved when sending it, has been delivered to at
+// least one of its recipients.
+func (mbox *Mailbox) delivered(mail *types.Mail) bool {
+	if !mbox.backend.Config.DeliveryReceipts || mail.Meta == nil || mail.Meta.Envelope == nil {
+		return false
+	}
+	id := types.MessageID(mail.Meta.Envelope.MessageId)
+	if id == "" {
+		return false
+	}
+	receipts, err := mbox.backend.Storage.ReceiptSelect(id)
+	return err == nil && len(receipts) > 0
+}
+
+// fetchBodySection returns a section of the mail. Sections of the top-level
+// header, which is what clients fetch most when listing a mailbox, come from
+// the stored metadata without reading the mail itself.
+func (mbox *Mailbox) fetchBodySection(mail *types.Mail, section *imap.BodySectionName) (imap.Literal, error) {
+	if len(section.Path) == 0 && section.Specifier == imap.HeaderSpecifier && mail.Meta.Header != nil {
+		hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(mail.Meta.Header)))
+		if err != nil {
+			return nil, fmt.Errorf("textproto.ReadHeader: %w", err)
+		}
+		return backendutil.FetchBodySection(hdr, bytes.NewReader(nil), section)
+	}
+	body, err := mbox.backend.Storage.MailOpen(mbox.name, int(mail.ID))
+	if err != nil {
+		return nil, fmt.Errorf("mbox.backend.Storage.MailOpen: %w", err)
+	}
+	defer body.Close()
+	bodyreader := bufio.NewReader(body)
+	hdr, err := textproto.ReadHeader(bodyreader)
+	if err != nil {
+		return nil, fmt.Errorf("textproto.ReadHeader: %w", err)
+	}
+	return backendutil.FetchBodySection(hdr, bodyreader, section)
+}
+
+// basicBodyStructure returns a copy of the body structure without the
+// extension data, which is what BODY returns as opposed to BODYSTRUCTURE.
+func basicBodyStructure(bs *imap.BodyStructure) *imap.BodyStructure {
+	basic := *bs
+	basic.Extended = false
+	basic.Parts = nil
+	for _, part := range bs.Parts {
+		basic.Parts = append(basic.Parts, basicBodyStructure(part))
+	}
+	if bs.BodyStructure != nil {
+		basic.BodyStructure = basicBodyStructure(bs.BodyStructure)
+	}
+	return &basic
+}
+
 func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
 	return mbox.backend.Storage.MailSearch(mbox.name)
 }
@@ -217,6 +252,9 @@ func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Lit
 	if err != nil {
 		return fmt.Errorf("b.ReadFrom: %w", err)
 	}
+	if err := mbox.backend.checkQuota(mbox.name, int64(len(b))); err != nil {
+		return err
+	}
 	id, err := mbox.backend.Storage.MailCreate(mbox.name, b)
 	if err != nil {
 		return fmt.Errorf("mbox.backend.Storage.MailCreate: %w", err)
@@ -248,11 +286,11 @@ func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 		return fmt.Errorf("mbox.getIDsFromSeqSet: %w", err)
 	}
 
-	for _, id := range ids {
+	for _, m := range ids {
 		var mail *types.Mail
 		if op != imap.SetFlags {
 			var err error
-			_, mail, err = mbox.backend.Storage.MailSelect(mbox.name, int(id))
+			_, mail, err = mbox.backend.Storage.MailSelect(mbox.name, m.ID)
 			if err != nil {
 				return fmt.Errorf("mbox.backend.Storage.MailSelect: %w", err)
 			}
@@ -290,19 +328,25 @@ func (mbox *Mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string
 		return fmt.Errorf("mbox.getIDsFromSeqSet: %w", err)
 	}
 
-	for _, id := range ids {
-		_, mail, err := mbox.backend.Storage.MailSelect(mbox.name, int(id))
+	// Either all of the mails fit or none of them are copied. Only the
+	// metadata is needed for that, since the copies share the contents.
+	var size int64
+	for _, m := range ids {
+		mail, err := mbox.backend.Storage.MailSelectMeta(mbox.name, m.ID)
 		if err != nil {
-			return fmt.Errorf("mbox.backend.Storage.MailSelect: %w", err)
+			return fmt.Errorf("mbox.backend.Storage.MailSelectMeta: %w", err)
 		}
-		pid, err := mbox.backend.Storage.MailCreate(destName, mail.Mail)
-		if err != nil {
-			return fmt.Errorf("mbox.backend.Storage.MailCreate: %w", err)
+		if mail.Meta != nil {
+			size += int64(mail.Meta.Size)
 		}
-		if err = mbox.backend.Storage.MailUpdateFlags(
-			mbox.name, pid, mail.Seen, mail.Answered, mail.Flagged, mail.Deleted,
-		); err != nil {
-			return fmt.Errorf("mbox.backend.Storage.MailUpdateFlags: %w", err)
+	}
+	if err := mbox.backend.checkQuota(destName, size); err != nil {
+		return err
+	}
+
+	for _, m := range ids {
+		if _, err := mbox.backend.Storage.MailCopy(mbox.name, m.ID, destName); err != nil {
+			return fmt.Errorf("mbox.backend.Storage.MailCopy: %w", err)
 		}
 	}
 	return nil
@@ -322,12 +366,12 @@ func (mbox *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) er
 		return fmt.Errorf("mbox.getIDsFromSeqSet: %w", err)
 	}
 
-	for _, id := range ids {
-		if err := mbox.backend.Storage.MailMove(mbox.name, int(id), dest); err != nil {
+	for _, m := range ids {
+		if err := mbox.backend.Storage.MailMove(mbox.name, m.ID, dest); err != nil {
 			return err
 		}
 		if mbox.name == "Outbox" {
-			mbox.backend.Storage.QueueDeleteDestinationForID("Outbox", int(id))
+			mbox.backend.Storage.QueueDeleteDestinationForID("Outbox", m.ID)
 		}
 	}
 	return nil
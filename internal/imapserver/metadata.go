@@ -0,0 +1,310 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package imapserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/neilalexander/yggmail/internal/config"
+)
+
+// The server metadata entries from RFC 5464 that we support. They allow
+// mail clients to configure the auto-responder.
+const (
+	metadataAutoReply        = "/private/vendor/yggmail/autoreply"
+	metadataAutoReplyEnabled = metadataAutoReply + "/enabled"
+	metadataAutoReplySubject = metadataAutoReply + "/subject"
+	metadataAutoReplyBody    = metadataAutoReply + "/body"
+	metadataAutoReplyDays    = metadataAutoReply + "/days"
+)
+
+// The mailbox metadata entry under which each mail with a lifetime has an
+// entry of its own, named after its UID, that says when it expires, i.e.
+// /private/vendor/yggmail/expires/42. The entries are read-only.
+const metadataExpires = "/private/vendor/yggmail/expires"
+
+var metadataEntries = []string{
+	metadataAutoReplyEnabled,
+	metadataAutoReplySubject,
+	metadataAutoReplyBody,
+	metadataAutoReplyDays,
+}
+
+// metadataExtension implements the IMAP METADATA extension. The server
+// annotations can be changed, but the only mailbox annotations are the
+// expiry times, which can only be read.
+type metadataExtension struct {
+	backend *Backend
+}
+
+func (ext *metadataExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"METADATA", "METADATA-SERVER"}
+	}
+	return nil
+}
+
+func (ext *metadataExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "GETMETADATA":
+		return func() server.Handler {
+			return &getMetadata{backend: ext.backend}
+		}
+	case "SETMETADATA":
+		return func() server.Handler {
+			return &setMetadata{backend: ext.backend}
+		}
+	}
+	return nil
+}
+
+type getMetadata struct {
+	backend *Backend
+	mailbox string
+	depth   string
+	entries []string
+}
+
+func (cmd *getMetadata) Parse(fields []interface{}) error {
+	if len(fields) == 3 {
+		options, ok := fields[0].([]interface{})
+		if !ok {
+			return errors.New("Options must be a list")
+		}
+		for i := 0; i+1 < len(options); i += 2 {
+			name, err := imap.ParseString(options[i])
+			if err != nil {
+				return err
+			}
+			value, err := imap.ParseString(options[i+1])
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(name) {
+			case "DEPTH":
+				cmd.depth = strings.ToLower(value)
+			case "MAXSIZE":
+			default:
+				return fmt.Errorf("Unknown option %q", name)
+			}
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return errors.New("Expected mailbox name and entries")
+	}
+	var err error
+	if cmd.mailbox, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+	if _, ok := fields[1].([]interface{}); ok {
+		cmd.entries, err = imap.ParseStringList(fields[1])
+	} else {
+		var entry string
+		entry, err = imap.ParseString(fields[1])
+		cmd.entries = []string{entry}
+	}
+	return err
+}
+
+func (cmd *getMetadata) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	if cmd.mailbox != "" {
+		return cmd.handleMailbox(conn)
+	}
+	a, err := config.LoadAutoReply(cmd.backend.Storage)
+	if err != nil {
+		return fmt.Errorf("config.LoadAutoReply: %w", err)
+	}
+	values := map[string]string{
+		metadataAutoReplyEnabled: "0",
+		metadataAutoReplySubject: a.Subject,
+		metadataAutoReplyBody:    a.Body,
+		metadataAutoReplyDays:    strconv.Itoa(a.Days),
+	}
+	if a.Enabled {
+		values[metadataAutoReplyEnabled] = "1"
+	}
+
+	var list []interface{}
+	for _, entry := range metadataEntries {
+		if values[entry] == "" {
+			continue
+		}
+		for _, requested := range cmd.entries {
+			if metadataMatches(strings.ToLower(requested), entry, cmd.depth) {
+				list = append(list, entry, values[entry])
+				break
+			}
+		}
+	}
+	return cmd.writeMetadata(conn, list)
+}
+
+// handleMailbox returns when the mails in the mailbox that have a lifetime
+// expire, as RFC 3339 times in UTC.
+func (cmd *getMetadata) handleMailbox(conn server.Conn) error {
+	if strings.EqualFold(cmd.mailbox, "INBOX") {
+		cmd.mailbox = "INBOX"
+	}
+	if ok, err := cmd.backend.Storage.MailboxSelect(cmd.mailbox); err != nil {
+		return fmt.Errorf("cmd.backend.Storage.MailboxSelect: %w", err)
+	} else if !ok {
+		return errors.New("No such mailbox")
+	}
+	ids, err := cmd.backend.Storage.MailSearch(cmd.mailbox)
+	if err != nil {
+		return fmt.Errorf("cmd.backend.Storage.MailSearch: %w", err)
+	}
+
+	var list []interface{}
+	for _, id := range ids {
+		entry := metadataExpires + "/" + strconv.Itoa(int(id))
+		requested := false
+		for _, r := range cmd.entries {
+			if metadataMatches(strings.ToLower(r), entry, cmd.depth) {
+				requested = true
+				break
+			}
+		}
+		if !requested {
+			continue
+		}
+		mail, err := cmd.backend.Storage.MailSelectMeta(cmd.mailbox, int(id))
+		if err != nil {
+			// The mail may have been expunged in the meantime.
+			continue
+		}
+		if expires, ok := mail.Meta.Expires(); ok {
+			list = append(list, entry, expires.UTC().Format(time.RFC3339))
+		}
+	}
+	return cmd.writeMetadata(conn, list)
+}
+
+func (cmd *getMetadata) writeMetadata(conn server.Conn, list []interface{}) error {
+	if len(list) == 0 {
+		return nil
+	}
+	return conn.WriteResp(&imap.DataResp{
+		Tag:    "*",
+		Fields: []interface{}{imap.RawString("METADATA"), cmd.mailbox, list},
+	})
+}
+
+// metadataMatches returns true if the entry was requested, either directly
+// or as a descendant of the requested entry within the given depth.
+func metadataMatches(requested, entry, depth string) bool {
+	if requested == entry {
+		return true
+	}
+	rest := strings.TrimPrefix(entry, requested+"/")
+	if rest == entry {
+		return false
+	}
+	switch depth {
+	case "1":
+		return !strings.Contains(rest, "/")
+	case "infinity":
+		return true
+	}
+	return false
+}
+
+type setMetadata struct {
+	backend *Backend
+	mailbox string
+	values  map[string]*string
+}
+
+func (cmd *setMetadata) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("Expected mailbox name and entries")
+	}
+	var err error
+	if cmd.mailbox, err = imap.ParseString(fields[0]); err != nil {
+		return err
+	}
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list)%2 != 0 {
+		return errors.New("Expected a list of entries and values")
+	}
+	cmd.values = make(map[string]*string)
+	for i := 0; i < len(list); i += 2 {
+		entry, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+		if list[i+1] == nil {
+			cmd.values[strings.ToLower(entry)] = nil
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		cmd.values[strings.ToLower(entry)] = &value
+	}
+	return nil
+}
+
+func (cmd *setMetadata) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	if cmd.mailbox != "" {
+		return errors.New("Mailbox annotations are read-only")
+	}
+	a, err := config.LoadAutoReply(cmd.backend.Storage)
+	if err != nil {
+		return fmt.Errorf("config.LoadAutoReply: %w", err)
+	}
+	for entry, value := range cmd.values {
+		// A NIL value removes the entry, which puts it back to the default.
+		v := ""
+		if value != nil {
+			v = *value
+		}
+		switch entry {
+		case metadataAutoReplyEnabled:
+			switch strings.ToLower(v) {
+			case "1", "yes", "true", "on":
+				a.Enabled = true
+			case "", "0", "no", "false", "off":
+				a.Enabled = false
+			default:
+				return fmt.Errorf("Invalid value for %s", entry)
+			}
+		case metadataAutoReplySubject:
+			a.Subject = v
+		case metadataAutoReplyBody:
+			a.Body = v
+		case metadataAutoReplyDays:
+			if v == "" {
+				a.Days = config.AutoReplyDefaultDays
+			} else if a.Days, err = strconv.Atoi(v); err != nil || a.Days < 1 {
+				return fmt.Errorf("Invalid value for %s", entry)
+			}
+		default:
+			return fmt.Errorf("Unsupported entry %s", entry)
+		}
+	}
+	if err := a.Save(cmd.backend.Storage); err != nil {
+		return fmt.Errorf("a.Save: %w", err)
+	}
+	return nil
+}
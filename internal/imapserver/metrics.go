@@ -0,0 +1,17 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package imapserver
+
+import "github.com/neilalexander/yggmail/internal/metrics"
+
+var (
+	imapSessions     = metrics.NewCounter("yggmail_imap_sessions_total", "IMAP sessions that logged in.")
+	imapSessionsOpen = metrics.NewGauge("yggmail_imap_sessions", "IMAP sessions that are logged in now.")
+	imapAuthFailures = metrics.NewCounter("yggmail_imap_auth_failures_total", "Failed IMAP logins.")
+)
@@ -10,7 +10,8 @@ package imapserver
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/server"
@@ -27,7 +28,7 @@ func (h *IMAPNotifyHandler) Handle(conn server.Conn) error {
 
 type IMAPNotify struct {
 	server *server.Server
-	log    *log.Logger
+	log    *slog.Logger
 }
 
 func (ext *IMAPNotify) Capabilities(c server.Conn) []string {
@@ -46,16 +47,16 @@ func (ext *IMAPNotify) Command(name string) server.HandlerFactory {
 	}
 }
 
-func (ext *IMAPNotify) NotifyNew(id, count int) error {
+func (ext *IMAPNotify) NotifyNew(name string, id, count int) error {
 	ext.server.ForEachConn(func(c server.Conn) {
 		var resptype imap.StatusRespType
-		if mailbox := c.Context().Mailbox; mailbox != nil && mailbox.Name() == "INBOX" {
+		if mailbox := c.Context().Mailbox; mailbox != nil && mailbox.Name() == name {
 			resptype = imap.StatusRespType(
 				fmt.Sprintf("EXISTS %d", id),
 			)
 		} else {
 			resptype = imap.StatusRespType(
-				fmt.Sprintf("STATUS INBOX (UIDNEXT %d MESSAGES %d)", id+1, count),
+				fmt.Sprintf("STATUS %s (UIDNEXT %d MESSAGES %d)", quoteMailboxName(name), id+1, count),
 			)
 		}
 		_ = c.WriteResp(&imap.StatusResp{
@@ -65,7 +66,40 @@ func (ext *IMAPNotify) NotifyNew(id, count int) error {
 	return nil
 }
 
-func NewIMAPNotify(s *server.Server, log *log.Logger) *IMAPNotify {
+// NotifyExpunge tells sessions that have the mailbox selected which mails
+// have gone, by their sequence numbers from last to first, and the others
+// how many mails are left.
+func (ext *IMAPNotify) NotifyExpunge(name string, seqs []int, count int) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	ext.server.ForEachConn(func(c server.Conn) {
+		if mailbox := c.Context().Mailbox; mailbox != nil && mailbox.Name() == name {
+			for _, seq := range seqs {
+				_ = c.WriteResp(&imap.DataResp{
+					Tag:    "*",
+					Fields: []interface{}{uint32(seq), imap.RawString("EXPUNGE")},
+				})
+			}
+			return
+		}
+		_ = c.WriteResp(&imap.StatusResp{
+			Type: imap.StatusRespType(
+				fmt.Sprintf("STATUS %s (MESSAGES %d)", quoteMailboxName(name), count),
+			),
+		})
+	})
+	return nil
+}
+
+func quoteMailboxName(name string) string {
+	if name == "INBOX" {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+func NewIMAPNotify(s *server.Server, log *slog.Logger) *IMAPNotify {
 	return &IMAPNotify{
 		server: s,
 		log:    log,
@@ -0,0 +1,171 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package imapserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/neilalexander/yggmail/internal/quota"
+)
+
+// quotaResource is the only resource from RFC 9208 that we have quotas
+// for, which is counted in units of 1024 bytes.
+const quotaResource = "STORAGE"
+
+// quotaExtension implements the IMAP QUOTA extension from RFC 9208. The
+// quotas are set in the configuration and so can't be changed by SETQUOTA.
+type quotaExtension struct {
+	backend *Backend
+}
+
+func (ext *quotaExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"QUOTA", "QUOTA=RES-" + quotaResource}
+	}
+	return nil
+}
+
+func (ext *quotaExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() server.Handler {
+			return &getQuota{backend: ext.backend}
+		}
+	case "GETQUOTAROOT":
+		return func() server.Handler {
+			return &getQuotaRoot{backend: ext.backend}
+		}
+	case "SETQUOTA":
+		return func() server.Handler {
+			return &setQuota{}
+		}
+	}
+	return nil
+}
+
+// writeQuota writes the untagged QUOTA response for a quota root.
+func writeQuota(conn server.Conn, root *quota.Root) error {
+	kib := func(n int64) uint32 {
+		return uint32((n + 1023) / 1024)
+	}
+	return conn.WriteResp(&imap.DataResp{
+		Tag: "*",
+		Fields: []interface{}{
+			imap.RawString("QUOTA"), root.Name,
+			[]interface{}{imap.RawString(quotaResource), kib(root.Usage), kib(root.Limit)},
+		},
+	})
+}
+
+type getQuota struct {
+	backend *Backend
+	root    string
+}
+
+func (cmd *getQuota) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Expected quota root")
+	}
+	var err error
+	cmd.root, err = imap.ParseString(fields[0])
+	return err
+}
+
+func (cmd *getQuota) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	root, err := quota.Get(cmd.backend.Config, cmd.backend.Storage, cmd.root)
+	if err != nil {
+		return fmt.Errorf("quota.Get: %w", err)
+	} else if root == nil {
+		return errors.New("No such quota root")
+	}
+	return writeQuota(conn, root)
+}
+
+type getQuotaRoot struct {
+	backend *Backend
+	mailbox string
+}
+
+func (cmd *getQuotaRoot) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("Expected mailbox name")
+	}
+	mailbox, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.mailbox, err = utf7.Encoding.NewDecoder().String(mailbox)
+	return err
+}
+
+func (cmd *getQuotaRoot) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	if ok, err := cmd.backend.Storage.MailboxSelect(cmd.mailbox); err != nil {
+		return fmt.Errorf("cmd.backend.Storage.MailboxSelect: %w", err)
+	} else if !ok {
+		return errors.New("No such mailbox")
+	}
+	roots, err := quota.Roots(cmd.backend.Config, cmd.backend.Storage, cmd.mailbox)
+	if err != nil {
+		return fmt.Errorf("quota.Roots: %w", err)
+	}
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.mailbox)
+	fields := []interface{}{imap.RawString("QUOTAROOT"), mailbox}
+	for _, root := range roots {
+		fields = append(fields, root.Name)
+	}
+	if err := conn.WriteResp(&imap.DataResp{Tag: "*", Fields: fields}); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := writeQuota(conn, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type setQuota struct{}
+
+func (cmd *setQuota) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (cmd *setQuota) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	return errors.New("Quotas are set in the Yggmail configuration")
+}
+
+// checkQuota returns an OVERQUOTA error if mail of the given size doesn't
+// fit into the mailbox.
+func (b *Backend) checkQuota(mailbox string, size int64) error {
+	err := quota.Check(b.Config, b.Storage, mailbox, size)
+	var qerr *quota.Error
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &qerr) {
+		return fmt.Errorf("quota.Check: %w", err)
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "OVERQUOTA",
+		Info: "Quota exceeded",
+	}}
+}
@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -19,6 +20,7 @@ import (
 
 type User struct {
 	backend  *Backend
+	log      *slog.Logger
 	username string
 	conn     *imap.ConnInfo
 }
@@ -52,8 +54,9 @@ func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
 			name:    "",
 		}, nil
 	}
-	ok, _ := u.backend.Storage.MailboxSelect(name)
-	if !ok {
+	if ok, err := u.backend.Storage.MailboxSelect(name); err != nil {
+		return nil, fmt.Errorf("u.backend.Storage.MailboxSelect: %w", err)
+	} else if !ok {
 		return nil, fmt.Errorf("mailbox %q not found", name)
 	}
 	return &Mailbox{
@@ -86,5 +89,7 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 }
 
 func (u *User) Logout() error {
+	u.log.Debug("IMAP session ended")
+	imapSessionsOpen.Add(-1)
 	return nil
 }
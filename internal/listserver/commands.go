@@ -0,0 +1,249 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package listserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// maxCommands stops us from working through an entire message if someone
+// sends something other than commands to the request address.
+const maxCommands = 10
+
+const helpText = `The following commands can be sent to %s,
+either in the subject or one per line in the body:
+
+    subscribe      Join the list
+    unsubscribe    Leave the list
+    help           Show this help
+
+List owners can also use:
+
+    members        List the members of the list
+    pending        List posts waiting for moderation
+    approve <id>   Distribute a post waiting for moderation
+    discard <id>   Throw away a post waiting for moderation
+`
+
+// command handles a mail sent to the request address of the list. The
+// commands are taken from the subject and from the start of the first
+// text part of the body, and the results are sent back to the sender.
+func (l *List) command(sender ed25519.PublicKey, settings *config.List, data []byte) error {
+	m, err := message.Read(bytes.NewReader(data))
+	if m == nil {
+		return fmt.Errorf("message.Read: %w", err)
+	}
+	if auto := m.Header.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(auto, "no") {
+		// Never reply to automatic replies, or we could end up in a loop.
+		return nil
+	}
+	member, err := l.Storage.ListMemberSelect(utils.EncodeKey(sender))
+	if err != nil {
+		return fmt.Errorf("l.Storage.ListMemberSelect: %w", err)
+	}
+
+	var results strings.Builder
+	handled := 0
+	for _, line := range commandLines(m) {
+		if handled >= maxCommands {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		result, ok := l.runCommand(sender, member, settings, strings.ToLower(fields[0]), fields[1:])
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&results, "> %s\n%s\n", line, result)
+		handled++
+	}
+	if handled == 0 {
+		fmt.Fprintf(&results, helpText, l.Address(requestTag))
+	}
+	subject := m.Header.Get("Subject")
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	return l.reply(utils.CreateAddress(sender), subject, results.String())
+}
+
+// commandLines returns the subject and the lines of the first text part of
+// the body, up to any signature.
+func commandLines(m *message.Entity) []string {
+	subject := strings.TrimSpace(m.Header.Get("Subject"))
+	for strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = strings.TrimSpace(subject[3:])
+	}
+	lines := []string{subject}
+	var body io.Reader
+	_ = m.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil || body != nil {
+			return nil
+		}
+		if t, _, _ := part.Header.ContentType(); t == "" || t == "text/plain" {
+			body = part.Body
+		}
+		return nil
+	})
+	if body == nil {
+		return lines
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "--" || strings.HasPrefix(line, ">") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// runCommand runs a single command and returns the result. It returns
+// false if the line wasn't a command at all, so that it can be skipped.
+func (l *List) runCommand(sender ed25519.PublicKey, member *types.ListMember, settings *config.List, name string, args []string) (string, bool) {
+	owner := member != nil && member.Owner
+	switch name {
+	case "help":
+		return fmt.Sprintf(helpText, l.Address(requestTag)), true
+
+	case "subscribe", "join":
+		switch {
+		case member != nil:
+			return "You are already a member of the list.", true
+		case settings.Subscribe != config.ListSubscribeOpen:
+			return "This list is closed, so please ask a list owner to add you.", true
+		}
+		if err := l.Storage.ListMemberSet(utils.EncodeKey(sender), false); err != nil {
+			return "Failed to subscribe you, please try again later.", true
+		}
+		l.Log.Info("Subscribed to the list", logging.Peer(sender))
+		return "You are now a member of the list.", true
+
+	case "unsubscribe", "leave":
+		if member == nil {
+			return "You are not a member of the list.", true
+		}
+		if err := l.Storage.ListMemberDelete(member.Key); err != nil {
+			return "Failed to unsubscribe you, please try again later.", true
+		}
+		l.Log.Info("Unsubscribed from the list", logging.Peer(sender))
+		return "You are no longer a member of the list.", true
+
+	case "members", "who":
+		if !owner {
+			return "Only list owners can do that.", true
+		}
+		members, err := l.Storage.ListMemberList()
+		if err != nil {
+			return "Failed to list the members, please try again later.", true
+		}
+		var b strings.Builder
+		for _, m := range members {
+			b.WriteString(m.Key + "@" + utils.Domain)
+			if m.Owner {
+				b.WriteString(" (owner)")
+			}
+			b.WriteString("\n")
+		}
+		return b.String(), true
+
+	case "pending":
+		if !owner {
+			return "Only list owners can do that.", true
+		}
+		return l.pending(), true
+
+	case "approve", "discard":
+		if !owner {
+			return "Only list owners can do that.", true
+		}
+		if len(args) != 1 {
+			return "Expected the ID of the post.", true
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "Expected the ID of the post.", true
+		}
+		done := "approved"
+		if name == "approve" {
+			err = l.Approve(id)
+		} else {
+			err, done = l.Discard(id), "discarded"
+		}
+		if err != nil {
+			return fmt.Sprintf("Failed to %s post %d: %s", name, id, err), true
+		}
+		return fmt.Sprintf("Post %d has been %s.", id, done), true
+	}
+	return "", false
+}
+
+// pending describes the posts that are waiting for moderation.
+func (l *List) pending() string {
+	posts, err := l.Pending()
+	if err != nil {
+		return "Failed to list the posts, please try again later."
+	}
+	if len(posts) == 0 {
+		return "There are no posts waiting for moderation."
+	}
+	var b strings.Builder
+	for _, post := range posts {
+		fmt.Fprintf(&b, "%d\t%s\t%s\n", post.ID, post.From, post.Subject)
+	}
+	return b.String()
+}
+
+// reply sends a plain text mail from the list to the given address.
+func (l *List) reply(to, subject, text string) error {
+	var h gomail.Header
+	h.SetAddressList("From", []*gomail.Address{{Address: l.Address(requestTag)}})
+	h.SetAddressList("To", []*gomail.Address{{Address: to}})
+	h.SetSubject(subject)
+	h.SetDate(time.Now())
+	if err := h.GenerateMessageID(); err != nil {
+		return fmt.Errorf("h.GenerateMessageID: %w", err)
+	}
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+
+	var b bytes.Buffer
+	w, err := message.CreateWriter(&b, h.Header)
+	if err != nil {
+		return fmt.Errorf("message.CreateWriter: %w", err)
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		return fmt.Errorf("w.Write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("w.Close: %w", err)
+	}
+	if err := l.Queues.QueueFor(l.Address(""), []string{to}, b.Bytes()); err != nil {
+		return fmt.Errorf("l.Queues.QueueFor: %w", err)
+	}
+	return nil
+}
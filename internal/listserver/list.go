@@ -0,0 +1,319 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package listserver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+const (
+	// ArchiveMailbox holds a copy of every post that was distributed.
+	ArchiveMailbox = "Archive"
+	// ModerationMailbox holds posts that are waiting for an owner to
+	// approve or discard them.
+	ModerationMailbox = "Moderation"
+)
+
+// The sub-addresses of the list, i.e. key+request@yggmail for commands,
+// with whichever sub-address separator is configured.
+const (
+	requestTag = "request"
+	ownerTag   = "owner"
+)
+
+// List is a mailing list server. It has its own identity, so posts are
+// sent to the key of the list and redistributed to every member from it.
+type List struct {
+	Config  *config.Config
+	Log     *slog.Logger
+	Storage storage.Storage
+	Queues  *smtpsender.Queues
+}
+
+// Setup creates the mailboxes that the list needs. The list can't work
+// without sub-addresses, since commands are sent to one, so it refuses to
+// start if sub-addressing is disabled.
+func (l *List) Setup() error {
+	if l.Config.SubaddressSeparator == "" {
+		return fmt.Errorf("a list needs a sub-address separator")
+	}
+	for _, name := range []string{"Outbox", ArchiveMailbox, ModerationMailbox} {
+		if err := l.Storage.MailboxCreate(name); err != nil {
+			return fmt.Errorf("l.Storage.MailboxCreate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Address returns the address of the list, or of one of its sub-addresses
+// if a tag is given.
+func (l *List) Address(tag string) string {
+	if tag == "" {
+		return utils.CreateAddress(l.Config.PublicKey)
+	}
+	return fmt.Sprintf("%s%s%s@%s", utils.EncodeKey(l.Config.PublicKey), l.Config.SubaddressSeparator, tag, utils.Domain)
+}
+
+// Receive handles a mail that arrived for the list from the given sender,
+// which has already been authenticated by the transport.
+func (l *List) Receive(sender ed25519.PublicKey, tags []string, data []byte) error {
+	settings, err := config.LoadList(l.Storage)
+	if err != nil {
+		return fmt.Errorf("config.LoadList: %w", err)
+	}
+	tag := ""
+	if len(tags) > 0 {
+		tag = strings.ToLower(tags[0])
+	}
+	switch tag {
+	case "":
+		return l.post(sender, settings, data)
+	case requestTag:
+		return l.command(sender, settings, data)
+	case ownerTag:
+		return l.forwardToOwners(data)
+	}
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Unknown list address",
+	}
+}
+
+func (l *List) post(sender ed25519.PublicKey, settings *config.List, data []byte) error {
+	m, err := message.Read(bytes.NewReader(data))
+	if m == nil {
+		return fmt.Errorf("message.Read: %w", err)
+	}
+	// Never accept our own posts back, i.e. if one of our members is also
+	// a list that has subscribed to us.
+	if strings.Contains(m.Header.Get("List-Id"), l.listID()) {
+		l.Log.Info("Dropping looped post", logging.Peer(sender))
+		return nil
+	}
+
+	member, err := l.Storage.ListMemberSelect(utils.EncodeKey(sender))
+	if err != nil {
+		return fmt.Errorf("l.Storage.ListMemberSelect: %w", err)
+	}
+	hold := false
+	switch {
+	case member != nil && member.Owner:
+	case settings.Posting == config.ListPostingModerated:
+		hold = true
+	case settings.Posting == config.ListPostingMembers:
+		hold = member == nil
+	}
+	if hold {
+		return l.hold(sender, m, data)
+	}
+	return l.Distribute(data)
+}
+
+// Distribute sends a post to every member of the list and archives it.
+func (l *List) Distribute(data []byte) error {
+	settings, err := config.LoadList(l.Storage)
+	if err != nil {
+		return fmt.Errorf("config.LoadList: %w", err)
+	}
+	m, err := message.Read(bytes.NewReader(data))
+	if m == nil {
+		return fmt.Errorf("message.Read: %w", err)
+	}
+
+	if prefix := "[" + settings.Name + "]"; settings.Name != "" {
+		if subject := m.Header.Get("Subject"); !strings.Contains(subject, prefix) {
+			m.Header.Set("Subject", strings.TrimSpace(prefix+" "+subject))
+		}
+	}
+	m.Header.Del("X-Yggmail-Tag")
+	l.setListHeaders(&m.Header, settings)
+
+	var b bytes.Buffer
+	if err := m.WriteTo(&b); err != nil {
+		return fmt.Errorf("m.WriteTo: %w", err)
+	}
+	if _, err := l.Storage.MailCreate(ArchiveMailbox, b.Bytes()); err != nil {
+		return fmt.Errorf("l.Storage.MailCreate: %w", err)
+	}
+
+	members, err := l.Storage.ListMemberList()
+	if err != nil {
+		return fmt.Errorf("l.Storage.ListMemberList: %w", err)
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	rcpts := make([]string, 0, len(members))
+	for _, member := range members {
+		rcpts = append(rcpts, member.Key+"@"+utils.Domain)
+	}
+	if err := l.Queues.QueueFor(l.Address(""), rcpts, b.Bytes()); err != nil {
+		return fmt.Errorf("l.Queues.QueueFor: %w", err)
+	}
+	l.Log.Info("Distributed post to list members", "rcpts", len(rcpts))
+	return nil
+}
+
+// listID returns the identifier for the List-Id header from RFC 2919.
+// The short key encoding is used so that it fits into a DNS label.
+func (l *List) listID() string {
+	return utils.EncodeShortKey(l.Config.PublicKey) + "." + utils.Domain
+}
+
+// setListHeaders sets the list headers from RFC 2369 and RFC 2919.
+func (l *List) setListHeaders(h *message.Header, settings *config.List) {
+	for _, name := range []string{"List-Id", "List-Post", "List-Help", "List-Subscribe", "List-Unsubscribe", "List-Owner"} {
+		h.Del(name)
+	}
+	id := "<" + l.listID() + ">"
+	if settings.Name != "" {
+		id = fmt.Sprintf("%q %s", settings.Name, id)
+	}
+	h.Set("List-Id", id)
+	h.Set("List-Post", "<mailto:"+l.Address("")+">")
+	h.Set("List-Help", "<mailto:"+l.Address(requestTag)+"?subject=help>")
+	h.Set("List-Subscribe", "<mailto:"+l.Address(requestTag)+"?subject=subscribe>")
+	h.Set("List-Unsubscribe", "<mailto:"+l.Address(requestTag)+"?subject=unsubscribe>")
+	h.Set("List-Owner", "<mailto:"+l.Address(ownerTag)+">")
+	h.Set("Precedence", "list")
+	h.Set("Sender", l.Address(""))
+}
+
+// hold puts a post into the moderation queue and lets the owners know
+// that it is there.
+func (l *List) hold(sender ed25519.PublicKey, m *message.Entity, data []byte) error {
+	id, err := l.Storage.MailCreate(ModerationMailbox, data)
+	if err != nil {
+		return fmt.Errorf("l.Storage.MailCreate: %w", err)
+	}
+	from := utils.CreateAddress(sender)
+	l.Log.Info("Holding post for moderation", logging.MailID(id), "from", from)
+
+	notice := fmt.Sprintf(
+		"A post to the list is waiting for moderation.\n\n"+
+			"From: %s\nSubject: %s\n\n"+
+			"To distribute it, reply with the command:\n\n    approve %d\n\n"+
+			"To throw it away, reply with the command:\n\n    discard %d\n",
+		m.Header.Get("From"), m.Header.Get("Subject"), id, id,
+	)
+	if err := l.notifyOwners(fmt.Sprintf("Post %d held for moderation", id), notice); err != nil {
+		l.Log.Error("Failed to notify list owners", logging.Err(err))
+	}
+	return l.reply(from, "Your post is awaiting moderation",
+		"Your post to the list has been held until a list owner approves it.\n")
+}
+
+// Approve distributes a post from the moderation queue.
+func (l *List) Approve(id int) error {
+	_, mail, err := l.Storage.MailSelect(ModerationMailbox, id)
+	if err != nil {
+		return fmt.Errorf("l.Storage.MailSelect: %w", err)
+	}
+	if err := l.Distribute(mail.Mail); err != nil {
+		return fmt.Errorf("l.Distribute: %w", err)
+	}
+	return l.Discard(id)
+}
+
+// Discard removes a post from the moderation queue without sending it.
+func (l *List) Discard(id int) error {
+	if _, _, err := l.Storage.MailSelect(ModerationMailbox, id); err != nil {
+		return fmt.Errorf("l.Storage.MailSelect: %w", err)
+	}
+	if err := l.Storage.MailDelete(ModerationMailbox, id); err != nil {
+		return fmt.Errorf("l.Storage.MailDelete: %w", err)
+	}
+	if err := l.Storage.MailExpunge(ModerationMailbox); err != nil {
+		return fmt.Errorf("l.Storage.MailExpunge: %w", err)
+	}
+	return nil
+}
+
+// Post is a post that is waiting for moderation.
+type Post struct {
+	ID      int
+	From    string
+	Subject string
+}
+
+// Pending returns the posts that are waiting for moderation.
+func (l *List) Pending() ([]Post, error) {
+	ids, err := l.Storage.MailSearch(ModerationMailbox)
+	if err != nil {
+		return nil, fmt.Errorf("l.Storage.MailSearch: %w", err)
+	}
+	posts := make([]Post, 0, len(ids))
+	for _, id := range ids {
+		_, mail, err := l.Storage.MailSelect(ModerationMailbox, int(id))
+		if err != nil {
+			return nil, fmt.Errorf("l.Storage.MailSelect: %w", err)
+		}
+		post := Post{ID: int(id)}
+		if m, _ := message.Read(bytes.NewReader(mail.Mail)); m != nil {
+			post.From, post.Subject = m.Header.Get("From"), m.Header.Get("Subject")
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+func (l *List) owners() ([]string, error) {
+	members, err := l.Storage.ListMemberList()
+	if err != nil {
+		return nil, fmt.Errorf("l.Storage.ListMemberList: %w", err)
+	}
+	var owners []string
+	for _, member := range members {
+		if member.Owner {
+			owners = append(owners, member.Key+"@"+utils.Domain)
+		}
+	}
+	return owners, nil
+}
+
+func (l *List) forwardToOwners(data []byte) error {
+	owners, err := l.owners()
+	if err != nil {
+		return err
+	}
+	if len(owners) == 0 {
+		l.Log.Warn("Dropping mail for the list owners since there are none")
+		return nil
+	}
+	if err := l.Queues.QueueFor(l.Address(""), owners, data); err != nil {
+		return fmt.Errorf("l.Queues.QueueFor: %w", err)
+	}
+	return nil
+}
+
+func (l *List) notifyOwners(subject, text string) error {
+	owners, err := l.owners()
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		if err := l.reply(owner, subject, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
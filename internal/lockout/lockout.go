@@ -0,0 +1,227 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package lockout slows down and then bans those who keep getting the
+// password wrong, so that it can't be guessed at full speed once the
+// listeners are reachable from beyond localhost. There is only the one
+// password, so every listener that checks it shares the same Lockout.
+package lockout
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrBanned is returned by Check for a source that is banned. The password
+// isn't even tried, so that a banned source can't learn anything.
+var ErrBanned = errors.New("too many failed logins, try again later")
+
+// Lockout tracks failed logins from each source IP address and from all of
+// them together. A nil Lockout allows everything, i.e. for the command line.
+type Lockout struct {
+	Log             *slog.Logger
+	BaseDelay       time.Duration // before the next attempt after one failure, doubling with each failure
+	MaxDelay        time.Duration // the most that an attempt is delayed by
+	MaxFailures     int           // from one source before it is banned
+	BanTime         time.Duration // how long a source is banned for
+	Window          time.Duration // after which failures are forgotten
+	GlobalThreshold int           // failures from all sources together before every attempt is delayed
+	mutex           sync.Mutex
+	sources         map[string]*record
+	global          record
+}
+
+type record struct {
+	failures int
+	last     time.Time // of the last failure
+	banned   time.Time // until
+}
+
+// New returns a Lockout with the default limits.
+func New(log *slog.Logger) *Lockout {
+	return &Lockout{
+		Log:             log,
+		BaseDelay:       250 * time.Millisecond,
+		MaxDelay:        30 * time.Second,
+		MaxFailures:     10,
+		BanTime:         15 * time.Minute,
+		Window:          15 * time.Minute,
+		GlobalThreshold: 50,
+		sources:         map[string]*record{},
+	}
+}
+
+// Source returns the IP address from a remote address, which is what
+// failures are tracked by, since the port changes for each connection.
+func Source(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Check is called before the password is tried. It waits for as long as
+// the failures so far call for, and returns ErrBanned if the source is
+// banned. The source is empty if it isn't known, in which case only the
+// global failures count.
+func (l *Lockout) Check(source string) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.expire(now)
+	var delay time.Duration
+	if r, ok := l.sources[source]; ok && source != "" {
+		if now.Before(r.banned) {
+			l.mutex.Unlock()
+			return ErrBanned
+		}
+		delay = l.delay(r.failures)
+	}
+	if excess := l.global.failures - l.GlobalThreshold; excess >= 0 {
+		if global := l.delay(excess + 1); global > delay {
+			delay = global
+		}
+	}
+	l.mutex.Unlock()
+	time.Sleep(delay)
+	return nil
+}
+
+// Failed records a failed login from the source.
+func (l *Lockout) Failed(source string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.expire(now)
+	l.global.failures++
+	l.global.last = now
+	if l.global.failures == l.GlobalThreshold {
+		l.Log.Warn("Too many failed logins from all sources, slowing down all logins", "failures", l.global.failures)
+	}
+	if source == "" {
+		return
+	}
+	r, ok := l.sources[source]
+	if !ok {
+		r = &record{}
+		l.sources[source] = r
+	}
+	r.failures++
+	r.last = now
+	if r.failures >= l.MaxFailures && !now.Before(r.banned) {
+		r.banned = now.Add(l.BanTime)
+		l.Log.Warn("Banned source after too many failed logins", "remote", source, "failures", r.failures, "until", r.banned)
+	}
+}
+
+// Succeeded forgets the failures from the source, so that someone who
+// mistypes the password now and again isn't slowed down for long.
+func (l *Lockout) Succeeded(source string) {
+	if l == nil || source == "" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sources, source)
+}
+
+// delay is how long to wait before the next attempt after the given number
+// of failures.
+func (l *Lockout) delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := 1; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+// expire forgets failures that are older than the window and bans that
+// have ended. The mutex must be held.
+func (l *Lockout) expire(now time.Time) {
+	for source, r := range l.sources {
+		if now.Sub(r.last) > l.Window && !now.Before(r.banned) {
+			delete(l.sources, source)
+		}
+	}
+	if l.global.failures > 0 && now.Sub(l.global.last) > l.Window {
+		l.global = record{}
+	}
+}
+
+// Ban is a source that has failed to log in recently.
+type Ban struct {
+	Source   string
+	Failures int
+	Last     time.Time // of the last failure
+	Until    time.Time // zero if the source isn't banned, only delayed
+}
+
+// Bans returns the sources that have failed to log in recently, whether
+// they are banned or only delayed, ordered by source, and the failures
+// from all sources together.
+func (l *Lockout) Bans() ([]Ban, int) {
+	if l == nil {
+		return nil, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.expire(now)
+	bans := make([]Ban, 0, len(l.sources))
+	for source, r := range l.sources {
+		ban := Ban{Source: source, Failures: r.failures, Last: r.last}
+		if now.Before(r.banned) {
+			ban.Until = r.banned
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Source < bans[j].Source
+	})
+	return bans, l.global.failures
+}
+
+// Clear forgets the failures from the source, lifting any ban, or from
+// all sources if it is empty. It returns how many sources were cleared.
+func (l *Lockout) Clear(source string) int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	cleared := 0
+	if source == "" {
+		cleared = len(l.sources)
+		l.sources = map[string]*record{}
+		l.global = record{}
+	} else if _, ok := l.sources[source]; ok {
+		cleared = 1
+		delete(l.sources, source)
+	}
+	l.Log.Info("Cleared failed logins", "remote", source, "cleared", cleared)
+	return cleared
+}
@@ -0,0 +1,57 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package logging
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// The fields that are logged the same way everywhere, so that the log can
+// be searched by them.
+
+// Peer is the key of the remote Yggmail node.
+func Peer(pk ed25519.PublicKey) slog.Attr {
+	return slog.String("peer", hex.EncodeToString(pk))
+}
+
+// MessageID is the Message-ID header of a mail.
+func MessageID(id string) slog.Attr {
+	return slog.String("message_id", id)
+}
+
+// Mailbox is the name of a mailbox.
+func Mailbox(name string) slog.Attr {
+	return slog.String("mailbox", name)
+}
+
+// MailID is the ID of a mail within its mailbox.
+func MailID(id int) slog.Attr {
+	return slog.Int("mail_id", id)
+}
+
+// Session identifies an IMAP or SMTP session, from NewSessionID.
+func Session(id string) slog.Attr {
+	return slog.String("session", id)
+}
+
+// Err is the error that something failed with.
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+// NewSessionID returns a random ID for a session, so that everything logged
+// during the session can be picked out of the log.
+func NewSessionID() string {
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
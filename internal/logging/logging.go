@@ -0,0 +1,230 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package logging sets up the structured log that the rest of Yggmail logs
+// through. Each subsystem gets its own logger, whose level can be changed
+// while Yggmail is running, i.e. to see what the queue is doing without
+// also seeing every IMAP command.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// LevelTrace is more verbose than debug, for the Yggdrasil log.
+const LevelTrace = slog.Level(-8)
+
+// Levels are the levels that a subsystem can be set to, from the least to
+// the most verbose.
+var Levels = []string{"error", "warn", "info", "debug", "trace"}
+
+// The subsystems that log separately.
+const (
+	Main      = "main"
+	Transport = "transport"
+	Queue     = "queue"
+	IMAP      = "imap"
+	SMTP      = "smtp"
+	Storage   = "storage"
+)
+
+// Subsystems are all of the subsystems, in the order that they are listed.
+var Subsystems = []string{Main, Transport, Queue, IMAP, SMTP, Storage}
+
+// The formats that the log can be written in.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Logging holds the loggers for each subsystem.
+type Logging struct {
+	handler slog.Handler
+	levels  map[string]*slog.LevelVar // the map doesn't change after New
+}
+
+// New returns loggers that write to w in the given format, with every
+// subsystem at the info level.
+func New(w io.Writer, format string) (*Logging, error) {
+	options := &slog.HandlerOptions{
+		Level:       LevelTrace, // each subsystem filters for itself
+		ReplaceAttr: replaceAttr,
+	}
+	l := &Logging{
+		levels: map[string]*slog.LevelVar{},
+	}
+	switch format {
+	case FormatText:
+		l.handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		l.handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", format, FormatText, FormatJSON)
+	}
+	for _, subsystem := range Subsystems {
+		l.levels[subsystem] = &slog.LevelVar{}
+	}
+	return l, nil
+}
+
+// For returns the logger for the given subsystem.
+func (l *Logging) For(subsystem string) *slog.Logger {
+	level, ok := l.levels[subsystem]
+	if !ok {
+		panic(fmt.Sprintf("unknown log subsystem %q", subsystem))
+	}
+	return slog.New(&levelHandler{
+		Handler: l.handler,
+		level:   level,
+	}).With("subsystem", subsystem)
+}
+
+// Level returns the level of the given subsystem.
+func (l *Logging) Level(subsystem string) (string, error) {
+	level, ok := l.levels[subsystem]
+	if !ok {
+		return "", fmt.Errorf("unknown log subsystem %q, expected one of %v", subsystem, Subsystems)
+	}
+	return levelName(level.Level()), nil
+}
+
+// SetLevel sets the level of the given subsystem, or of all of them if the
+// subsystem is empty.
+func (l *Logging) SetLevel(subsystem, level string) error {
+	parsed, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if subsystem == "" {
+		for _, level := range l.levels {
+			level.Set(parsed)
+		}
+		return nil
+	}
+	if _, ok := l.levels[subsystem]; !ok {
+		return fmt.Errorf("unknown log subsystem %q, expected one of %v", subsystem, Subsystems)
+	}
+	l.levels[subsystem].Set(parsed)
+	return nil
+}
+
+// SetLevels sets the levels from a list such as "info,queue=debug,imap=warn",
+// where a level without a subsystem applies to all of them. Later entries
+// override earlier ones.
+func (l *Logging) SetLevels(levels string) error {
+	for _, entry := range strings.Split(levels, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		subsystem, level, ok := strings.Cut(entry, "=")
+		if !ok {
+			subsystem, level = "", entry
+		}
+		if err := l.SetLevel(subsystem, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Levels returns the level of every subsystem.
+func (l *Logging) Levels() map[string]string {
+	levels := make(map[string]string, len(l.levels))
+	for subsystem, level := range l.levels {
+		levels[subsystem] = levelName(level.Level())
+	}
+	return levels
+}
+
+func parseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "error":
+		return slog.LevelError, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, expected one of %v", level, Levels)
+	}
+}
+
+func levelName(level slog.Level) string {
+	switch {
+	case level <= LevelTrace:
+		return "trace"
+	case level <= slog.LevelDebug:
+		return "debug"
+	case level <= slog.LevelInfo:
+		return "info"
+	case level <= slog.LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// levelHandler only passes on records at or above the level of the
+// subsystem that it belongs to.
+type levelHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// sensitive are the keys whose values are never written out, in case
+// someone logs one by mistake.
+var sensitive = map[string]bool{
+	"password":    true,
+	"passphrase":  true,
+	"hash":        true,
+	"secret":      true,
+	"token":       true,
+	"private_key": true,
+}
+
+// Redacted is written out in place of sensitive values.
+const Redacted = "[redacted]"
+
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level <= LevelTrace {
+			return slog.String(slog.LevelKey, "TRACE")
+		}
+		return a
+	}
+	if sensitive[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	// URLs such as the smarthost can have a password in them.
+	if u, ok := a.Value.Any().(*url.URL); ok && u != nil {
+		return slog.String(a.Key, u.Redacted())
+	}
+	return a
+}
@@ -0,0 +1,128 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package mdn creates message disposition notifications as described in
+// RFC 3798, both for the delivery receipts that we give ourselves and for
+// the notifications that senders ask for with Disposition-Notification-To.
+package mdn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Policy is what we do when a mail arrives that asks for a message
+// disposition notification.
+type Policy string
+
+const (
+	// PolicyAsk leaves the request in the mail so that the mail client can
+	// ask whether to send a notification when the mail is read.
+	PolicyAsk Policy = "ask"
+	// PolicyAlways sends a notification as soon as the mail is delivered.
+	PolicyAlways Policy = "always"
+	// PolicyNever never sends a notification, and takes the request out of
+	// the mail so that mail clients don't ask either.
+	PolicyNever Policy = "never"
+)
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(strings.ToLower(name)); policy {
+	case PolicyAsk, PolicyAlways, PolicyNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q, expected ask, always or never", name)
+	}
+}
+
+// Header is the header that senders ask for notifications with.
+const Header = "Disposition-Notification-To"
+
+// Notification is a message disposition notification that a mail was
+// processed, i.e. delivered, without anyone having looked at it yet.
+type Notification struct {
+	From      string // the address that the notification is sent from
+	To        string // the address that asked for it
+	Recipient string // the recipient that the mail was delivered to
+	Subject   string // the subject of the notification
+	Text      string // explains the notification to people
+	Original  textproto.Header
+}
+
+// Mail returns the notification as a multipart/report mail, with the header
+// of the original mail attached so that it can be matched up with it.
+func (n *Notification) Mail() ([]byte, error) {
+	var h gomail.Header
+	h.SetAddressList("From", []*gomail.Address{{Address: n.From}})
+	h.SetAddressList("To", []*gomail.Address{{Address: n.To}})
+	h.SetSubject(n.Subject)
+	h.SetDate(time.Now())
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, fmt.Errorf("h.GenerateMessageID: %w", err)
+	}
+	id := n.Original.Get("Message-Id")
+	if id != "" {
+		h.Set("In-Reply-To", id)
+		h.Set("References", id)
+	}
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/report", map[string]string{"report-type": "disposition-notification"})
+
+	var b bytes.Buffer
+	w, err := message.CreateWriter(&b, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("message.CreateWriter: %w", err)
+	}
+	for _, part := range []struct {
+		contentType string
+		write       func(io.Writer) error
+	}{
+		{"text/plain", func(b io.Writer) error {
+			_, err := io.WriteString(b, strings.ReplaceAll(n.Text, "\n", "\r\n"))
+			return err
+		}},
+		{"message/disposition-notification", func(b io.Writer) error {
+			fmt.Fprintf(b, "Reporting-UA: %s; Yggmail\r\n", n.From)
+			fmt.Fprintf(b, "Final-Recipient: rfc822; %s\r\n", n.Recipient)
+			if id != "" {
+				fmt.Fprintf(b, "Original-Message-ID: %s\r\n", id)
+			}
+			fmt.Fprintf(b, "Disposition: automatic-action/MDN-sent-automatically; processed\r\n")
+			return nil
+		}},
+		{"text/rfc822-headers", func(b io.Writer) error {
+			return textproto.WriteHeader(b, n.Original)
+		}},
+	} {
+		var ph message.Header
+		ph.SetContentType(part.contentType, nil)
+		pw, err := w.CreatePart(ph)
+		if err != nil {
+			return nil, fmt.Errorf("w.CreatePart: %w", err)
+		}
+		if err := part.write(pw); err != nil {
+			return nil, err
+		}
+		if err := pw.Close(); err != nil {
+			return nil, fmt.Errorf("pw.Close: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("w.Close: %w", err)
+	}
+	return b.Bytes(), nil
+}
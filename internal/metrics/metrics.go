@@ -0,0 +1,301 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package metrics keeps counters, gauges and histograms about what Yggmail
+// is doing and serves them in the Prometheus text format. Packages create
+// their metrics when they are loaded, so that they are all in Default
+// whether or not the metrics are being served.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics that are written out together.
+type Registry struct {
+	mutex      sync.Mutex
+	metrics    []metric
+	collectors []func()
+}
+
+// Default is where metrics are registered by default.
+var Default = &Registry{}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type family struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+}
+
+func (f *family) name() string {
+	return f.Name
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.Name, f.Help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+}
+
+// key joins label values so that they can be used as a map key.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.Labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.Name, len(f.Labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// labels formats the label pairs for a sample, with an extra label on the
+// end for histogram buckets.
+func (f *family) labels(key string, extra ...string) string {
+	var pairs []string
+	if len(f.Labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, f.Labels[i]+"="+quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values the way that Prometheus expects, which
+// is not quite the same as Go's own quoting.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// values is the value of a counter or a gauge for each set of labels.
+type values struct {
+	family
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func (v *values) add(delta float64, labels []string) {
+	key := v.key(labels)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] += delta
+}
+
+func (v *values) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.header(w)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.Name, v.labels(key), formatValue(v.values[key]))
+	}
+}
+
+// Counter is a value that only goes up, i.e. how many mails were sent.
+type Counter struct {
+	values
+}
+
+// NewCounter registers a counter with Default, with the given labels.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{values{
+		family: family{Name: name, Help: help, Type: "counter", Labels: labels},
+		values: map[string]float64{},
+	}}
+	if len(labels) == 0 {
+		c.values.values[""] = 0
+	}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labels ...string) {
+	c.add(1, labels)
+}
+
+// Add adds to the counter with the given label values.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("counters can't go down")
+	}
+	c.add(delta, labels)
+}
+
+// Gauge is a value that goes up and down, i.e. how many sessions are open.
+type Gauge struct {
+	values
+}
+
+// NewGauge registers a gauge with Default, with the given labels.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values{
+		family: family{Name: name, Help: help, Type: "gauge", Labels: labels},
+		values: map[string]float64{},
+	}}
+	if len(labels) == 0 {
+		g.values.values[""] = 0
+	}
+	Default.register(g)
+	return g
+}
+
+// Add adds to the gauge with the given label values, or takes away from
+// it if delta is negative.
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.add(delta, labels)
+}
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(value float64, labels ...string) {
+	key := g.key(labels)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values.values[key] = value
+}
+
+// Reset forgets the values for all label values, so that a collector can
+// set only those that still exist.
+func (g *Gauge) Reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values.values = map[string]float64{}
+	if len(g.Labels) == 0 {
+		g.values.values[""] = 0
+	}
+}
+
+// Histogram counts observations, i.e. how long something took, into
+// buckets by their upper bounds.
+type Histogram struct {
+	family
+	buckets []float64
+	mutex   sync.Mutex
+	counts  []uint64 // for each bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// DurationBuckets suit observations in seconds of things that usually
+// take milliseconds.
+var DurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram registers a histogram with Default, with the given upper
+// bounds of its buckets in ascending order.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		family:  family{Name: name, Help: help, Type: "histogram"},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels("", "le", formatValue(bound)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels("", "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.Name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.Name, h.count)
+}
+
+// Collect registers a function with Default that is called to set gauges
+// each time before the metrics are written out, for values that are easier
+// to look up than to keep track of, such as how much mail is in the queue.
+func Collect(collect func()) {
+	Default.mutex.Lock()
+	defer Default.mutex.Unlock()
+	Default.collectors = append(Default.collectors, collect)
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric %s is already registered", m.name()))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Print writes out all of the metrics in the Prometheus text format, in
+// order of name.
+func (r *Registry) Print(w io.Writer) {
+	r.mutex.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Print(w)
+}
@@ -0,0 +1,227 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package quota works out how much of the storage quotas is in use, in the
+// terms of RFC 9208. The quota for all mailboxes together is the quota root
+// named "", and each mailbox is a quota root of its own for the quota that
+// applies to every mailbox.
+package quota
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// AccountRoot is the name of the quota root for all mailboxes together.
+const AccountRoot = ""
+
+// warnedKey is where we remember which quota roots have been warned about,
+// so that we warn once each time a quota fills up rather than for every
+// mail that arrives after.
+const warnedKey = "quota_warned:"
+
+// Storage is the part of the storage that quotas are worked out from.
+type Storage interface {
+	config.ConfigStore
+	MailboxList(onlySubscribed bool) ([]string, error)
+	MailboxSelect(mailbox string) (bool, error)
+	MailboxUsage(mailbox string) (int64, error)
+}
+
+// Root is a quota root with how much of it is in use, in bytes.
+type Root struct {
+	Name  string
+	Usage int64
+	Limit int64
+}
+
+// Percent returns how full the quota root is.
+func (r *Root) Percent() int {
+	if r.Limit <= 0 {
+		return 0
+	}
+	return int(r.Usage * 100 / r.Limit)
+}
+
+// Get returns the quota root with the given name, or nil if there is no such
+// quota root, i.e. because that quota isn't limited.
+func Get(cfg *config.Config, s Storage, name string) (*Root, error) {
+	if name == AccountRoot {
+		if cfg.QuotaAccount <= 0 {
+			return nil, nil
+		}
+		mailboxes, err := s.MailboxList(false)
+		if err != nil {
+			return nil, fmt.Errorf("s.MailboxList: %w", err)
+		}
+		root := &Root{Name: AccountRoot, Limit: cfg.QuotaAccount}
+		for _, mailbox := range mailboxes {
+			usage, err := s.MailboxUsage(mailbox)
+			if err != nil {
+				return nil, fmt.Errorf("s.MailboxUsage: %w", err)
+			}
+			root.Usage += usage
+		}
+		return root, nil
+	}
+	if cfg.QuotaMailbox <= 0 {
+		return nil, nil
+	}
+	if ok, err := s.MailboxSelect(name); err != nil {
+		return nil, fmt.Errorf("s.MailboxSelect: %w", err)
+	} else if !ok {
+		return nil, nil
+	}
+	usage, err := s.MailboxUsage(name)
+	if err != nil {
+		return nil, fmt.Errorf("s.MailboxUsage: %w", err)
+	}
+	return &Root{Name: name, Usage: usage, Limit: cfg.QuotaMailbox}, nil
+}
+
+// Roots returns the quota roots that a mailbox is under. The mailbox
+// AccountRoot is only under the quota for all mailboxes together.
+func Roots(cfg *config.Config, s Storage, mailbox string) ([]*Root, error) {
+	names := []string{AccountRoot}
+	if mailbox != AccountRoot {
+		names = append(names, mailbox)
+	}
+	var roots []*Root
+	for _, name := range names {
+		root, err := Get(cfg, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if root != nil {
+			roots = append(roots, root)
+		}
+	}
+	return roots, nil
+}
+
+// Error is returned by Check when a mail doesn't fit into a quota root.
+type Error struct {
+	Root *Root
+	Size int64
+}
+
+func (e *Error) Error() string {
+	if e.Permanent() {
+		return fmt.Sprintf("mail of %d bytes is larger than the quota of %d bytes", e.Size, e.Root.Limit)
+	}
+	return fmt.Sprintf("quota exceeded, %d of %d bytes in use", e.Root.Usage, e.Root.Limit)
+}
+
+// Permanent returns true if the mail would never fit, even if everything
+// else was deleted, so there's no point in trying again later.
+func (e *Error) Permanent() bool {
+	return e.Size > e.Root.Limit
+}
+
+// Check returns an *Error if a mail of the given size doesn't fit into the
+// mailbox without going over a quota.
+func Check(cfg *config.Config, s Storage, mailbox string, size int64) error {
+	roots, err := Roots(cfg, s, mailbox)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if root.Usage+size > root.Limit {
+			return &Error{Root: root, Size: size}
+		}
+	}
+	return nil
+}
+
+// Warnings returns the quota roots of the mailbox that have filled up past
+// the warning level since we last warned about them. Quota roots that have
+// gone back under the warning level are forgotten about, so that we warn
+// about them again if they fill up again.
+func Warnings(cfg *config.Config, s Storage, mailbox string) ([]*Root, error) {
+	if cfg.QuotaWarning <= 0 {
+		return nil, nil
+	}
+	roots, err := Roots(cfg, s, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []*Root
+	for _, root := range roots {
+		warned, err := s.ConfigGet(warnedKey + root.Name)
+		if err != nil {
+			return nil, fmt.Errorf("s.ConfigGet: %w", err)
+		}
+		full := root.Percent() >= cfg.QuotaWarning
+		switch {
+		case full && warned == "":
+			warnings = append(warnings, root)
+			err = s.ConfigSet(warnedKey+root.Name, "1")
+		case !full && warned != "":
+			err = s.ConfigSet(warnedKey+root.Name, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("s.ConfigSet: %w", err)
+		}
+	}
+	return warnings, nil
+}
+
+// WarningMail returns a mail from ourselves to ourselves that warns that
+// the quota root is nearly full.
+func WarningMail(cfg *config.Config, root *Root) ([]byte, error) {
+	self := []*gomail.Address{{Name: "Yggmail", Address: utils.CreateAddress(cfg.PublicKey)}}
+	what := "Your mailboxes are"
+	if root.Name != AccountRoot {
+		what = fmt.Sprintf("Your mailbox %q is", root.Name)
+	}
+	var h gomail.Header
+	h.SetAddressList("From", self)
+	h.SetAddressList("To", self)
+	h.SetSubject(fmt.Sprintf("%s %d%% full", what, root.Percent()))
+	h.SetDate(time.Now())
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, fmt.Errorf("h.GenerateMessageID: %w", err)
+	}
+	h.Set("Auto-Submitted", "auto-generated")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+
+	var b bytes.Buffer
+	w, err := message.CreateWriter(&b, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("message.CreateWriter: %w", err)
+	}
+	fmt.Fprintf(w, "%s %d%% full, using %s of %s.\r\n\r\n", what, root.Percent(), Format(root.Usage), Format(root.Limit))
+	fmt.Fprintf(w, "Once there is no room left, mail sent to you will be turned away\r\n")
+	fmt.Fprintf(w, "until you delete some. Deleted mail only stops counting once it has\r\n")
+	fmt.Fprintf(w, "been expunged, i.e. by emptying the Trash.\r\n")
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("w.Close: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Format formats a size in bytes for people to read.
+func Format(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package retention
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage"
+)
+
+// Notifier tells IMAP sessions about mail that the janitor has expunged or
+// moved into another mailbox.
+type Notifier interface {
+	NotifyNew(mailbox string, id, count int) error
+	NotifyExpunge(mailbox string, seqs []int, count int) error
+}
+
+// Janitor applies the retention rules and deletes expired mail at a regular
+// interval. The rules are loaded again each time, so that changes to them
+// are picked up without a restart.
+type Janitor struct {
+	Log      *slog.Logger
+	Storage  storage.Storage
+	Notify   Notifier // may be nil
+	Interval time.Duration
+}
+
+// Run applies the retention rules until the process exits.
+func (j *Janitor) Run() {
+	for {
+		if err := j.Tidy(); err != nil {
+			j.Log.Error("Failed to apply retention rules", logging.Err(err))
+		}
+		time.Sleep(j.Interval)
+	}
+}
+
+// Tidy applies the retention rules once.
+func (j *Janitor) Tidy() error {
+	rules, err := LoadRules(j.Storage)
+	if err != nil {
+		return fmt.Errorf("LoadRules: %w", err)
+	}
+	actions, err := Plan(j.Storage, rules, time.Now())
+	if err != nil {
+		return fmt.Errorf("Plan: %w", err)
+	}
+	j.Apply(actions)
+	return nil
+}
+
+// Apply carries out the actions, one mailbox at a time. A mailbox that
+// fails is logged and skipped, so that it doesn't hold up the others.
+func (j *Janitor) Apply(actions []Action) {
+	var mailboxes []string
+	byMailbox := map[string][]Action{}
+	for _, action := range actions {
+		if _, ok := byMailbox[action.Mailbox]; !ok {
+			mailboxes = append(mailboxes, action.Mailbox)
+		}
+		byMailbox[action.Mailbox] = append(byMailbox[action.Mailbox], action)
+	}
+	for _, mailbox := range mailboxes {
+		if err := j.apply(mailbox, byMailbox[mailbox]); err != nil {
+			j.Log.Error("Failed to apply retention rules", logging.Mailbox(mailbox), logging.Err(err))
+		}
+	}
+}
+
+func (j *Janitor) apply(mailbox string, actions []Action) error {
+	// Take the sequence numbers before anything changes, since those are
+	// what IMAP sessions with the mailbox selected know the mails by.
+	before, err := j.Storage.MailRange(mailbox, false, 1, 0)
+	if err != nil {
+		return fmt.Errorf("j.Storage.MailRange: %w", err)
+	}
+
+	var deleted, archived int
+	destinations := map[string]bool{}
+	for _, action := range actions {
+		if action.Archive == "" {
+			if err := j.Storage.MailDelete(mailbox, action.ID); err != nil {
+				return fmt.Errorf("j.Storage.MailDelete: %w", err)
+			}
+			deleted++
+			continue
+		}
+		if !destinations[action.Archive] {
+			if ok, err := j.Storage.MailboxSelect(action.Archive); err != nil {
+				return fmt.Errorf("j.Storage.MailboxSelect: %w", err)
+			} else if !ok {
+				if err := j.Storage.MailboxCreate(action.Archive); err != nil {
+					return fmt.Errorf("j.Storage.MailboxCreate: %w", err)
+				}
+				if err := j.Storage.MailboxSubscribe(action.Archive, true); err != nil {
+					return fmt.Errorf("j.Storage.MailboxSubscribe: %w", err)
+				}
+			}
+			destinations[action.Archive] = true
+		}
+		if err := j.Storage.MailMove(mailbox, action.ID, action.Archive); err != nil {
+			return fmt.Errorf("j.Storage.MailMove: %w", err)
+		}
+		archived++
+	}
+	// This also expunges any mail that was already marked as deleted, which
+	// is why the mails that have gone are worked out afterwards rather than
+	// from the actions.
+	if deleted > 0 {
+		if err := j.Storage.MailExpunge(mailbox); err != nil {
+			return fmt.Errorf("j.Storage.MailExpunge: %w", err)
+		}
+	}
+	j.Log.Info("Applied retention rules", logging.Mailbox(mailbox), "deleted", deleted, "archived", archived)
+
+	if j.Notify == nil {
+		return nil
+	}
+	after, err := j.Storage.MailRange(mailbox, false, 1, 0)
+	if err != nil {
+		return fmt.Errorf("j.Storage.MailRange: %w", err)
+	}
+	remaining := map[int]bool{}
+	for _, m := range after {
+		remaining[m.ID] = true
+	}
+	var gone []int
+	for _, m := range before {
+		if !remaining[m.ID] {
+			gone = append(gone, m.Seq)
+		}
+	}
+	// Each expunge renumbers the mails after it, so they are sent from the
+	// last to the first so that every sequence number is still right.
+	sort.Sort(sort.Reverse(sort.IntSlice(gone)))
+	if err := j.Notify.NotifyExpunge(mailbox, gone, len(after)); err != nil {
+		j.Log.Error("Failed to notify", logging.Err(err))
+	}
+	for destination := range destinations {
+		next, err := j.Storage.MailNextID(destination)
+		if err != nil {
+			continue
+		}
+		if count, err := j.Storage.MailCount(destination); err == nil {
+			if err := j.Notify.NotifyNew(destination, next-1, count); err != nil {
+				j.Log.Error("Failed to notify", logging.Err(err))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package retention deletes or archives old mail according to the retention
+// rules of each mailbox, so that mail doesn't pile up forever, and deletes
+// mail that has expired.
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/storage"
+)
+
+// RulesKey is where the retention rules are stored in the config table of
+// the database.
+const RulesKey = "retention_rules"
+
+// DefaultArchive is the mailbox that dated archive folders are created
+// under if a rule doesn't say otherwise.
+const DefaultArchive = "Archive"
+
+// Rule is the retention policy of a mailbox. Zero values turn each part of
+// the rule off.
+type Rule struct {
+	Mailbox      string
+	DeleteAfter  int    `json:",omitempty"` // days after which mail is deleted
+	ArchiveAfter int    `json:",omitempty"` // days after which mail is archived
+	ArchiveTo    string `json:",omitempty"` // mail is archived into ArchiveTo/<year>
+	MaxMails     int    `json:",omitempty"` // how many mails to keep at most
+}
+
+// String describes the rule for people to read.
+func (r *Rule) String() string {
+	s := ""
+	add := func(part string) {
+		if s != "" {
+			s += ", "
+		}
+		s += part
+	}
+	if r.ArchiveAfter > 0 {
+		add(fmt.Sprintf("archive into %s/<year> after %d days", r.archive(), r.ArchiveAfter))
+	}
+	if r.DeleteAfter > 0 {
+		add(fmt.Sprintf("delete after %d days", r.DeleteAfter))
+	}
+	if r.MaxMails > 0 {
+		add(fmt.Sprintf("keep at most %d mails", r.MaxMails))
+	}
+	if s == "" {
+		return "keep everything"
+	}
+	return s
+}
+
+func (r *Rule) archive() string {
+	if r.ArchiveTo == "" {
+		return DefaultArchive
+	}
+	return r.ArchiveTo
+}
+
+// LoadRules returns the retention rules, in order of mailbox name.
+func LoadRules(store config.ConfigStore) ([]Rule, error) {
+	value, err := store.ConfigGet(RulesKey)
+	if err != nil {
+		return nil, fmt.Errorf("store.ConfigGet: %w", err)
+	}
+	var rules []Rule
+	if value == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Mailbox < rules[j].Mailbox
+	})
+	return rules, nil
+}
+
+// SaveRules stores the retention rules, replacing all of the rules that
+// were stored before.
+func SaveRules(store config.ConfigStore, rules []Rule) error {
+	value, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := store.ConfigSet(RulesKey, string(value)); err != nil {
+		return fmt.Errorf("store.ConfigSet: %w", err)
+	}
+	return nil
+}
+
+// Action is something that the rules say should happen to a mail.
+type Action struct {
+	Mailbox string
+	ID      int
+	Date    time.Time
+	Subject string
+	Archive string // the mailbox to move the mail into, or empty to delete it
+	Reason  string
+}
+
+func (a *Action) String() string {
+	what := "delete"
+	if a.Archive != "" {
+		what = "archive into " + a.Archive
+	}
+	subject := a.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	return fmt.Sprintf("%s %d from %s, %q: %s (%s)",
+		a.Mailbox, a.ID, a.Date.Format("2006-01-02"), subject, what, a.Reason,
+	)
+}
+
+// Plan works out what should happen to the mail that is in the mailboxes
+// now, without changing anything. Mail whose sender gave it a lifetime is
+// deleted from every mailbox once it expires, whether the mailbox has a rule
+// or not. A mail that the rule says should be deleted isn't archived, and
+// mails that are deleted or archived don't count towards the most mails to
+// keep.
+func Plan(s storage.Storage, rules []Rule, now time.Time) ([]Action, error) {
+	mailboxes, err := s.MailboxList(false)
+	if err != nil {
+		return nil, fmt.Errorf("s.MailboxList: %w", err)
+	}
+	sort.Strings(mailboxes)
+	byMailbox := map[string]*Rule{}
+	for i := range rules {
+		byMailbox[rules[i].Mailbox] = &rules[i]
+	}
+	var actions []Action
+	for _, mailbox := range mailboxes {
+		// Expired mail in the Outbox is dropped by the queue instead, since
+		// it knows which destinations the mail is still waiting for.
+		if mailbox == "Outbox" {
+			continue
+		}
+		rule := byMailbox[mailbox]
+		mails, err := s.MailRange(mailbox, false, 1, 0)
+		if err != nil {
+			return nil, fmt.Errorf("s.MailRange: %w", err)
+		}
+		var kept []Action
+		for _, m := range mails {
+			mail, err := s.MailSelectMeta(mailbox, m.ID)
+			if err != nil {
+				return nil, fmt.Errorf("s.MailSelectMeta: %w", err)
+			}
+			if mail.Deleted {
+				// It will go the next time that the mailbox is expunged
+				// anyway.
+				continue
+			}
+			action := Action{Mailbox: mailbox, ID: m.ID, Date: mail.Date}
+			if mail.Meta != nil && mail.Meta.Envelope != nil {
+				action.Subject = mail.Meta.Envelope.Subject
+			}
+			if expires, ok := mail.Meta.Expires(); ok && !now.Before(expires) {
+				action.Reason = "expired " + expires.Format("2006-01-02 15:04")
+				actions = append(actions, action)
+				continue
+			}
+			if rule == nil {
+				continue
+			}
+			days := int(now.Sub(mail.Date) / (24 * time.Hour))
+			switch {
+			case rule.DeleteAfter > 0 && days >= rule.DeleteAfter:
+				action.Reason = fmt.Sprintf("older than %d days", rule.DeleteAfter)
+				actions = append(actions, action)
+			case rule.ArchiveAfter > 0 && days >= rule.ArchiveAfter:
+				action.Archive = rule.archive() + "/" + strconv.Itoa(mail.Date.Year())
+				if action.Archive == mailbox {
+					kept = append(kept, action)
+					continue
+				}
+				action.Reason = fmt.Sprintf("older than %d days", rule.ArchiveAfter)
+				actions = append(actions, action)
+			default:
+				kept = append(kept, action)
+			}
+		}
+		if rule != nil && rule.MaxMails > 0 && len(kept) > rule.MaxMails {
+			sort.SliceStable(kept, func(i, j int) bool {
+				return kept[i].Date.Before(kept[j].Date)
+			})
+			for _, action := range kept[:len(kept)-rule.MaxMails] {
+				action.Archive = ""
+				action.Reason = fmt.Sprintf("more than %d mails", rule.MaxMails)
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions, nil
+}
@@ -0,0 +1,371 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieve
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// Delivery is a mailbox that the message should be stored into. An empty
+// mailbox name means the default mailbox, i.e. for keep.
+type Delivery struct {
+	Mailbox string
+	Flags   []string
+	Create  bool
+}
+
+// MaxVacationDays is the longest that :days can be, which RFC 5230 allows
+// a site to limit. Replies are remembered for this long, whatever the
+// :days of the script that sent them.
+const MaxVacationDays = 365
+
+// Vacation is an automatic reply requested by the vacation extension,
+// as described in RFC 5230.
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	Mime      bool
+	Handle    string
+	Reason    string
+}
+
+// Result is the outcome of running a script against a message. If there
+// are no deliveries and the message wasn't rejected then it was discarded.
+type Result struct {
+	Deliveries []Delivery
+	Redirects  []string
+	Rejected   bool
+	Reject     string
+	Vacation   *Vacation
+}
+
+type interpreter struct {
+	script       *Script
+	msg          *Message
+	result       *Result
+	flags        []string
+	implicitKeep bool
+	stopped      bool
+}
+
+// Execute runs the script against the message. If an error is returned
+// then the caller should fall back to keeping the message, as required
+// by RFC 5228 section 2.10.6.
+func (s *Script) Execute(msg *Message) (*Result, error) {
+	in := &interpreter{
+		script:       s,
+		msg:          msg,
+		result:       &Result{},
+		implicitKeep: true,
+	}
+	if err := in.run(s.Commands); err != nil {
+		return nil, err
+	}
+	if in.implicitKeep {
+		in.deliver(Delivery{Flags: in.flags})
+	}
+	if in.result.Rejected && len(in.result.Deliveries) > 0 {
+		return nil, fmt.Errorf("reject cannot be used with keep or fileinto")
+	}
+	return in.result, nil
+}
+
+func (in *interpreter) run(commands []*Command) error {
+	branched := false // whether a branch of the current if chain was taken
+	for _, cmd := range commands {
+		if in.stopped {
+			return nil
+		}
+		args, err := bind(cmd.Name, cmd.Line, cmd.Args, commandSpecs[cmd.Name])
+		if err != nil {
+			return err
+		}
+		switch cmd.Name {
+		case "require":
+
+		case "if", "elsif", "else":
+			if cmd.Name == "if" {
+				branched = false
+			}
+			if branched {
+				continue
+			}
+			ok := true
+			if cmd.Name != "else" {
+				if ok, err = in.test(cmd.Tests[0]); err != nil {
+					return err
+				}
+			}
+			if ok {
+				branched = true
+				if err := in.run(cmd.Block); err != nil {
+					return err
+				}
+			}
+
+		case "stop":
+			in.stopped = true
+
+		case "keep":
+			flags := in.flags
+			if f, ok := args.tags["flags"]; ok {
+				flags = splitFlags(f.strings)
+			}
+			in.deliver(Delivery{Flags: flags})
+			in.implicitKeep = false
+
+		case "discard":
+			in.implicitKeep = false
+
+		case "fileinto":
+			flags := in.flags
+			if f, ok := args.tags["flags"]; ok {
+				flags = splitFlags(f.strings)
+			}
+			in.deliver(Delivery{
+				Mailbox: args.str(0),
+				Flags:   flags,
+				Create:  args.has("create"),
+			})
+			if !args.has("copy") {
+				in.implicitKeep = false
+			}
+
+		case "redirect":
+			if _, err := mail.ParseAddress(args.str(0)); err != nil {
+				return fmt.Errorf("line %d: invalid redirect address %q", cmd.Line, args.str(0))
+			}
+			in.result.Redirects = append(in.result.Redirects, args.str(0))
+			if !args.has("copy") {
+				in.implicitKeep = false
+			}
+
+		case "reject":
+			in.result.Rejected = true
+			in.result.Reject = args.str(0)
+			in.implicitKeep = false
+
+		case "setflag":
+			in.flags = splitFlags(args.list(0))
+
+		case "addflag":
+			in.flags = mergeFlags(in.flags, splitFlags(args.list(0)))
+
+		case "removeflag":
+			remove := splitFlags(args.list(0))
+			var flags []string
+			for _, flag := range in.flags {
+				if !containsFold(remove, flag) {
+					flags = append(flags, flag)
+				}
+			}
+			in.flags = flags
+
+		case "vacation":
+			v := &Vacation{
+				Days:   7,
+				Reason: args.str(0),
+				Mime:   args.has("mime"),
+			}
+			if d, ok := args.tags["days"]; ok {
+				v.Days = int(d.number)
+				if v.Days < 1 {
+					v.Days = 1
+				} else if v.Days > MaxVacationDays {
+					v.Days = MaxVacationDays
+				}
+			}
+			if s, ok := args.tags["subject"]; ok {
+				v.Subject = s.strings[0]
+			}
+			if f, ok := args.tags["from"]; ok {
+				v.From = f.strings[0]
+			}
+			if a, ok := args.tags["addresses"]; ok {
+				v.Addresses = a.strings
+			}
+			if h, ok := args.tags["handle"]; ok {
+				v.Handle = h.strings[0]
+			}
+			in.result.Vacation = v
+		}
+	}
+	return nil
+}
+
+// deliver adds a delivery, merging the flags if the message is already
+// being delivered to the same mailbox.
+func (in *interpreter) deliver(d Delivery) {
+	for i, e := range in.result.Deliveries {
+		if e.Mailbox == d.Mailbox {
+			in.result.Deliveries[i].Flags = mergeFlags(e.Flags, d.Flags)
+			in.result.Deliveries[i].Create = e.Create || d.Create
+			return
+		}
+	}
+	d.Flags = append([]string{}, d.Flags...)
+	in.result.Deliveries = append(in.result.Deliveries, d)
+}
+
+func (in *interpreter) test(t *Test) (bool, error) {
+	args, err := bind(t.Name, t.Line, t.Args, testSpecs[t.Name])
+	if err != nil {
+		return false, err
+	}
+	switch t.Name {
+	case "true":
+		return true, nil
+
+	case "false":
+		return false, nil
+
+	case "not":
+		ok, err := in.test(t.Tests[0])
+		return !ok, err
+
+	case "anyof", "allof":
+		all := t.Name == "allof"
+		for _, sub := range t.Tests {
+			ok, err := in.test(sub)
+			if err != nil {
+				return false, err
+			}
+			if ok != all {
+				return ok, nil
+			}
+		}
+		return all, nil
+
+	case "exists":
+		for _, name := range args.list(0) {
+			if len(in.msg.Header(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "size":
+		if over, ok := args.tags["over"]; ok {
+			return int64(in.msg.Size()) > over.number, nil
+		}
+		return int64(in.msg.Size()) < args.tags["under"].number, nil
+
+	case "header":
+		var values []string
+		for _, name := range args.list(0) {
+			values = append(values, in.msg.Header(name)...)
+		}
+		return newMatcher(args).any(values, args.list(1)), nil
+
+	case "address", "envelope":
+		var addrs []string
+		for _, name := range args.list(0) {
+			if t.Name == "envelope" {
+				addrs = append(addrs, in.msg.Envelope(name)...)
+				continue
+			}
+			for _, value := range in.msg.Header(name) {
+				list, err := mail.ParseAddressList(value)
+				if err != nil {
+					addrs = append(addrs, value)
+					continue
+				}
+				for _, addr := range list {
+					addrs = append(addrs, addr.Address)
+				}
+			}
+		}
+		var values []string
+		for _, addr := range addrs {
+			if part, ok := addressPart(args, addr); ok {
+				values = append(values, part)
+			}
+		}
+		return newMatcher(args).any(values, args.list(1)), nil
+
+	case "body":
+		transform := "text"
+		var contentTypes []string
+		switch {
+		case args.has("raw"):
+			transform = "raw"
+		case args.has("content"):
+			transform = "content"
+			contentTypes = args.tags["content"].strings
+		}
+		return newMatcher(args).any(in.msg.Body(transform, contentTypes), args.list(0)), nil
+
+	case "hasflag":
+		m := newMatcher(args)
+		return m.any(in.flags, splitFlags(args.list(0))), nil
+	}
+	return false, fmt.Errorf("line %d: unknown test %q", t.Line, t.Name)
+}
+
+// addressPart returns the part of the address selected by the address
+// part tag, which is the whole address if none was given. It returns
+// false if the part doesn't exist, i.e. :detail without a separator.
+func addressPart(args *boundArgs, addr string) (string, bool) {
+	localpart, domain := addr, ""
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		localpart, domain = addr[:at], addr[at+1:]
+	}
+	sep := strings.IndexAny(localpart, utils.SubaddressSeparators)
+	switch {
+	case args.has("localpart"):
+		return localpart, true
+	case args.has("domain"):
+		return domain, true
+	case args.has("user"):
+		if sep >= 0 {
+			return localpart[:sep], true
+		}
+		return localpart, true
+	case args.has("detail"):
+		if sep >= 0 {
+			return localpart[sep+1:], true
+		}
+		return "", false
+	}
+	return addr, true
+}
+
+// splitFlags splits space-separated flag lists into individual flags.
+func splitFlags(lists []string) []string {
+	var flags []string
+	for _, list := range lists {
+		flags = mergeFlags(flags, strings.Fields(list))
+	}
+	return flags
+}
+
+func mergeFlags(flags, add []string) []string {
+	flags = append([]string{}, flags...)
+	for _, flag := range add {
+		if !containsFold(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	num  int64
+	line int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + t.text
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return t.text
+	}
+}
+
+// lex splits a script into tokens as described in RFC 5228 section 2.
+func lex(script string) ([]token, error) {
+	var tokens []token
+	line := 1
+	i := 0
+	for i < len(script) {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+
+		case strings.ContainsRune("[](){},;", rune(c)):
+			tokens = append(tokens, token{typ: tokenPunct, text: string(c), line: line})
+			i++
+
+		case c == ':':
+			j := i + 1
+			for j < len(script) && isIdentifierChar(script[j], j == i+1) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("line %d: expected tag name after ':'", line)
+			}
+			tokens = append(tokens, token{typ: tokenTag, text: strings.ToLower(script[i+1 : j]), line: line})
+			i = j
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j++
+			}
+			n, err := strconv.ParseInt(script[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number: %w", line, err)
+			}
+			if j < len(script) {
+				switch script[j] {
+				case 'K', 'k':
+					n, j = n<<10, j+1
+				case 'M', 'm':
+					n, j = n<<20, j+1
+				case 'G', 'g':
+					n, j = n<<30, j+1
+				}
+			}
+			tokens = append(tokens, token{typ: tokenNumber, num: n, text: script[i:j], line: line})
+			i = j
+
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			start := line
+			for {
+				if j >= len(script) {
+					return nil, fmt.Errorf("line %d: unterminated string", start)
+				}
+				if script[j] == '"' {
+					break
+				}
+				if script[j] == '\\' && j+1 < len(script) {
+					j++
+				}
+				if script[j] == '\n' {
+					line++
+				}
+				sb.WriteByte(script[j])
+				j++
+			}
+			tokens = append(tokens, token{typ: tokenString, text: sb.String(), line: start})
+			i = j + 1
+
+		case strings.HasPrefix(strings.ToLower(script[i:]), "text:"):
+			// Multi-line strings run until a line containing a single dot,
+			// with dot-stuffing removed from the start of each line.
+			start := line
+			nl := strings.Index(script[i:], "\n")
+			if nl < 0 {
+				return nil, fmt.Errorf("line %d: unterminated multi-line string", start)
+			}
+			i += nl + 1
+			line++
+			var lines []string
+			for {
+				if i >= len(script) {
+					return nil, fmt.Errorf("line %d: unterminated multi-line string", start)
+				}
+				end := strings.Index(script[i:], "\n")
+				var l string
+				if end < 0 {
+					l, i = script[i:], len(script)
+				} else {
+					l, i = script[i:i+end], i+end+1
+				}
+				line++
+				l = strings.TrimSuffix(l, "\r")
+				if l == "." {
+					break
+				}
+				lines = append(lines, strings.TrimPrefix(l, "."))
+			}
+			text := ""
+			if len(lines) > 0 {
+				text = strings.Join(lines, "\r\n") + "\r\n"
+			}
+			tokens = append(tokens, token{typ: tokenString, text: text, line: start})
+
+		case isIdentifierChar(c, true):
+			j := i
+			for j < len(script) && isIdentifierChar(script[j], j == i) {
+				j++
+			}
+			tokens = append(tokens, token{typ: tokenIdentifier, text: strings.ToLower(script[i:j]), line: line})
+			i = j
+
+		default:
+			return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+		}
+	}
+	tokens = append(tokens, token{typ: tokenEOF, line: line})
+	return tokens, nil
+}
+
+func isIdentifierChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
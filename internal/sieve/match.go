@@ -0,0 +1,107 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieve
+
+import (
+	"strings"
+)
+
+// matcher compares values against keys using the comparator and the
+// match type given to a test, as described in RFC 5228 section 2.7.
+type matcher struct {
+	octet bool // i;octet rather than i;ascii-casemap
+	match string
+}
+
+func newMatcher(b *boundArgs) matcher {
+	m := matcher{match: "is"}
+	if c, ok := b.tags["comparator"]; ok {
+		m.octet = strings.EqualFold(c.strings[0], "i;octet")
+	}
+	for _, tag := range []string{"is", "contains", "matches"} {
+		if b.has(tag) {
+			m.match = tag
+		}
+	}
+	return m
+}
+
+func (m matcher) fold(s string) string {
+	if m.octet {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// any returns true if any of the values match any of the keys.
+func (m matcher) any(values, keys []string) bool {
+	for _, value := range values {
+		for _, key := range keys {
+			if m.one(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m matcher) one(value, key string) bool {
+	value, key = m.fold(value), m.fold(key)
+	switch m.match {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcard(value, key)
+	default:
+		return value == key
+	}
+}
+
+// wildcard matches a value against a pattern where "*" matches zero or
+// more characters, "?" matches exactly one and "\" escapes the next one.
+func wildcard(value, pattern string) bool {
+	v, p := []rune(value), []rune(pattern)
+	vi, pi := 0, 0
+	starV, starP := -1, -1
+	for vi < len(v) {
+		if pi < len(p) {
+			switch c := p[pi]; {
+			case c == '*':
+				starP, starV = pi, vi
+				pi++
+				continue
+			case c == '?':
+				vi, pi = vi+1, pi+1
+				continue
+			case c == '\\' && pi+1 < len(p):
+				if p[pi+1] == v[vi] {
+					vi, pi = vi+1, pi+2
+					continue
+				}
+			case c == v[vi]:
+				vi, pi = vi+1, pi+1
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starV++
+		vi, pi = starV, starP+1
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
@@ -0,0 +1,122 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Message is a mail and its envelope, as seen by a Sieve script at the
+// time of delivery.
+type Message struct {
+	from   string
+	to     []string
+	raw    []byte
+	header textproto.Header
+	body   []byte
+}
+
+func NewMessage(from string, to []string, raw []byte) (*Message, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("textproto.ReadHeader: %w", err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	return &Message{
+		from:   from,
+		to:     to,
+		raw:    raw,
+		header: hdr,
+		body:   body,
+	}, nil
+}
+
+var wordDecoder = mime.WordDecoder{}
+
+// Header returns all of the values of the named header, with any
+// RFC 2047 encoded words decoded.
+func (m *Message) Header(name string) []string {
+	values := m.header.Values(name)
+	for i, v := range values {
+		if d, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = d
+		}
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// Envelope returns the envelope sender for "from" or the envelope
+// recipients for "to".
+func (m *Message) Envelope(part string) []string {
+	switch strings.ToLower(part) {
+	case "from":
+		return []string{m.from}
+	case "to":
+		return m.to
+	}
+	return nil
+}
+
+func (m *Message) Size() int {
+	return len(m.raw)
+}
+
+// Body returns the parts of the body to test against, as described in
+// RFC 5173. The transform is one of "raw", "text" or "content", and for
+// "content" only parts with one of the given content types are included.
+func (m *Message) Body(transform string, contentTypes []string) []string {
+	if transform == "raw" {
+		return []string{string(m.body)}
+	}
+	if transform == "text" {
+		contentTypes = []string{"text"}
+	}
+	entity, err := message.Read(bytes.NewReader(m.raw))
+	if entity == nil || (err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err)) {
+		return nil
+	}
+	var parts []string
+	_ = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return nil
+		}
+		t, _, _ := part.Header.ContentType()
+		if t == "" {
+			t = "text/plain"
+		}
+		if strings.HasPrefix(t, "multipart/") {
+			return nil
+		}
+		for _, want := range contentTypes {
+			want = strings.ToLower(want)
+			if want == "" || want == t || (!strings.Contains(want, "/") && strings.HasPrefix(t, want+"/")) {
+				if b, err := io.ReadAll(part.Body); err == nil {
+					parts = append(parts, string(b))
+				}
+				break
+			}
+		}
+		return nil
+	})
+	return parts
+}
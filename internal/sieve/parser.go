@@ -0,0 +1,472 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+type argType int
+
+const (
+	argNone argType = iota
+	argTag
+	argNumber
+	argString     // a single string
+	argStringList // a string or a list of strings
+)
+
+type Argument struct {
+	typ     argType
+	tag     string
+	number  int64
+	strings []string
+	list    bool // the strings were given in [brackets]
+}
+
+type Test struct {
+	Name  string
+	Args  []Argument
+	Tests []*Test
+	Line  int
+}
+
+type Command struct {
+	Name     string
+	Args     []Argument
+	Tests    []*Test
+	Block    []*Command
+	Line     int
+	hasBlock bool
+}
+
+// Script is a parsed and validated Sieve script.
+type Script struct {
+	Require  map[string]bool
+	Commands []*Command
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses and validates a Sieve script, returning an error if the
+// script is malformed or uses extensions that we don't support.
+func Parse(script string) (*Script, error) {
+	tokens, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("line %d: unexpected %s", t.line, t)
+	}
+	s := &Script{
+		Require:  map[string]bool{},
+		Commands: commands,
+	}
+	if err := s.validate(commands, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.typ == tokenPunct && t.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	if t := p.next(); t.typ != tokenPunct || t.text != s {
+		return fmt.Errorf("line %d: expected %q but got %s", t.line, s, t)
+	}
+	return nil
+}
+
+func (p *parser) commands() ([]*Command, error) {
+	var commands []*Command
+	for {
+		t := p.peek()
+		if t.typ != tokenIdentifier {
+			return commands, nil
+		}
+		p.next()
+		cmd := &Command{Name: t.text, Line: t.line}
+		var err error
+		if cmd.Args, cmd.Tests, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		if p.isPunct("{") {
+			p.next()
+			cmd.hasBlock = true
+			if cmd.Block, err = p.commands(); err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("}"); err != nil {
+				return nil, err
+			}
+		} else if err := p.expectPunct(";"); err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+}
+
+func (p *parser) arguments() ([]Argument, []*Test, error) {
+	var args []Argument
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == tokenTag:
+			p.next()
+			args = append(args, Argument{typ: argTag, tag: t.text})
+
+		case t.typ == tokenNumber:
+			p.next()
+			args = append(args, Argument{typ: argNumber, number: t.num})
+
+		case t.typ == tokenString:
+			p.next()
+			args = append(args, Argument{typ: argStringList, strings: []string{t.text}})
+
+		case p.isPunct("["):
+			p.next()
+			var list []string
+			for {
+				s := p.next()
+				if s.typ != tokenString {
+					return nil, nil, fmt.Errorf("line %d: expected string in list but got %s", s.line, s)
+				}
+				list = append(list, s.text)
+				if p.isPunct(",") {
+					p.next()
+					continue
+				}
+				if err := p.expectPunct("]"); err != nil {
+					return nil, nil, err
+				}
+				break
+			}
+			args = append(args, Argument{typ: argStringList, strings: list, list: true})
+
+		case t.typ == tokenIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []*Test{test}, nil
+
+		case p.isPunct("("):
+			p.next()
+			var tests []*Test
+			for {
+				test, err := p.test()
+				if err != nil {
+					return nil, nil, err
+				}
+				tests = append(tests, test)
+				if p.isPunct(",") {
+					p.next()
+					continue
+				}
+				if err := p.expectPunct(")"); err != nil {
+					return nil, nil, err
+				}
+				return args, tests, nil
+			}
+
+		default:
+			return args, nil, nil
+		}
+	}
+}
+
+func (p *parser) test() (*Test, error) {
+	t := p.next()
+	if t.typ != tokenIdentifier {
+		return nil, fmt.Errorf("line %d: expected test but got %s", t.line, t)
+	}
+	test := &Test{Name: t.text, Line: t.line}
+	var err error
+	if test.Args, test.Tests, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+// spec describes the arguments that a command or test accepts.
+type spec struct {
+	extension  string             // the extension that must be required first
+	tags       map[string]argType // tagged arguments and the type of their value
+	positional []argType          // positional arguments, in order
+	tests      int                // number of tests, or -1 for a test list
+	block      bool               // whether the command takes a block
+}
+
+var matchTags = map[string]argType{
+	"is": argNone, "contains": argNone, "matches": argNone,
+	"comparator": argString,
+}
+
+var addressTags = map[string]argType{
+	"all": argNone, "localpart": argNone, "domain": argNone,
+	"user": argNone, "detail": argNone,
+}
+
+func withTags(sets ...map[string]argType) map[string]argType {
+	tags := map[string]argType{}
+	for _, set := range sets {
+		for k, v := range set {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+var commandSpecs = map[string]spec{
+	"require":    {positional: []argType{argStringList}},
+	"if":         {tests: 1, block: true},
+	"elsif":      {tests: 1, block: true},
+	"else":       {block: true},
+	"stop":       {},
+	"keep":       {tags: map[string]argType{"flags": argStringList}},
+	"discard":    {},
+	"redirect":   {tags: map[string]argType{"copy": argNone}, positional: []argType{argString}},
+	"fileinto":   {extension: "fileinto", tags: map[string]argType{"copy": argNone, "flags": argStringList, "create": argNone}, positional: []argType{argString}},
+	"reject":     {extension: "reject", positional: []argType{argString}},
+	"setflag":    {extension: "imap4flags", positional: []argType{argStringList}},
+	"addflag":    {extension: "imap4flags", positional: []argType{argStringList}},
+	"removeflag": {extension: "imap4flags", positional: []argType{argStringList}},
+	"vacation": {extension: "vacation", tags: map[string]argType{
+		"days": argNumber, "subject": argString, "from": argString,
+		"addresses": argStringList, "mime": argNone, "handle": argString,
+	}, positional: []argType{argString}},
+}
+
+var testSpecs = map[string]spec{
+	"address":  {tags: withTags(matchTags, addressTags), positional: []argType{argStringList, argStringList}},
+	"envelope": {extension: "envelope", tags: withTags(matchTags, addressTags), positional: []argType{argStringList, argStringList}},
+	"header":   {tags: matchTags, positional: []argType{argStringList, argStringList}},
+	"exists":   {positional: []argType{argStringList}},
+	"size":     {tags: map[string]argType{"over": argNumber, "under": argNumber}},
+	"not":      {tests: 1},
+	"anyof":    {tests: -1},
+	"allof":    {tests: -1},
+	"true":     {},
+	"false":    {},
+	"body":     {extension: "body", tags: withTags(matchTags, map[string]argType{"raw": argNone, "text": argNone, "content": argStringList}), positional: []argType{argStringList}},
+	"hasflag":  {extension: "imap4flags", tags: matchTags, positional: []argType{argStringList}},
+}
+
+// Extensions lists the extensions that can be given to "require".
+var Extensions = []string{
+	"body", "comparator-i;ascii-casemap", "comparator-i;octet", "copy",
+	"envelope", "fileinto", "imap4flags", "mailbox", "reject",
+	"subaddress", "vacation",
+}
+
+// extensionForTag lists tags that are only valid with an extension.
+var extensionForTag = map[string]string{
+	"copy": "copy", "create": "mailbox", "flags": "imap4flags",
+	"user": "subaddress", "detail": "subaddress",
+}
+
+// boundArgs holds the arguments of a command or test once they have been
+// matched against the spec.
+type boundArgs struct {
+	tags       map[string]Argument
+	positional []Argument
+}
+
+func (b *boundArgs) has(tag string) bool {
+	_, ok := b.tags[tag]
+	return ok
+}
+
+func (b *boundArgs) str(i int) string {
+	return b.positional[i].strings[0]
+}
+
+func (b *boundArgs) list(i int) []string {
+	return b.positional[i].strings
+}
+
+func bind(name string, line int, args []Argument, sp spec) (*boundArgs, error) {
+	b := &boundArgs{tags: map[string]Argument{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.typ != argTag {
+			b.positional = append(b.positional, arg)
+			continue
+		}
+		valueType, ok := sp.tags[arg.tag]
+		if !ok {
+			return nil, fmt.Errorf("line %d: %s does not accept :%s", line, name, arg.tag)
+		}
+		if _, dup := b.tags[arg.tag]; dup {
+			return nil, fmt.Errorf("line %d: :%s given more than once", line, arg.tag)
+		}
+		if valueType == argNone {
+			b.tags[arg.tag] = arg
+			continue
+		}
+		if i+1 >= len(args) || !argMatches(args[i+1], valueType) {
+			return nil, fmt.Errorf("line %d: :%s expects a value", line, arg.tag)
+		}
+		i++
+		b.tags[arg.tag] = args[i]
+	}
+	if len(b.positional) != len(sp.positional) {
+		return nil, fmt.Errorf("line %d: %s expects %d arguments but got %d", line, name, len(sp.positional), len(b.positional))
+	}
+	for i, t := range sp.positional {
+		if !argMatches(b.positional[i], t) {
+			return nil, fmt.Errorf("line %d: %s has an invalid argument %d", line, name, i+1)
+		}
+	}
+	exclusive := 0
+	for _, tag := range []string{"is", "contains", "matches"} {
+		if b.has(tag) {
+			exclusive++
+		}
+	}
+	if exclusive > 1 {
+		return nil, fmt.Errorf("line %d: only one match type may be given", line)
+	}
+	exclusive = 0
+	for tag := range addressTags {
+		if b.has(tag) {
+			exclusive++
+		}
+	}
+	if exclusive > 1 {
+		return nil, fmt.Errorf("line %d: only one address part may be given", line)
+	}
+	return b, nil
+}
+
+func argMatches(arg Argument, t argType) bool {
+	switch t {
+	case argNumber:
+		return arg.typ == argNumber
+	case argString:
+		return arg.typ == argStringList && !arg.list && len(arg.strings) == 1
+	case argStringList:
+		return arg.typ == argStringList
+	}
+	return false
+}
+
+func (s *Script) validate(commands []*Command, top bool) error {
+	prev := ""
+	for i, cmd := range commands {
+		sp, ok := commandSpecs[cmd.Name]
+		if !ok {
+			return fmt.Errorf("line %d: unknown command %q", cmd.Line, cmd.Name)
+		}
+		if err := s.validateSpec(cmd.Name, cmd.Line, cmd.Args, cmd.Tests, sp); err != nil {
+			return err
+		}
+		switch {
+		case sp.block && !cmd.hasBlock:
+			return fmt.Errorf("line %d: %s requires a block", cmd.Line, cmd.Name)
+		case !sp.block && cmd.hasBlock:
+			return fmt.Errorf("line %d: %s does not take a block", cmd.Line, cmd.Name)
+		}
+		switch cmd.Name {
+		case "require":
+			if !top || (i > 0 && prev != "require") {
+				return fmt.Errorf("line %d: require must come before any other commands", cmd.Line)
+			}
+			for _, ext := range cmd.Args[0].strings {
+				if !isSupported(ext) {
+					return fmt.Errorf("line %d: unsupported extension %q", cmd.Line, ext)
+				}
+				s.Require[strings.ToLower(ext)] = true
+			}
+		case "elsif", "else":
+			if prev != "if" && prev != "elsif" {
+				return fmt.Errorf("line %d: %s must follow if or elsif", cmd.Line, cmd.Name)
+			}
+		}
+		if err := s.validate(cmd.Block, false); err != nil {
+			return err
+		}
+		prev = cmd.Name
+	}
+	return nil
+}
+
+func (s *Script) validateSpec(name string, line int, args []Argument, tests []*Test, sp spec) error {
+	if sp.extension != "" && !s.Require[sp.extension] {
+		return fmt.Errorf("line %d: %s requires the %q extension", line, name, sp.extension)
+	}
+	b, err := bind(name, line, args, sp)
+	if err != nil {
+		return err
+	}
+	for tag := range b.tags {
+		if ext, ok := extensionForTag[tag]; ok && !s.Require[ext] {
+			return fmt.Errorf("line %d: :%s requires the %q extension", line, tag, ext)
+		}
+	}
+	if name == "size" && b.has("over") == b.has("under") {
+		return fmt.Errorf("line %d: size expects exactly one of :over or :under", line)
+	}
+	if c, ok := b.tags["comparator"]; ok {
+		if cmp := strings.ToLower(c.strings[0]); cmp != "i;octet" && cmp != "i;ascii-casemap" {
+			return fmt.Errorf("line %d: unsupported comparator %q", line, c.strings[0])
+		}
+	}
+	switch {
+	case sp.tests == 1 && len(tests) != 1:
+		return fmt.Errorf("line %d: %s expects a single test", line, name)
+	case sp.tests == -1 && len(tests) == 0:
+		return fmt.Errorf("line %d: %s expects a list of tests", line, name)
+	case sp.tests == 0 && len(tests) != 0:
+		return fmt.Errorf("line %d: %s does not take a test", line, name)
+	}
+	for _, test := range tests {
+		tsp, ok := testSpecs[test.Name]
+		if !ok {
+			return fmt.Errorf("line %d: unknown test %q", test.Line, test.Name)
+		}
+		if err := s.validateSpec(test.Name, test.Line, test.Args, test.Tests, tsp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSupported(ext string) bool {
+	for _, e := range Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
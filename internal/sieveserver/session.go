@@ -0,0 +1,382 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieveserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/sieve"
+)
+
+// Scripts larger than this are refused, both to protect the database and
+// to stop clients from sending us enormous literals.
+const maxScriptSize = 1024 * 1024
+
+type session struct {
+	server *ManageSieveServer
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	authed bool
+}
+
+// response is a ManageSieve response, i.e. NO (NONEXISTENT) "text".
+type response struct {
+	status string
+	code   string
+	text   string
+}
+
+func (r *response) Error() string {
+	return r.text
+}
+
+func no(code, format string, args ...interface{}) *response {
+	return &response{status: "NO", code: code, text: fmt.Sprintf(format, args...)}
+}
+
+func (s *session) serve() {
+	defer s.conn.Close()
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
+
+	s.writeCapabilities()
+	s.writeResponse(&response{status: "OK", text: "Yggmail ManageSieve ready"})
+	if err := s.writer.Flush(); err != nil {
+		return
+	}
+
+	for {
+		args, err := s.readCommand()
+		if err != nil {
+			var resp *response
+			if !errors.As(err, &resp) {
+				return
+			}
+			s.writeResponse(resp)
+			if s.writer.Flush() != nil {
+				return
+			}
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		resp := s.handle(name, args[1:])
+		if resp == nil {
+			resp = &response{status: "OK"}
+		}
+		s.writeResponse(resp)
+		if err := s.writer.Flush(); err != nil || resp.status == "BYE" {
+			return
+		}
+	}
+}
+
+func (s *session) handle(name string, args []string) *response {
+	switch name {
+	case "CAPABILITY":
+		s.writeCapabilities()
+		return nil
+
+	case "NOOP":
+		if len(args) > 0 {
+			return &response{status: "OK", code: "TAG " + quote(args[0]), text: "Done"}
+		}
+		return nil
+
+	case "LOGOUT":
+		return &response{status: "BYE", text: "Logging out"}
+
+	case "AUTHENTICATE":
+		if s.authed {
+			return no("", "Already authenticated")
+		}
+		return s.authenticate(args)
+	}
+
+	if !s.authed {
+		return no("", "Authenticate first")
+	}
+
+	storage := s.server.backend.Storage
+	switch name {
+	case "UNAUTHENTICATE":
+		s.authed = false
+		return nil
+
+	case "HAVESPACE":
+		if len(args) != 2 {
+			return no("", "Expected script name and size")
+		}
+		if size, err := strconv.Atoi(args[1]); err != nil || size > maxScriptSize {
+			return no("QUOTA/MAXSIZE", "Script is too large")
+		}
+		return nil
+
+	case "CHECKSCRIPT":
+		if len(args) != 1 {
+			return no("", "Expected script")
+		}
+		if _, err := sieve.Parse(args[0]); err != nil {
+			return no("", "%s", err)
+		}
+		return nil
+
+	case "PUTSCRIPT":
+		if len(args) != 2 {
+			return no("", "Expected script name and script")
+		}
+		if args[0] == "" {
+			return no("", "Script name cannot be empty")
+		}
+		if _, err := sieve.Parse(args[1]); err != nil {
+			return no("", "%s", err)
+		}
+		if err := storage.SievePut(args[0], args[1]); err != nil {
+			return no("TRYLATER", "Failed to store script: %s", err)
+		}
+		return nil
+
+	case "LISTSCRIPTS":
+		scripts, err := storage.SieveList()
+		if err != nil {
+			return no("TRYLATER", "Failed to list scripts: %s", err)
+		}
+		for _, script := range scripts {
+			if script.Active {
+				fmt.Fprintf(s.writer, "%s ACTIVE\r\n", quote(script.Name))
+			} else {
+				fmt.Fprintf(s.writer, "%s\r\n", quote(script.Name))
+			}
+		}
+		return nil
+
+	case "SETACTIVE":
+		if len(args) != 1 {
+			return no("", "Expected script name")
+		}
+		if args[0] != "" {
+			if script, err := storage.SieveSelect(args[0]); err != nil {
+				return no("TRYLATER", "Failed to find script: %s", err)
+			} else if script == nil {
+				return no("NONEXISTENT", "There is no script with that name")
+			}
+		}
+		if err := storage.SieveSetActive(args[0]); err != nil {
+			return no("TRYLATER", "Failed to activate script: %s", err)
+		}
+		return nil
+
+	case "GETSCRIPT":
+		if len(args) != 1 {
+			return no("", "Expected script name")
+		}
+		script, err := storage.SieveSelect(args[0])
+		if err != nil {
+			return no("TRYLATER", "Failed to find script: %s", err)
+		} else if script == nil {
+			return no("NONEXISTENT", "There is no script with that name")
+		}
+		fmt.Fprintf(s.writer, "{%d}\r\n%s\r\n", len(script.Script), script.Script)
+		return nil
+
+	case "DELETESCRIPT":
+		if len(args) != 1 {
+			return no("", "Expected script name")
+		}
+		script, err := storage.SieveSelect(args[0])
+		switch {
+		case err != nil:
+			return no("TRYLATER", "Failed to find script: %s", err)
+		case script == nil:
+			return no("NONEXISTENT", "There is no script with that name")
+		case script.Active:
+			return no("ACTIVE", "You may not delete an active script")
+		}
+		if err := storage.SieveDelete(args[0]); err != nil {
+			return no("TRYLATER", "Failed to delete script: %s", err)
+		}
+		return nil
+
+	case "RENAMESCRIPT":
+		if len(args) != 2 || args[1] == "" {
+			return no("", "Expected old and new script names")
+		}
+		if script, err := storage.SieveSelect(args[0]); err != nil {
+			return no("TRYLATER", "Failed to find script: %s", err)
+		} else if script == nil {
+			return no("NONEXISTENT", "There is no script with that name")
+		}
+		if script, err := storage.SieveSelect(args[1]); err != nil {
+			return no("TRYLATER", "Failed to find script: %s", err)
+		} else if script != nil {
+			return no("ALREADYEXISTS", "A script with that name already exists")
+		}
+		if err := storage.SieveRename(args[0], args[1]); err != nil {
+			return no("TRYLATER", "Failed to rename script: %s", err)
+		}
+		return nil
+	}
+
+	return no("", "Unknown command %q", name)
+}
+
+// authenticate handles the PLAIN SASL mechanism, which is the only one we
+// support since we don't support TLS on the listener yet anyway.
+func (s *session) authenticate(args []string) *response {
+	if len(args) == 0 || !strings.EqualFold(args[0], "PLAIN") {
+		return no("", "Unsupported authentication mechanism")
+	}
+	var encoded string
+	if len(args) > 1 {
+		encoded = args[1]
+	} else {
+		fmt.Fprintf(s.writer, "\"\"\r\n")
+		if err := s.writer.Flush(); err != nil {
+			return &response{status: "BYE", text: "Connection error"}
+		}
+		reply, err := s.readCommand()
+		if err != nil || len(reply) != 1 {
+			return no("", "Invalid authentication response")
+		}
+		if reply[0] == "*" {
+			return no("", "Authentication cancelled")
+		}
+		encoded = reply[0]
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return no("", "Invalid base64 in authentication response")
+	}
+	parts := bytes.Split(decoded, []byte{0})
+	if len(parts) != 3 {
+		return no("", "Invalid authentication response")
+	}
+	username, password := string(parts[1]), string(parts[2])
+	if err := s.server.backend.Login(s.conn.RemoteAddr(), username, password); errors.Is(err, lockout.ErrBanned) {
+		return no("TRYLATER", "Too many failed logins, try again later")
+	} else if err != nil {
+		return no("", "Authentication failed")
+	}
+	s.server.backend.Log.Info("Authenticated ManageSieve user", "remote", s.conn.RemoteAddr().String())
+	s.authed = true
+	return &response{status: "OK", text: "Authenticated"}
+}
+
+func (s *session) writeCapabilities() {
+	fmt.Fprintf(s.writer, "\"IMPLEMENTATION\" \"Yggmail\"\r\n")
+	fmt.Fprintf(s.writer, "\"SASL\" \"PLAIN\"\r\n")
+	fmt.Fprintf(s.writer, "\"SIEVE\" %s\r\n", quote(strings.Join(sieve.Extensions, " ")))
+	fmt.Fprintf(s.writer, "\"MAXREDIRECTS\" \"%d\"\r\n", 4)
+	fmt.Fprintf(s.writer, "\"VERSION\" \"1.0\"\r\n")
+}
+
+func (s *session) writeResponse(r *response) {
+	s.writer.WriteString(r.status)
+	if r.code != "" {
+		s.writer.WriteString(" (" + r.code + ")")
+	}
+	if r.text != "" {
+		s.writer.WriteString(" " + quote(r.text))
+	}
+	s.writer.WriteString("\r\n")
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n") || len(s) > 1024 {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return "\"" + s + "\""
+}
+
+// readCommand reads a single line from the client, which may span several
+// actual lines if it contains literals, and splits it into atoms and
+// strings.
+func (s *session) readCommand() ([]string, error) {
+	var args []string
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args, nil
+		}
+		switch line[0] {
+		case '"':
+			var sb strings.Builder
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				sb.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, no("", "Unterminated string")
+			}
+			args = append(args, sb.String())
+			line = line[i+1:]
+
+		case '{':
+			end := strings.Index(line, "}")
+			if end < 0 || end != len(line)-1 {
+				return nil, no("", "Invalid literal")
+			}
+			size, err := strconv.Atoi(strings.TrimSuffix(line[1:end], "+"))
+			if err != nil || size < 0 {
+				return nil, no("", "Invalid literal size")
+			}
+			if size > maxScriptSize {
+				return nil, no("QUOTA/MAXSIZE", "Literal is too large")
+			}
+			literal := make([]byte, size)
+			if _, err := io.ReadFull(s.reader, literal); err != nil {
+				return nil, err
+			}
+			args = append(args, string(literal))
+			if line, err = s.readLine(); err != nil {
+				return nil, err
+			}
+
+		default:
+			end := strings.IndexAny(line, " ")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+		}
+	}
+}
+
+func (s *session) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > maxScriptSize {
+		return "", no("", "Line is too long")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
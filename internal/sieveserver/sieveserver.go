@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sieveserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+type Backend struct {
+	Config  *config.Config
+	Log     *slog.Logger
+	Storage storage.Storage
+	Lockout *lockout.Lockout // shared with the other listeners that check the password
+}
+
+func (b *Backend) Login(remote net.Addr, username, password string) error {
+	source := lockout.Source(remote)
+	if err := b.Lockout.Check(source); err != nil {
+		b.Log.Warn("Refused ManageSieve login from banned source", "remote", source)
+		return err
+	}
+	// If our username is email-like, then take just the localpart
+	if pk, err := utils.ParseAddress(username, b.Config.SubaddressSeparator); err == nil {
+		if !pk.Equal(b.Config.PublicKey) {
+			b.Log.Warn("Failed to authenticate ManageSieve user due to wrong domain", logging.Peer(pk))
+			b.Lockout.Failed(source)
+			return fmt.Errorf("failed to authenticate: wrong domain in username")
+		}
+	}
+	if authed, err := b.Storage.ConfigTryPassword(password); err != nil {
+		b.Log.Warn("Failed to authenticate ManageSieve user", logging.Err(err))
+		// A wrong password is also an error from bcrypt.
+		b.Lockout.Failed(source)
+		return fmt.Errorf("failed to authenticate: %w", err)
+	} else if !authed {
+		b.Log.Warn("Failed to authenticate ManageSieve user")
+		b.Lockout.Failed(source)
+		return fmt.Errorf("invalid credentials")
+	}
+	b.Lockout.Succeeded(source)
+	return nil
+}
+
+// ManageSieveServer implements the ManageSieve protocol from RFC 5804, so
+// that mail clients can upload and manage Sieve scripts.
+type ManageSieveServer struct {
+	listener net.Listener
+	backend  *Backend
+}
+
+func NewManageSieveServer(backend *Backend, addr string) (*ManageSieveServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	s := &ManageSieveServer{
+		listener: listener,
+		backend:  backend,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				backend.Log.Error("Failed to accept ManageSieve connection", logging.Err(err))
+				os.Exit(1)
+			}
+			session := &session{
+				server: s,
+				conn:   conn,
+			}
+			go session.serve()
+		}
+	}()
+	return s, nil
+}
@@ -0,0 +1,124 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpsender
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// bounce gives up on sending a mail to a recipient that the remote server
+// rejected permanently. The mail is taken out of the queue and a delivery
+// status notification is put into INBOX so that we know it wasn't sent.
+func (q *Queue) bounce(ref types.QueuedMail, content []byte, serr *smtp.SMTPError) error {
+	if err := q.queues.Storage.QueueDeleteDestinationForID(q.destination, ref.ID); err != nil {
+		return fmt.Errorf("q.queues.Storage.QueueDeleteDestinationForID: %w", err)
+	}
+	if remaining, err := q.queues.Storage.QueueSelectIsMessagePendingSend("Outbox", ref.ID); err != nil {
+		return fmt.Errorf("q.queues.Storage.QueueSelectIsMessagePendingSend: %w", err)
+	} else if !remaining {
+		if err := q.queues.Storage.MailDelete("Outbox", ref.ID); err != nil {
+			return fmt.Errorf("q.queues.Storage.MailDelete: %w", err)
+		}
+	}
+	dsn, err := q.queues.deliveryStatus(ref.Rcpt, content, serr)
+	if err != nil {
+		return fmt.Errorf("q.queues.deliveryStatus: %w", err)
+	}
+	if _, err := q.queues.Storage.MailCreate("INBOX", dsn); err != nil {
+		return fmt.Errorf("q.queues.Storage.MailCreate: %w", err)
+	}
+	return nil
+}
+
+// deliveryStatus returns a delivery status notification as described in
+// RFC 3464 for a mail that couldn't be delivered to the recipient, with the
+// header of the mail attached so that we can tell which mail it was.
+func (qs *Queues) deliveryStatus(rcpt string, content []byte, serr *smtp.SMTPError) ([]byte, error) {
+	self := utils.CreateAddress(qs.Config.PublicKey)
+	var h gomail.Header
+	h.SetAddressList("From", []*gomail.Address{{Name: "Mail Delivery System", Address: self}})
+	h.SetAddressList("To", []*gomail.Address{{Address: self}})
+	h.SetSubject("Undelivered Mail Returned to Sender")
+	h.SetDate(time.Now())
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, fmt.Errorf("h.GenerateMessageID: %w", err)
+	}
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/report", map[string]string{"report-type": "delivery-status"})
+
+	original, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return nil, fmt.Errorf("textproto.ReadHeader: %w", err)
+	}
+	status := fmt.Sprintf("%d.%d.%d", serr.EnhancedCode[0], serr.EnhancedCode[1], serr.EnhancedCode[2])
+	if serr.EnhancedCode == smtp.NoEnhancedCode {
+		status = "5.0.0"
+	}
+
+	var b bytes.Buffer
+	w, err := message.CreateWriter(&b, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("message.CreateWriter: %w", err)
+	}
+	for _, part := range []struct {
+		contentType string
+		write       func(io.Writer) error
+	}{
+		{"text/plain", func(b io.Writer) error {
+			fmt.Fprintf(b, "Your mail to %s could not be delivered and won't be\r\n", rcpt)
+			fmt.Fprintf(b, "tried again. The remote server said:\r\n\r\n")
+			fmt.Fprintf(b, "    %d %s %s\r\n", serr.Code, status, serr.Message)
+			return nil
+		}},
+		{"message/delivery-status", func(b io.Writer) error {
+			fmt.Fprintf(b, "Reporting-MTA: x-yggmail; %s\r\n", self)
+			if date := original.Get("Date"); date != "" {
+				fmt.Fprintf(b, "Arrival-Date: %s\r\n", date)
+			}
+			fmt.Fprintf(b, "\r\n")
+			fmt.Fprintf(b, "Final-Recipient: rfc822; %s\r\n", rcpt)
+			fmt.Fprintf(b, "Action: failed\r\n")
+			fmt.Fprintf(b, "Status: %s\r\n", status)
+			fmt.Fprintf(b, "Diagnostic-Code: smtp; %d %s\r\n", serr.Code, serr.Message)
+			return nil
+		}},
+		{"text/rfc822-headers", func(b io.Writer) error {
+			return textproto.WriteHeader(b, original)
+		}},
+	} {
+		var ph message.Header
+		ph.SetContentType(part.contentType, nil)
+		pw, err := w.CreatePart(ph)
+		if err != nil {
+			return nil, fmt.Errorf("w.CreatePart: %w", err)
+		}
+		if err := part.write(pw); err != nil {
+			return nil, err
+		}
+		if err := pw.Close(); err != nil {
+			return nil, fmt.Errorf("pw.Close: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("w.Close: %w", err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,159 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpsender
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// SmarthostDestination is the queue destination for mail that is relayed
+// to Internet addresses through the smarthost. It can never clash with a
+// destination key since it isn't valid hex.
+const SmarthostDestination = "smarthost"
+
+// GatewayHeader marks mail that has passed through a gateway between
+// Yggmail and Internet mail, since the sender of such mail can't be
+// authenticated by their key.
+const GatewayHeader = "X-Yggmail-Gateway"
+
+// IsInternetAddress returns true if the address is a regular Internet
+// address rather than a Yggmail one.
+func IsInternetAddress(address string) bool {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return false
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	return at > 0 && !strings.EqualFold(addr.Address[at+1:], utils.Domain)
+}
+
+// routeInternet works out where mail for an Internet address should be
+// queued, which is either the smarthost if we are a gateway ourselves, or
+// the configured gateway node.
+func (qs *Queues) routeInternet(from, rcpt string) (string, error) {
+	switch {
+	case qs.Config.Smarthost != nil:
+		pk, err := utils.ParseAddress(from, qs.Config.SubaddressSeparator)
+		if err != nil {
+			return "", fmt.Errorf("utils.ParseAddress: %w", err)
+		}
+		mapping, err := qs.Storage.GatewaySelectByKey(utils.EncodeKey(pk))
+		if err != nil {
+			return "", fmt.Errorf("qs.Storage.GatewaySelectByKey: %w", err)
+		} else if mapping == nil {
+			return "", fmt.Errorf("sender %s has no Internet address on this gateway", from)
+		}
+		return SmarthostDestination, nil
+
+	case qs.Config.Gateway != nil:
+		return utils.EncodeKey(qs.Config.Gateway), nil
+	}
+	return "", fmt.Errorf("no gateway is configured for Internet address %s", rcpt)
+}
+
+// dialSmarthost connects and authenticates to the smarthost. Plain smtp://
+// URLs require STARTTLS unless ?insecure=true is given.
+func (qs *Queues) dialSmarthost() (*smtp.Client, error) {
+	u := qs.Config.Smarthost
+	host := u.Hostname()
+	tlsConfig := &tls.Config{ServerName: host}
+	insecure := u.Query().Get("insecure") == "true"
+
+	var client *smtp.Client
+	var err error
+	switch u.Scheme {
+	case "smtps":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(host, "465")
+		}
+		if client, err = smtp.DialTLS(addr, tlsConfig); err != nil {
+			return nil, fmt.Errorf("smtp.DialTLS: %w", err)
+		}
+	default:
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(host, "587")
+		}
+		if client, err = smtp.Dial(addr); err != nil {
+			return nil, fmt.Errorf("smtp.Dial: %w", err)
+		}
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("client.StartTLS: %w", err)
+			}
+		} else if !insecure {
+			client.Close()
+			return nil, fmt.Errorf("smarthost %s does not support STARTTLS", addr)
+		}
+	}
+
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = os.Getenv("YGGMAIL_SMARTHOST_PASSWORD")
+		}
+		if err := client.Auth(sasl.NewPlainClient("", u.User.Username(), password)); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("client.Auth: %w", err)
+		}
+	}
+	return client, nil
+}
+
+// rewriteForInternet prepares mail from a Yggmail sender to be sent to the
+// Internet. The sender is replaced with their mapped Internet address so
+// that replies come back through the gateway, and the mail is marked with
+// the key that it came from.
+func (qs *Queues) rewriteForInternet(from string, content []byte) (string, []byte, error) {
+	pk, err := utils.ParseAddress(from, qs.Config.SubaddressSeparator)
+	if err != nil {
+		return "", nil, fmt.Errorf("utils.ParseAddress: %w", err)
+	}
+	mapping, err := qs.Storage.GatewaySelectByKey(utils.EncodeKey(pk))
+	if err != nil {
+		return "", nil, fmt.Errorf("qs.Storage.GatewaySelectByKey: %w", err)
+	} else if mapping == nil {
+		return "", nil, fmt.Errorf("sender %s has no Internet address on this gateway", from)
+	}
+
+	m, err := message.Read(bytes.NewReader(content))
+	if m == nil {
+		return "", nil, fmt.Errorf("message.Read: %w", err)
+	}
+	h := gomail.Header{Header: m.Header}
+	sender := &gomail.Address{Address: mapping.Address}
+	if addrs, err := h.AddressList("From"); err == nil && len(addrs) > 0 {
+		sender.Name = addrs[0].Name
+	}
+	h.SetAddressList("From", []*gomail.Address{sender})
+	h.Del("Bcc")
+	h.Del(GatewayHeader)
+	h.Add(GatewayHeader, fmt.Sprintf("outbound; key=%s", utils.CreateAddress(pk)))
+	m.Header = h.Header
+
+	var b bytes.Buffer
+	if err := m.WriteTo(&b); err != nil {
+		return "", nil, fmt.Errorf("m.WriteTo: %w", err)
+	}
+	return mapping.Address, b.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpsender
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/metrics"
+)
+
+var (
+	deliveryAttempts = metrics.NewCounter("yggmail_delivery_attempts_total", "Attempts to deliver a queued mail to one recipient.")
+	deliveryFailures = metrics.NewCounter("yggmail_delivery_failures_total", "Failed delivery attempts, by the step that failed and whether the remote server turned the mail away for now or for good, or couldn't be reached at all.", "stage", "class")
+	messagesSent     = metrics.NewCounter("yggmail_messages_sent_total", "Mails delivered to one recipient, by whether they went over Yggdrasil or through the smarthost.", "via")
+	queueDepth       = metrics.NewGauge("yggmail_queue_depth", "Deliveries waiting to be sent, by destination.", "destination")
+	queueOldest      = metrics.NewGauge("yggmail_queue_oldest_seconds", "How long the oldest mail waiting to be sent has been in the Outbox, by destination.", "destination")
+)
+
+// via says how mail for this queue leaves the node.
+func (q *Queue) via() string {
+	if q.destination == SmarthostDestination {
+		return "smarthost"
+	}
+	return "overlay"
+}
+
+// errorClass sorts delivery errors into those where the remote server gave
+// a temporary or a permanent SMTP error, and those where we didn't get one.
+func errorClass(err error) string {
+	var serr *smtp.SMTPError
+	switch {
+	case !errors.As(err, &serr):
+		return "network"
+	case serr.Code >= 500:
+		return "permanent"
+	default:
+		return "temporary"
+	}
+}
+
+// CollectMetrics sets the queue gauges from what is in the queue now. It is
+// meant to be passed to metrics.Collect.
+func (qs *Queues) CollectMetrics() {
+	queueDepth.Reset()
+	queueOldest.Reset()
+	destinations, err := qs.Storage.QueueListDestinations()
+	if err != nil {
+		qs.Log.Error("Failed to collect queue metrics", logging.Err(err))
+		return
+	}
+	now := time.Now()
+	for _, destination := range destinations {
+		refs, err := qs.Storage.QueueMailIDsForDestination(destination)
+		if err != nil {
+			qs.Log.Error("Failed to collect queue metrics", logging.Err(err))
+			continue
+		}
+		queueDepth.Set(float64(len(refs)), destination)
+		oldest := now
+		for _, ref := range refs {
+			mail, err := qs.Storage.MailSelectMeta("Outbox", ref.ID)
+			if err != nil || mail == nil {
+				continue
+			}
+			if mail.Date.Before(oldest) {
+				oldest = mail.Date
+			}
+		}
+		queueOldest.Set(now.Sub(oldest).Seconds(), destination)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpsender
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/neilalexander/yggmail/internal/mdn"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// messageID returns the Message-ID of the mail, for the log.
+func messageID(content []byte) string {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return ""
+	}
+	return types.MessageID(hdr.Get("Message-Id"))
+}
+
+// receipt records that the remote node accepted the mail for the recipient,
+// if delivery receipts are on. Only the recipient's own node can tell us
+// that, so there are no receipts for mail that went through a gateway or
+// the smarthost, and none for automatic mail such as notifications, which
+// would otherwise be receipted in turn.
+func (q *Queue) receipt(ref types.QueuedMail, content []byte) error {
+	if !q.queues.Config.DeliveryReceipts || q.destination == SmarthostDestination || IsInternetAddress(ref.Rcpt) {
+		return nil
+	}
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return fmt.Errorf("textproto.ReadHeader: %w", err)
+	}
+	if auto := hdr.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(strings.SplitN(auto, ";", 2)[0], "no") {
+		return nil
+	}
+	id := types.MessageID(hdr.Get("Message-Id"))
+	if id == "" {
+		return nil
+	}
+	delivered := time.Now()
+	if err := q.queues.Storage.ReceiptInsert(id, ref.Rcpt, delivered); err != nil {
+		return fmt.Errorf("q.queues.Storage.ReceiptInsert: %w", err)
+	}
+	if !q.queues.Config.ReceiptMails {
+		return nil
+	}
+	subject := "Delivered: " + hdr.Get("Subject")
+	notification := &mdn.Notification{
+		From:      utils.CreateAddress(q.queues.Config.PublicKey),
+		To:        ref.From,
+		Recipient: ref.Rcpt,
+		Subject:   strings.TrimSpace(subject),
+		Text: fmt.Sprintf(
+			"Your mail to %s was delivered to their node at %s.\n\n"+
+				"This only means that it has arrived, not that it has been read.\n",
+			ref.Rcpt, delivered.Format(time.RFC1123Z),
+		),
+		Original: hdr,
+	}
+	receipt, err := notification.Mail()
+	if err != nil {
+		return fmt.Errorf("notification.Mail: %w", err)
+	}
+	if _, err := q.queues.Storage.MailCreate("INBOX", receipt); err != nil {
+		return fmt.Errorf("q.queues.Storage.MailCreate: %w", err)
+	}
+	return nil
+}
@@ -9,18 +9,25 @@
 package smtpsender
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/mail"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/logging"
 	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/types"
 	"github.com/neilalexander/yggmail/internal/transport"
 	"github.com/neilalexander/yggmail/internal/utils"
 	"go.uber.org/atomic"
@@ -28,20 +35,22 @@ import (
 
 type Queues struct {
 	Config    *config.Config
-	Log       *log.Logger
+	Log       *slog.Logger
 	Transport transport.Transport
 	Storage   storage.Storage
 	queues    sync.Map // servername -> *Queue
 }
 
-func NewQueues(config *config.Config, log *log.Logger, transport transport.Transport, storage storage.Storage) *Queues {
+func NewQueues(config *config.Config, log *slog.Logger, transport transport.Transport, storage storage.Storage) *Queues {
 	qs := &Queues{
 		Config:    config,
 		Log:       log,
 		Transport: transport,
 		Storage:   storage,
 	}
-	time.AfterFunc(time.Second*5, qs.manager)
+	if transport != nil {
+		time.AfterFunc(time.Second*5, qs.manager)
+	}
 	return qs
 }
 
@@ -56,6 +65,22 @@ func (qs *Queues) manager() {
 	time.AfterFunc(time.Minute, qs.manager)
 }
 
+// Flush tries to send the mail for every destination in the queue now,
+// rather than waiting for the next time that the queue is checked, and
+// returns the destinations.
+func (qs *Queues) Flush() ([]string, error) {
+	destinations, err := qs.Storage.QueueListDestinations()
+	if err != nil {
+		return nil, fmt.Errorf("qs.Storage.QueueListDestinations: %w", err)
+	}
+	for _, destination := range destinations {
+		if _, err := qs.queueFor(destination); err != nil {
+			return nil, fmt.Errorf("qs.queueFor: %w", err)
+		}
+	}
+	return destinations, nil
+}
+
 func (qs *Queues) QueueFor(from string, rcpts []string, content []byte) error {
 	pid, err := qs.Storage.MailCreate("Outbox", content)
 	if err != nil {
@@ -63,19 +88,32 @@ func (qs *Queues) QueueFor(from string, rcpts []string, content []byte) error {
 	}
 
 	for _, rcpt := range rcpts {
-		addr, err := mail.ParseAddress(rcpt)
-		if err != nil {
-			return fmt.Errorf("mail.ParseAddress: %w", err)
+		if IsInternetAddress(rcpt) {
+			host, err := qs.routeInternet(from, rcpt)
+			if err != nil {
+				return fmt.Errorf("qs.routeInternet: %w", err)
+			}
+			addr, _ := mail.ParseAddress(rcpt)
+			if err := qs.Storage.QueueInsertDestinationForID(host, pid, from, addr.Address); err != nil {
+				return fmt.Errorf("qs.Storage.QueueInsertDestinationForID: %w", err)
+			}
+			_, _ = qs.queueFor(host)
+			continue
 		}
-		pk, err := utils.ParseAddress(addr.Address)
+
+		pk, detail, err := qs.resolve(rcpt)
 		if err != nil {
-			return fmt.Errorf("parseAddress: %w", err)
+			return fmt.Errorf("qs.resolve: %w", err)
 		}
 		host := hex.EncodeToString(pk)
 		if host == hex.EncodeToString(qs.Config.PublicKey) {
 			continue
 		}
 
+		// Always queue using the canonical key-based address, since the
+		// remote side knows nothing about our address book petnames. Any
+		// sub-address tag is kept so that the remote side can use it.
+		rcpt := fmt.Sprintf("%s%s@%s", utils.EncodeKey(pk), detail, utils.Domain)
 		if err := qs.Storage.QueueInsertDestinationForID(host, pid, from, rcpt); err != nil {
 			return fmt.Errorf("qs.Storage.QueueInsertDestinationForID: %w", err)
 		}
@@ -86,7 +124,53 @@ func (qs *Queues) QueueFor(from string, rcpts []string, content []byte) error {
 	return nil
 }
 
+// resolve works out the public key and any sub-address detail for a
+// recipient. If the localpart isn't a public key already then it is looked
+// up in the address book, either by petname or by the display name of the
+// recipient.
+func (qs *Queues) resolve(rcpt string) (ed25519.PublicKey, string, error) {
+	addr, err := mail.ParseAddress(rcpt)
+	if err != nil {
+		return nil, "", fmt.Errorf("mail.ParseAddress: %w", err)
+	}
+	pk, detail, err := utils.ParseSubaddress(addr.Address, qs.Config.SubaddressSeparator)
+	if err == nil {
+		return pk, detail, nil
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if at <= 0 || addr.Address[at+1:] != utils.Domain {
+		return nil, "", fmt.Errorf("parseAddress: %w", err)
+	}
+	name := addr.Address[:at]
+	contact, cerr := qs.Storage.ContactSelect(name)
+	if sep := strings.Index(name, qs.Config.SubaddressSeparator); cerr == nil && contact == nil && sep > 0 {
+		contact, cerr = qs.Storage.ContactSelect(name[:sep])
+		detail = name[sep:]
+	}
+	if cerr == nil && contact == nil && addr.Name != "" {
+		contact, cerr = qs.Storage.ContactSelect(addr.Name)
+		detail = ""
+	}
+	switch {
+	case cerr != nil:
+		return nil, "", fmt.Errorf("qs.Storage.ContactSelect: %w", cerr)
+	case contact == nil:
+		return nil, "", fmt.Errorf("parseAddress: %w", err)
+	}
+	pk, err = utils.ParseKey(contact.Key)
+	if err != nil {
+		return nil, "", fmt.Errorf("contact %q has invalid key: %w", contact.Name, err)
+	}
+	return pk, detail, nil
+}
+
 func (qs *Queues) queueFor(server string) (*Queue, error) {
+	if qs.Transport == nil {
+		// Without a transport we can only leave the mail in the queue,
+		// i.e. from the command line, and the running instance will send
+		// it the next time that it checks the queue.
+		return nil, nil
+	}
 	v, _ := qs.queues.LoadOrStore(server, &Queue{
 		queues:      qs,
 		destination: server,
@@ -107,12 +191,16 @@ type Queue struct {
 	running     atomic.Bool
 }
 
+func (q *Queue) log() *slog.Logger {
+	return q.queues.Log.With("destination", q.destination)
+}
+
 func (q *Queue) run() {
 	defer q.running.Store(false)
 
 	refs, err := q.queues.Storage.QueueMailIDsForDestination(q.destination)
 	if err != nil {
-		q.queues.Log.Println("Error with queue:", err)
+		q.log().Error("Failed to read the queue", logging.Err(err))
 	}
 	defer q.queues.Storage.MailExpunge("Outbox") // nolint:errcheck
 
@@ -122,50 +210,74 @@ func (q *Queue) run() {
 			if errors.Is(err, sql.ErrNoRows) {
 				q.queues.Storage.QueueDeleteDestinationForID("Outbox", ref.ID)
 			} else {
-				q.queues.Log.Println("Failed to get mail", ref.ID, "due to error:", err)
+				q.log().Error("Failed to get queued mail", logging.MailID(ref.ID), logging.Err(err))
 			}
 			continue
 		}
 
-		q.queues.Log.Println("Sending mail from", ref.From, "to", q.destination)
+		log := q.log().With(
+			logging.MailID(ref.ID), "from", ref.From, "rcpt", ref.Rcpt,
+			logging.MessageID(messageID(mail.Mail)),
+		)
+		if q.expired(log, ref, mail.Mail) {
+			continue
+		}
+
+		log.Info("Sending mail")
+		deliveryAttempts.Inc()
 
+		// stage is the step that we got to, so that failures can be told
+		// apart in the metrics.
+		stage := "connect"
 		if err := func() error {
-			conn, err := q.queues.Transport.Dial(q.destination)
-			if err != nil {
-				return fmt.Errorf("q.queues.Transport.Dial: %w", err)
-			}
-			defer conn.Close()
-
-			client, err := smtp.NewClient(conn, q.destination)
+			client, err := q.connect(log)
 			if err != nil {
-				return fmt.Errorf("smtp.NewClient: %w", err)
+				return err
 			}
 			defer client.Close()
+			stage = "mail"
 
-			if err := client.Hello(hex.EncodeToString(q.queues.Config.PublicKey)); err != nil {
-				q.queues.Log.Println("Remote server", q.destination, "did not accept HELLO:", err)
-				return fmt.Errorf("client.Hello: %w", err)
+			from, content := ref.From, mail.Mail
+			if q.destination == SmarthostDestination {
+				if from, content, err = q.queues.rewriteForInternet(from, content); err != nil {
+					return fmt.Errorf("q.queues.rewriteForInternet: %w", err)
+				}
 			}
 
-			if err := client.Mail(ref.From, nil); err != nil {
-				q.queues.Log.Println("Remote server", q.destination, "did not accept MAIL:", err)
+			// Tell the remote server how large the mail is, so that it can
+			// turn it away straight away if it won't fit.
+			if err := client.Mail(from, &smtp.MailOptions{Size: len(content)}); err != nil {
+				log.Warn("Remote server did not accept MAIL", logging.Err(err))
 				return fmt.Errorf("client.Mail: %w", err)
 			}
 
+			stage = "rcpt"
 			if err := client.Rcpt(ref.Rcpt); err != nil {
-				q.queues.Log.Println("Remote server", q.destination, "did not accept RCPT:", err)
+				log.Warn("Remote server did not accept RCPT", logging.Err(err))
 				return fmt.Errorf("client.Rcpt: %w", err)
 			}
 
+			stage = "data"
 			writer, err := client.Data()
 			if err != nil {
 				return fmt.Errorf("client.Data: %w", err)
 			}
-			defer writer.Close()
-
-			if _, err := writer.Write(mail.Mail); err != nil {
+			if _, err := writer.Write(content); err != nil {
+				writer.Close()
 				return fmt.Errorf("writer.Write: %w", err)
 			}
+			// The remote server only accepts or rejects the mail once
+			// we have finished writing it.
+			if err := writer.Close(); err != nil {
+				log.Warn("Remote server did not accept DATA", logging.Err(err))
+				return fmt.Errorf("writer.Close: %w", err)
+			}
+			messagesSent.Inc(q.via())
+			stage = "dequeue"
+
+			if err := q.receipt(ref, content); err != nil {
+				log.Error("Failed to record delivery receipt", logging.Err(err))
+			}
 
 			if err := q.queues.Storage.QueueDeleteDestinationForID(q.destination, ref.ID); err != nil {
 				return fmt.Errorf("q.queues.Storage.QueueDeleteDestinationForID: %w", err)
@@ -179,10 +291,72 @@ func (q *Queue) run() {
 
 			return nil
 		}(); err != nil {
-			q.queues.Log.Println("Will retry sending to", q.destination, "later due to error:", err)
-			// TODO: Send a mail to the inbox on the first instance?
+			deliveryFailures.Inc(stage, errorClass(err))
+			var serr *smtp.SMTPError
+			if !errors.As(err, &serr) || serr.Code < 500 {
+				log.Warn("Will retry sending later", logging.Err(err))
+				continue
+			}
+			log.Warn("Giving up sending", logging.Err(err))
+			if err := q.bounce(ref, mail.Mail, serr); err != nil {
+				log.Error("Failed to return mail to sender", logging.Err(err))
+			}
 		} else {
-			q.queues.Log.Println("Sent mail from", ref.From, "to", q.destination)
+			log.Info("Sent mail")
 		}
 	}
 }
+
+// expired drops the mail from the queue for this destination without
+// sending it if the sender gave it a lifetime that has passed.
+func (q *Queue) expired(log *slog.Logger, ref types.QueuedMail, content []byte) bool {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return false
+	}
+	expires, ok := types.Expires(hdr)
+	if !ok || time.Now().Before(expires) {
+		return false
+	}
+	log.Info("Dropping mail that has expired", "expires", expires)
+	if err := q.queues.Storage.QueueDeleteDestinationForID(q.destination, ref.ID); err != nil {
+		log.Error("Failed to drop expired mail", logging.Err(err))
+		return true
+	}
+	if remaining, err := q.queues.Storage.QueueSelectIsMessagePendingSend("Outbox", ref.ID); err == nil && !remaining {
+		if err := q.queues.Storage.MailDelete("Outbox", ref.ID); err != nil {
+			log.Error("Failed to drop expired mail", logging.Err(err))
+		}
+	}
+	return true
+}
+
+// connect opens an SMTP session with the destination, which is either a
+// remote Yggmail node or the smarthost.
+func (q *Queue) connect(log *slog.Logger) (*smtp.Client, error) {
+	if q.destination == SmarthostDestination {
+		client, err := q.queues.dialSmarthost()
+		if err != nil {
+			return nil, fmt.Errorf("q.queues.dialSmarthost: %w", err)
+		}
+		return client, nil
+	}
+
+	conn, err := q.queues.Transport.Dial(q.destination)
+	if err != nil {
+		return nil, fmt.Errorf("q.queues.Transport.Dial: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, q.destination)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp.NewClient: %w", err)
+	}
+
+	if err := client.Hello(hex.EncodeToString(q.queues.Config.PublicKey)); err != nil {
+		log.Warn("Remote server did not accept HELLO", logging.Err(err))
+		client.Close()
+		return nil, fmt.Errorf("client.Hello: %w", err)
+	}
+	return client, nil
+}
@@ -11,11 +11,14 @@ package smtpserver
 import (
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/emersion/go-smtp"
 	"github.com/neilalexander/yggmail/internal/config"
 	"github.com/neilalexander/yggmail/internal/imapserver"
+	"github.com/neilalexander/yggmail/internal/listserver"
+	"github.com/neilalexander/yggmail/internal/lockout"
+	"github.com/neilalexander/yggmail/internal/logging"
 	"github.com/neilalexander/yggmail/internal/smtpsender"
 	"github.com/neilalexander/yggmail/internal/storage"
 	"github.com/neilalexander/yggmail/internal/utils"
@@ -26,43 +29,87 @@ type BackendMode int
 const (
 	BackendModeInternal BackendMode = iota
 	BackendModeExternal
+	BackendModeGateway
 )
 
+func (m BackendMode) String() string {
+	switch m {
+	case BackendModeInternal:
+		return "local"
+	case BackendModeExternal:
+		return "overlay"
+	case BackendModeGateway:
+		return "gateway"
+	default:
+		return "unknown"
+	}
+}
+
 type Backend struct {
 	Mode    BackendMode
-	Log     *log.Logger
+	Log     *slog.Logger
 	Config  *config.Config
 	Queues  *smtpsender.Queues
 	Storage storage.Storage
 	Notify  *imapserver.IMAPNotify
+	List    *listserver.List // if set, incoming mail is for a mailing list
+	Lockout *lockout.Lockout // shared with the other listeners that check the password
 }
 
 func (b *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
 	switch b.Mode {
 	case BackendModeInternal:
+		log := b.Log.With("remote", remoteAddr(state), "username", username)
+		var source string
+		if state != nil {
+			source = lockout.Source(state.RemoteAddr)
+		}
+		if err := b.Lockout.Check(source); err != nil {
+			log.Warn("Refused SMTP login from banned source")
+			smtpAuthFailures.Inc()
+			return nil, &smtp.SMTPError{
+				Code:         454,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      err.Error(),
+			}
+		}
 		// If our username is email-like, then take just the localpart
-		if pk, err := utils.ParseAddress(username); err == nil {
+		if pk, err := utils.ParseAddress(username, b.Config.SubaddressSeparator); err == nil {
 			if !pk.Equal(b.Config.PublicKey) {
+				log.Warn("Failed to authenticate SMTP user due to wrong domain", logging.Peer(pk))
+				smtpAuthFailures.Inc()
+				b.Lockout.Failed(source)
 				return nil, fmt.Errorf("failed to authenticate: wrong domain in username")
 			}
 		}
-		username = hex.EncodeToString(b.Config.PublicKey)
 		// The connection came from our local listener
 		if authed, err := b.Storage.ConfigTryPassword(password); err != nil {
-			b.Log.Printf("Failed to authenticate SMTP user %q due to error: %s", username, err)
+			log.Warn("Failed to authenticate SMTP user", logging.Err(err))
+			smtpAuthFailures.Inc()
+			// A wrong password is also an error from bcrypt.
+			b.Lockout.Failed(source)
 			return nil, fmt.Errorf("failed to authenticate: %w", err)
 		} else if !authed {
-			b.Log.Printf("Failed to authenticate SMTP user %q\n", username)
+			log.Warn("Failed to authenticate SMTP user")
+			smtpAuthFailures.Inc()
+			b.Lockout.Failed(source)
 			return nil, smtp.ErrAuthRequired
 		}
-		defer b.Log.Printf("Authenticated SMTP user from %s as %q\n", state.RemoteAddr.String(), username)
+		b.Lockout.Succeeded(source)
+		log = b.Log.With(logging.Session(logging.NewSessionID()), "remote", remoteAddr(state))
+		log.Info("Authenticated SMTP user")
+		sessionStarted(b.Mode)
 		return &SessionLocal{
 			backend: b,
+			log:     log,
 			state:   state,
 		}, nil
 
 	case BackendModeExternal:
 		return nil, fmt.Errorf("Not expecting authenticated connection on external backend")
+
+	case BackendModeGateway:
+		return nil, fmt.Errorf("Not expecting authenticated connection on gateway backend")
 	}
 
 	return nil, fmt.Errorf("Authenticated login failed")
@@ -85,13 +132,37 @@ func (b *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, err
 			return nil, fmt.Errorf("You are not who you claim to be")
 		}
 
-		b.Log.Println("Incoming SMTP session from", remote)
+		log := b.Log.With(logging.Session(logging.NewSessionID()), logging.Peer(pks))
+		log.Info("Incoming SMTP session")
+		sessionStarted(b.Mode)
 		return &SessionRemote{
 			backend: b,
+			log:     log,
 			state:   state,
 			public:  pks[:],
 		}, nil
+
+	case BackendModeGateway:
+		// The connection came from the Internet, so there is nothing that
+		// we can check about who they are
+		log := b.Log.With(logging.Session(logging.NewSessionID()), "remote", remoteAddr(state))
+		log.Info("Incoming gateway SMTP session")
+		sessionStarted(b.Mode)
+		return &SessionGateway{
+			backend: b,
+			log:     log,
+			state:   state,
+		}, nil
 	}
 
 	return nil, fmt.Errorf("Anonymous login failed")
 }
+
+// remoteAddr is where the connection came from, which is only known when
+// there is a connection.
+func remoteAddr(state *smtp.ConnectionState) string {
+	if state == nil || state.RemoteAddr == nil {
+		return ""
+	}
+	return state.RemoteAddr.String()
+}
@@ -0,0 +1,95 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/neilalexander/yggmail/internal/mdn"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// dispositionNotification applies the MDN policy to a mail that asks for a
+// message disposition notification. The request is taken out of the mail
+// unless it is left for the mail client to ask about, and if we are to
+// send one straight away then the notification is returned, to be sent
+// once the mail has been stored.
+func (s *SessionRemote) dispositionNotification(m *message.Entity) *mdn.Notification {
+	if s.backend.List != nil || len(s.rcpts) == 0 || !m.Header.Has(mdn.Header) {
+		return nil
+	}
+	if s.backend.Config.MDNPolicy == mdn.PolicyNever {
+		m.Header.Del(mdn.Header)
+		return nil
+	}
+	if s.backend.Config.MDNPolicy != mdn.PolicyAlways {
+		return nil
+	}
+	if reason := s.shouldNotNotify(m); reason != "" {
+		// RFC 3798 says that we mustn't send a notification without asking
+		// in some of these cases, so the mail client is left to ask.
+		s.mailLog().Info("Not sending disposition notification", "reason", reason)
+		return nil
+	}
+	original := m.Header.Header.Copy()
+	m.Header.Del(mdn.Header)
+	return &mdn.Notification{
+		From:      utils.CreateAddress(s.backend.Config.PublicKey),
+		To:        s.from,
+		Recipient: s.rcpts[0],
+		Subject:   strings.TrimSpace("Delivered: " + m.Header.Get("Subject")),
+		Text: fmt.Sprintf(
+			"Your mail to %s has been delivered.\n\n"+
+				"This only means that it has arrived, not that it has been read.\n",
+			s.rcpts[0],
+		),
+		Original: original,
+	}
+}
+
+// shouldNotNotify returns the reason for not sending a disposition
+// notification for the mail straight away, or an empty string if it is
+// fine to.
+func (s *SessionRemote) shouldNotNotify(m *message.Entity) string {
+	if s.public.Equal(s.backend.Config.PublicKey) {
+		return "mail is from ourselves"
+	}
+	// The notification must only go back to the sender, or else anyone
+	// could have us send mail to somebody else.
+	to, err := mail.ParseAddressList(m.Header.Get(mdn.Header))
+	if err != nil || len(to) != 1 {
+		return "notification is not requested for a single address"
+	}
+	if pk, err := utils.ParseAddress(to[0].Address, s.backend.Config.SubaddressSeparator); err != nil || !pk.Equal(s.public) {
+		return "notification is requested for someone other than the sender"
+	}
+	if auto := m.Header.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(strings.SplitN(auto, ";", 2)[0], "no") {
+		return "message was automatically submitted"
+	}
+	if t, _, _ := m.Header.ContentType(); strings.EqualFold(t, "multipart/report") {
+		return "message is a report"
+	}
+	return ""
+}
+
+// sendDispositionNotification queues the notification to the sender.
+func (s *SessionRemote) sendDispositionNotification(n *mdn.Notification) error {
+	data, err := n.Mail()
+	if err != nil {
+		return fmt.Errorf("n.Mail: %w", err)
+	}
+	if err := s.backend.Queues.QueueFor(n.From, []string{n.To}, data); err != nil {
+		return fmt.Errorf("s.backend.Queues.QueueFor: %w", err)
+	}
+	s.mailLog().Info("Sent disposition notification")
+	return nil
+}
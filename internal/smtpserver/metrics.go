@@ -0,0 +1,30 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import "github.com/neilalexander/yggmail/internal/metrics"
+
+var (
+	smtpSessions      = metrics.NewCounter("yggmail_smtp_sessions_total", "SMTP sessions started, by the listener that they came in on.", "listener")
+	smtpSessionsOpen  = metrics.NewGauge("yggmail_smtp_sessions", "SMTP sessions that are open now, by the listener that they came in on.", "listener")
+	smtpAuthFailures  = metrics.NewCounter("yggmail_smtp_auth_failures_total", "Failed SMTP logins on the local listener.")
+	messagesReceived  = metrics.NewCounter("yggmail_messages_received_total", "Mails accepted from others, by whether they came over Yggdrasil or through the gateway.", "via")
+	messagesSubmitted = metrics.NewCounter("yggmail_messages_submitted_total", "Mails accepted from our own mail client to be sent.")
+)
+
+// sessionStarted counts a new session on the listener for the given mode.
+// The session must call sessionEnded when it logs out.
+func sessionStarted(mode BackendMode) {
+	smtpSessions.Inc(mode.String())
+	smtpSessionsOpen.Add(1, mode.String())
+}
+
+func sessionEnded(mode BackendMode) {
+	smtpSessionsOpen.Add(-1, mode.String())
+}
@@ -0,0 +1,75 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/quota"
+)
+
+// checkQuota returns an SMTP error if a mail of the given size doesn't fit
+// into the mailbox. If the mail is larger than the quota then it will never
+// fit and the sender should give up, otherwise the sender should try again
+// later, when we might have made some room.
+func (s *SessionRemote) checkQuota(mailbox string, size int64) error {
+	err := quota.Check(s.backend.Config, s.backend.Storage, mailbox, size)
+	var qerr *quota.Error
+	switch {
+	case err == nil:
+		return nil
+	case !errors.As(err, &qerr):
+		return fmt.Errorf("quota.Check: %w", err)
+	case qerr.Permanent():
+		s.mailLog().Info("Rejected mail larger than the quota", logging.Err(err))
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Message is larger than the recipient's quota",
+		}
+	default:
+		s.mailLog().Info("Deferred mail", logging.Mailbox(mailbox), logging.Err(err))
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+			Message:      "Mailbox full, try again later",
+		}
+	}
+}
+
+// warnQuota puts a warning into INBOX for each quota that the mailbox is
+// under that has filled up past the warning level.
+func (s *SessionRemote) warnQuota(mailbox string) {
+	roots, err := quota.Warnings(s.backend.Config, s.backend.Storage, mailbox)
+	if err != nil {
+		s.mailLog().Error("Failed to check quota warnings", logging.Err(err))
+		return
+	}
+	for _, root := range roots {
+		data, err := quota.WarningMail(s.backend.Config, root)
+		if err != nil {
+			s.mailLog().Error("Failed to create quota warning", logging.Err(err))
+			continue
+		}
+		id, err := s.backend.Storage.MailCreate("INBOX", data)
+		if err != nil {
+			s.mailLog().Error("Failed to store quota warning", logging.Err(err))
+			continue
+		}
+		s.mailLog().Warn("Quota is nearly full", "quota_root", root.Name, "percent", root.Percent())
+		if count, err := s.backend.Storage.MailCount("INBOX"); err == nil {
+			if err := s.backend.Notify.NotifyNew("INBOX", id, count); err != nil {
+				s.mailLog().Error("Failed to notify", logging.Err(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// SessionGateway is a session from a regular Internet mail server to our
+// gateway listener. Nothing about the sender can be authenticated, so the
+// mail is marked as such before it is passed on to the mapped keys.
+type SessionGateway struct {
+	backend *Backend
+	log     *slog.Logger
+	state   *smtp.ConnectionState
+	from    string
+	rcpts   []ed25519.PublicKey
+}
+
+func (s *SessionGateway) Mail(from string, opts smtp.MailOptions) error {
+	if from != "" && !smtpsender.IsInternetAddress(from) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Mail from Yggmail addresses must be sent over Yggdrasil",
+		}
+	}
+	s.from = from
+	s.rcpts = s.rcpts[:0]
+	return nil
+}
+
+func (s *SessionGateway) Rcpt(to string) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("mail.ParseAddress: %w", err)
+	}
+	mapping, err := s.backend.Storage.GatewaySelect(addr.Address)
+	if err != nil {
+		return fmt.Errorf("s.backend.Storage.GatewaySelect: %w", err)
+	} else if mapping == nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+		}
+	}
+	pk, err := utils.ParseKey(mapping.Key)
+	if err != nil {
+		return fmt.Errorf("utils.ParseKey: %w", err)
+	}
+	s.rcpts = append(s.rcpts, pk)
+	return nil
+}
+
+func (s *SessionGateway) Data(r io.Reader) (err error) {
+	defer func() {
+		if err == nil {
+			messagesReceived.Inc("gateway")
+		}
+	}()
+	m, err := message.Read(r)
+	if err != nil {
+		return fmt.Errorf("message.Read: %w", err)
+	}
+	log := s.log.With("from", s.from, logging.MessageID(types.MessageID(m.Header.Get("Message-Id"))))
+
+	// Only we get to say that mail came through the gateway.
+	m.Header.Del(smtpsender.GatewayHeader)
+	m.Header.Add(
+		smtpsender.GatewayHeader, fmt.Sprintf("inbound; from=<%s>; unauthenticated", s.from),
+	)
+	m.Header.Add(
+		"Received", fmt.Sprintf("from %s (%s) by Yggmail gateway %s; %s",
+			s.state.Hostname, s.state.RemoteAddr.String(),
+			hex.EncodeToString(s.backend.Config.PublicKey),
+			time.Now().String(),
+		),
+	)
+
+	var b bytes.Buffer
+	if err := m.WriteTo(&b); err != nil {
+		return fmt.Errorf("m.WriteTo: %w", err)
+	}
+
+	self := utils.CreateAddress(s.backend.Config.PublicKey)
+	var remote []string
+	for _, pk := range s.rcpts {
+		if !pk.Equal(s.backend.Config.PublicKey) {
+			remote = append(remote, utils.CreateAddress(pk))
+			continue
+		}
+		id, err := s.backend.Storage.MailCreate("INBOX", b.Bytes())
+		if err != nil {
+			return fmt.Errorf("s.backend.Storage.MailCreate: %w", err)
+		}
+		log.Info("Stored new mail", logging.Mailbox("INBOX"), logging.MailID(id))
+		if count, err := s.backend.Storage.MailCount("INBOX"); err == nil {
+			if err := s.backend.Notify.NotifyNew("INBOX", id, count); err != nil {
+				log.Error("Failed to notify", logging.Err(err))
+			}
+		}
+	}
+	if len(remote) > 0 {
+		// The mail is sent on from our own key, so that the recipients
+		// can see that it came through this gateway.
+		if err := s.backend.Queues.QueueFor(self, remote, b.Bytes()); err != nil {
+			return fmt.Errorf("s.backend.Queues.QueueFor: %w", err)
+		}
+		log.Info("Queued mail for Yggmail recipients", "rcpts", len(remote))
+	}
+	return nil
+}
+
+func (s *SessionGateway) Reset() {
+	s.from = ""
+	s.rcpts = s.rcpts[:0]
+}
+
+func (s *SessionGateway) Logout() error {
+	sessionEnded(s.backend.Mode)
+	return nil
+}
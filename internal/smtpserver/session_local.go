@@ -13,15 +13,19 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"time"
 
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/storage/types"
 	"github.com/neilalexander/yggmail/internal/utils"
 )
 
 type SessionLocal struct {
 	backend *Backend
+	log     *slog.Logger
 	state   *smtp.ConnectionState
 	from    string
 	rcpt    []string
@@ -30,7 +34,7 @@ type SessionLocal struct {
 func (s *SessionLocal) Mail(from string, opts smtp.MailOptions) error {
 	s.rcpt = s.rcpt[:0]
 
-	pk, err := utils.ParseAddress(from)
+	pk, err := utils.ParseAddress(from, s.backend.Config.SubaddressSeparator)
 	if err != nil {
 		return fmt.Errorf("parseAddress: %w", err)
 	}
@@ -39,7 +43,8 @@ func (s *SessionLocal) Mail(from string, opts smtp.MailOptions) error {
 		return fmt.Errorf("not allowed to send outgoing mail as %s", from)
 	}
 
-	s.from = from
+	// Always use the canonical form of our address on the wire.
+	s.from = utils.CreateAddress(pk)
 	return nil
 }
 
@@ -76,7 +81,8 @@ func (s *SessionLocal) Data(r io.Reader) error {
 		return fmt.Errorf("s.backend.Queues.QueueFor: %w", err)
 	}
 
-	s.backend.Log.Println("Queued mail for", s.rcpt)
+	s.log.Info("Queued mail", "from", s.from, "rcpt", s.rcpt, logging.MessageID(types.MessageID(m.Header.Get("Message-Id"))))
+	messagesSubmitted.Inc()
 
 	return nil
 }
@@ -87,5 +93,6 @@ func (s *SessionLocal) Reset() {
 }
 
 func (s *SessionLocal) Logout() error {
+	sessionEnded(s.backend.Mode)
 	return nil
 }
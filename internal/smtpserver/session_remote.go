@@ -14,22 +14,40 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/quota"
+	"github.com/neilalexander/yggmail/internal/sieve"
+	"github.com/neilalexander/yggmail/internal/smtpsender"
+	"github.com/neilalexander/yggmail/internal/storage/types"
 	"github.com/neilalexander/yggmail/internal/utils"
 )
 
 type SessionRemote struct {
-	backend *Backend
-	state   *smtp.ConnectionState
-	public  ed25519.PublicKey
-	from    string
+	backend   *Backend
+	log       *slog.Logger
+	state     *smtp.ConnectionState
+	public    ed25519.PublicKey
+	from      string
+	rcpts     []string
+	tags      []string
+	relay     []string // Internet recipients, if we are a gateway
+	messageID string   // of the mail being received, for the log
+}
+
+// mailLog returns the session's log with the mail that is being received.
+func (s *SessionRemote) mailLog() *slog.Logger {
+	return s.log.With("from", s.from, logging.MessageID(s.messageID))
 }
 
 func (s *SessionRemote) Mail(from string, opts smtp.MailOptions) error {
-	pk, err := utils.ParseAddress(from)
+	pk, err := utils.ParseAddress(from, s.backend.Config.SubaddressSeparator)
 	if err != nil {
 		return fmt.Errorf("mail.ParseAddress: %w", err)
 	}
@@ -38,12 +56,27 @@ func (s *SessionRemote) Mail(from string, opts smtp.MailOptions) error {
 		return fmt.Errorf("not allowed to send incoming mail as %s", from)
 	}
 
+	// If the sender told us how large the mail is, then we can turn it
+	// away before it is sent if it won't fit.
+	if opts.Size > 0 && s.backend.List == nil {
+		if err := s.checkQuota(quota.AccountRoot, int64(opts.Size)); err != nil {
+			return err
+		}
+	}
+
 	s.from = from
+	s.rcpts = s.rcpts[:0]
+	s.tags = s.tags[:0]
+	s.relay = s.relay[:0]
 	return nil
 }
 
 func (s *SessionRemote) Rcpt(to string) error {
-	pk, err := utils.ParseAddress(to)
+	if smtpsender.IsInternetAddress(to) {
+		return s.rcptRelay(to)
+	}
+
+	pk, detail, err := utils.ParseSubaddress(to, s.backend.Config.SubaddressSeparator)
 	if err != nil {
 		return fmt.Errorf("mail.ParseAddress: %w", err)
 	}
@@ -52,14 +85,41 @@ func (s *SessionRemote) Rcpt(to string) error {
 		return fmt.Errorf("unexpected recipient for wrong domain")
 	}
 
+	s.rcpts = append(s.rcpts, to)
+	if len(detail) > 1 {
+		tag := detail[1:]
+		for _, t := range s.tags {
+			if t == tag {
+				return nil
+			}
+		}
+		s.tags = append(s.tags, tag)
+	}
+
 	return nil
 }
 
-func (s *SessionRemote) Data(r io.Reader) error {
+func (s *SessionRemote) Data(r io.Reader) (err error) {
+	defer func() {
+		if err == nil {
+			messagesReceived.Inc("overlay")
+		}
+	}()
 	m, err := message.Read(r)
 	if err != nil {
 		return fmt.Errorf("message.Read: %w", err)
 	}
+	s.messageID = types.MessageID(m.Header.Get("Message-Id"))
+
+	// Mail that expired on the way isn't kept at all, since it would only
+	// be deleted again straight away.
+	if expires, ok := types.Expires(m.Header.Header); ok && time.Now().After(expires) {
+		s.mailLog().Info("Discarded new mail that has expired", "expires", expires)
+		return nil
+	}
+
+	notification := s.dispositionNotification(m)
+	s.fillDisplayName(m)
 
 	m.Header.Add(
 		"Received", fmt.Sprintf("from Yggmail %s; %s",
@@ -70,29 +130,251 @@ func (s *SessionRemote) Data(r io.Reader) error {
 	m.Header.Add(
 		"Delivery-Date", time.Now().UTC().Format(time.RFC822),
 	)
+	for _, tag := range s.tags {
+		m.Header.Add("X-Yggmail-Tag", tag)
+	}
 
 	var b bytes.Buffer
 	if err := m.WriteTo(&b); err != nil {
 		return fmt.Errorf("m.WriteTo: %w", err)
 	}
 
-	if id, err := s.backend.Storage.MailCreate("INBOX", b.Bytes()); err != nil {
+	if s.backend.List != nil {
+		return s.backend.List.Receive(s.public, s.tags, b.Bytes())
+	}
+
+	// Run the Sieve script and check the quota of every mailbox that the
+	// mail is going into before relaying, storing, redirecting or replying,
+	// so that nothing happens to mail that we then turn away. The sender
+	// would only send it again, and we would do it all again too.
+	size := int64(b.Len())
+	var msg *sieve.Message
+	var result *sieve.Result
+	var mailboxes []string
+	if len(s.rcpts) > 0 {
+		if err := s.checkQuota(quota.AccountRoot, size); err != nil {
+			return err
+		}
+		if msg, result, err = s.filter(b.Bytes()); err != nil {
+			return err
+		}
+		mailboxes = make([]string, len(result.Deliveries))
+		for i, delivery := range result.Deliveries {
+			mailboxes[i] = s.mailboxForDelivery(delivery)
+			if err := s.checkQuota(mailboxes[i], size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(s.relay) > 0 {
+		if err := s.backend.Queues.QueueFor(s.from, s.relay, b.Bytes()); err != nil {
+			return fmt.Errorf("s.backend.Queues.QueueFor: %w", err)
+		}
+		s.mailLog().Info("Relaying mail to Internet recipients", "rcpts", len(s.relay))
+		if len(s.rcpts) == 0 {
+			return nil
+		}
+	}
+
+	if len(mailboxes) == 0 {
+		s.mailLog().Info("Discarded new mail")
+	}
+	for i, delivery := range result.Deliveries {
+		if err := s.store(mailboxes[i], delivery, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	s.act(msg, result, b.Bytes())
+	for _, mailbox := range mailboxes {
+		s.warnQuota(mailbox)
+	}
+	if notification != nil && len(mailboxes) > 0 {
+		if err := s.sendDispositionNotification(notification); err != nil {
+			s.mailLog().Error("Failed to send disposition notification", logging.Err(err))
+		}
+	}
+
+	return nil
+}
+
+// mailboxForDelivery returns the mailbox that a Sieve delivery should be
+// filed into, creating it if the script asked us to.
+func (s *SessionRemote) mailboxForDelivery(delivery sieve.Delivery) string {
+	mailbox := delivery.Mailbox
+	switch {
+	case mailbox == "":
+		mailbox = s.mailboxFor()
+	case strings.EqualFold(mailbox, "INBOX"), mailbox == "Outbox":
+		mailbox = "INBOX"
+	default:
+		if ok, err := s.backend.Storage.MailboxSelect(mailbox); err != nil {
+			s.mailLog().Error("Failed to look up mailbox, filing into INBOX instead", logging.Mailbox(mailbox), logging.Err(err))
+			mailbox = "INBOX"
+			break
+		} else if ok {
+			break
+		}
+		if !delivery.Create {
+			s.mailLog().Warn("Mailbox does not exist, filing into INBOX instead", logging.Mailbox(mailbox))
+			mailbox = "INBOX"
+		} else if err := s.backend.Storage.MailboxCreate(mailbox); err != nil {
+			s.mailLog().Error("Failed to create mailbox, filing into INBOX instead", logging.Mailbox(mailbox), logging.Err(err))
+			mailbox = "INBOX"
+		}
+	}
+	return mailbox
+}
+
+func (s *SessionRemote) store(mailbox string, delivery sieve.Delivery, data []byte) error {
+	id, err := s.backend.Storage.MailCreate(mailbox, data)
+	if err != nil {
 		return fmt.Errorf("s.backend.Storage.StoreMessageFor: %w", err)
-	} else {
-		s.backend.Log.Printf("Stored new mail from %s", s.from)
+	}
+	s.mailLog().Info("Stored new mail", logging.Mailbox(mailbox), logging.MailID(id))
 
-		if count, err := s.backend.Storage.MailCount("INBOX"); err == nil {
-			if err := s.backend.Notify.NotifyNew(id, count); err != nil {
-				s.backend.Log.Println("Failed to notify:", s.from)
+	if len(delivery.Flags) > 0 {
+		var seen, answered, flagged, deleted bool
+		for _, flag := range delivery.Flags {
+			switch strings.ToLower(flag) {
+			case "\\seen":
+				seen = true
+			case "\\answered":
+				answered = true
+			case "\\flagged":
+				flagged = true
+			case "\\deleted":
+				deleted = true
 			}
 		}
+		if err := s.backend.Storage.MailUpdateFlags(
+			mailbox, id, seen, answered, flagged, deleted,
+		); err != nil {
+			s.mailLog().Error("Failed to set flags", logging.Mailbox(mailbox), logging.MailID(id), logging.Err(err))
+		}
 	}
 
+	if count, err := s.backend.Storage.MailCount(mailbox); err == nil {
+		if err := s.backend.Notify.NotifyNew(mailbox, id, count); err != nil {
+			s.mailLog().Error("Failed to notify", logging.Err(err))
+		}
+	}
 	return nil
 }
 
-func (s *SessionRemote) Reset() {}
+// Tags are chosen by whoever sends the mail, so only short and simple ones
+// become mailbox names, and only so many mailboxes are created for them.
+const (
+	maxTagLength       = 32
+	maxTaggedMailboxes = 100 // of all mailboxes together, before no more are created
+)
+
+// validTag returns true if the tag can be used as a mailbox name, which
+// rules out the "/" hierarchy separator, control characters and anything
+// that a mail client might struggle with.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength || tag[0] == '.' {
+		return false
+	}
+	for _, c := range tag {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("._-", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// mailboxFor returns the mailbox that the mail should be filed into, which
+// is INBOX unless the mail was sent to a tagged sub-address and filing
+// into sub-address folders is enabled.
+func (s *SessionRemote) mailboxFor() string {
+	if !s.backend.Config.SubaddressFolders || len(s.tags) == 0 {
+		return "INBOX"
+	}
+	name := s.tags[0]
+	if !validTag(name) || strings.EqualFold(name, "INBOX") || name == "Outbox" {
+		return "INBOX"
+	}
+	if ok, err := s.backend.Storage.MailboxSelect(name); err != nil {
+		s.mailLog().Error("Failed to look up mailbox for tagged mail", logging.Mailbox(name), logging.Err(err))
+		return "INBOX"
+	} else if ok {
+		return name
+	}
+	if !s.backend.Config.SubaddressCreateFolders {
+		return "INBOX"
+	}
+	if mailboxes, err := s.backend.Storage.MailboxList(false); err != nil {
+		s.mailLog().Error("Failed to list mailboxes", logging.Err(err))
+		return "INBOX"
+	} else if len(mailboxes) >= maxTaggedMailboxes {
+		s.mailLog().Warn("Not creating mailbox for tagged mail, there are too many mailboxes", logging.Mailbox(name), "mailboxes", len(mailboxes))
+		return "INBOX"
+	}
+	if err := s.backend.Storage.MailboxCreate(name); err != nil {
+		s.mailLog().Error("Failed to create mailbox for tagged mail", logging.Mailbox(name), logging.Err(err))
+		return "INBOX"
+	}
+	return name
+}
+
+// fillDisplayName sets the display name in the From header if the sender
+// is in our address book and didn't supply a display name themselves.
+func (s *SessionRemote) fillDisplayName(m *message.Entity) {
+	contact, err := s.backend.Storage.ContactSelectByKey(hex.EncodeToString(s.public))
+	if err != nil || contact == nil {
+		return
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil || from.Name != "" {
+		return
+	}
+	if pk, err := utils.ParseAddress(from.Address, s.backend.Config.SubaddressSeparator); err != nil || !pk.Equal(s.public) {
+		return
+	}
+	from.Name = contact.DisplayName
+	if from.Name == "" {
+		from.Name = contact.Name
+	}
+	m.Header.Set("From", from.String())
+}
+
+// rcptRelay accepts an Internet recipient if we are a gateway and the
+// sender has an Internet address on this gateway, since otherwise we
+// would be an open relay.
+func (s *SessionRemote) rcptRelay(to string) error {
+	if s.backend.Config.Smarthost == nil || s.backend.List != nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "This node is not a gateway to Internet mail",
+		}
+	}
+	mapping, err := s.backend.Storage.GatewaySelectByKey(hex.EncodeToString(s.public))
+	if err != nil {
+		return fmt.Errorf("s.backend.Storage.GatewaySelectByKey: %w", err)
+	} else if mapping == nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Relaying denied, you have no Internet address on this gateway",
+		}
+	}
+	s.relay = append(s.relay, to)
+	return nil
+}
+
+func (s *SessionRemote) Reset() {
+	s.messageID = ""
+	s.rcpts = nil
+	s.tags = s.tags[:0]
+	s.relay = s.relay[:0]
+}
 
 func (s *SessionRemote) Logout() error {
+	sessionEnded(s.backend.Mode)
 	return nil
 }
@@ -0,0 +1,127 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/neilalexander/yggmail/internal/config"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/sieve"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// filter runs the active Sieve script, if there is one, and returns what
+// it decided, including the mailboxes that the mail should be delivered
+// into. Nothing is sent from here, so that the mail can still be turned
+// away afterwards, i.e. for being over quota. If there is no script, or the
+// script fails, then the mail is kept as normal. An error is only returned
+// if the script rejected the mail.
+func (s *SessionRemote) filter(data []byte) (*sieve.Message, *sieve.Result, error) {
+	keep := &sieve.Result{Deliveries: []sieve.Delivery{{}}}
+
+	msg, err := sieve.NewMessage(s.from, s.rcpts, data)
+	if err != nil {
+		s.mailLog().Warn("Failed to parse mail for Sieve, keeping mail", logging.Err(err))
+		return nil, keep, nil
+	}
+	result := s.runScript(msg)
+	if result == nil {
+		result = keep
+	}
+
+	if result.Rejected {
+		s.mailLog().Info("Rejected new mail by Sieve script")
+		reason := strings.Join(strings.Fields(result.Reject), " ")
+		if reason == "" {
+			reason = "Message rejected by recipient"
+		}
+		return nil, nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      reason,
+		}
+	}
+	return msg, result, nil
+}
+
+// act sends the redirects and the automatic reply that the Sieve script
+// asked for. It is only called once the mail has been stored, since the
+// sender would send the mail again if we turned it away, and these would
+// then be sent again too.
+func (s *SessionRemote) act(msg *sieve.Message, result *sieve.Result, data []byte) {
+	if msg == nil {
+		return
+	}
+	self := utils.CreateAddress(s.backend.Config.PublicKey)
+	for _, rcpt := range result.Redirects {
+		if err := s.backend.Queues.QueueFor(self, []string{rcpt}, data); err != nil {
+			s.mailLog().Error("Failed to redirect mail", "rcpt", rcpt, logging.Err(err))
+		}
+	}
+
+	// A vacation action in the script takes priority over the configured
+	// auto-reply, and we don't auto-reply to mail that was discarded.
+	vacation := result.Vacation
+	if vacation == nil && len(result.Deliveries) > 0 {
+		vacation = s.autoReply()
+	}
+	if vacation != nil {
+		if err := s.vacation(msg, vacation); err != nil {
+			s.mailLog().Error("Failed to send automatic reply", logging.Err(err))
+		}
+	}
+}
+
+// runScript runs the active Sieve script against the message. It returns
+// nil if there is no active script or if the script failed, in which case
+// the mail should be kept.
+func (s *SessionRemote) runScript(msg *sieve.Message) *sieve.Result {
+	active, err := s.backend.Storage.SieveSelectActive()
+	if err != nil {
+		s.mailLog().Error("Failed to load Sieve script, keeping mail", logging.Err(err))
+		return nil
+	} else if active == nil {
+		return nil
+	}
+	script, err := sieve.Parse(active.Script)
+	if err != nil {
+		s.mailLog().Warn("Failed to parse Sieve script, keeping mail", "script", active.Name, logging.Err(err))
+		return nil
+	}
+	result, err := script.Execute(msg)
+	if err != nil {
+		s.mailLog().Warn("Failed to run Sieve script, keeping mail", "script", active.Name, logging.Err(err))
+		return nil
+	}
+	return result
+}
+
+// autoReply returns the configured auto-reply as a vacation action, or
+// nil if the auto-responder is disabled.
+func (s *SessionRemote) autoReply() *sieve.Vacation {
+	a, err := config.LoadAutoReply(s.backend.Storage)
+	if err != nil {
+		s.mailLog().Error("Failed to load auto-reply settings", logging.Err(err))
+		return nil
+	}
+	if !a.Enabled || a.Body == "" {
+		return nil
+	}
+	days := a.Days
+	if days > sieve.MaxVacationDays {
+		days = sieve.MaxVacationDays
+	}
+	return &sieve.Vacation{
+		Days:    days,
+		Subject: a.Subject,
+		Reason:  a.Body,
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package smtpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/neilalexander/yggmail/internal/sieve"
+	"github.com/neilalexander/yggmail/internal/utils"
+)
+
+// vacation sends an automatic reply to the sender of a message. It follows
+// RFC 5230 and RFC 3834 so that we never reply to automated mail, mailing
+// lists or bounces, and reply to each sender at most once every few days.
+func (s *SessionRemote) vacation(msg *sieve.Message, v *sieve.Vacation) error {
+	if reason := s.shouldNotAutoReply(msg, v); reason != "" {
+		s.mailLog().Info("Not sending automatic reply", "reason", reason)
+		return nil
+	}
+
+	handle := v.Handle
+	if handle == "" {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%v", v.Subject, v.From, v.Reason, v.Mime)))
+		handle = hex.EncodeToString(sum[:])
+	}
+	sender := utils.EncodeKey(s.public)
+	days := time.Duration(v.Days) * time.Hour * 24
+	if last, err := s.backend.Storage.VacationLastSent(handle, sender); err != nil {
+		return fmt.Errorf("s.backend.Storage.VacationLastSent: %w", err)
+	} else if time.Since(last) < days {
+		return nil
+	}
+
+	reply, err := s.vacationReply(msg, v)
+	if err != nil {
+		return fmt.Errorf("s.vacationReply: %w", err)
+	}
+	self := utils.CreateAddress(s.backend.Config.PublicKey)
+	if err := s.backend.Queues.QueueFor(self, []string{utils.CreateAddress(s.public)}, reply); err != nil {
+		return fmt.Errorf("s.backend.Queues.QueueFor: %w", err)
+	}
+	// Other handles may have a longer :days than this one, so only replies
+	// that are older than any :days could be are forgotten.
+	expiry := time.Now().Add(-time.Duration(sieve.MaxVacationDays) * time.Hour * 24)
+	if err := s.backend.Storage.VacationRecordSent(handle, sender, expiry); err != nil {
+		return fmt.Errorf("s.backend.Storage.VacationRecordSent: %w", err)
+	}
+	s.mailLog().Info("Sent automatic reply")
+	return nil
+}
+
+// shouldNotAutoReply returns the reason for not sending an automatic reply
+// to the message, or an empty string if it is fine to reply.
+func (s *SessionRemote) shouldNotAutoReply(msg *sieve.Message, v *sieve.Vacation) string {
+	if s.from == "" || s.public.Equal(s.backend.Config.PublicKey) {
+		return "no sender"
+	}
+	if at := strings.LastIndex(s.from, "@"); at > 0 {
+		localpart := strings.ToLower(s.from[:at])
+		switch {
+		case localpart == "mailer-daemon", localpart == "listserv", localpart == "majordomo":
+			return "sender is automated"
+		case strings.HasPrefix(localpart, "owner-"), strings.HasSuffix(localpart, "-request"):
+			return "sender is a mailing list"
+		}
+	}
+	for _, value := range msg.Header("Auto-Submitted") {
+		if !strings.EqualFold(strings.SplitN(value, ";", 2)[0], "no") {
+			return "message was automatically submitted"
+		}
+	}
+	for _, value := range msg.Header("Precedence") {
+		switch strings.ToLower(value) {
+		case "bulk", "list", "junk":
+			return "message has " + value + " precedence"
+		}
+	}
+	for _, name := range []string{"List-Id", "List-Post", "List-Unsubscribe", "List-Help"} {
+		if len(msg.Header(name)) > 0 {
+			return "message came from a mailing list"
+		}
+	}
+	if !s.addressedToUs(msg, v.Addresses) {
+		return "we are not an explicit recipient"
+	}
+	return ""
+}
+
+// addressedToUs checks that one of our addresses appears in the recipient
+// headers, so that we don't reply to mail that reached us by Bcc or via
+// a mailing list.
+func (s *SessionRemote) addressedToUs(msg *sieve.Message, addresses []string) bool {
+	for _, name := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		for _, value := range msg.Header(name) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, addr := range list {
+				if pk, err := utils.ParseAddress(addr.Address, s.backend.Config.SubaddressSeparator); err == nil && pk.Equal(s.backend.Config.PublicKey) {
+					return true
+				}
+				for _, a := range addresses {
+					if strings.EqualFold(a, addr.Address) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *SessionRemote) vacationReply(msg *sieve.Message, v *sieve.Vacation) ([]byte, error) {
+	var h gomail.Header
+	self := &gomail.Address{Address: utils.CreateAddress(s.backend.Config.PublicKey)}
+	if from, err := mail.ParseAddress(v.From); err == nil {
+		// We can only ever send mail as ourselves, so only the display
+		// name of the :from address is used if it isn't one of ours.
+		self.Name = from.Name
+		if pk, err := utils.ParseAddress(from.Address, s.backend.Config.SubaddressSeparator); err == nil && pk.Equal(s.backend.Config.PublicKey) {
+			self.Address = from.Address
+		}
+	}
+	h.SetAddressList("From", []*gomail.Address{self})
+	h.SetAddressList("To", []*gomail.Address{{Address: s.from}})
+	subject := v.Subject
+	if subject == "" {
+		original := ""
+		if values := msg.Header("Subject"); len(values) > 0 {
+			original = values[0]
+		}
+		subject = "Auto: " + original
+	}
+	h.SetSubject(subject)
+	h.SetDate(time.Now())
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, fmt.Errorf("h.GenerateMessageID: %w", err)
+	}
+	if ids := msg.Header("Message-Id"); len(ids) > 0 {
+		h.Set("In-Reply-To", ids[0])
+		refs := msg.Header("References")
+		h.Set("References", strings.TrimSpace(strings.Join(append(refs, ids[0]), " ")))
+	}
+	h.Set("Auto-Submitted", "auto-replied (vacation)")
+	h.Set("MIME-Version", "1.0")
+
+	var b bytes.Buffer
+	if v.Mime {
+		// The reason is a complete MIME entity with its own headers.
+		entity, err := message.Read(strings.NewReader(v.Reason))
+		if err != nil {
+			return nil, fmt.Errorf("message.Read: %w", err)
+		}
+		fields := entity.Header.Fields()
+		for fields.Next() {
+			h.Add(fields.Key(), fields.Value())
+		}
+		if err := textproto.WriteHeader(&b, h.Header.Header); err != nil {
+			return nil, fmt.Errorf("textproto.WriteHeader: %w", err)
+		}
+		if _, err := b.ReadFrom(entity.Body); err != nil {
+			return nil, fmt.Errorf("b.ReadFrom: %w", err)
+		}
+		return b.Bytes(), nil
+	}
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	w, err := message.CreateWriter(&b, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("message.CreateWriter: %w", err)
+	}
+	if _, err := w.Write([]byte(v.Reason)); err != nil {
+		return nil, fmt.Errorf("w.Write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("w.Close: %w", err)
+	}
+	return b.Bytes(), nil
+}
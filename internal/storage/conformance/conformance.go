@@ -0,0 +1,875 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package conformance checks that a storage backend behaves the way that
+// the rest of Yggmail expects, which is the way that the SQLite backend
+// behaves. Every backend must pass all of the checks, so each of them runs
+// them from its own tests with Run.
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Check is one of the conformance checks. Each check is given an empty
+// storage of its own.
+type Check struct {
+	Name string
+	Run  func(s storage.Storage) error
+}
+
+// Checks are all of the conformance checks.
+var Checks = []Check{
+	{"Config", checkConfig},
+	{"Mailboxes", checkMailboxes},
+	{"Mails", checkMails},
+	{"Large mails", checkLargeMails},
+	{"Flags and expunging", checkFlags},
+	{"Sequence numbers", checkSequences},
+	{"Moving mail", checkMove},
+	{"Copying mail", checkCopy},
+	{"Mailbox usage", checkUsage},
+	{"Queue", checkQueue},
+	{"Contacts", checkContacts},
+	{"Sieve scripts", checkSieve},
+	{"Automatic replies", checkVacation},
+	{"Delivery receipts", checkReceipts},
+	{"List members", checkListMembers},
+	{"Gateway mappings", checkGateway},
+}
+
+// Run runs each of the checks as a subtest against storage from open, which
+// must return a new, empty storage each time that it is called, i.e. in
+// t.TempDir().
+func Run(t *testing.T, open func(t *testing.T) storage.Storage) {
+	for _, check := range Checks {
+		t.Run(check.Name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			if err := check.Run(s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+const testMail = "From: alice@example.com\r\nSubject: Hello\r\n\r\nHello, world!\r\n"
+
+// expect returns an error describing the difference if got isn't want.
+func expect(what string, got, want interface{}) error {
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("%s: got %v, want %v", what, got, want)
+	}
+	return nil
+}
+
+// expectAll returns the first error, so that a check can compare several
+// things at once.
+func expectAll(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createMails creates a mailbox with the given number of mails in it.
+func createMails(s storage.Storage, mailbox string, count int) error {
+	if err := s.MailboxCreate(mailbox); err != nil {
+		return fmt.Errorf("s.MailboxCreate: %w", err)
+	}
+	for i := 0; i < count; i++ {
+		if _, err := s.MailCreate(mailbox, []byte(testMail)); err != nil {
+			return fmt.Errorf("s.MailCreate: %w", err)
+		}
+	}
+	return nil
+}
+
+func checkConfig(s storage.Storage) error {
+	value, err := s.ConfigGet("missing")
+	if err != nil {
+		return fmt.Errorf("s.ConfigGet: %w", err)
+	}
+	if err := expect("missing value", value, ""); err != nil {
+		return err
+	}
+	for _, v := range []string{"one", "two"} {
+		if err := s.ConfigSet("key", v); err != nil {
+			return fmt.Errorf("s.ConfigSet: %w", err)
+		}
+		if value, _ = s.ConfigGet("key"); value != v {
+			return expect("value", value, v)
+		}
+	}
+
+	if ok, err := s.ConfigTryPassword("anything"); err != nil || !ok {
+		return fmt.Errorf("login without a password set was refused: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		return fmt.Errorf("bcrypt.GenerateFromPassword: %w", err)
+	}
+	if err := s.ConfigSetPassword(string(hash)); err != nil {
+		return fmt.Errorf("s.ConfigSetPassword: %w", err)
+	}
+	if ok, _ := s.ConfigTryPassword("wrong"); ok {
+		return errors.New("the wrong password was accepted")
+	}
+	if ok, err := s.ConfigTryPassword("secret"); err != nil || !ok {
+		return fmt.Errorf("the right password was refused: %v", err)
+	}
+	return nil
+}
+
+func checkMailboxes(s storage.Storage) error {
+	for _, name := range []string{"INBOX", "Archive", "INBOX"} {
+		if err := s.MailboxCreate(name); err != nil {
+			return fmt.Errorf("s.MailboxCreate(%q): %w", name, err)
+		}
+	}
+	if ok, err := s.MailboxSelect("Archive"); err != nil || !ok {
+		return fmt.Errorf("created mailbox not found: %v", err)
+	}
+	if ok, err := s.MailboxSelect("Missing"); err != nil {
+		return fmt.Errorf("missing mailbox is an error: %w", err)
+	} else if ok {
+		return errors.New("missing mailbox found")
+	}
+	list := func(subscribed bool) []string {
+		names, _ := s.MailboxList(subscribed)
+		sort.Strings(names)
+		return names
+	}
+	if err := expect("mailboxes", list(false), []string{"Archive", "INBOX"}); err != nil {
+		return err
+	}
+	if err := s.MailboxSubscribe("Archive", false); err != nil {
+		return fmt.Errorf("s.MailboxSubscribe: %w", err)
+	}
+	if err := expectAll(
+		expect("subscribed mailboxes", list(true), []string{"INBOX"}),
+		expect("all mailboxes", list(false), []string{"Archive", "INBOX"}),
+	); err != nil {
+		return err
+	}
+
+	if _, err := s.MailCreate("Archive", []byte(testMail)); err != nil {
+		return fmt.Errorf("s.MailCreate: %w", err)
+	}
+	if err := s.MailboxRename("Archive", "Old"); err != nil {
+		return fmt.Errorf("s.MailboxRename: %w", err)
+	}
+	count, _ := s.MailCount("Old")
+	if err := expectAll(
+		expect("mailboxes after renaming", list(false), []string{"INBOX", "Old"}),
+		expect("mails in the renamed mailbox", count, 1),
+	); err != nil {
+		return err
+	}
+	if err := s.MailboxRename("Old", "INBOX"); err == nil {
+		return errors.New("renaming over an existing mailbox succeeded")
+	}
+	if err := s.MailboxDelete("Old"); err != nil {
+		return fmt.Errorf("s.MailboxDelete: %w", err)
+	}
+	if err := s.MailboxCreate("Old"); err != nil {
+		return fmt.Errorf("s.MailboxCreate: %w", err)
+	}
+	count, _ = s.MailCount("Old")
+	return expect("mails in a deleted mailbox that was created again", count, 0)
+}
+
+func checkMails(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 0); err != nil {
+		return err
+	}
+	if _, err := s.MailCreate("Missing", []byte(testMail)); err == nil {
+		return errors.New("created a mail in a missing mailbox")
+	}
+	next, _ := s.MailNextID("INBOX")
+	if err := expect("next ID of an empty mailbox", next, 1); err != nil {
+		return err
+	}
+	before := time.Now().Add(-time.Second)
+	for want := 1; want <= 3; want++ {
+		id, err := s.MailCreate("INBOX", []byte(testMail))
+		if err != nil {
+			return fmt.Errorf("s.MailCreate: %w", err)
+		}
+		if err := expect("ID of a new mail", id, want); err != nil {
+			return err
+		}
+	}
+
+	seq, mail, err := s.MailSelect("INBOX", 2)
+	if err != nil {
+		return fmt.Errorf("s.MailSelect: %w", err)
+	}
+	if err := expectAll(
+		expect("sequence number", seq, 2),
+		expect("ID", mail.ID, 2),
+		expect("contents", string(mail.Mail), testMail),
+		expect("flags", []bool{mail.Seen, mail.Answered, mail.Flagged, mail.Deleted}, []bool{false, false, false, false}),
+	); err != nil {
+		return err
+	}
+	if mail.Date.Before(before.Truncate(time.Second)) || mail.Date.After(time.Now()) {
+		return fmt.Errorf("date of a new mail is %s", mail.Date)
+	}
+	if _, _, err := s.MailSelect("INBOX", 10); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("selecting a missing mail returned %v, want storage.ErrNotFound", err)
+	}
+
+	mail, err = s.MailSelectMeta("INBOX", 3)
+	if err != nil {
+		return fmt.Errorf("s.MailSelectMeta: %w", err)
+	}
+	if mail.Meta == nil || mail.Meta.Envelope == nil || mail.Meta.BodyStructure == nil {
+		return errors.New("mail has no envelope or body structure")
+	}
+	if err := expectAll(
+		expect("ID", mail.ID, 3),
+		expect("size", mail.Meta.Size, len(testMail)),
+		expect("subject", mail.Meta.Envelope.Subject, "Hello"),
+	); err != nil {
+		return err
+	}
+	r, err := s.MailOpen("INBOX", 3)
+	if err != nil {
+		return fmt.Errorf("s.MailOpen: %w", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if err := expect("contents", string(data), testMail); err != nil {
+		return err
+	}
+
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, err := s.MailImport("INBOX", []byte(testMail), date, true, false, true, false)
+	if err != nil {
+		return fmt.Errorf("s.MailImport: %w", err)
+	}
+	_, mail, err = s.MailSelect("INBOX", id)
+	if err != nil {
+		return fmt.Errorf("s.MailSelect: %w", err)
+	}
+	ids, _ := s.MailSearch("INBOX")
+	count, _ := s.MailCount("INBOX")
+	next, _ = s.MailNextID("INBOX")
+	return expectAll(
+		expect("ID of an imported mail", id, 4),
+		expect("date of an imported mail", mail.Date.Unix(), date.Unix()),
+		expect("flags of an imported mail", []bool{mail.Seen, mail.Answered, mail.Flagged, mail.Deleted}, []bool{true, false, true, false}),
+		expect("IDs", ids, []uint32{1, 2, 3, 4}),
+		expect("count", count, 4),
+		expect("next ID", next, 5),
+	)
+}
+
+// checkLargeMails stores mails that are bigger than backends are likely to
+// read at once, one that compresses well and one that doesn't, and checks
+// that they are read back whole.
+func checkLargeMails(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 0); err != nil {
+		return err
+	}
+	header := "From: alice@example.com\r\nSubject: Large\r\n\r\n"
+	text := header + strings.Repeat("All work and no play makes Jack a dull boy.\r\n", 20000)
+	random := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	binary := append([]byte(header), random...)
+	for _, mail := range [][]byte{[]byte(text), binary} {
+		id, err := s.MailCreate("INBOX", mail)
+		if err != nil {
+			return fmt.Errorf("s.MailCreate: %w", err)
+		}
+		r, err := s.MailOpen("INBOX", id)
+		if err != nil {
+			return fmt.Errorf("s.MailOpen: %w", err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("io.ReadAll: %w", err)
+		}
+		if !bytes.Equal(data, mail) {
+			return fmt.Errorf("contents of mail %d: got %d bytes, want %d bytes that match", id, len(data), len(mail))
+		}
+	}
+	return nil
+}
+
+func checkFlags(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 4); err != nil {
+		return err
+	}
+	if err := s.MailUpdateFlags("INBOX", 1, true, true, false, false); err != nil {
+		return fmt.Errorf("s.MailUpdateFlags: %w", err)
+	}
+	if err := s.MailUpdateFlags("INBOX", 2, true, false, true, false); err != nil {
+		return fmt.Errorf("s.MailUpdateFlags: %w", err)
+	}
+	_, mail, _ := s.MailSelect("INBOX", 1)
+	unseen, _ := s.MailUnseen("INBOX")
+	if err := expectAll(
+		expect("flags", []bool{mail.Seen, mail.Answered, mail.Flagged, mail.Deleted}, []bool{true, true, false, false}),
+		expect("unseen", unseen, 2),
+	); err != nil {
+		return err
+	}
+
+	for _, id := range []int{2, 4} {
+		if err := s.MailDelete("INBOX", id); err != nil {
+			return fmt.Errorf("s.MailDelete: %w", err)
+		}
+	}
+	_, mail, _ = s.MailSelect("INBOX", 4)
+	count, _ := s.MailCount("INBOX")
+	if err := expectAll(
+		expect("deleted flag", mail.Deleted, true),
+		expect("count before expunging", count, 4),
+	); err != nil {
+		return err
+	}
+	if err := s.MailExpunge("INBOX"); err != nil {
+		return fmt.Errorf("s.MailExpunge: %w", err)
+	}
+	ids, _ := s.MailSearch("INBOX")
+	count, _ = s.MailCount("INBOX")
+	unseen, _ = s.MailUnseen("INBOX")
+	if err := expectAll(
+		expect("IDs after expunging", ids, []uint32{1, 3}),
+		expect("count after expunging", count, 2),
+		expect("unseen after expunging", unseen, 1),
+	); err != nil {
+		return err
+	}
+	// IDs come after the highest one left. Whether the ID of the last mail
+	// is used again once it has been expunged is up to the backend: SQLite
+	// does, but Maildir doesn't, since Dovecot wouldn't.
+	next, _ := s.MailNextID("INBOX")
+	id, err := s.MailCreate("INBOX", []byte(testMail))
+	if err != nil {
+		return fmt.Errorf("s.MailCreate: %w", err)
+	}
+	if id <= 3 {
+		return fmt.Errorf("ID after expunging the last mail: got %d, want more than 3", id)
+	}
+	return expect("ID after expunging the last mail", id, next)
+}
+
+func checkSequences(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 0); err != nil {
+		return err
+	}
+	mails, err := s.MailRange("INBOX", false, 1, 0)
+	if err != nil {
+		return fmt.Errorf("s.MailRange: %w", err)
+	}
+	if len(mails) != 0 {
+		return fmt.Errorf("range of an empty mailbox: got %v", mails)
+	}
+
+	if err := createMails(s, "INBOX", 6); err != nil {
+		return err
+	}
+	if err := createMails(s, "Other", 2); err != nil {
+		return err
+	}
+	for _, id := range []int{2, 3} {
+		if err := s.MailDelete("INBOX", id); err != nil {
+			return fmt.Errorf("s.MailDelete: %w", err)
+		}
+	}
+	if err := s.MailExpunge("INBOX"); err != nil {
+		return fmt.Errorf("s.MailExpunge: %w", err)
+	}
+
+	// The mailbox now has IDs 1, 4, 5 and 6 at sequence numbers 1 to 4.
+	seqs := func(pairs ...int) []types.MailSeq {
+		var mails []types.MailSeq
+		for i := 0; i < len(pairs); i += 2 {
+			mails = append(mails, types.MailSeq{Seq: pairs[i], ID: pairs[i+1]})
+		}
+		return mails
+	}
+	for _, c := range []struct {
+		uid         bool
+		start, stop int
+		want        []types.MailSeq
+	}{
+		{false, 1, 0, seqs(1, 1, 2, 4, 3, 5, 4, 6)},
+		{false, 2, 3, seqs(2, 4, 3, 5)},
+		{false, 0, 0, seqs(4, 6)},
+		{false, 9, 0, seqs(4, 6)},
+		{false, 9, 10, nil},
+		{true, 1, 0, seqs(1, 1, 2, 4, 3, 5, 4, 6)},
+		{true, 2, 4, seqs(2, 4)},
+		{true, 3, 3, nil},
+		{true, 5, 0, seqs(3, 5, 4, 6)},
+		{true, 10, 0, seqs(4, 6)},
+	} {
+		got, err := s.MailRange("INBOX", c.uid, c.start, c.stop)
+		if err != nil {
+			return fmt.Errorf("s.MailRange: %w", err)
+		}
+		if len(got) == 0 {
+			got = nil
+		}
+		what := fmt.Sprintf("range %d:%d (uid %v)", c.start, c.stop, c.uid)
+		if err := expect(what, got, c.want); err != nil {
+			return err
+		}
+	}
+
+	id, err := s.MailIDForSeq("INBOX", 3)
+	if err != nil {
+		return fmt.Errorf("s.MailIDForSeq: %w", err)
+	}
+	seq, _, err := s.MailSelect("INBOX", 6)
+	if err != nil {
+		return fmt.Errorf("s.MailSelect: %w", err)
+	}
+	next, _ := s.MailNextID("INBOX")
+	return expectAll(
+		expect("ID for sequence number 3", id, 5),
+		expect("sequence number of ID 6", seq, 4),
+		expect("next ID", next, 7),
+	)
+}
+
+func checkMove(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 3); err != nil {
+		return err
+	}
+	if err := createMails(s, "Sent", 1); err != nil {
+		return err
+	}
+	if err := createMails(s, "Archive", 1); err != nil {
+		return err
+	}
+	if err := s.MailMove("INBOX", 2, "Archive"); err != nil {
+		return fmt.Errorf("s.MailMove: %w", err)
+	}
+	// The moved mail gets the next ID in the destination, so that mails
+	// from two mailboxes with the same ID can be moved into the same one.
+	if err := s.MailMove("INBOX", 1, "Archive"); err != nil {
+		return fmt.Errorf("s.MailMove: %w", err)
+	}
+	if err := s.MailMove("Sent", 1, "Archive"); err != nil {
+		return fmt.Errorf("s.MailMove: %w", err)
+	}
+	inbox, _ := s.MailSearch("INBOX")
+	sent, _ := s.MailSearch("Sent")
+	archive, _ := s.MailSearch("Archive")
+	if err := expectAll(
+		expect("IDs left behind", inbox, []uint32{3}),
+		expect("IDs left behind in Sent", len(sent), 0),
+		expect("IDs in the destination", archive, []uint32{1, 2, 3, 4}),
+	); err != nil {
+		return err
+	}
+	if err := s.MailMove("INBOX", 3, "Missing"); err == nil {
+		return errors.New("moving a mail into a missing mailbox succeeded")
+	}
+	_, mail, err := s.MailSelect("Archive", 4)
+	if err != nil {
+		return fmt.Errorf("s.MailSelect: %w", err)
+	}
+	return expect("contents of the moved mail", string(mail.Mail), testMail)
+}
+
+func checkCopy(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 2); err != nil {
+		return err
+	}
+	if err := createMails(s, "Archive", 1); err != nil {
+		return err
+	}
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, err := s.MailImport("INBOX", []byte(testMail), date, true, false, true, false)
+	if err != nil {
+		return fmt.Errorf("s.MailImport: %w", err)
+	}
+	copied, err := s.MailCopy("INBOX", id, "Archive")
+	if err != nil {
+		return fmt.Errorf("s.MailCopy: %w", err)
+	}
+	inbox, _ := s.MailSearch("INBOX")
+	archive, _ := s.MailSearch("Archive")
+	if err := expectAll(
+		expect("IDs in the source", inbox, []uint32{1, 2, 3}),
+		expect("IDs in the destination", archive, []uint32{1, 2}),
+		expect("ID of the copy", copied, 2),
+	); err != nil {
+		return err
+	}
+	_, mail, err := s.MailSelect("Archive", copied)
+	if err != nil {
+		return fmt.Errorf("s.MailSelect: %w", err)
+	}
+	if err := expectAll(
+		expect("contents of the copy", string(mail.Mail), testMail),
+		expect("date of the copy", mail.Date.Unix(), date.Unix()),
+		expect("flags of the copy", []bool{mail.Seen, mail.Answered, mail.Flagged, mail.Deleted}, []bool{true, false, true, false}),
+	); err != nil {
+		return err
+	}
+	// Expunging the original mustn't take the copy with it.
+	if err := s.MailDelete("INBOX", id); err != nil {
+		return fmt.Errorf("s.MailDelete: %w", err)
+	}
+	if err := s.MailExpunge("INBOX"); err != nil {
+		return fmt.Errorf("s.MailExpunge: %w", err)
+	}
+	r, err := s.MailOpen("Archive", copied)
+	if err != nil {
+		return fmt.Errorf("s.MailOpen: %w", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if err := expect("contents of the copy after expunging the original", string(data), testMail); err != nil {
+		return err
+	}
+	if _, err := s.MailCopy("INBOX", 1, "Missing"); err == nil {
+		return errors.New("copying a mail into a missing mailbox succeeded")
+	}
+	if _, err := s.MailCopy("INBOX", 10, "Archive"); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("copying a missing mail returned %v, want storage.ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkUsage(s storage.Storage) error {
+	if err := createMails(s, "INBOX", 0); err != nil {
+		return err
+	}
+	usage, err := s.MailboxUsage("INBOX")
+	if err != nil {
+		return fmt.Errorf("s.MailboxUsage: %w", err)
+	}
+	missing, _ := s.MailboxUsage("Missing")
+	if err := expectAll(
+		expect("usage of an empty mailbox", usage, int64(0)),
+		expect("usage of a missing mailbox", missing, int64(0)),
+	); err != nil {
+		return err
+	}
+	// Backends may count what mails take up once compressed, so only the
+	// direction in which the usage moves is checked.
+	var last int64
+	for i := 0; i < 2; i++ {
+		if _, err := s.MailCreate("INBOX", []byte(testMail)); err != nil {
+			return fmt.Errorf("s.MailCreate: %w", err)
+		}
+		if usage, _ = s.MailboxUsage("INBOX"); usage <= last {
+			return fmt.Errorf("usage didn't go up with a new mail: %d after %d", usage, last)
+		}
+		last = usage
+	}
+	for _, id := range []int{1, 2} {
+		if err := s.MailDelete("INBOX", id); err != nil {
+			return fmt.Errorf("s.MailDelete: %w", err)
+		}
+	}
+	if usage, _ = s.MailboxUsage("INBOX"); usage != last {
+		return fmt.Errorf("usage changed before expunging: %d after %d", usage, last)
+	}
+	if err := s.MailExpunge("INBOX"); err != nil {
+		return fmt.Errorf("s.MailExpunge: %w", err)
+	}
+	usage, _ = s.MailboxUsage("INBOX")
+	return expect("usage after expunging everything", usage, int64(0))
+}
+
+func checkQueue(s storage.Storage) error {
+	if err := createMails(s, "Outbox", 3); err != nil {
+		return err
+	}
+	for _, q := range []struct {
+		destination string
+		id          int
+	}{{"bob", 1}, {"bob", 2}, {"carol", 2}} {
+		if err := s.QueueInsertDestinationForID(q.destination, q.id, "alice", q.destination); err != nil {
+			return fmt.Errorf("s.QueueInsertDestinationForID: %w", err)
+		}
+	}
+	if err := s.QueueInsertDestinationForID("bob", 1, "alice", "bob"); err == nil {
+		return errors.New("queueing the same mail twice succeeded")
+	}
+	if err := s.QueueInsertDestinationForID("bob", 10, "alice", "bob"); err == nil {
+		return errors.New("queueing a missing mail succeeded")
+	}
+	destinations, _ := s.QueueListDestinations()
+	sort.Strings(destinations)
+	queued, _ := s.QueueMailIDsForDestination("bob")
+	pending, _ := s.QueueSelectIsMessagePendingSend("Outbox", 2)
+	notPending, _ := s.QueueSelectIsMessagePendingSend("Outbox", 3)
+	if err := expectAll(
+		expect("destinations", destinations, []string{"bob", "carol"}),
+		expect("queued for bob", queued, []types.QueuedMail{{ID: 2, From: "alice", Rcpt: "bob"}, {ID: 1, From: "alice", Rcpt: "bob"}}),
+		expect("mail 2 pending", pending, true),
+		expect("mail 3 pending", notPending, false),
+	); err != nil {
+		return err
+	}
+
+	if err := s.QueueDeleteDestinationForID("bob", 2); err != nil {
+		return fmt.Errorf("s.QueueDeleteDestinationForID: %w", err)
+	}
+	queued, _ = s.QueueMailIDsForDestination("bob")
+	pending, _ = s.QueueSelectIsMessagePendingSend("Outbox", 2)
+	if err := expectAll(
+		expect("queued for bob after sending", queued, []types.QueuedMail{{ID: 1, From: "alice", Rcpt: "bob"}}),
+		expect("mail 2 still pending for carol", pending, true),
+	); err != nil {
+		return err
+	}
+
+	// Expunging a mail takes it out of the queue too.
+	if err := s.MailDelete("Outbox", 2); err != nil {
+		return fmt.Errorf("s.MailDelete: %w", err)
+	}
+	if err := s.MailExpunge("Outbox"); err != nil {
+		return fmt.Errorf("s.MailExpunge: %w", err)
+	}
+	destinations, _ = s.QueueListDestinations()
+	pending, _ = s.QueueSelectIsMessagePendingSend("Outbox", 2)
+	return expectAll(
+		expect("destinations after expunging", destinations, []string{"bob"}),
+		expect("expunged mail pending", pending, false),
+	)
+}
+
+func checkContacts(s storage.Storage) error {
+	if err := s.ContactSet("bob", "b0b", "Bob Smith"); err != nil {
+		return fmt.Errorf("s.ContactSet: %w", err)
+	}
+	if err := s.ContactSet("alice", "a11ce", ""); err != nil {
+		return fmt.Errorf("s.ContactSet: %w", err)
+	}
+	if err := s.ContactSet("Alice", "a11ce2", ""); err != nil {
+		return fmt.Errorf("s.ContactSet: %w", err)
+	}
+	contacts, _ := s.ContactList()
+	byName, _ := s.ContactSelect("ALICE")
+	byDisplay, _ := s.ContactSelect("bob smith")
+	byKey, _ := s.ContactSelectByKey("b0b")
+	missing, _ := s.ContactSelect("carol")
+	if byName == nil || byDisplay == nil || byKey == nil {
+		return errors.New("contact not found")
+	}
+	if err := expectAll(
+		expect("contacts", len(contacts), 2),
+		expect("first contact", contacts[0].Key, "a11ce2"),
+		expect("contact by name", byName.Key, "a11ce2"),
+		expect("contact by display name", byDisplay.Name, "bob"),
+		expect("contact by key", byKey.Name, "bob"),
+		expect("missing contact", missing, (*types.Contact)(nil)),
+	); err != nil {
+		return err
+	}
+	deleted, err := s.ContactDelete("BOB")
+	if err != nil {
+		return fmt.Errorf("s.ContactDelete: %w", err)
+	}
+	notDeleted, err := s.ContactDelete("nobody")
+	if err != nil {
+		return fmt.Errorf("s.ContactDelete: %w", err)
+	}
+	contacts, _ = s.ContactList()
+	return expectAll(
+		expect("contacts deleted", deleted, 1),
+		expect("missing contacts deleted", notDeleted, 0),
+		expect("contacts after deleting", len(contacts), 1),
+	)
+}
+
+func checkSieve(s storage.Storage) error {
+	for _, name := range []string{"one", "two"} {
+		if err := s.SievePut(name, "keep;"); err != nil {
+			return fmt.Errorf("s.SievePut: %w", err)
+		}
+	}
+	if err := s.SieveSetActive("one"); err != nil {
+		return fmt.Errorf("s.SieveSetActive: %w", err)
+	}
+	if err := s.SievePut("one", "discard;"); err != nil {
+		return fmt.Errorf("s.SievePut: %w", err)
+	}
+	active, _ := s.SieveSelectActive()
+	if active == nil {
+		return errors.New("no active script")
+	}
+	if err := expectAll(
+		expect("active script", active.Name, "one"),
+		expect("replaced script", active.Script, "discard;"),
+	); err != nil {
+		return err
+	}
+	if err := s.SieveSetActive("two"); err != nil {
+		return fmt.Errorf("s.SieveSetActive: %w", err)
+	}
+	if err := s.SieveRename("two", "three"); err != nil {
+		return fmt.Errorf("s.SieveRename: %w", err)
+	}
+	if err := s.SieveRename("three", "one"); err == nil {
+		return errors.New("renaming over an existing script succeeded")
+	}
+	scripts, _ := s.SieveList()
+	if err := expect("scripts", scripts, []types.SieveScript{{Name: "one"}, {Name: "three", Active: true}}); err != nil {
+		return err
+	}
+	if err := s.SieveSetActive(""); err != nil {
+		return fmt.Errorf("s.SieveSetActive: %w", err)
+	}
+	if err := s.SieveDelete("one"); err != nil {
+		return fmt.Errorf("s.SieveDelete: %w", err)
+	}
+	active, _ = s.SieveSelectActive()
+	missing, _ := s.SieveSelect("one")
+	return expectAll(
+		expect("active script after deactivating", active, (*types.SieveScript)(nil)),
+		expect("deleted script", missing, (*types.SieveScript)(nil)),
+	)
+}
+
+func checkVacation(s storage.Storage) error {
+	sent, err := s.VacationLastSent("away", "bob")
+	if err != nil {
+		return fmt.Errorf("s.VacationLastSent: %w", err)
+	}
+	if !sent.IsZero() {
+		return fmt.Errorf("reply never sent was sent at %s", sent)
+	}
+	if err := s.VacationRecordSent("away", "bob", time.Now().Add(-time.Hour)); err != nil {
+		return fmt.Errorf("s.VacationRecordSent: %w", err)
+	}
+	if sent, _ = s.VacationLastSent("away", "bob"); time.Since(sent) > time.Minute {
+		return fmt.Errorf("reply just sent was sent at %s", sent)
+	}
+	// Recording another reply forgets about those sent before the expiry.
+	if err := s.VacationRecordSent("away", "carol", time.Now().Add(time.Hour)); err != nil {
+		return fmt.Errorf("s.VacationRecordSent: %w", err)
+	}
+	sent, _ = s.VacationLastSent("away", "bob")
+	return expect("expired reply", sent.IsZero(), true)
+}
+
+func checkReceipts(s storage.Storage) error {
+	receipts, err := s.ReceiptSelect("1@yggmail")
+	if err != nil {
+		return fmt.Errorf("s.ReceiptSelect: %w", err)
+	}
+	if len(receipts) != 0 {
+		return fmt.Errorf("mail never sent has %d receipts", len(receipts))
+	}
+	first := time.Unix(time.Now().Unix(), 0).Add(-time.Hour)
+	if err := s.ReceiptInsert("1@yggmail", "bob@yggmail", first); err != nil {
+		return fmt.Errorf("s.ReceiptInsert: %w", err)
+	}
+	if err := s.ReceiptInsert("1@yggmail", "carol@yggmail", first.Add(time.Minute)); err != nil {
+		return fmt.Errorf("s.ReceiptInsert: %w", err)
+	}
+	// Delivering the same mail to the same recipient again replaces the
+	// receipt rather than adding another.
+	if err := s.ReceiptInsert("1@yggmail", "bob@yggmail", first.Add(time.Hour)); err != nil {
+		return fmt.Errorf("s.ReceiptInsert: %w", err)
+	}
+	receipts, _ = s.ReceiptSelect("1@yggmail")
+	if len(receipts) != 2 {
+		return fmt.Errorf("expected 2 receipts, got %d", len(receipts))
+	}
+	other, _ := s.ReceiptSelect("2@yggmail")
+	return expectAll(
+		expect("first recipient", receipts[0].Rcpt, "carol@yggmail"),
+		expect("second recipient", receipts[1].Rcpt, "bob@yggmail"),
+		expect("delivered", receipts[1].Delivered, first.Add(time.Hour)),
+		expect("message ID", receipts[0].MessageID, "1@yggmail"),
+		expect("other mail", len(other), 0),
+	)
+}
+
+func checkListMembers(s storage.Storage) error {
+	if err := s.ListMemberSet("b0b", false); err != nil {
+		return fmt.Errorf("s.ListMemberSet: %w", err)
+	}
+	if err := s.ListMemberSet("a11ce", true); err != nil {
+		return fmt.Errorf("s.ListMemberSet: %w", err)
+	}
+	joined, _ := s.ListMemberSelect("b0b")
+	if err := s.ListMemberSet("b0b", true); err != nil {
+		return fmt.Errorf("s.ListMemberSet: %w", err)
+	}
+	member, _ := s.ListMemberSelect("b0b")
+	if member == nil || joined == nil {
+		return errors.New("member not found")
+	}
+	members, _ := s.ListMemberList()
+	if err := expectAll(
+		expect("owner", member.Owner, true),
+		expect("joined", member.Joined, joined.Joined),
+		expect("members", len(members), 2),
+	); err != nil {
+		return err
+	}
+	if err := s.ListMemberDelete("b0b"); err != nil {
+		return fmt.Errorf("s.ListMemberDelete: %w", err)
+	}
+	member, _ = s.ListMemberSelect("b0b")
+	return expect("deleted member", member, (*types.ListMember)(nil))
+}
+
+func checkGateway(s storage.Storage) error {
+	if err := s.GatewaySet("Bob@example.com", "b0b"); err != nil {
+		return fmt.Errorf("s.GatewaySet: %w", err)
+	}
+	if err := s.GatewaySet("alice@example.com", "a11ce"); err != nil {
+		return fmt.Errorf("s.GatewaySet: %w", err)
+	}
+	mappings, _ := s.GatewayList()
+	byAddress, _ := s.GatewaySelect("bob@EXAMPLE.com")
+	byKey, _ := s.GatewaySelectByKey("a11ce")
+	if byAddress == nil || byKey == nil {
+		return errors.New("mapping not found")
+	}
+	if err := expectAll(
+		expect("mappings", len(mappings), 2),
+		expect("first mapping", mappings[0].Address, "alice@example.com"),
+		expect("mapping by address", byAddress.Key, "b0b"),
+		expect("mapping by key", byKey.Address, "alice@example.com"),
+	); err != nil {
+		return err
+	}
+	if err := s.GatewayDelete("BOB@example.com"); err != nil {
+		return fmt.Errorf("s.GatewayDelete: %w", err)
+	}
+	mapping, _ := s.GatewaySelect("bob@example.com")
+	return expect("deleted mapping", mapping, (*types.GatewayMapping)(nil))
+}
@@ -0,0 +1,26 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package maildir
+
+import (
+	"testing"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) storage.Storage {
+		s, err := NewMaildirStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewMaildirStorage: %s", err)
+		}
+		return s
+	})
+}
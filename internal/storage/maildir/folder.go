@@ -0,0 +1,382 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package maildir
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	uidlistFile = "dovecot-uidlist"
+	uidlistLock = "dovecot-uidlist.lock"
+
+	// lockTimeout is how long we wait for another program to finish with
+	// the UID list, and lockStale is how old a lock has to be before we
+	// decide that whoever took it has gone away. These are the same as
+	// Dovecot uses.
+	lockTimeout = 10 * time.Second
+	lockStale   = 2 * time.Minute
+)
+
+// entry is a mail in a folder.
+type entry struct {
+	uid  int
+	ext  string // extension fields from the UID list, kept as they were
+	base string // the unique part of the filename, without the flags
+	file string // where the mail is now, i.e. "cur/<base>:2,S"
+}
+
+// folder is what we know about a Maildir folder: which mails are in it and
+// their UIDs. It is thrown away and built again whenever something changes
+// the folder, including other programs.
+type folder struct {
+	path        string
+	stamps      [3]stamp // of new, cur and the UID list, when we read them
+	uidValidity int
+	next        int
+	header      []string // other fields from the header of the UID list
+	mails       []*entry // in order of UID
+}
+
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{info.ModTime(), info.Size()}
+}
+
+func (f *folder) currentStamps() [3]stamp {
+	return [3]stamp{
+		stampOf(filepath.Join(f.path, "new")),
+		stampOf(filepath.Join(f.path, "cur")),
+		stampOf(filepath.Join(f.path, uidlistFile)),
+	}
+}
+
+// find returns the position of the mail in the folder and the mail, or a
+// nil mail if there isn't one with that UID.
+func (f *folder) find(uid int) (int, *entry) {
+	i := sort.Search(len(f.mails), func(i int) bool {
+		return f.mails[i].uid >= uid
+	})
+	if i < len(f.mails) && f.mails[i].uid == uid {
+		return i, f.mails[i]
+	}
+	return i, nil
+}
+
+func (f *folder) findBase(base string) *entry {
+	for _, e := range f.mails {
+		if e.base == base {
+			return e
+		}
+	}
+	return nil
+}
+
+// rename renames a mail within the folder, i.e. to change its flags. We
+// know what changed, so the folder doesn't have to be read again, which
+// would make changing the flags of every mail in a large folder slow.
+func (f *folder) rename(e *entry, file string) error {
+	if file == e.file {
+		return nil
+	}
+	if err := os.Rename(filepath.Join(f.path, e.file), filepath.Join(f.path, file)); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	e.file = file
+	f.stamps = f.currentStamps()
+	return nil
+}
+
+// baseName returns the unique part of a Maildir filename.
+func baseName(filename string) string {
+	if i := strings.IndexByte(filename, ':'); i >= 0 {
+		return filename[:i]
+	}
+	return filename
+}
+
+// lock takes the lock on the UID list in the way that Dovecot does, so that
+// we don't both give out the same UIDs. The lock file is where the new UID
+// list is written before it is renamed over the old one.
+func lock(path string) (*os.File, error) {
+	filename := filepath.Join(path, uidlistLock)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("os.OpenFile: %w", err)
+		}
+		if info, err := os.Stat(filename); err == nil && time.Since(info.ModTime()) > lockStale {
+			_ = os.Remove(filename)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", filename)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readFolder reads the folder at the path and brings the UID list up to
+// date with it, giving UIDs to mails that other programs have delivered.
+// It returns the UIDs of mails that have gone.
+func readFolder(path string) (*folder, []int, error) {
+	f := &folder{path: path}
+	// Take the stamps before reading anything, so that if something else
+	// changes the folder while we're reading it, we read it again next time.
+	stamps := f.currentStamps()
+
+	lockFile, err := lock(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lock: %w", err)
+	}
+	locked := true
+	defer func() {
+		if locked {
+			lockFile.Close()
+			_ = os.Remove(lockFile.Name())
+		}
+	}()
+
+	if err := f.readUIDList(); err != nil {
+		return nil, nil, fmt.Errorf("f.readUIDList: %w", err)
+	}
+	files := map[string]string{}
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(path, dir))
+		if err != nil {
+			return nil, nil, fmt.Errorf("os.ReadDir: %w", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			files[baseName(e.Name())] = dir + "/" + e.Name()
+		}
+	}
+
+	changed := f.uidValidity == 0
+	var gone []int
+	mails := f.mails[:0]
+	for _, e := range f.mails {
+		file, ok := files[e.base]
+		if !ok {
+			gone = append(gone, e.uid)
+			changed = true
+			continue
+		}
+		e.file = file
+		mails = append(mails, e)
+		delete(files, e.base)
+	}
+	f.mails = mails
+	if len(files) > 0 {
+		// Maildir filenames start with the time of delivery, so sorting
+		// them gives UIDs in roughly the order that mail arrived.
+		bases := make([]string, 0, len(files))
+		for base := range files {
+			bases = append(bases, base)
+		}
+		sort.Strings(bases)
+		for _, base := range bases {
+			f.mails = append(f.mails, &entry{uid: f.next, base: base, file: files[base]})
+			f.next++
+		}
+		changed = true
+	}
+
+	if changed {
+		if err := f.writeUIDList(lockFile); err != nil {
+			return nil, nil, fmt.Errorf("f.writeUIDList: %w", err)
+		}
+		// The lock file is now the UID list.
+		lockFile.Close()
+		locked = false
+		stamps[2] = stampOf(filepath.Join(path, uidlistFile))
+	}
+	f.stamps = stamps
+	return f, gone, nil
+}
+
+// readUIDList reads the UID list, which is in version 3 of Dovecot's format
+// or the older version 1. A missing UID list starts a new one.
+func (f *folder) readUIDList() error {
+	f.next = 1
+	file, err := os.Open(filepath.Join(f.path, uidlistFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) == 0 {
+		return fmt.Errorf("empty header")
+	}
+	version := header[0]
+	switch version {
+	case "1":
+		if len(header) < 3 {
+			return fmt.Errorf("invalid header %q", scanner.Text())
+		}
+		f.uidValidity, _ = strconv.Atoi(header[1])
+		f.next, _ = strconv.Atoi(header[2])
+	case "3":
+		for _, field := range header[1:] {
+			switch {
+			case strings.HasPrefix(field, "V"):
+				f.uidValidity, _ = strconv.Atoi(field[1:])
+			case strings.HasPrefix(field, "N"):
+				f.next, _ = strconv.Atoi(field[1:])
+			default:
+				f.header = append(f.header, field)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported version %q", version)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(line[:space])
+		if err != nil {
+			continue
+		}
+		e := &entry{uid: uid}
+		rest := line[space+1:]
+		if version == "1" {
+			e.base = baseName(rest)
+		} else if colon := strings.Index(rest, ":"); colon >= 0 {
+			e.ext = strings.TrimSpace(rest[:colon])
+			e.base = baseName(rest[colon+1:])
+		} else {
+			continue
+		}
+		f.mails = append(f.mails, e)
+		if uid >= f.next {
+			f.next = uid + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner.Err: %w", err)
+	}
+	sort.Slice(f.mails, func(i, j int) bool {
+		return f.mails[i].uid < f.mails[j].uid
+	})
+	if f.next < 1 {
+		f.next = 1
+	}
+	return nil
+}
+
+// writeUIDList writes the UID list into the lock file and then renames it
+// over the old one, which is what Dovecot expects.
+func (f *folder) writeUIDList(lockFile *os.File) error {
+	if f.uidValidity == 0 {
+		f.uidValidity = int(time.Now().Unix())
+		guid := make([]byte, 16)
+		if _, err := rand.Read(guid); err != nil {
+			return fmt.Errorf("rand.Read: %w", err)
+		}
+		f.header = append(f.header, "G"+hex.EncodeToString(guid))
+	}
+	w := bufio.NewWriter(lockFile)
+	fmt.Fprintf(w, "3 V%d N%d", f.uidValidity, f.next)
+	for _, field := range f.header {
+		fmt.Fprintf(w, " %s", field)
+	}
+	fmt.Fprintln(w)
+	for _, e := range f.mails {
+		if e.ext != "" {
+			fmt.Fprintf(w, "%d %s :%s\n", e.uid, e.ext, e.base)
+		} else {
+			fmt.Fprintf(w, "%d :%s\n", e.uid, e.base)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("w.Flush: %w", err)
+	}
+	if err := lockFile.Sync(); err != nil {
+		return fmt.Errorf("lockFile.Sync: %w", err)
+	}
+	if err := os.Rename(lockFile.Name(), filepath.Join(f.path, uidlistFile)); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+// flags returns the flags of a mail from its filename. Mail in "new" hasn't
+// been seen by anyone yet, so it has none.
+func flags(file string) (seen, answered, flagged, deleted bool) {
+	i := strings.Index(file, ":2,")
+	if i < 0 {
+		return
+	}
+	info := file[i+3:]
+	return strings.ContainsRune(info, 'S'), strings.ContainsRune(info, 'R'),
+		strings.ContainsRune(info, 'F'), strings.ContainsRune(info, 'T')
+}
+
+// withFlags returns the filename in "cur" for a mail with the given flags,
+// keeping any flags that we don't know about, i.e. drafts or keywords.
+func withFlags(file string, seen, answered, flagged, deleted bool) string {
+	name := file[strings.IndexByte(file, '/')+1:]
+	base, info := baseName(name), ""
+	if i := strings.Index(name, ":2,"); i >= 0 {
+		info = name[i+3:]
+	}
+	set := map[rune]bool{'S': seen, 'R': answered, 'F': flagged, 'T': deleted}
+	var letters []rune
+	for _, r := range info {
+		if _, ok := set[r]; !ok {
+			letters = append(letters, r)
+		}
+	}
+	for r, on := range set {
+		if on {
+			letters = append(letters, r)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i] < letters[j]
+	})
+	return "cur/" + base + ":2," + string(letters)
+}
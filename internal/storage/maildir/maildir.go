@@ -0,0 +1,331 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package maildir is a storage backend that keeps mail in a Maildir++ tree,
+// so that other tools such as notmuch, mu or offlineimap can work on it
+// too. The flags of a mail are in its filename and the UIDs are in a
+// Dovecot-compatible "dovecot-uidlist" in each folder. Everything else,
+// i.e. the configuration and the queue, is in a small SQLite database
+// called "yggmail.db" in the top of the tree.
+//
+// INBOX is the top of the tree and other mailboxes are folders named after
+// them with a leading dot, i.e. "Archive/2021" is in ".Archive.2021".
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/sqlite3"
+)
+
+func init() {
+	storage.Register("maildir", func(u *url.URL) (storage.Storage, error) {
+		return NewMaildirStorage(storage.Path(u))
+	})
+}
+
+const (
+	inbox             = "INBOX"
+	sidecarFile       = "yggmail.db"
+	subscriptionsFile = "subscriptions"
+)
+
+type MaildirStorage struct {
+	*sqlite3.TableConfig
+	*sqlite3.TableContacts
+	*sqlite3.TableSieve
+	*sqlite3.TableVacation
+	*sqlite3.TableReceipts
+	*sqlite3.TableListMembers
+	*sqlite3.TableGateway
+	*tableQueue
+	root    string
+	sidecar *sqlite3.SQLite3Storage
+	mutex   sync.Mutex
+	folders map[string]*folder
+}
+
+func NewMaildirStorage(root string) (*MaildirStorage, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	filename := filepath.Join(root, sidecarFile)
+	sidecar, err := sqlite3.NewSQLite3StorageStorage(filename)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3.NewSQLite3StorageStorage: %w", err)
+	}
+	s := &MaildirStorage{
+		TableConfig:      sidecar.TableConfig,
+		TableContacts:    sidecar.TableContacts,
+		TableSieve:       sidecar.TableSieve,
+		TableVacation:    sidecar.TableVacation,
+		TableReceipts:    sidecar.TableReceipts,
+		TableListMembers: sidecar.TableListMembers,
+		TableGateway:     sidecar.TableGateway,
+		root:             root,
+		sidecar:          sidecar,
+		folders:          map[string]*folder{},
+	}
+	s.tableQueue, err = newTableQueue(filename)
+	if err != nil {
+		sidecar.Close()
+		return nil, fmt.Errorf("newTableQueue: %w", err)
+	}
+	return s, nil
+}
+
+func (s *MaildirStorage) Close() error {
+	_ = s.tableQueue.db.Close()
+	return s.sidecar.Close()
+}
+
+// EncryptionEnabled and Unlock let an encrypted sidecar database be used,
+// which protects the private key. The mail itself isn't encrypted.
+func (s *MaildirStorage) EncryptionEnabled() bool {
+	return s.sidecar.EncryptionEnabled()
+}
+
+func (s *MaildirStorage) Unlock(passphrase string) error {
+	return s.sidecar.Unlock(passphrase)
+}
+
+var (
+	encodeName = strings.NewReplacer("%", "%25", ".", "%2E", "/", ".")
+	decodeName = strings.NewReplacer(".", "/", "%2E", ".", "%25", "%")
+)
+
+// path returns the directory of the folder for a mailbox. Maildir++ uses
+// dots to separate the levels of folders, so dots in the names of mailboxes
+// are escaped.
+func (s *MaildirStorage) path(name string) string {
+	if name == inbox {
+		return s.root
+	}
+	return filepath.Join(s.root, "."+encodeName.Replace(name))
+}
+
+func exists(path string) bool {
+	info, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// folder returns the folder for a mailbox, reading it again if anything has
+// changed it since we last did. The mutex must be held.
+func (s *MaildirStorage) folder(name string) (*folder, error) {
+	if f, ok := s.folders[name]; ok && f.stamps == f.currentStamps() {
+		return f, nil
+	}
+	delete(s.folders, name)
+	path := s.path(name)
+	if !exists(path) {
+		return nil, fmt.Errorf("mailbox %q does not exist", name)
+	}
+	f, gone, err := readFolder(path)
+	if err != nil {
+		return nil, fmt.Errorf("readFolder: %w", err)
+	}
+	// Mail that has gone, whether we expunged it or something else took it
+	// away, can't be sent any more.
+	for _, id := range gone {
+		if err := s.dequeue(name, id); err != nil {
+			return nil, fmt.Errorf("s.dequeue: %w", err)
+		}
+	}
+	s.folders[name] = f
+	return f, nil
+}
+
+func (s *MaildirStorage) MailboxSelect(name string) (bool, error) {
+	info, err := os.Stat(filepath.Join(s.path(name), "cur"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+	return info.IsDir(), nil
+}
+
+func (s *MaildirStorage) MailboxList(onlySubscribed bool) ([]string, error) {
+	var names []string
+	if onlySubscribed {
+		subscribed, err := s.subscriptions()
+		if err != nil {
+			return nil, fmt.Errorf("s.subscriptions: %w", err)
+		}
+		for name := range subscribed {
+			if exists(s.path(name)) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	if exists(s.root) {
+		names = append(names, inbox)
+	}
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || len(name) < 2 || name[0] != '.' || name == ".." {
+			continue
+		}
+		if exists(filepath.Join(s.root, name)) {
+			names = append(names, decodeName.Replace(name[1:]))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MaildirStorage) MailboxCreate(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := s.path(name)
+	if exists(path) {
+		return nil
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return fmt.Errorf("os.MkdirAll: %w", err)
+		}
+	}
+	if name != inbox {
+		// Tells other Maildir++ programs that this is a folder.
+		if err := os.WriteFile(filepath.Join(path, "maildirfolder"), nil, 0600); err != nil {
+			return fmt.Errorf("os.WriteFile: %w", err)
+		}
+	}
+	return s.subscribe(name, true)
+}
+
+func (s *MaildirStorage) MailboxRename(old, new string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old == inbox || new == inbox {
+		return errors.New("INBOX can't be renamed")
+	}
+	if !exists(s.path(old)) {
+		return nil
+	}
+	if exists(s.path(new)) {
+		return fmt.Errorf("mailbox %q already exists", new)
+	}
+	if err := os.Rename(s.path(old), s.path(new)); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	delete(s.folders, old)
+	subscribed, err := s.subscriptions()
+	if err != nil {
+		return fmt.Errorf("s.subscriptions: %w", err)
+	}
+	if subscribed[old] {
+		if err := s.subscribe(old, false); err != nil {
+			return err
+		}
+		if err := s.subscribe(new, true); err != nil {
+			return err
+		}
+	}
+	return s.renameQueue(old, new)
+}
+
+func (s *MaildirStorage) MailboxDelete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := s.path(name)
+	if !exists(path) {
+		return nil
+	}
+	delete(s.folders, name)
+	if name == inbox {
+		// INBOX is the top of the tree, so only its own mail goes.
+		for _, dir := range []string{"tmp", "new", "cur", uidlistFile} {
+			if err := os.RemoveAll(filepath.Join(path, dir)); err != nil {
+				return fmt.Errorf("os.RemoveAll: %w", err)
+			}
+		}
+	} else if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("os.RemoveAll: %w", err)
+	}
+	if err := s.subscribe(name, false); err != nil {
+		return err
+	}
+	return s.deleteQueue(name)
+}
+
+func (s *MaildirStorage) MailboxSubscribe(name string, subscribed bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !exists(s.path(name)) {
+		return nil
+	}
+	return s.subscribe(name, subscribed)
+}
+
+// subscriptions reads the names of the subscribed mailboxes, one per line,
+// skipping the header that newer versions of Dovecot write.
+func (s *MaildirStorage) subscriptions() (map[string]bool, error) {
+	subscribed := map[string]bool{}
+	file, err := os.Open(filepath.Join(s.root, subscriptionsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return subscribed, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "V\t") {
+			continue
+		}
+		subscribed[line] = true
+	}
+	return subscribed, scanner.Err()
+}
+
+func (s *MaildirStorage) subscribe(name string, subscribe bool) error {
+	subscribed, err := s.subscriptions()
+	if err != nil {
+		return fmt.Errorf("s.subscriptions: %w", err)
+	}
+	if subscribed[name] == subscribe {
+		return nil
+	}
+	if subscribe {
+		subscribed[name] = true
+	} else {
+		delete(subscribed, name)
+	}
+	names := make([]string, 0, len(subscribed))
+	for name := range subscribed {
+		names = append(names, name+"\n")
+	}
+	sort.Strings(names)
+	filename := filepath.Join(s.root, subscriptionsFile)
+	if err := os.WriteFile(filename+".tmp", []byte(strings.Join(names, "")), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
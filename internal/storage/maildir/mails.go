@@ -0,0 +1,418 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"go.uber.org/atomic"
+)
+
+var deliveries atomic.Uint64
+
+// uniqueName returns a new Maildir filename, in the usual form of the time,
+// something that makes it unique to this process and the hostname.
+func uniqueName(now time.Time) string {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveries.Inc(), hostname,
+	)
+}
+
+// deliver writes a mail into "tmp" and then moves it into place, which is
+// how Maildir makes sure that nobody sees half of a mail. Mail with flags
+// goes straight into "cur", otherwise it goes into "new" like any other
+// mail that has just arrived.
+func (s *MaildirStorage) deliver(mailbox string, data []byte, date time.Time, seen, answered, flagged, deleted bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := s.path(mailbox)
+	if !exists(path) {
+		return 0, fmt.Errorf("mailbox %q does not exist", mailbox)
+	}
+	base := uniqueName(time.Now())
+	tmp := filepath.Join(path, "tmp", base)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// The modification time is the date of the mail.
+		err = os.Chtimes(tmp, date, date)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("file.Write: %w", err)
+	}
+	return s.place(mailbox, base, seen, answered, flagged, deleted)
+}
+
+// place moves a mail from "tmp" into place and returns its UID. The mutex
+// must be held.
+func (s *MaildirStorage) place(mailbox, base string, seen, answered, flagged, deleted bool) (int, error) {
+	path := s.path(mailbox)
+	tmp := filepath.Join(path, "tmp", base)
+	name := "new/" + base
+	if seen || answered || flagged || deleted {
+		name = withFlags(name, seen, answered, flagged, deleted)
+	}
+	if err := os.Rename(tmp, filepath.Join(path, name)); err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("os.Rename: %w", err)
+	}
+	f, err := s.folder(mailbox)
+	if err != nil {
+		return 0, err
+	}
+	e := f.findBase(base)
+	if e == nil {
+		return 0, fmt.Errorf("delivered mail %q not found", base)
+	}
+	return e.uid, nil
+}
+
+func (s *MaildirStorage) MailCreate(mailbox string, data []byte) (int, error) {
+	return s.deliver(mailbox, data, time.Now(), false, false, false, false)
+}
+
+func (s *MaildirStorage) MailImport(mailbox string, data []byte, date time.Time, seen, answered, flagged, deleted bool) (int, error) {
+	return s.deliver(mailbox, data, date, seen, answered, flagged, deleted)
+}
+
+// lookup finds a mail and returns its sequence number, its filename and the
+// mail without its contents.
+func (s *MaildirStorage) lookup(mailbox string, id int) (int, string, *types.Mail, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := s.folder(mailbox)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	i, e := f.find(id)
+	if e == nil {
+		return 0, "", nil, storage.ErrNotFound
+	}
+	filename := filepath.Join(f.path, e.file)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("os.Stat: %w", err)
+	}
+	mail := &types.Mail{
+		ID:   id,
+		Date: time.Unix(info.ModTime().Unix(), 0),
+	}
+	mail.Seen, mail.Answered, mail.Flagged, mail.Deleted = flags(e.file)
+	return i + 1, filename, mail, nil
+}
+
+// read reads a mail, looking it up again if another program renamed it in
+// the meantime, i.e. to change its flags.
+func (s *MaildirStorage) read(mailbox string, id int) (int, *types.Mail, error) {
+	for attempt := 0; ; attempt++ {
+		seq, filename, mail, err := s.lookup(mailbox, id)
+		if err != nil {
+			return 0, &types.Mail{}, err
+		}
+		data, err := os.ReadFile(filename)
+		if errors.Is(err, fs.ErrNotExist) && attempt == 0 {
+			continue
+		} else if err != nil {
+			return 0, &types.Mail{}, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		mail.Mail = data
+		return seq, mail, nil
+	}
+}
+
+func (s *MaildirStorage) MailSelect(mailbox string, id int) (int, *types.Mail, error) {
+	return s.read(mailbox, id)
+}
+
+// MailSelectMeta parses the mail each time, since there's nowhere to keep
+// what we learn about it that other programs wouldn't trip over.
+func (s *MaildirStorage) MailSelectMeta(mailbox string, id int) (*types.Mail, error) {
+	_, mail, err := s.read(mailbox, id)
+	if err != nil {
+		return mail, err
+	}
+	mail.Meta = types.ParseMailMeta(mail.Mail)
+	mail.Mail = nil
+	return mail, nil
+}
+
+func (s *MaildirStorage) MailOpen(mailbox string, id int) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		_, filename, _, err := s.lookup(mailbox, id)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(filename)
+		if errors.Is(err, fs.ErrNotExist) && attempt == 0 {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("os.Open: %w", err)
+		}
+		return file, nil
+	}
+}
+
+// withFolder runs f with the folder for the mailbox. A missing mailbox is
+// treated as an empty one, like the SQLite backend does.
+func (s *MaildirStorage) withFolder(mailbox string, f func(f *folder) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !exists(s.path(mailbox)) {
+		return f(&folder{next: 1})
+	}
+	folder, err := s.folder(mailbox)
+	if err != nil {
+		return err
+	}
+	return f(folder)
+}
+
+func (s *MaildirStorage) MailSearch(mailbox string) ([]uint32, error) {
+	var ids []uint32
+	err := s.withFolder(mailbox, func(f *folder) error {
+		for _, e := range f.mails {
+			ids = append(ids, uint32(e.uid))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s *MaildirStorage) MailNextID(mailbox string) (int, error) {
+	var next int
+	err := s.withFolder(mailbox, func(f *folder) error {
+		next = f.next
+		return nil
+	})
+	return next, err
+}
+
+func (s *MaildirStorage) MailIDForSeq(mailbox string, seq int) (int, error) {
+	var id int
+	err := s.withFolder(mailbox, func(f *folder) error {
+		if seq < 1 || seq > len(f.mails) {
+			return storage.ErrNotFound
+		}
+		id = f.mails[seq-1].uid
+		return nil
+	})
+	return id, err
+}
+
+// MailRange behaves like the SQLite backend: a start of 0 means the last
+// mail, a stop of 0 means up to the last mail, and "n:*" always includes
+// the last mail even if n is beyond it.
+func (s *MaildirStorage) MailRange(mailbox string, uid bool, start, stop int) ([]types.MailSeq, error) {
+	var mails []types.MailSeq
+	err := s.withFolder(mailbox, func(f *folder) error {
+		if len(f.mails) == 0 {
+			return nil
+		}
+		if start > 0 {
+			first, last := start-1, len(f.mails)
+			if uid {
+				first, _ = f.find(start)
+				if stop > 0 {
+					last, _ = f.find(stop + 1)
+				}
+			} else if stop > 0 && stop < last {
+				last = stop
+			}
+			for i := first; i < last; i++ {
+				mails = append(mails, types.MailSeq{Seq: i + 1, ID: f.mails[i].uid})
+			}
+		}
+		if len(mails) == 0 && (start == 0 || stop == 0) {
+			n := len(f.mails)
+			mails = append(mails, types.MailSeq{Seq: n, ID: f.mails[n-1].uid})
+		}
+		return nil
+	})
+	return mails, err
+}
+
+func (s *MaildirStorage) MailUnseen(mailbox string) (int, error) {
+	unseen := 0
+	err := s.withFolder(mailbox, func(f *folder) error {
+		for _, e := range f.mails {
+			if seen, _, _, _ := flags(e.file); !seen {
+				unseen++
+			}
+		}
+		return nil
+	})
+	return unseen, err
+}
+
+func (s *MaildirStorage) MailCount(mailbox string) (int, error) {
+	count := 0
+	err := s.withFolder(mailbox, func(f *folder) error {
+		count = len(f.mails)
+		return nil
+	})
+	return count, err
+}
+
+// MailboxUsage adds up the sizes of the mail files. Files that have gone in
+// the meantime, i.e. because another program expunged them, don't count.
+func (s *MaildirStorage) MailboxUsage(mailbox string) (int64, error) {
+	var usage int64
+	err := s.withFolder(mailbox, func(f *folder) error {
+		for _, e := range f.mails {
+			if info, err := os.Stat(filepath.Join(f.path, e.file)); err == nil {
+				usage += info.Size()
+			}
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// MailUpdateFlags renames the mail with its new flags, which moves it into
+// "cur" if it was still in "new".
+func (s *MaildirStorage) MailUpdateFlags(mailbox string, id int, seen, answered, flagged, deleted bool) error {
+	return s.withFolder(mailbox, func(f *folder) error {
+		_, e := f.find(id)
+		if e == nil {
+			return nil
+		}
+		return f.rename(e, withFlags(e.file, seen, answered, flagged, deleted))
+	})
+}
+
+func (s *MaildirStorage) MailDelete(mailbox string, id int) error {
+	return s.withFolder(mailbox, func(f *folder) error {
+		_, e := f.find(id)
+		if e == nil {
+			return nil
+		}
+		seen, answered, flagged, _ := flags(e.file)
+		return f.rename(e, withFlags(e.file, seen, answered, flagged, true))
+	})
+}
+
+func (s *MaildirStorage) MailExpunge(mailbox string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !exists(s.path(mailbox)) {
+		return nil
+	}
+	f, err := s.folder(mailbox)
+	if err != nil {
+		return err
+	}
+	for _, e := range f.mails {
+		if _, _, _, deleted := flags(e.file); !deleted {
+			continue
+		}
+		if err := os.Remove(filepath.Join(f.path, e.file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+	// Reading the folder again takes the mail out of the UID list and out
+	// of the queue.
+	delete(s.folders, mailbox)
+	_, err = s.folder(mailbox)
+	return err
+}
+
+// MailMove moves the mail file into the other folder, where it gets the
+// next UID, since UIDs in a folder must only ever go up.
+func (s *MaildirStorage) MailMove(mailbox string, id int, destination string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mailbox == destination {
+		return nil
+	}
+	f, err := s.folder(mailbox)
+	if err != nil {
+		return err
+	}
+	_, e := f.find(id)
+	if e == nil {
+		return nil
+	}
+	dest := s.path(destination)
+	if !exists(dest) {
+		return fmt.Errorf("mailbox %q does not exist", destination)
+	}
+	if err := os.Rename(filepath.Join(f.path, e.file), filepath.Join(dest, e.file)); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	d, err := s.folder(destination)
+	if err != nil {
+		return err
+	}
+	moved := d.findBase(e.base)
+	if moved == nil {
+		return fmt.Errorf("moved mail %q not found", e.base)
+	}
+	if err := s.moveQueue(mailbox, id, destination, moved.uid); err != nil {
+		return fmt.Errorf("s.moveQueue: %w", err)
+	}
+	_, err = s.folder(mailbox)
+	return err
+}
+
+// QueueInsertDestinationForID queues a mail from the Outbox, which has to be
+// there, since there's no foreign key to check it for us.
+func (s *MaildirStorage) QueueInsertDestinationForID(destination string, id int, from, rcpt string) error {
+	return s.withFolder("Outbox", func(f *folder) error {
+		if _, e := f.find(id); e == nil {
+			return fmt.Errorf("mail %d is not in the Outbox", id)
+		}
+		_, err := s.insert.Exec(destination, "Outbox", id, from, rcpt)
+		return err
+	})
+}
+
+// MailCopy links the mail file into the other folder rather than copying
+// it, which is safe since a mail file is never changed once it is in place,
+// only renamed to change its flags. The link shares the modification time,
+// which is the date of the mail.
+func (s *MaildirStorage) MailCopy(mailbox string, id int, destination string) (int, error) {
+	_, filename, mail, err := s.lookup(mailbox, id)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := s.path(destination)
+	if !exists(path) {
+		return 0, fmt.Errorf("mailbox %q does not exist", destination)
+	}
+	base := uniqueName(time.Now())
+	if err := os.Link(filename, filepath.Join(path, "tmp", base)); err != nil {
+		return 0, fmt.Errorf("os.Link: %w", err)
+	}
+	return s.place(destination, base, mail.Seen, mail.Answered, mail.Flagged, mail.Deleted)
+}
@@ -0,0 +1,182 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package maildir
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// tableQueue is the queue of outgoing mail. It lives in the sidecar database
+// next to the tables from the SQLite backend, but in a table of its own,
+// since the queue of the SQLite backend refers to the mails table.
+type tableQueue struct {
+	db                *sql.DB
+	selectDestination *sql.Stmt
+	selectIDs         *sql.Stmt
+	insert            *sql.Stmt
+	delete            *sql.Stmt
+	selectPending     *sql.Stmt
+	dequeueID         *sql.Stmt
+	dequeueMailbox    *sql.Stmt
+	renameMailbox     *sql.Stmt
+	move              *sql.Stmt
+}
+
+const queueSchema = `
+	CREATE TABLE IF NOT EXISTS maildir_queue (
+		destination TEXT NOT NULL,
+		mailbox TEXT NOT NULL,
+		id INTEGER NOT NULL,
+		mail TEXT NOT NULL,
+		rcpt TEXT NOT NULL,
+		PRIMARY KEY (destination, mailbox, id)
+	);
+`
+
+const queueSelectDestinations = `
+	SELECT DISTINCT destination FROM maildir_queue
+`
+
+const queueSelectIDsForDestination = `
+	SELECT id, mail, rcpt FROM maildir_queue WHERE destination = $1
+	ORDER BY id DESC
+`
+
+const queueInsert = `
+	INSERT INTO maildir_queue (destination, mailbox, id, mail, rcpt) VALUES($1, $2, $3, $4, $5)
+`
+
+const queueDelete = `
+	DELETE FROM maildir_queue WHERE destination = $1 AND mailbox = $2 AND id = $3
+`
+
+const queueSelectPending = `
+	SELECT COUNT(*) FROM maildir_queue WHERE mailbox = $1 AND id = $2
+`
+
+const queueDequeueID = `
+	DELETE FROM maildir_queue WHERE mailbox = $1 AND id = $2
+`
+
+const queueDequeueMailbox = `
+	DELETE FROM maildir_queue WHERE mailbox = $1
+`
+
+const queueRenameMailbox = `
+	UPDATE maildir_queue SET mailbox = $1 WHERE mailbox = $2
+`
+
+const queueMove = `
+	UPDATE maildir_queue SET mailbox = $1, id = $2 WHERE mailbox = $3 AND id = $4
+`
+
+func newTableQueue(filename string) (*tableQueue, error) {
+	// The SQLite backend has the same database open, so wait for it rather
+	// than failing if it is busy.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate", filename))
+	if err != nil {
+		return nil, fmt.Errorf("sql.Open: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(queueSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db.Exec: %w", err)
+	}
+	t := &tableQueue{db: db}
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&t.selectDestination, queueSelectDestinations},
+		{&t.selectIDs, queueSelectIDsForDestination},
+		{&t.insert, queueInsert},
+		{&t.delete, queueDelete},
+		{&t.selectPending, queueSelectPending},
+		{&t.dequeueID, queueDequeueID},
+		{&t.dequeueMailbox, queueDequeueMailbox},
+		{&t.renameMailbox, queueRenameMailbox},
+		{&t.move, queueMove},
+	} {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("db.Prepare: %w", err)
+		}
+	}
+	return t, nil
+}
+
+func (t *tableQueue) QueueListDestinations() ([]string, error) {
+	rows, err := t.selectDestination.Query()
+	if err != nil {
+		return nil, fmt.Errorf("t.selectDestination.Query: %w", err)
+	}
+	defer rows.Close()
+	var destinations []string
+	for rows.Next() {
+		var destination string
+		if err := rows.Scan(&destination); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, rows.Err()
+}
+
+func (t *tableQueue) QueueMailIDsForDestination(destination string) ([]types.QueuedMail, error) {
+	rows, err := t.selectIDs.Query(destination)
+	if err != nil {
+		return nil, fmt.Errorf("t.selectIDs.Query: %w", err)
+	}
+	defer rows.Close()
+	var ids []types.QueuedMail
+	for rows.Next() {
+		var q types.QueuedMail
+		if err := rows.Scan(&q.ID, &q.From, &q.Rcpt); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		ids = append(ids, q)
+	}
+	return ids, rows.Err()
+}
+
+func (t *tableQueue) QueueDeleteDestinationForID(destination string, id int) error {
+	_, err := t.delete.Exec(destination, "Outbox", id)
+	return err
+}
+
+func (t *tableQueue) QueueSelectIsMessagePendingSend(mailbox string, id int) (bool, error) {
+	var count int
+	if err := t.selectPending.QueryRow(mailbox, id).Scan(&count); err != nil {
+		return false, fmt.Errorf("row.Scan: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (t *tableQueue) dequeue(mailbox string, id int) error {
+	_, err := t.dequeueID.Exec(mailbox, id)
+	return err
+}
+
+func (t *tableQueue) deleteQueue(mailbox string) error {
+	_, err := t.dequeueMailbox.Exec(mailbox)
+	return err
+}
+
+func (t *tableQueue) renameQueue(old, new string) error {
+	_, err := t.renameMailbox.Exec(new, old)
+	return err
+}
+
+func (t *tableQueue) moveQueue(mailbox string, id int, destination string, newID int) error {
+	_, err := t.move.Exec(destination, newID, mailbox, id)
+	return err
+}
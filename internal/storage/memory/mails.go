@@ -0,0 +1,309 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// find returns the position of the mail in the mailbox and the mail, or a
+// nil mail if there isn't one with that ID.
+func (s *MemoryStorage) find(mailbox string, id int) (int, *types.Mail) {
+	mb, ok := s.mailboxes[mailbox]
+	if !ok {
+		return 0, nil
+	}
+	i := sort.Search(len(mb.mails), func(i int) bool {
+		return mb.mails[i].ID >= id
+	})
+	if i < len(mb.mails) && mb.mails[i].ID == id {
+		return i, mb.mails[i]
+	}
+	return i, nil
+}
+
+// copyMail returns a copy of the mail without its contents, so that callers
+// can change it without changing what we have stored.
+func copyMail(m *types.Mail) *types.Mail {
+	c := *m
+	c.Mail = nil
+	return &c
+}
+
+func (s *MemoryStorage) insert(mailbox string, data []byte, date time.Time) (*types.Mail, error) {
+	mb, ok := s.mailboxes[mailbox]
+	if !ok {
+		return nil, fmt.Errorf("mailbox %q does not exist", mailbox)
+	}
+	id := 1
+	if n := len(mb.mails); n > 0 {
+		id = mb.mails[n-1].ID + 1
+	}
+	m := &types.Mail{
+		ID:   id,
+		Mail: append([]byte(nil), data...),
+		Meta: types.ParseMailMeta(data),
+		Date: time.Unix(date.Unix(), 0),
+	}
+	mb.mails = append(mb.mails, m)
+	return m, nil
+}
+
+func (s *MemoryStorage) MailCreate(mailbox string, data []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, err := s.insert(mailbox, data, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return m.ID, nil
+}
+
+func (s *MemoryStorage) MailImport(mailbox string, data []byte, date time.Time, seen, answered, flagged, deleted bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, err := s.insert(mailbox, data, date)
+	if err != nil {
+		return 0, err
+	}
+	m.Seen, m.Answered, m.Flagged, m.Deleted = seen, answered, flagged, deleted
+	return m.ID, nil
+}
+
+func (s *MemoryStorage) MailSelect(mailbox string, id int) (int, *types.Mail, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	i, m := s.find(mailbox, id)
+	if m == nil {
+		return 0, &types.Mail{}, storage.ErrNotFound
+	}
+	c := copyMail(m)
+	c.Mail = append([]byte(nil), m.Mail...)
+	return i + 1, c, nil
+}
+
+func (s *MemoryStorage) MailSelectMeta(mailbox string, id int) (*types.Mail, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, m := s.find(mailbox, id)
+	if m == nil {
+		return &types.Mail{}, storage.ErrNotFound
+	}
+	return copyMail(m), nil
+}
+
+func (s *MemoryStorage) MailOpen(mailbox string, id int) (io.ReadCloser, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, m := s.find(mailbox, id)
+	if m == nil {
+		return nil, storage.ErrNotFound
+	}
+	// The contents are never changed once stored, so they can be read
+	// without holding the lock.
+	return io.NopCloser(bytes.NewReader(m.Mail)), nil
+}
+
+func (s *MemoryStorage) MailSearch(mailbox string) ([]uint32, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var ids []uint32
+	if mb, ok := s.mailboxes[mailbox]; ok {
+		for _, m := range mb.mails {
+			ids = append(ids, uint32(m.ID))
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStorage) MailNextID(mailbox string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if mb, ok := s.mailboxes[mailbox]; ok && len(mb.mails) > 0 {
+		return mb.mails[len(mb.mails)-1].ID + 1, nil
+	}
+	return 1, nil
+}
+
+func (s *MemoryStorage) MailIDForSeq(mailbox string, seq int) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	mb, ok := s.mailboxes[mailbox]
+	if !ok || seq < 1 || seq > len(mb.mails) {
+		return 0, storage.ErrNotFound
+	}
+	return mb.mails[seq-1].ID, nil
+}
+
+// MailRange behaves like the SQLite backend: a start of 0 means the last
+// mail, a stop of 0 means up to the last mail, and "n:*" always includes
+// the last mail even if n is beyond it.
+func (s *MemoryStorage) MailRange(mailbox string, uid bool, start, stop int) ([]types.MailSeq, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	mb, ok := s.mailboxes[mailbox]
+	if !ok || len(mb.mails) == 0 {
+		return nil, nil
+	}
+	var mails []types.MailSeq
+	if start > 0 {
+		first, last := start-1, len(mb.mails)
+		if uid {
+			first, _ = s.find(mailbox, start)
+			if stop > 0 {
+				last, _ = s.find(mailbox, stop+1)
+			}
+		} else if stop > 0 && stop < last {
+			last = stop
+		}
+		for i := first; i < last; i++ {
+			mails = append(mails, types.MailSeq{Seq: i + 1, ID: mb.mails[i].ID})
+		}
+	}
+	if len(mails) == 0 && (start == 0 || stop == 0) {
+		n := len(mb.mails)
+		mails = append(mails, types.MailSeq{Seq: n, ID: mb.mails[n-1].ID})
+	}
+	return mails, nil
+}
+
+func (s *MemoryStorage) MailUnseen(mailbox string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	unseen := 0
+	if mb, ok := s.mailboxes[mailbox]; ok {
+		for _, m := range mb.mails {
+			if !m.Seen {
+				unseen++
+			}
+		}
+	}
+	return unseen, nil
+}
+
+func (s *MemoryStorage) MailCount(mailbox string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if mb, ok := s.mailboxes[mailbox]; ok {
+		return len(mb.mails), nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryStorage) MailboxUsage(mailbox string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var usage int64
+	if mb, ok := s.mailboxes[mailbox]; ok {
+		for _, m := range mb.mails {
+			usage += int64(len(m.Mail))
+		}
+	}
+	return usage, nil
+}
+
+func (s *MemoryStorage) MailUpdateFlags(mailbox string, id int, seen, answered, flagged, deleted bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, m := s.find(mailbox, id); m != nil {
+		m.Seen, m.Answered, m.Flagged, m.Deleted = seen, answered, flagged, deleted
+	}
+	return nil
+}
+
+func (s *MemoryStorage) MailDelete(mailbox string, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, m := s.find(mailbox, id); m != nil {
+		m.Deleted = true
+	}
+	return nil
+}
+
+func (s *MemoryStorage) MailExpunge(mailbox string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mb, ok := s.mailboxes[mailbox]
+	if !ok {
+		return nil
+	}
+	expunged := map[int]struct{}{}
+	mails := mb.mails[:0]
+	for _, m := range mb.mails {
+		if m.Deleted {
+			expunged[m.ID] = struct{}{}
+		} else {
+			mails = append(mails, m)
+		}
+	}
+	mb.mails = mails
+	s.dequeue(func(q queued) bool {
+		_, ok := expunged[q.id]
+		return q.mailbox == mailbox && ok
+	})
+	return nil
+}
+
+// MailMove moves the mail into another mailbox, where it gets the next ID,
+// since another mail there may already have the ID it had.
+func (s *MemoryStorage) MailMove(mailbox string, id int, destination string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i, m := s.find(mailbox, id)
+	if m == nil || mailbox == destination {
+		return nil
+	}
+	dest, ok := s.mailboxes[destination]
+	if !ok {
+		return fmt.Errorf("mailbox %q does not exist", destination)
+	}
+	next := 1
+	if n := len(dest.mails); n > 0 {
+		next = dest.mails[n-1].ID + 1
+	}
+	mb := s.mailboxes[mailbox]
+	mb.mails = append(mb.mails[:i], mb.mails[i+1:]...)
+	m.ID = next
+	dest.mails = append(dest.mails, m)
+	for k := range s.queue {
+		if s.queue[k].mailbox == mailbox && s.queue[k].id == id {
+			s.queue[k].mailbox, s.queue[k].id = destination, next
+		}
+	}
+	return nil
+}
+
+// MailCopy copies the mail into another mailbox with its date and flags. The
+// copy shares the contents, since they are never changed once stored.
+func (s *MemoryStorage) MailCopy(mailbox string, id int, destination string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, m := s.find(mailbox, id)
+	if m == nil {
+		return 0, storage.ErrNotFound
+	}
+	dest, ok := s.mailboxes[destination]
+	if !ok {
+		return 0, fmt.Errorf("mailbox %q does not exist", destination)
+	}
+	c := *m
+	c.ID = 1
+	if n := len(dest.mails); n > 0 {
+		c.ID = dest.mails[n-1].ID + 1
+	}
+	dest.mails = append(dest.mails, &c)
+	return c.ID, nil
+}
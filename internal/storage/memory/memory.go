@@ -0,0 +1,163 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package memory is a storage backend that keeps everything in memory, for
+// tests and for nodes that don't need to remember anything once they stop.
+// It behaves like the SQLite backend, down to how mail IDs are allocated.
+package memory
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	storage.Register("memory", func(u *url.URL) (storage.Storage, error) {
+		return NewMemoryStorage(), nil
+	})
+}
+
+type MemoryStorage struct {
+	mutex     sync.RWMutex
+	config    map[string]string
+	mailboxes map[string]*mailbox
+	queue     []queued
+	contacts  map[string]types.Contact
+	sieve     map[string]*sieveScript
+	vacation  map[vacationKey]int64
+	receipts  map[string][]types.Receipt
+	members   map[string]*listMember
+	gateway   map[string]types.GatewayMapping
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		config:    map[string]string{},
+		mailboxes: map[string]*mailbox{},
+		contacts:  map[string]types.Contact{},
+		sieve:     map[string]*sieveScript{},
+		vacation:  map[vacationKey]int64{},
+		receipts:  map[string][]types.Receipt{},
+		members:   map[string]*listMember{},
+		gateway:   map[string]types.GatewayMapping{},
+	}
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) ConfigGet(key string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.config[key], nil
+}
+
+func (s *MemoryStorage) ConfigSet(key, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config[key] = value
+	return nil
+}
+
+func (s *MemoryStorage) ConfigSetPassword(passwordHash string) error {
+	return s.ConfigSet("password", passwordHash)
+}
+
+func (s *MemoryStorage) ConfigTryPassword(password string) (bool, error) {
+	passwordHash, err := s.ConfigGet("password")
+	if err != nil {
+		return false, err
+	}
+	if passwordHash == "" {
+		return true, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type mailbox struct {
+	subscribed bool
+	mails      []*types.Mail // in order of ID
+}
+
+func (s *MemoryStorage) MailboxSelect(name string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.mailboxes[name]
+	return ok, nil
+}
+
+func (s *MemoryStorage) MailboxList(onlySubscribed bool) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var names []string
+	for name, mb := range s.mailboxes {
+		if !onlySubscribed || mb.subscribed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStorage) MailboxCreate(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.mailboxes[name]; !ok {
+		s.mailboxes[name] = &mailbox{subscribed: true}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) MailboxRename(old, new string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mb, ok := s.mailboxes[old]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.mailboxes[new]; ok {
+		return fmt.Errorf("mailbox %q already exists", new)
+	}
+	delete(s.mailboxes, old)
+	s.mailboxes[new] = mb
+	for i := range s.queue {
+		if s.queue[i].mailbox == old {
+			s.queue[i].mailbox = new
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) MailboxDelete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.mailboxes, name)
+	s.dequeue(func(q queued) bool {
+		return q.mailbox == name
+	})
+	return nil
+}
+
+func (s *MemoryStorage) MailboxSubscribe(name string, subscribed bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mb, ok := s.mailboxes[name]; ok {
+		mb.subscribed = subscribed
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memory
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// queued is a mail in the Outbox that is waiting to be sent to the
+// destination.
+type queued struct {
+	destination string
+	mailbox     string
+	id          int
+	from        string
+	rcpt        string
+}
+
+// dequeue removes the queued mails that match, i.e. because the mail that
+// they refer to has gone.
+func (s *MemoryStorage) dequeue(match func(q queued) bool) {
+	queue := s.queue[:0]
+	for _, q := range s.queue {
+		if !match(q) {
+			queue = append(queue, q)
+		}
+	}
+	s.queue = queue
+}
+
+func (s *MemoryStorage) QueueListDestinations() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	seen := map[string]struct{}{}
+	var destinations []string
+	for _, q := range s.queue {
+		if _, ok := seen[q.destination]; !ok {
+			seen[q.destination] = struct{}{}
+			destinations = append(destinations, q.destination)
+		}
+	}
+	sort.Strings(destinations)
+	return destinations, nil
+}
+
+func (s *MemoryStorage) QueueMailIDsForDestination(destination string) ([]types.QueuedMail, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var ids []types.QueuedMail
+	for _, q := range s.queue {
+		if q.destination == destination {
+			ids = append(ids, types.QueuedMail{ID: q.id, From: q.from, Rcpt: q.rcpt})
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return ids[i].ID > ids[j].ID
+	})
+	return ids, nil
+}
+
+func (s *MemoryStorage) QueueInsertDestinationForID(destination string, id int, from, rcpt string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, m := s.find("Outbox", id); m == nil {
+		return fmt.Errorf("mail %d is not in the Outbox", id)
+	}
+	for _, q := range s.queue {
+		if q.destination == destination && q.mailbox == "Outbox" && q.id == id {
+			return fmt.Errorf("mail %d is already queued for %q", id, destination)
+		}
+	}
+	s.queue = append(s.queue, queued{destination, "Outbox", id, from, rcpt})
+	return nil
+}
+
+func (s *MemoryStorage) QueueDeleteDestinationForID(destination string, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dequeue(func(q queued) bool {
+		return q.destination == destination && q.mailbox == "Outbox" && q.id == id
+	})
+	return nil
+}
+
+func (s *MemoryStorage) QueueSelectIsMessagePendingSend(mailbox string, id int) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, q := range s.queue {
+		if q.mailbox == mailbox && q.id == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,327 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// Contacts are keyed by the lower-cased name, since names are matched
+// without regard to case, like the SQLite backend does.
+func (s *MemoryStorage) ContactList() ([]types.Contact, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.contactList(), nil
+}
+
+func (s *MemoryStorage) ContactSelect(name string) (*types.Contact, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if c, ok := s.contacts[strings.ToLower(name)]; ok {
+		return &c, nil
+	}
+	contacts := s.contactList()
+	for _, c := range contacts {
+		if c.DisplayName != "" && strings.EqualFold(c.DisplayName, name) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) ContactSelectByKey(key string) (*types.Contact, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	contacts := s.contactList()
+	for _, c := range contacts {
+		if c.Key == key {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) contactList() []types.Contact {
+	contacts := make([]types.Contact, 0, len(s.contacts))
+	for _, c := range s.contacts {
+		contacts = append(contacts, c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return strings.ToLower(contacts[i].Name) < strings.ToLower(contacts[j].Name)
+	})
+	return contacts
+}
+
+func (s *MemoryStorage) ContactSet(name, key, displayName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.contacts[strings.ToLower(name)] = types.Contact{Name: name, Key: key, DisplayName: displayName}
+	return nil
+}
+
+func (s *MemoryStorage) ContactDelete(name string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.contacts[strings.ToLower(name)]; !ok {
+		return 0, nil
+	}
+	delete(s.contacts, strings.ToLower(name))
+	return 1, nil
+}
+
+type sieveScript struct {
+	script string
+	active bool
+}
+
+func (s *MemoryStorage) SieveList() ([]types.SieveScript, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	scripts := make([]types.SieveScript, 0, len(s.sieve))
+	for name, script := range s.sieve {
+		scripts = append(scripts, types.SieveScript{Name: name, Active: script.active})
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts, nil
+}
+
+func (s *MemoryStorage) SieveSelect(name string) (*types.SieveScript, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	script, ok := s.sieve[name]
+	if !ok {
+		return nil, nil
+	}
+	return &types.SieveScript{Name: name, Script: script.script, Active: script.active}, nil
+}
+
+func (s *MemoryStorage) SieveSelectActive() (*types.SieveScript, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for name, script := range s.sieve {
+		if script.active {
+			return &types.SieveScript{Name: name, Script: script.script, Active: true}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) SievePut(name, script string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if existing, ok := s.sieve[name]; ok {
+		existing.script = script
+	} else {
+		s.sieve[name] = &sieveScript{script: script}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) SieveDelete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sieve, name)
+	return nil
+}
+
+func (s *MemoryStorage) SieveRename(old, new string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	script, ok := s.sieve[old]
+	if !ok || old == new {
+		return nil
+	}
+	if _, ok := s.sieve[new]; ok {
+		return fmt.Errorf("script %q already exists", new)
+	}
+	delete(s.sieve, old)
+	s.sieve[new] = script
+	return nil
+}
+
+// SieveSetActive makes the named script the active one, or deactivates
+// all scripts if the name is empty.
+func (s *MemoryStorage) SieveSetActive(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for n, script := range s.sieve {
+		script.active = n == name
+	}
+	return nil
+}
+
+type vacationKey struct {
+	handle string
+	sender string
+}
+
+func (s *MemoryStorage) VacationLastSent(handle, sender string) (time.Time, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	sent, ok := s.vacation[vacationKey{handle, sender}]
+	if !ok {
+		return time.Time{}, nil
+	}
+	return time.Unix(sent, 0), nil
+}
+
+func (s *MemoryStorage) VacationRecordSent(handle, sender string, expiry time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, sent := range s.vacation {
+		if sent < expiry.Unix() {
+			delete(s.vacation, key)
+		}
+	}
+	s.vacation[vacationKey{handle, sender}] = time.Now().Unix()
+	return nil
+}
+
+func (s *MemoryStorage) ReceiptInsert(messageID, rcpt string, delivered time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	receipts := s.receipts[messageID]
+	for i := range receipts {
+		if receipts[i].Rcpt == rcpt {
+			receipts[i].Delivered = delivered
+			return nil
+		}
+	}
+	s.receipts[messageID] = append(receipts, types.Receipt{
+		MessageID: messageID,
+		Rcpt:      rcpt,
+		Delivered: delivered,
+	})
+	return nil
+}
+
+func (s *MemoryStorage) ReceiptSelect(messageID string) ([]types.Receipt, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	receipts := append([]types.Receipt(nil), s.receipts[messageID]...)
+	sort.SliceStable(receipts, func(i, j int) bool {
+		return receipts[i].Delivered.Before(receipts[j].Delivered)
+	})
+	return receipts, nil
+}
+
+type listMember struct {
+	owner  bool
+	joined int64
+}
+
+func (s *MemoryStorage) ListMemberList() ([]types.ListMember, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	members := make([]types.ListMember, 0, len(s.members))
+	for key, member := range s.members {
+		members = append(members, types.ListMember{
+			Key:    key,
+			Owner:  member.owner,
+			Joined: time.Unix(member.joined, 0),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].Joined.Equal(members[j].Joined) {
+			return members[i].Joined.Before(members[j].Joined)
+		}
+		return members[i].Key < members[j].Key
+	})
+	return members, nil
+}
+
+func (s *MemoryStorage) ListMemberSelect(key string) (*types.ListMember, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	member, ok := s.members[key]
+	if !ok {
+		return nil, nil
+	}
+	return &types.ListMember{Key: key, Owner: member.owner, Joined: time.Unix(member.joined, 0)}, nil
+}
+
+// ListMemberSet adds a member, or changes whether an existing member is an
+// owner without changing when they joined.
+func (s *MemoryStorage) ListMemberSet(key string, owner bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if member, ok := s.members[key]; ok {
+		member.owner = owner
+	} else {
+		s.members[key] = &listMember{owner: owner, joined: time.Now().Unix()}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ListMemberDelete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.members, key)
+	return nil
+}
+
+// Gateway mappings are keyed by the lower-cased address, like contacts.
+func (s *MemoryStorage) GatewayList() ([]types.GatewayMapping, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.gatewayList(), nil
+}
+
+func (s *MemoryStorage) gatewayList() []types.GatewayMapping {
+	mappings := make([]types.GatewayMapping, 0, len(s.gateway))
+	for _, mapping := range s.gateway {
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return strings.ToLower(mappings[i].Address) < strings.ToLower(mappings[j].Address)
+	})
+	return mappings
+}
+
+func (s *MemoryStorage) GatewaySelect(address string) (*types.GatewayMapping, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	mapping, ok := s.gateway[strings.ToLower(address)]
+	if !ok {
+		return nil, nil
+	}
+	return &mapping, nil
+}
+
+func (s *MemoryStorage) GatewaySelectByKey(key string) (*types.GatewayMapping, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, mapping := range s.gatewayList() {
+		if mapping.Key == key {
+			return &mapping, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) GatewaySet(address, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gateway[strings.ToLower(address)] = types.GatewayMapping{Address: address, Key: key}
+	return nil
+}
+
+func (s *MemoryStorage) GatewayDelete(address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.gateway, strings.ToLower(address))
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBackend is the backend that is used for a plain path rather than
+// a URI, i.e. "yggmail.db".
+const DefaultBackend = "sqlite3"
+
+// ErrNotFound is returned by backends when a mail doesn't exist. It is the
+// same as sql.ErrNoRows, which the SQLite backend returns.
+var ErrNotFound = sql.ErrNoRows
+
+// Backend opens a storage backend from its URI. Backends register themselves
+// by the scheme of the URI that selects them, i.e. "sqlite3:///yggmail.db".
+type Backend func(u *url.URL) (Storage, error)
+
+var backends = struct {
+	sync.RWMutex
+	m map[string]Backend
+}{m: map[string]Backend{}}
+
+// Register makes a backend available to Open under the given scheme.
+func Register(scheme string, backend Backend) {
+	backends.Lock()
+	defer backends.Unlock()
+	if _, ok := backends.m[scheme]; ok {
+		panic("storage: backend registered twice: " + scheme)
+	}
+	backends.m[scheme] = backend
+}
+
+// Backends returns the schemes of the registered backends.
+func Backends() []string {
+	backends.RLock()
+	defer backends.RUnlock()
+	schemes := make([]string, 0, len(backends.m))
+	for scheme := range backends.m {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// ParseURI parses a storage URI. Anything without a scheme is taken to be
+// the path of a database for the default backend.
+func ParseURI(uri string) (*url.URL, error) {
+	if !strings.Contains(uri, "://") {
+		return &url.URL{Scheme: DefaultBackend, Path: uri}, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	return u, nil
+}
+
+// Path returns the path from a storage URI. Both "sqlite3:///var/yggmail.db"
+// and the relative "sqlite3://yggmail.db" work.
+func Path(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// Open opens the storage backend that the URI selects.
+func Open(uri string) (Storage, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	backends.RLock()
+	backend, ok := backends.m[u.Scheme]
+	backends.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, expected one of %q", u.Scheme, Backends())
+	}
+	return backend(u)
+}
@@ -0,0 +1,111 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	gosqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// schemaTables are the tables that a database must have for us to be able
+// to use it, i.e. when restoring from a backup.
+var schemaTables = []string{
+	"config", "mailboxes", "mails", "queue",
+}
+
+// Snapshot writes a consistent copy of the database to the given file using
+// the SQLite online backup API. It is safe to call while the database is in
+// use, even from another process.
+func (s *SQLite3Storage) Snapshot(filename string) error {
+	return snapshot(s.db, filename)
+}
+
+func snapshot(db *sql.DB, filename string) error {
+	ctx := context.Background()
+	dst, err := sql.Open("sqlite3", "file:"+filename)
+	if err != nil {
+		return fmt.Errorf("sql.Open: %w", err)
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("dst.Conn: %w", err)
+	}
+	defer dstConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Conn: %w", err)
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			backup, err := dc.(*gosqlite3.SQLiteConn).Backup("main", sc.(*gosqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("Backup: %w", err)
+			}
+			// Copying everything in a single step means that the snapshot
+			// can't be restarted by writes that happen part way through.
+			if _, err := backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return fmt.Errorf("backup.Step: %w", err)
+			}
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("backup.Finish: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// Verify checks that the given database file is intact and that it has
+// the schema and identity that we expect. The file is opened read-only.
+func Verify(filename string) error {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("sql.Open: %w", err)
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("db.QueryRow(integrity_check): %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("schemaVersion: %w", err)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w (schema version %d, we support up to %d)", ErrSchemaTooNew, version, SchemaVersion)
+	}
+	for _, table := range schemaTables {
+		var count int
+		if err := db.QueryRow(
+			"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1", table,
+		).Scan(&count); err != nil {
+			return fmt.Errorf("db.QueryRow(sqlite_master): %w", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("database is missing the %q table", table)
+		}
+	}
+	var sk string
+	if err := db.QueryRow("SELECT value FROM config WHERE key = 'private_key'").Scan(&sk); err == sql.ErrNoRows || sk == "" {
+		return fmt.Errorf("database has no private key")
+	} else if err != nil {
+		return fmt.Errorf("db.QueryRow(config): %w", err)
+	}
+	return nil
+}
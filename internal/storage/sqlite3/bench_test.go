@@ -0,0 +1,126 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const benchmarkMailbox = "INBOX"
+
+var benchmarkMails = flag.Int("mails", 100000, "Number of mails in the mailbox to benchmark against")
+
+// BenchmarkMailbox fills a scratch database with a mailbox of -mails mails
+// and measures what resolving sequence numbers and UIDs costs against it,
+// i.e. what a FETCH 1:* on a large mailbox turns into. Every other ID is
+// left unused, so that the UIDs are sparse like they are after mail has
+// been expunged. Run it with:
+//
+//	go test -run - -bench . ./internal/storage/sqlite3 -mails=100000
+func BenchmarkMailbox(b *testing.B) {
+	s, err := NewSQLite3StorageStorage(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("NewSQLite3StorageStorage: %s", err)
+	}
+	defer s.Close()
+	if err := s.MailboxCreate(benchmarkMailbox); err != nil {
+		b.Fatalf("s.MailboxCreate: %s", err)
+	}
+	mails := *benchmarkMails
+	if err := s.writer.Do(func(txn *sql.Tx) error {
+		now := time.Now().Unix()
+		for i := 0; i < mails; i++ {
+			hash, err := storeBlob(txn, s.crypt, []byte(fmt.Sprintf(
+				"Subject: Benchmark %d\r\n\r\nThis is mail number %d.\r\n", i, i,
+			)))
+			if err != nil {
+				return err
+			}
+			if _, err := txn.Exec(
+				"INSERT INTO mails (mailbox, id, blob, datetime) VALUES($1, $2, $3, $4)",
+				benchmarkMailbox, i*2+1, hash, now,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		b.Fatalf("s.writer.Do: %s", err)
+	}
+	middle := mails / 2
+
+	b.Run("SequenceRangeAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.MailRange(benchmarkMailbox, false, 1, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("UIDRangeAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.MailRange(benchmarkMailbox, true, 1, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SequenceRangeOf100InTheMiddle", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.MailRange(benchmarkMailbox, false, middle, middle+99); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SequenceNumberInTheMiddle", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.MailIDForSeq(benchmarkMailbox, middle); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("MailInTheMiddle", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := s.MailSelect(benchmarkMailbox, middle*2+1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SequenceNumberInTheMiddleFromInboxesView", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var id int
+			if err := s.db.QueryRow(
+				"SELECT id FROM inboxes WHERE mailbox = $1 AND seq = $2", benchmarkMailbox, middle,
+			).Scan(&id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ParallelDeliveries", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := s.MailCreate(benchmarkMailbox, []byte("Subject: Delivery\r\n\r\nHello.\r\n")); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	stats := s.Stats()
+	b.Logf("Write tasks: %d in %d transactions (at most %d in one), %d failed",
+		stats.Writer.Tasks, stats.Writer.Batches, stats.Writer.MaxBatch, stats.Writer.Failed)
+	b.Logf("Time waiting to write: %s, time spent writing: %s",
+		stats.Writer.Waiting, stats.Writer.Running)
+	b.Logf("Time waiting for a read connection: %s (%d times)",
+		stats.Reads.WaitDuration, stats.Reads.WaitCount)
+}
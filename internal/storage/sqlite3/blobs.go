@@ -0,0 +1,265 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// Mail contents are stored once in the blobs table, keyed by their hash, so
+// that copies of the same mail in several mailboxes share a single blob. The
+// triggers count the references from the mails table and remove a blob once
+// nothing refers to it any more, i.e. when the last copy is expunged.
+const blobsSchema = `
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash		TEXT NOT NULL,
+		data		BLOB NOT NULL,
+		compressed	BOOLEAN NOT NULL DEFAULT 0,
+		refs		INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(hash)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS mails_blob_insert AFTER INSERT ON mails BEGIN
+		UPDATE blobs SET refs = refs + 1 WHERE hash = NEW.blob;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS mails_blob_update AFTER UPDATE OF blob ON mails BEGIN
+		UPDATE blobs SET refs = refs + 1 WHERE hash = NEW.blob;
+		UPDATE blobs SET refs = refs - 1 WHERE hash = OLD.blob;
+		DELETE FROM blobs WHERE hash = OLD.blob AND refs <= 0;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS mails_blob_delete AFTER DELETE ON mails BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE hash = OLD.blob;
+		DELETE FROM blobs WHERE hash = OLD.blob AND refs <= 0;
+	END;
+`
+
+const selectBlobChunkStmt = `
+	SELECT SUBSTR(data, $1, $2) FROM blobs WHERE hash = $3
+`
+
+const insertBlobStmt = `
+	INSERT OR IGNORE INTO blobs (hash, data, compressed, meta) VALUES($1, $2, $3, $4)
+`
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compress returns the compressed data, or the data as it was if it doesn't
+// get any smaller, i.e. if it is mostly attachments that are compressed
+// already.
+func compress(data []byte) ([]byte, bool) {
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return data, false
+	}
+	return compressed, true
+}
+
+// storeBlob stores the mail contents if there isn't a blob with the same
+// contents already, and returns the hash to refer to it by. The reference
+// is counted when a mail that refers to it is inserted.
+func storeBlob(txn *sql.Tx, crypt *Crypt, data []byte) (string, error) {
+	hash, err := crypt.hash(data)
+	if err != nil {
+		return "", err
+	}
+	stored, compressed := compress(data)
+	if stored, err = crypt.seal(stored); err != nil {
+		return "", err
+	}
+	meta, err := encodeMeta(crypt, types.ParseMailMeta(data))
+	if err != nil {
+		return "", err
+	}
+	if _, err := txn.Exec(insertBlobStmt, hash, stored, compressed, meta); err != nil {
+		return "", fmt.Errorf("txn.Exec: %w", err)
+	}
+	return hash, nil
+}
+
+// openBlob returns the mail contents from a stored blob.
+func openBlob(crypt *Crypt, data []byte, compressed bool) ([]byte, error) {
+	data, err := crypt.open(data)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data, compressed)
+}
+
+// openBlobReader returns a reader for the mail contents from a stored blob,
+// which decompresses them as they are read rather than all at once.
+func openBlobReader(crypt *Crypt, data []byte, compressed bool) (io.ReadCloser, error) {
+	data, err := crypt.open(data)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("zstd.NewReader: %w", err)
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// blobChunkSize is how much of a blob is read from the database at a time.
+const blobChunkSize = 64 * 1024
+
+// blobReader reads a stored blob from the database a chunk at a time, so
+// that a large mail is never held in memory all at once. Each chunk is a
+// query of its own rather than part of one long transaction, so that an
+// open reader doesn't hold on to one of the read connections. That is safe
+// since a blob is only ever changed in place when it is re-sealed, which
+// needs the whole blob anyway, and otherwise moves to a new hash, which is
+// noticed as the blob going missing part way through.
+type blobReader struct {
+	stmt   *sql.Stmt
+	hash   string
+	offset int64 // of the next chunk to read from the database
+	length int64
+	chunk  []byte
+}
+
+func (r *blobReader) fill() error {
+	if r.offset >= r.length {
+		return io.EOF
+	}
+	var chunk []byte
+	err := r.stmt.QueryRow(r.offset+1, blobChunkSize, r.hash).Scan(&chunk)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("blob %s went away while it was being read", r.hash)
+	} else if err != nil {
+		return fmt.Errorf("r.stmt.QueryRow: %w", err)
+	}
+	if len(chunk) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.offset += int64(len(chunk))
+	r.chunk = chunk
+	return nil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// streamBlob returns a reader for the mail contents from a stored blob that
+// reads and decompresses it as it goes. An encrypted blob is sealed as a
+// whole, so it has to be read whole before it can be opened.
+func streamBlob(crypt *Crypt, blob *blobReader, compressed bool) (io.ReadCloser, error) {
+	if err := blob.fill(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isEncrypted(blob.chunk) {
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			return nil, fmt.Errorf("io.ReadAll: %w", err)
+		}
+		return openBlobReader(crypt, data, compressed)
+	}
+	if !compressed {
+		return io.NopCloser(blob), nil
+	}
+	decoder, err := zstd.NewReader(blob, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("zstd.NewReader: %w", err)
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func decompress(data []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return data, nil
+	}
+	data, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstdDecoder.DecodeAll: %w", err)
+	}
+	return data, nil
+}
+
+func sha256Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateBlobs moves the contents of existing mails into the blobs table.
+// Mails that are encrypted can't be hashed by their contents, since the
+// database isn't unlocked while it is migrated, so they are stored as they
+// are and only deduplicated once the data key is next rotated.
+func migrateBlobs(txn *sql.Tx) error {
+	if _, err := txn.Exec(blobsSchema); err != nil {
+		return fmt.Errorf("txn.Exec: %w", err)
+	}
+	if _, err := txn.Exec("ALTER TABLE mails ADD COLUMN blob TEXT REFERENCES blobs(hash)"); err != nil {
+		return fmt.Errorf("txn.Exec: %w", err)
+	}
+	type key struct {
+		mailbox string
+		id      int
+	}
+	var keys []key
+	rows, err := txn.Query("SELECT mailbox, id FROM mails")
+	if err != nil {
+		return fmt.Errorf("txn.Query: %w", err)
+	}
+	for rows.Next() {
+		var k key
+		if err := rows.Scan(&k.mailbox, &k.id); err != nil {
+			rows.Close()
+			return fmt.Errorf("rows.Scan: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	for _, k := range keys {
+		var data []byte
+		if err := txn.QueryRow("SELECT mail FROM mails WHERE mailbox = $1 AND id = $2", k.mailbox, k.id).Scan(&data); err != nil {
+			return fmt.Errorf("txn.QueryRow: %w", err)
+		}
+		hash, stored, compressed := sha256Hash(data), data, false
+		if !isEncrypted(data) {
+			stored, compressed = compress(data)
+		}
+		if _, err := txn.Exec(
+			"INSERT OR IGNORE INTO blobs (hash, data, compressed) VALUES($1, $2, $3)",
+			hash, stored, compressed,
+		); err != nil {
+			return fmt.Errorf("txn.Exec: %w", err)
+		}
+		if _, err := txn.Exec("UPDATE mails SET blob = $1 WHERE mailbox = $2 AND id = $3", hash, k.mailbox, k.id); err != nil {
+			return fmt.Errorf("txn.Exec: %w", err)
+		}
+	}
+	if _, err := txn.Exec("ALTER TABLE mails DROP COLUMN mail"); err != nil {
+		return fmt.Errorf("txn.Exec: %w", err)
+	}
+	return nil
+}
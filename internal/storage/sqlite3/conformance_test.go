@@ -0,0 +1,27 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/neilalexander/yggmail/internal/storage"
+	"github.com/neilalexander/yggmail/internal/storage/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) storage.Storage {
+		s, err := NewSQLite3StorageStorage(filepath.Join(t.TempDir(), "yggmail.db"))
+		if err != nil {
+			t.Fatalf("NewSQLite3StorageStorage: %s", err)
+		}
+		return s
+	})
+}
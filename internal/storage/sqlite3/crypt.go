@@ -0,0 +1,493 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encryption at rest works with a random data key, which encrypts the mail
+// blobs and the sensitive config values, such as the private key. The data key is
+// itself encrypted with a key derived from the passphrase using Argon2id and
+// stored in the config table, so that changing the passphrase doesn't mean
+// encrypting everything again, but rotating the data key does.
+const encryptionKeyConfig = "encryption_key"
+
+// encryptedConfigKeys are the config values that are encrypted.
+var encryptedConfigKeys = map[string]struct{}{
+	"private_key": {},
+}
+
+// Encrypted values start with a prefix that plain mail or config values
+// never will, so that values written before encryption was enabled can
+// still be told apart from encrypted ones.
+var encryptedPrefix = []byte{0, 'Y', 'E', 1}
+
+const encryptedConfigPrefix = "enc:"
+
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	saltSize     = 16
+)
+
+var (
+	// ErrLocked is returned when encrypted data is read or written before
+	// the storage has been unlocked.
+	ErrLocked = errors.New("storage is encrypted and has not been unlocked")
+	// ErrWrongPassphrase is returned when the passphrase doesn't unlock the
+	// data key.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// Crypt holds the data key once the storage has been unlocked. It is shared
+// by the tables that have encrypted columns.
+type Crypt struct {
+	mutex   sync.RWMutex
+	enabled bool
+	aead    cipher.AEAD // nil while locked or if encryption is disabled
+	hashKey []byte      // keys the hashes of blobs while encryption is enabled
+}
+
+func (c *Crypt) state() (bool, cipher.AEAD) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.enabled, c.aead
+}
+
+func (c *Crypt) seal(plain []byte) ([]byte, error) {
+	enabled, aead := c.state()
+	if !enabled {
+		return plain, nil
+	}
+	return sealWith(aead, plain)
+}
+
+func (c *Crypt) open(data []byte) ([]byte, error) {
+	_, aead := c.state()
+	return openWith(aead, data)
+}
+
+func (c *Crypt) sealString(plain string) (string, error) {
+	enabled, aead := c.state()
+	if !enabled {
+		return plain, nil
+	}
+	return sealStringWith(aead, plain)
+}
+
+func (c *Crypt) openString(value string) (string, error) {
+	_, aead := c.state()
+	return openStringWith(aead, value)
+}
+
+// hash returns the hash that mail contents are stored under. While the
+// database is encrypted, the hash is keyed so that it doesn't give away
+// whether the database holds a given mail.
+func (c *Crypt) hash(data []byte) (string, error) {
+	c.mutex.RLock()
+	enabled, hashKey := c.enabled, c.hashKey
+	c.mutex.RUnlock()
+	if enabled && hashKey == nil {
+		return "", ErrLocked
+	}
+	return hashWith(hashKey, data), nil
+}
+
+func hashWith(hashKey, data []byte) string {
+	if hashKey == nil {
+		return sha256Hash(data)
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func blobHashKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	_, _ = mac.Write([]byte("yggmail blob hash"))
+	return mac.Sum(nil)
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedPrefix)
+}
+
+func sealWith(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, ErrLocked
+	}
+	nonce := make([]byte, aead.NonceSize(), len(encryptedPrefix)+aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	sealed := append(append([]byte{}, encryptedPrefix...), nonce...)
+	return aead.Seal(sealed, nonce, plain, encryptedPrefix), nil
+}
+
+func openWith(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if aead == nil {
+		return nil, ErrLocked
+	}
+	data = data[len(encryptedPrefix):]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], encryptedPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("aead.Open: %w", err)
+	}
+	return plain, nil
+}
+
+func sealStringWith(aead cipher.AEAD, plain string) (string, error) {
+	sealed, err := sealWith(aead, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+	return encryptedConfigPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openStringWith(aead cipher.AEAD, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedConfigPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedConfigPrefix))
+	if err != nil {
+		return "", fmt.Errorf("base64.DecodeString: %w", err)
+	}
+	plain, err := openWith(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// wrapKey encrypts the data key with the passphrase. The result holds the
+// Argon2id parameters, the salt and the encrypted data key.
+func wrapKey(passphrase string, dataKey []byte) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	kek, err := chacha20poly1305.NewX(argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize))
+	if err != nil {
+		return "", fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+	wrapped, err := sealWith(kek, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("argon2id$m=%d,t=%d,p=%d$%s$%s",
+		argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(wrapped),
+	), nil
+}
+
+// unwrapKey decrypts the data key with the passphrase.
+func unwrapKey(passphrase, record string) ([]byte, error) {
+	parts := strings.Split(record, "$")
+	if len(parts) != 4 || parts[0] != "argon2id" {
+		return nil, errors.New("unknown encryption key format")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return nil, fmt.Errorf("fmt.Sscanf: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("base64.DecodeString: %w", err)
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("base64.DecodeString: %w", err)
+	}
+	kek, err := chacha20poly1305.NewX(argon2.IDKey([]byte(passphrase), salt, time, memory, threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+	dataKey, err := openWith(kek, wrapped)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return dataKey, nil
+}
+
+// EncryptionEnabled returns true if the database is encrypted at rest.
+func (s *SQLite3Storage) EncryptionEnabled() bool {
+	enabled, _ := s.crypt.state()
+	return enabled
+}
+
+// Unlock decrypts the data key with the passphrase, so that encrypted mail
+// and config values can be read and written.
+func (s *SQLite3Storage) Unlock(passphrase string) error {
+	record, err := s.ConfigGet(encryptionKeyConfig)
+	if err != nil {
+		return fmt.Errorf("s.ConfigGet: %w", err)
+	}
+	if record == "" {
+		return errors.New("the database is not encrypted")
+	}
+	dataKey, err := unwrapKey(passphrase, record)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(dataKey)
+	if err != nil {
+		return fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+	s.crypt.mutex.Lock()
+	defer s.crypt.mutex.Unlock()
+	s.crypt.aead, s.crypt.hashKey = aead, blobHashKey(dataKey)
+	return nil
+}
+
+// EnableEncryption encrypts the database with a new data key protected by
+// the given passphrase.
+func (s *SQLite3Storage) EnableEncryption(passphrase string) error {
+	if s.EncryptionEnabled() {
+		return errors.New("the database is already encrypted")
+	}
+	return s.rekey(passphrase, true)
+}
+
+// RotateKey encrypts the database again with a new data key. The passphrase
+// that protects it can be changed at the same time.
+func (s *SQLite3Storage) RotateKey(passphrase string) error {
+	if _, aead := s.crypt.state(); aead == nil {
+		return ErrLocked
+	}
+	return s.rekey(passphrase, true)
+}
+
+// DisableEncryption decrypts the database and removes the data key.
+func (s *SQLite3Storage) DisableEncryption() error {
+	if _, aead := s.crypt.state(); aead == nil {
+		return ErrLocked
+	}
+	return s.rekey("", false)
+}
+
+// ChangePassphrase protects the data key with a new passphrase. Nothing
+// else needs to be encrypted again.
+func (s *SQLite3Storage) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	record, err := s.ConfigGet(encryptionKeyConfig)
+	if err != nil {
+		return fmt.Errorf("s.ConfigGet: %w", err)
+	}
+	if record == "" {
+		return errors.New("the database is not encrypted")
+	}
+	dataKey, err := unwrapKey(oldPassphrase, record)
+	if err != nil {
+		return err
+	}
+	if record, err = wrapKey(newPassphrase, dataKey); err != nil {
+		return err
+	}
+	// The data key wrapped with the old passphrase mustn't be left behind
+	// for the old passphrase to unwrap.
+	if err := s.secureDelete(); err != nil {
+		return err
+	}
+	if err := s.ConfigSet(encryptionKeyConfig, record); err != nil {
+		return err
+	}
+	return s.scrub()
+}
+
+// rekey encrypts everything with a new data key, or decrypts everything if
+// encryption is being disabled, in a single transaction.
+func (s *SQLite3Storage) rekey(passphrase string, enable bool) error {
+	_, oldAEAD := s.crypt.state()
+	var newAEAD cipher.AEAD
+	var hashKey []byte
+	record := ""
+	if enable {
+		dataKey := make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return fmt.Errorf("rand.Read: %w", err)
+		}
+		var err error
+		if newAEAD, err = chacha20poly1305.NewX(dataKey); err != nil {
+			return fmt.Errorf("chacha20poly1305.NewX: %w", err)
+		}
+		if record, err = wrapKey(passphrase, dataKey); err != nil {
+			return err
+		}
+		hashKey = blobHashKey(dataKey)
+	}
+
+	if err := s.secureDelete(); err != nil {
+		return err
+	}
+	err := s.writer.Do(func(txn *sql.Tx) error {
+		if err := reencryptBlobs(txn, oldAEAD, newAEAD, hashKey); err != nil {
+			return fmt.Errorf("reencryptBlobs: %w", err)
+		}
+		for key := range encryptedConfigKeys {
+			if err := reencryptConfig(txn, key, oldAEAD, newAEAD); err != nil {
+				return fmt.Errorf("reencryptConfig: %w", err)
+			}
+		}
+		if !enable {
+			_, err := txn.Exec("DELETE FROM config WHERE key = $1", encryptionKeyConfig)
+			return err
+		}
+		_, err := txn.Exec("INSERT OR REPLACE INTO config (key, value) VALUES($1, $2)", encryptionKeyConfig, record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.crypt.mutex.Lock()
+	s.crypt.enabled, s.crypt.aead, s.crypt.hashKey = enable, newAEAD, hashKey
+	s.crypt.mutex.Unlock()
+	if !enable {
+		return nil
+	}
+	return s.scrub()
+}
+
+// secureDelete makes SQLite overwrite what it deletes with zeroes, rather
+// than only marking it as free, on the write connection.
+func (s *SQLite3Storage) secureDelete() error {
+	if _, err := s.writer.db.Exec("PRAGMA secure_delete = ON"); err != nil {
+		return fmt.Errorf("s.writer.db.Exec(secure_delete): %w", err)
+	}
+	return nil
+}
+
+// scrub gets rid of the old contents of the database once everything has
+// been encrypted again. Otherwise the plaintext, or the data under the old
+// key, could still be recovered from free pages in the database and from
+// the WAL by anyone who copies them. VACUUM rebuilds the database without
+// any free pages, and the checkpoint then writes the WAL back into the
+// database and truncates it.
+func (s *SQLite3Storage) scrub() error {
+	if _, err := s.writer.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("s.writer.db.Exec(VACUUM): %w", err)
+	}
+	var busy, frames, checkpointed int
+	if err := s.writer.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &frames, &checkpointed); err != nil {
+		return fmt.Errorf("s.writer.db.QueryRow(wal_checkpoint): %w", err)
+	}
+	if busy != 0 {
+		return errors.New("the WAL is in use and could not be truncated, check that Yggmail isn't running")
+	}
+	return nil
+}
+
+// reencryptBlobs encrypts every blob with the new key. Since the hashes of
+// blobs are keyed too, each blob is moved to its new hash, which merges any
+// blobs that turn out to have the same contents.
+func reencryptBlobs(txn *sql.Tx, from, to cipher.AEAD, hashKey []byte) error {
+	var hashes []string
+	rows, err := txn.Query("SELECT hash FROM blobs")
+	if err != nil {
+		return fmt.Errorf("txn.Query: %w", err)
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("rows.Scan: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	for _, hash := range hashes {
+		var data, meta []byte
+		var compressed bool
+		if err := txn.QueryRow("SELECT data, compressed, meta FROM blobs WHERE hash = $1", hash).Scan(&data, &compressed, &meta); err != nil {
+			return fmt.Errorf("txn.QueryRow: %w", err)
+		}
+		if meta != nil {
+			if meta, err = openWith(from, meta); err != nil {
+				return fmt.Errorf("openWith: %w", err)
+			}
+			if to != nil {
+				if meta, err = sealWith(to, meta); err != nil {
+					return fmt.Errorf("sealWith: %w", err)
+				}
+			}
+		}
+		if data, err = openWith(from, data); err != nil {
+			return fmt.Errorf("openWith: %w", err)
+		}
+		if data, err = decompress(data, compressed); err != nil {
+			return fmt.Errorf("decompress: %w", err)
+		}
+		newHash := hashWith(hashKey, data)
+		data, compressed = compress(data)
+		if to != nil {
+			if data, err = sealWith(to, data); err != nil {
+				return fmt.Errorf("sealWith: %w", err)
+			}
+		}
+		if newHash == hash {
+			if _, err := txn.Exec("UPDATE blobs SET data = $1, compressed = $2, meta = $3 WHERE hash = $4", data, compressed, meta, hash); err != nil {
+				return fmt.Errorf("txn.Exec: %w", err)
+			}
+			continue
+		}
+		// Moving the mails over to the new blob moves the references with
+		// them, and the old blob goes once the last one has moved.
+		if _, err := txn.Exec(insertBlobStmt, newHash, data, compressed, meta); err != nil {
+			return fmt.Errorf("txn.Exec: %w", err)
+		}
+		if _, err := txn.Exec("UPDATE mails SET blob = $1 WHERE blob = $2", newHash, hash); err != nil {
+			return fmt.Errorf("txn.Exec: %w", err)
+		}
+	}
+	return nil
+}
+
+func reencryptConfig(txn *sql.Tx, key string, from, to cipher.AEAD) error {
+	var value string
+	err := txn.QueryRow("SELECT value FROM config WHERE key = $1", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("txn.QueryRow: %w", err)
+	}
+	if value, err = openStringWith(from, value); err != nil {
+		return fmt.Errorf("openStringWith: %w", err)
+	}
+	if to != nil {
+		if value, err = sealStringWith(to, value); err != nil {
+			return fmt.Errorf("sealStringWith: %w", err)
+		}
+	}
+	_, err = txn.Exec("UPDATE config SET value = $1 WHERE key = $2", value, key)
+	return err
+}
@@ -0,0 +1,84 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+// encodeMeta serialises the metadata to store alongside the blob. It holds
+// the header, so it is encrypted like the mail itself.
+func encodeMeta(crypt *Crypt, meta *types.MailMeta) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return crypt.seal(data)
+}
+
+func decodeMeta(crypt *Crypt, data []byte) (*types.MailMeta, error) {
+	data, err := crypt.open(data)
+	if err != nil {
+		return nil, err
+	}
+	meta := &types.MailMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return meta, nil
+}
+
+// migrateMeta adds the metadata to the blobs. Blobs that are encrypted can't
+// be parsed while the database is being migrated, so their metadata is
+// worked out the first time that they are fetched instead.
+func migrateMeta(txn *sql.Tx) error {
+	if _, err := txn.Exec("ALTER TABLE blobs ADD COLUMN meta BLOB"); err != nil {
+		return fmt.Errorf("txn.Exec: %w", err)
+	}
+	var hashes []string
+	rows, err := txn.Query("SELECT hash FROM blobs")
+	if err != nil {
+		return fmt.Errorf("txn.Query: %w", err)
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("rows.Scan: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	for _, hash := range hashes {
+		var data []byte
+		var compressed bool
+		if err := txn.QueryRow("SELECT data, compressed FROM blobs WHERE hash = $1", hash).Scan(&data, &compressed); err != nil {
+			return fmt.Errorf("txn.QueryRow: %w", err)
+		}
+		if isEncrypted(data) {
+			continue
+		}
+		if data, err = decompress(data, compressed); err != nil {
+			return fmt.Errorf("decompress: %w", err)
+		}
+		meta, err := json.Marshal(types.ParseMailMeta(data))
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+		if _, err := txn.Exec("UPDATE blobs SET meta = $1 WHERE hash = $2", meta, hash); err != nil {
+			return fmt.Errorf("txn.Exec: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import "github.com/neilalexander/yggmail/internal/metrics"
+
+var (
+	writerWait         = metrics.NewHistogram("yggmail_sqlite_writer_wait_seconds", "How long write tasks waited behind other writes before their transaction began.", metrics.DurationBuckets)
+	writerTransactions = metrics.NewHistogram("yggmail_sqlite_writer_transaction_seconds", "How long each write transaction took, including the sync to disk.", metrics.DurationBuckets)
+	writerTasks        = metrics.NewCounter("yggmail_sqlite_writer_tasks_total", "Write tasks run, by whether they were committed.", "result")
+	databaseSize       = metrics.NewGauge("yggmail_sqlite_database_bytes", "Size of the database file, not counting the write-ahead log.")
+)
+
+// CollectMetrics sets the database size gauge. It is meant to be passed to
+// metrics.Collect.
+func (s *SQLite3Storage) CollectMetrics() {
+	var pages, size int64
+	if err := s.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return
+	}
+	if err := s.db.QueryRow("PRAGMA page_size").Scan(&size); err != nil {
+		return
+	}
+	databaseSize.Set(float64(pages * size))
+}
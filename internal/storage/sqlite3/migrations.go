@@ -0,0 +1,190 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// migration moves the schema from the previous version to this one. Each
+// migration runs in its own transaction along with recording the version,
+// so a failed migration leaves the database as it was.
+type migration struct {
+	version     int
+	description string
+	migrate     func(txn *sql.Tx) error
+}
+
+// migrations must be kept in order, and once released must never change,
+// since databases out there have already been migrated by them. A schema
+// change always needs a new migration at the end.
+var migrations = []migration{
+	{
+		// Databases from before schema versioning may have any of these
+		// tables already, so they are only created if they don't exist.
+		version:     1,
+		description: "Create the initial schema",
+		migrate: execMigration(
+			configSchema, mailboxesSchema, mailsSchema, queueSchema,
+			contactsSchema, sieveSchema, vacationSchema,
+			listMembersSchema, gatewaySchema,
+		),
+	},
+	{
+		version:     2,
+		description: "Store mail contents in a deduplicated and compressed blob table",
+		migrate:     migrateBlobs,
+	},
+	{
+		version:     3,
+		description: "Store the envelope and body structure of mails for FETCH",
+		migrate:     migrateMeta,
+	},
+	{
+		version:     4,
+		description: "Record delivery receipts for sent mail",
+		migrate:     execMigration(receiptsSchema),
+	},
+}
+
+// SchemaVersion is the version of the schema that this build uses. It will
+// not open databases with a newer schema than this.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+const schemaVersionSchema = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version		INTEGER NOT NULL,
+		description	TEXT NOT NULL,
+		datetime	INTEGER NOT NULL,
+		PRIMARY KEY(version)
+	);
+`
+
+// ErrSchemaTooNew is returned when a database has been migrated by a newer
+// version of Yggmail than this one.
+var ErrSchemaTooNew = errors.New("database was created by a newer version of Yggmail")
+
+func execMigration(statements ...string) func(txn *sql.Tx) error {
+	return func(txn *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := txn.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migration describes a migration that has been, or would be, applied.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// Migrate brings the database up to the current schema version. A backup
+// of an existing database is taken first. With dryRun, the migrations that
+// would be applied are returned without changing anything.
+func Migrate(filename string, dryRun bool) ([]Migration, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("sql.Open: %w", err)
+	}
+	defer db.Close()
+	return migrate(db, filename, dryRun)
+}
+
+// DatabaseVersion returns the schema version of the given database without
+// migrating it.
+func DatabaseVersion(filename string) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("sql.Open: %w", err)
+	}
+	defer db.Close()
+	return schemaVersion(db)
+}
+
+func migrate(db *sql.DB, filename string, dryRun bool) ([]Migration, error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, fmt.Errorf("schemaVersion: %w", err)
+	}
+	if current > SchemaVersion {
+		return nil, fmt.Errorf("%w (schema version %d, we support up to %d)", ErrSchemaTooNew, current, SchemaVersion)
+	}
+	var pending []migration
+	var applied []Migration
+	for _, m := range migrations {
+		if m.version > current {
+			pending = append(pending, m)
+			applied = append(applied, Migration{m.version, m.description})
+		}
+	}
+	if dryRun || len(pending) == 0 {
+		return applied, nil
+	}
+
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		return nil, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	if tables > 0 && filename != ":memory:" {
+		backup := fmt.Sprintf("%s.v%d.bak", filename, current)
+		if err := snapshot(db, backup); err != nil {
+			return nil, fmt.Errorf("snapshot: %w", err)
+		}
+	}
+
+	if _, err := db.Exec(schemaVersionSchema); err != nil {
+		return nil, fmt.Errorf("db.Exec: %w", err)
+	}
+	for _, m := range pending {
+		txn, err := db.Begin()
+		if err != nil {
+			return nil, fmt.Errorf("db.Begin: %w", err)
+		}
+		if err := m.migrate(txn); err != nil {
+			_ = txn.Rollback()
+			return nil, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if _, err := txn.Exec(
+			"INSERT INTO schema_version (version, description, datetime) VALUES($1, $2, $3)",
+			m.version, m.description, time.Now().Unix(),
+		); err != nil {
+			_ = txn.Rollback()
+			return nil, fmt.Errorf("txn.Exec: %w", err)
+		}
+		if err := txn.Commit(); err != nil {
+			return nil, fmt.Errorf("txn.Commit: %w", err)
+		}
+	}
+	return applied, nil
+}
+
+// schemaVersion returns the version of the schema of the database, which
+// is zero if it has never been migrated.
+func schemaVersion(db *sql.DB) (int, error) {
+	var count int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'",
+	).Scan(&count); err != nil {
+		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	var version int
+	if err := db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("db.QueryRow: %w", err)
+	}
+	return version, nil
+}
@@ -11,8 +11,12 @@ package sqlite3
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/neilalexander/yggmail/internal/storage"
 	"go.uber.org/atomic"
 )
 
@@ -21,22 +25,70 @@ type SQLite3Storage struct {
 	*TableMailboxes
 	*TableMails
 	*TableQueue
+	*TableContacts
+	*TableSieve
+	*TableVacation
+	*TableReceipts
+	*TableListMembers
+	*TableGateway
 	db     *sql.DB
 	writer *Writer
+	crypt  *Crypt
 }
 
+func init() {
+	storage.Register("sqlite3", func(u *url.URL) (storage.Storage, error) {
+		return NewSQLite3StorageStorage(storage.Path(u))
+	})
+}
+
+// readConnections is how many connections are kept for reads. In WAL mode
+// they don't block the writer or each other, so a long FETCH doesn't hold
+// up incoming mail.
+const readConnections = 8
+
+// busyTimeout is how long a connection waits for a lock, i.e. when another
+// process such as the command line is writing to the same database.
+const busyTimeout = 5 * time.Second
+
 func NewSQLite3StorageStorage(filename string) (*SQLite3Storage, error) {
-	db, err := sql.Open("sqlite3", "file:"+filename+"?_foreign_keys=on")
+	// All writes go through the writer on a single connection, which takes
+	// the write lock when it begins a transaction rather than part way
+	// through, where it might have to give up.
+	wdb, err := sql.Open("sqlite3", fmt.Sprintf(
+		"file:%s?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+		filename, busyTimeout.Milliseconds(),
+	))
 	if err != nil {
 		return nil, fmt.Errorf("sql.Open: %w", err)
 	}
+	wdb.SetMaxOpenConns(1)
+	if _, err := migrate(wdb, filename, false); err != nil {
+		wdb.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	db := wdb
+	if filename != ":memory:" {
+		db, err = sql.Open("sqlite3", fmt.Sprintf(
+			"file:%s?_foreign_keys=on&_busy_timeout=%d&_query_only=true",
+			filename, busyTimeout.Milliseconds(),
+		))
+		if err != nil {
+			wdb.Close()
+			return nil, fmt.Errorf("sql.Open: %w", err)
+		}
+		db.SetMaxOpenConns(readConnections)
+		db.SetMaxIdleConns(readConnections)
+	}
 	s := &SQLite3Storage{
 		db: db,
 		writer: &Writer{
+			db:   wdb,
 			todo: make(chan writerTask),
 		},
+		crypt: &Crypt{},
 	}
-	s.TableConfig, err = NewTableConfig(db, s.writer)
+	s.TableConfig, err = NewTableConfig(db, s.writer, s.crypt)
 	if err != nil {
 		return nil, fmt.Errorf("NewTableConfig: %w", err)
 	}
@@ -44,72 +96,209 @@ func NewSQLite3StorageStorage(filename string) (*SQLite3Storage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("NewTableMailboxes: %w", err)
 	}
-	s.TableMails, err = NewTableMails(db, s.writer)
+	s.TableMails, err = NewTableMails(db, s.writer, s.crypt)
 	if err != nil {
 		return nil, fmt.Errorf("NewTableMails: %w", err)
 	}
+	record, err := s.ConfigGet(encryptionKeyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("s.ConfigGet: %w", err)
+	}
+	s.crypt.enabled = record != ""
 	s.TableQueue, err = NewTableQueue(db, s.writer)
 	if err != nil {
 		return nil, fmt.Errorf("NewTableQueue: %w", err)
 	}
+	s.TableContacts, err = NewTableContacts(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableContacts: %w", err)
+	}
+	s.TableSieve, err = NewTableSieve(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableSieve: %w", err)
+	}
+	s.TableVacation, err = NewTableVacation(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableVacation: %w", err)
+	}
+	s.TableReceipts, err = NewTableReceipts(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableReceipts: %w", err)
+	}
+	s.TableListMembers, err = NewTableListMembers(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableListMembers: %w", err)
+	}
+	s.TableGateway, err = NewTableGateway(db, s.writer)
+	if err != nil {
+		return nil, fmt.Errorf("NewTableGateway: %w", err)
+	}
 	return s, nil
 }
 
 func (s *SQLite3Storage) Close() error {
-	return s.db.Close()
+	if s.db != s.writer.db {
+		_ = s.db.Close()
+	}
+	return s.writer.db.Close()
+}
+
+// Stats shows how much the database is contended.
+type Stats struct {
+	Writer WriterStats
+	Reads  sql.DBStats
+	Writes sql.DBStats
+}
+
+func (s *SQLite3Storage) Stats() Stats {
+	return Stats{
+		Writer: s.writer.Stats(),
+		Reads:  s.db.Stats(),
+		Writes: s.writer.db.Stats(),
+	}
 }
 
+// writerBatchSize is the most write tasks that are committed together.
+const writerBatchSize = 64
+
+// Writer serialises writes onto the write connection. Tasks that queue up
+// while a transaction is running are committed together in the next one,
+// which saves a sync to disk for each of them when mail arrives quickly.
 type Writer struct {
+	db      *sql.DB
 	running atomic.Bool
 	todo    chan writerTask
+	mutex   sync.Mutex
+	stats   WriterStats
+}
+
+// WriterStats shows how contended the writer is. Tasks that wait a long time
+// compared to how long they take are waiting behind other writes.
+type WriterStats struct {
+	Tasks    uint64        // write tasks run
+	Failed   uint64        // write tasks that returned an error
+	Batches  uint64        // transactions that the tasks were run in
+	Waiting  time.Duration // total time that tasks waited to be run
+	Running  time.Duration // total time spent in transactions
+	MaxBatch int           // most tasks committed in one transaction
 }
 
 type writerTask struct {
-	db   *sql.DB
-	txn  *sql.Tx
-	f    func(txn *sql.Tx) error
-	wait chan error
+	f      func(txn *sql.Tx) error
+	queued time.Time
+	wait   chan error
 }
 
-func (w *Writer) Do(db *sql.DB, txn *sql.Tx, f func(txn *sql.Tx) error) error {
+// Prepare prepares a statement on the write connection, so that it can be
+// used with txn.Stmt in a write task.
+func (w *Writer) Prepare(query string) (*sql.Stmt, error) {
+	return w.db.Prepare(query)
+}
+
+// Do runs f in a transaction on the write connection and returns once the
+// transaction has been committed, or straight away if f fails, in which
+// case nothing that f wrote is kept.
+func (w *Writer) Do(f func(txn *sql.Tx) error) error {
 	if !w.running.Load() {
 		go w.run()
 	}
 	task := writerTask{
-		db:   db,
-		txn:  txn,
-		f:    f,
-		wait: make(chan error, 1),
+		f:      f,
+		queued: time.Now(),
+		wait:   make(chan error, 1),
 	}
 	w.todo <- task
 	return <-task.wait
 }
 
+func (w *Writer) Stats() WriterStats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.stats
+}
+
 func (w *Writer) run() {
 	if !w.running.CAS(false, true) {
 		return
 	}
 	defer w.running.Store(false)
 	for task := range w.todo {
-		if task.db != nil && task.txn != nil {
-			task.wait <- task.f(task.txn)
-		} else if task.db != nil && task.txn == nil {
-			func() {
-				txn, err := task.db.Begin()
-				if err != nil {
-					return
-				}
-				err = task.f(txn)
-				task.wait <- err
-				if err == nil {
-					_ = txn.Commit()
-				} else {
-					_ = txn.Rollback()
-				}
-			}()
-		} else {
-			task.wait <- task.f(nil)
+		batch := []writerTask{task}
+	collect:
+		for len(batch) < writerBatchSize {
+			select {
+			case task := <-w.todo:
+				batch = append(batch, task)
+			default:
+				break collect
+			}
+		}
+		w.commit(batch)
+	}
+}
+
+func (w *Writer) commit(batch []writerTask) {
+	started := time.Now()
+	errs := make([]error, len(batch))
+	txn, err := w.db.Begin()
+	if err == nil {
+		for i, task := range batch {
+			errs[i] = apply(txn, task)
+		}
+		err = txn.Commit()
+	}
+
+	// Only report back once the transaction has been committed, otherwise
+	// a caller that exits straight away, i.e. from the command line, can
+	// lose the last write. If the transaction couldn't be started or
+	// committed then none of the tasks were written.
+	failed := 0
+	for i, task := range batch {
+		if errs[i] == nil {
+			errs[i] = err
 		}
+		if errs[i] != nil {
+			failed++
+		}
+		task.wait <- errs[i]
 		close(task.wait)
 	}
+
+	running := time.Since(started)
+	writerTransactions.Observe(running.Seconds())
+	writerTasks.Add(float64(len(batch)-failed), "ok")
+	writerTasks.Add(float64(failed), "failed")
+	for _, task := range batch {
+		writerWait.Observe(started.Sub(task.queued).Seconds())
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stats.Tasks += uint64(len(batch))
+	w.stats.Failed += uint64(failed)
+	w.stats.Batches++
+	w.stats.Running += running
+	for _, task := range batch {
+		w.stats.Waiting += started.Sub(task.queued)
+	}
+	if len(batch) > w.stats.MaxBatch {
+		w.stats.MaxBatch = len(batch)
+	}
+}
+
+// apply runs a task within a savepoint, so that a task that fails is rolled
+// back without taking the rest of the batch with it.
+func apply(txn *sql.Tx, task writerTask) error {
+	if _, err := txn.Exec("SAVEPOINT task"); err != nil {
+		return fmt.Errorf("txn.Exec(SAVEPOINT): %w", err)
+	}
+	if err := task.f(txn); err != nil {
+		_, _ = txn.Exec("ROLLBACK TO task")
+		_, _ = txn.Exec("RELEASE task")
+		return err
+	}
+	if _, err := txn.Exec("RELEASE task"); err != nil {
+		return fmt.Errorf("txn.Exec(RELEASE): %w", err)
+	}
+	return nil
 }
@@ -18,6 +18,7 @@ import (
 type TableConfig struct {
 	db     *sql.DB
 	writer *Writer
+	crypt  *Crypt
 	get    *sql.Stmt
 	set    *sql.Stmt
 }
@@ -38,22 +39,20 @@ const configSet = `
 	INSERT OR REPLACE INTO config (key, value) VALUES($1, $2)
 `
 
-func NewTableConfig(db *sql.DB, writer *Writer) (*TableConfig, error) {
+func NewTableConfig(db *sql.DB, writer *Writer, crypt *Crypt) (*TableConfig, error) {
 	t := &TableConfig{
 		db:     db,
 		writer: writer,
+		crypt:  crypt,
 	}
-	_, err := db.Exec(configSchema)
-	if err != nil {
-		return nil, fmt.Errorf("db.Exec: %w", err)
-	}
+	var err error
 	t.get, err = db.Prepare(configGet)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(get): %w", err)
 	}
-	t.set, err = db.Prepare(configSet)
+	t.set, err = writer.Prepare(configSet)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(set): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(set): %w", err)
 	}
 	return t, nil
 }
@@ -63,13 +62,24 @@ func (t *TableConfig) ConfigGet(key string) (string, error) {
 	err := t.get.QueryRow(key).Scan(&value)
 	if err == sql.ErrNoRows {
 		return "", nil
+	} else if err != nil {
+		return "", err
 	}
-	return value, err
+	if _, ok := encryptedConfigKeys[key]; ok {
+		return t.crypt.openString(value)
+	}
+	return value, nil
 }
 
 func (t *TableConfig) ConfigSet(key, value string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.set.Exec(key, value)
+	if _, ok := encryptedConfigKeys[key]; ok {
+		var err error
+		if value, err = t.crypt.sealString(value); err != nil {
+			return err
+		}
+	}
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.set).Exec(key, value)
 		return err
 	})
 }
@@ -0,0 +1,143 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+type TableContacts struct {
+	db                 *sql.DB
+	writer             *Writer
+	listContacts       *sql.Stmt
+	selectContact      *sql.Stmt
+	selectContactByKey *sql.Stmt
+	insertContact      *sql.Stmt
+	deleteContact      *sql.Stmt
+}
+
+const contactsSchema = `
+	CREATE TABLE IF NOT EXISTS contacts (
+		name 		TEXT NOT NULL COLLATE NOCASE, -- the petname, i.e. "alice" in alice@yggmail
+		key 		TEXT NOT NULL,                -- hex-encoded ed25519 public key
+		display 	TEXT NOT NULL DEFAULT '',     -- optional display name, i.e. "Alice Smith"
+		PRIMARY KEY(name)
+	);
+
+	CREATE INDEX IF NOT EXISTS contacts_key ON contacts(key);
+`
+
+const contactsList = `
+	SELECT name, key, display FROM contacts ORDER BY name
+`
+
+const contactsSelect = `
+	SELECT name, key, display FROM contacts WHERE name = $1 OR (display != '' AND display = $1 COLLATE NOCASE)
+	ORDER BY name = $1 DESC LIMIT 1
+`
+
+const contactsSelectByKey = `
+	SELECT name, key, display FROM contacts WHERE key = $1
+	ORDER BY name LIMIT 1
+`
+
+const contactsInsert = `
+	INSERT OR REPLACE INTO contacts (name, key, display) VALUES($1, $2, $3)
+`
+
+const contactsDelete = `
+	DELETE FROM contacts WHERE name = $1
+`
+
+func NewTableContacts(db *sql.DB, writer *Writer) (*TableContacts, error) {
+	t := &TableContacts{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.listContacts, err = db.Prepare(contactsList)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(contactsList): %w", err)
+	}
+	t.selectContact, err = db.Prepare(contactsSelect)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(contactsSelect): %w", err)
+	}
+	t.selectContactByKey, err = db.Prepare(contactsSelectByKey)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(contactsSelectByKey): %w", err)
+	}
+	t.insertContact, err = writer.Prepare(contactsInsert)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(contactsInsert): %w", err)
+	}
+	t.deleteContact, err = writer.Prepare(contactsDelete)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(contactsDelete): %w", err)
+	}
+	return t, nil
+}
+
+func (t *TableContacts) ContactList() ([]types.Contact, error) {
+	rows, err := t.listContacts.Query()
+	if err != nil {
+		return nil, fmt.Errorf("t.listContacts.Query: %w", err)
+	}
+	defer rows.Close()
+	var contacts []types.Contact
+	for rows.Next() {
+		var contact types.Contact
+		if err := rows.Scan(&contact.Name, &contact.Key, &contact.DisplayName); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+func (t *TableContacts) ContactSelect(name string) (*types.Contact, error) {
+	contact := &types.Contact{}
+	err := t.selectContact.QueryRow(name).Scan(&contact.Name, &contact.Key, &contact.DisplayName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return contact, err
+}
+
+func (t *TableContacts) ContactSelectByKey(key string) (*types.Contact, error) {
+	contact := &types.Contact{}
+	err := t.selectContactByKey.QueryRow(key).Scan(&contact.Name, &contact.Key, &contact.DisplayName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return contact, err
+}
+
+func (t *TableContacts) ContactSet(name, key, displayName string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.insertContact).Exec(name, key, displayName)
+		return err
+	})
+}
+
+func (t *TableContacts) ContactDelete(name string) (int, error) {
+	var deleted int64
+	err := t.writer.Do(func(txn *sql.Tx) error {
+		res, err := txn.Stmt(t.deleteContact).Exec(name)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	return int(deleted), err
+}
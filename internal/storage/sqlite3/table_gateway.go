@@ -0,0 +1,135 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+type TableGateway struct {
+	db                 *sql.DB
+	writer             *Writer
+	listMappings       *sql.Stmt
+	selectMapping      *sql.Stmt
+	selectMappingByKey *sql.Stmt
+	insertMapping      *sql.Stmt
+	deleteMapping      *sql.Stmt
+}
+
+const gatewaySchema = `
+	CREATE TABLE IF NOT EXISTS gateway (
+		address 	TEXT NOT NULL COLLATE NOCASE, -- the Internet address, i.e. alice@example.com
+		key 		TEXT NOT NULL,                -- hex-encoded ed25519 public key
+		PRIMARY KEY(address)
+	);
+
+	CREATE INDEX IF NOT EXISTS gateway_key ON gateway(key);
+`
+
+const gatewayList = `
+	SELECT address, key FROM gateway ORDER BY address
+`
+
+const gatewaySelect = `
+	SELECT address, key FROM gateway WHERE address = $1
+`
+
+const gatewaySelectByKey = `
+	SELECT address, key FROM gateway WHERE key = $1
+	ORDER BY address LIMIT 1
+`
+
+const gatewayInsert = `
+	INSERT OR REPLACE INTO gateway (address, key) VALUES($1, $2)
+`
+
+const gatewayDelete = `
+	DELETE FROM gateway WHERE address = $1
+`
+
+func NewTableGateway(db *sql.DB, writer *Writer) (*TableGateway, error) {
+	t := &TableGateway{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.listMappings, err = db.Prepare(gatewayList)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(gatewayList): %w", err)
+	}
+	t.selectMapping, err = db.Prepare(gatewaySelect)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(gatewaySelect): %w", err)
+	}
+	t.selectMappingByKey, err = db.Prepare(gatewaySelectByKey)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(gatewaySelectByKey): %w", err)
+	}
+	t.insertMapping, err = writer.Prepare(gatewayInsert)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(gatewayInsert): %w", err)
+	}
+	t.deleteMapping, err = writer.Prepare(gatewayDelete)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(gatewayDelete): %w", err)
+	}
+	return t, nil
+}
+
+func (t *TableGateway) GatewayList() ([]types.GatewayMapping, error) {
+	rows, err := t.listMappings.Query()
+	if err != nil {
+		return nil, fmt.Errorf("t.listMappings.Query: %w", err)
+	}
+	defer rows.Close()
+	var mappings []types.GatewayMapping
+	for rows.Next() {
+		var mapping types.GatewayMapping
+		if err := rows.Scan(&mapping.Address, &mapping.Key); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+func (t *TableGateway) GatewaySelect(address string) (*types.GatewayMapping, error) {
+	mapping := &types.GatewayMapping{}
+	err := t.selectMapping.QueryRow(address).Scan(&mapping.Address, &mapping.Key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return mapping, err
+}
+
+func (t *TableGateway) GatewaySelectByKey(key string) (*types.GatewayMapping, error) {
+	mapping := &types.GatewayMapping{}
+	err := t.selectMappingByKey.QueryRow(key).Scan(&mapping.Address, &mapping.Key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return mapping, err
+}
+
+func (t *TableGateway) GatewaySet(address, key string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.insertMapping).Exec(address, key)
+		return err
+	})
+}
+
+func (t *TableGateway) GatewayDelete(address string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.deleteMapping).Exec(address)
+		return err
+	})
+}
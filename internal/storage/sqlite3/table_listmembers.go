@@ -0,0 +1,121 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+type TableListMembers struct {
+	db           *sql.DB
+	writer       *Writer
+	listMembers  *sql.Stmt
+	selectMember *sql.Stmt
+	insertMember *sql.Stmt
+	deleteMember *sql.Stmt
+}
+
+const listMembersSchema = `
+	CREATE TABLE IF NOT EXISTS list_members (
+		key 		TEXT NOT NULL,                -- hex-encoded ed25519 public key
+		owner 		BOOLEAN NOT NULL DEFAULT 0,   -- whether the member can moderate the list
+		datetime	INTEGER NOT NULL,             -- when the member joined
+		PRIMARY KEY(key)
+	);
+`
+
+const listMembersList = `
+	SELECT key, owner, datetime FROM list_members ORDER BY datetime, key
+`
+
+const listMembersSelect = `
+	SELECT key, owner, datetime FROM list_members WHERE key = $1
+`
+
+const listMembersInsert = `
+	INSERT INTO list_members (key, owner, datetime) VALUES($1, $2, $3)
+	ON CONFLICT(key) DO UPDATE SET owner = excluded.owner
+`
+
+const listMembersDelete = `
+	DELETE FROM list_members WHERE key = $1
+`
+
+func NewTableListMembers(db *sql.DB, writer *Writer) (*TableListMembers, error) {
+	t := &TableListMembers{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.listMembers, err = db.Prepare(listMembersList)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(listMembersList): %w", err)
+	}
+	t.selectMember, err = db.Prepare(listMembersSelect)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(listMembersSelect): %w", err)
+	}
+	t.insertMember, err = writer.Prepare(listMembersInsert)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(listMembersInsert): %w", err)
+	}
+	t.deleteMember, err = writer.Prepare(listMembersDelete)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(listMembersDelete): %w", err)
+	}
+	return t, nil
+}
+
+func (t *TableListMembers) ListMemberList() ([]types.ListMember, error) {
+	rows, err := t.listMembers.Query()
+	if err != nil {
+		return nil, fmt.Errorf("t.listMembers.Query: %w", err)
+	}
+	defer rows.Close()
+	var members []types.ListMember
+	for rows.Next() {
+		var member types.ListMember
+		var joined int64
+		if err := rows.Scan(&member.Key, &member.Owner, &joined); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		member.Joined = time.Unix(joined, 0)
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (t *TableListMembers) ListMemberSelect(key string) (*types.ListMember, error) {
+	member := &types.ListMember{}
+	var joined int64
+	err := t.selectMember.QueryRow(key).Scan(&member.Key, &member.Owner, &joined)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	member.Joined = time.Unix(joined, 0)
+	return member, err
+}
+
+func (t *TableListMembers) ListMemberSet(key string, owner bool) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.insertMember).Exec(key, owner, time.Now().Unix())
+		return err
+	})
+}
+
+func (t *TableListMembers) ListMemberDelete(key string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.deleteMember).Exec(key)
+		return err
+	})
+}
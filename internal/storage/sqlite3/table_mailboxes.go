@@ -66,10 +66,7 @@ func NewTableMailboxes(db *sql.DB, writer *Writer) (*TableMailboxes, error) {
 		db:     db,
 		writer: writer,
 	}
-	_, err := db.Exec(mailboxesSchema)
-	if err != nil {
-		return nil, fmt.Errorf("db.Exec: %w", err)
-	}
+	var err error
 	t.listMailboxes, err = db.Prepare(mailboxesList)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(mailboxesCreate): %w", err)
@@ -82,21 +79,21 @@ func NewTableMailboxes(db *sql.DB, writer *Writer) (*TableMailboxes, error) {
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(mailboxesSelect): %w", err)
 	}
-	t.createMailbox, err = db.Prepare(mailboxesCreate)
+	t.createMailbox, err = writer.Prepare(mailboxesCreate)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(mailboxesCreate): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(mailboxesCreate): %w", err)
 	}
-	t.deleteMailbox, err = db.Prepare(mailboxesDelete)
+	t.deleteMailbox, err = writer.Prepare(mailboxesDelete)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(mailboxesDelete): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(mailboxesDelete): %w", err)
 	}
-	t.renameMailbox, err = db.Prepare(mailboxesRename)
+	t.renameMailbox, err = writer.Prepare(mailboxesRename)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(mailboxesRename): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(mailboxesRename): %w", err)
 	}
-	t.subscribeMailbox, err = db.Prepare(mailboxesSubscribe)
+	t.subscribeMailbox, err = writer.Prepare(mailboxesSubscribe)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(mailboxesSubscribe): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(mailboxesSubscribe): %w", err)
 	}
 	return t, nil
 }
@@ -123,36 +120,34 @@ func (t *TableMailboxes) MailboxList(onlySubscribed bool) ([]string, error) {
 }
 
 func (t *TableMailboxes) MailboxSelect(mailbox string) (bool, error) {
-	row := t.selectMailboxes.QueryRow(mailbox)
-	if err := row.Err(); err != nil && err != sql.ErrNoRows {
-		return false, fmt.Errorf("row.Err: %w", err)
-	} else if err == sql.ErrNoRows {
-		return false, nil
-	}
+	// A mailbox that doesn't exist isn't an error, so that callers can
+	// tell it apart from the database failing.
 	var got string
-	if err := row.Scan(&got); err != nil {
+	if err := t.selectMailboxes.QueryRow(mailbox).Scan(&got); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
 		return false, fmt.Errorf("row.Scan: %w", err)
 	}
 	return mailbox == got, nil
 }
 
 func (t *TableMailboxes) MailboxCreate(name string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.createMailbox.Exec(name)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.createMailbox).Exec(name)
 		return err
 	})
 }
 
 func (t *TableMailboxes) MailboxRename(old, new string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.renameMailbox.Exec(old, new)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.renameMailbox).Exec(new, old)
 		return err
 	})
 }
 
 func (t *TableMailboxes) MailboxDelete(name string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.deleteMailbox.Exec(name)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.deleteMailbox).Exec(name)
 		return err
 	})
 }
@@ -162,8 +157,8 @@ func (t *TableMailboxes) MailboxSubscribe(name string, subscribed bool) error {
 	if !subscribed {
 		sn = 0
 	}
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.subscribeMailbox.Exec(sn, name)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.subscribeMailbox).Exec(sn, name)
 		return err
 	})
 }
@@ -11,6 +11,8 @@ package sqlite3
 import (
 	"database/sql"
 	"fmt"
+	"io"
+	"math"
 	"time"
 
 	"github.com/neilalexander/yggmail/internal/storage/types"
@@ -19,18 +21,30 @@ import (
 type TableMails struct {
 	db               *sql.DB
 	writer           *Writer
+	crypt            *Crypt
 	selectMails      *sql.Stmt
 	selectMail       *sql.Stmt
+	selectMailMeta   *sql.Stmt
+	selectMailData   *sql.Stmt
+	selectMailBlob   *sql.Stmt
+	selectBlobChunk  *sql.Stmt
+	updateBlobMeta   *sql.Stmt
 	selectMailNextID *sql.Stmt
 	selectIDForSeq   *sql.Stmt
+	selectSeqRange   *sql.Stmt
+	selectIDRange    *sql.Stmt
+	countMailsBefore *sql.Stmt
+	selectLastMail   *sql.Stmt
 	searchMail       *sql.Stmt
 	createMail       *sql.Stmt
 	countMails       *sql.Stmt
 	countUnseenMails *sql.Stmt
+	mailboxUsage     *sql.Stmt
 	updateMailFlags  *sql.Stmt
 	deleteMail       *sql.Stmt
 	expungeMail      *sql.Stmt
 	moveMail         *sql.Stmt
+	copyMail         *sql.Stmt
 }
 
 const mailsSchema = `
@@ -58,16 +72,50 @@ const selectMailsStmt = `
 	ORDER BY mailbox, id
 `
 
+// The sequence number is counted from the primary key index rather than
+// taken from the inboxes view, which would number every mail in the table.
 const selectMailStmt = `
-	SELECT seq, id, mail, datetime, seen, answered, flagged, deleted FROM inboxes
+	SELECT (
+		SELECT COUNT(*) FROM mails AS m WHERE m.mailbox = mails.mailbox AND m.id <= mails.id
+	), id, blobs.data, blobs.compressed, datetime, seen, answered, flagged, deleted FROM mails
+	JOIN blobs ON blobs.hash = mails.blob
+	WHERE mailbox = $1 AND id = $2
+`
+
+const selectMailMetaStmt = `
+	SELECT id, blobs.hash, blobs.meta, datetime, seen, answered, flagged, deleted FROM mails
+	JOIN blobs ON blobs.hash = mails.blob
+	WHERE mailbox = $1 AND id = $2
+`
+
+const selectMailDataStmt = `
+	SELECT blobs.data, blobs.compressed FROM mails
+	JOIN blobs ON blobs.hash = mails.blob
 	WHERE mailbox = $1 AND id = $2
-	ORDER BY mailbox, id
+`
+
+const selectMailBlobStmt = `
+	SELECT blobs.hash, blobs.compressed, LENGTH(blobs.data) FROM mails
+	JOIN blobs ON blobs.hash = mails.blob
+	WHERE mailbox = $1 AND id = $2
+`
+
+const updateBlobMetaStmt = `
+	UPDATE blobs SET meta = $1 WHERE hash = $2
 `
 
 const selectMailCountStmt = `
 	SELECT COUNT(*) FROM mails WHERE mailbox = $1
 `
 
+// The usage is what the mails take up once compressed, and a blob that is
+// shared between mailboxes counts towards each of them.
+const selectMailboxUsageStmt = `
+	SELECT IFNULL(SUM(LENGTH(blobs.data)), 0) FROM mails
+	JOIN blobs ON blobs.hash = mails.blob
+	WHERE mailbox = $1
+`
+
 const selectMailUnseenStmt = `
 	SELECT COUNT(*) FROM mails WHERE mailbox = $1 AND seen = 0
 `
@@ -79,7 +127,7 @@ const searchMailStmt = `
 `
 
 const insertMailStmt = `
-	INSERT INTO mails (mailbox, id, mail, datetime) VALUES(
+	INSERT INTO mails (mailbox, id, blob, datetime) VALUES(
 		$1, (
 			SELECT IFNULL(MAX(id)+1,1) AS id FROM mails
 			WHERE mailbox = $1
@@ -89,8 +137,29 @@ const insertMailStmt = `
 `
 
 const selectIDForSeqStmt = `
-	SELECT id FROM inboxes
-	WHERE mailbox = $1 AND seq = $2
+	SELECT id FROM mails
+	WHERE mailbox = $1
+	ORDER BY id LIMIT 1 OFFSET $2 - 1
+`
+
+const selectSeqRangeStmt = `
+	SELECT id FROM mails
+	WHERE mailbox = $1
+	ORDER BY id LIMIT $2 OFFSET $3
+`
+
+const selectIDRangeStmt = `
+	SELECT id FROM mails
+	WHERE mailbox = $1 AND id >= $2 AND id <= $3
+	ORDER BY id
+`
+
+const selectMailCountBeforeStmt = `
+	SELECT COUNT(*) FROM mails WHERE mailbox = $1 AND id < $2
+`
+
+const selectLastMailStmt = `
+	SELECT COUNT(*), IFNULL(MAX(id), 0) FROM mails WHERE mailbox = $1
 `
 
 const selectMailNextID = `
@@ -110,19 +179,33 @@ const expungeMailStmt = `
 	DELETE FROM mails WHERE mailbox = $1 AND deleted = 1
 `
 
+// The mail gets the next ID in the destination rather than keeping its own,
+// which another mail there may already have. The queue follows it there,
+// since its foreign key cascades on update.
 const moveMailStmt = `
-	UPDATE mails SET mailbox = $1 WHERE mailbox = $2 AND id = $3
+	UPDATE mails SET mailbox = $1, id = (
+		SELECT IFNULL(MAX(id)+1,1) FROM mails WHERE mailbox = $1
+	) WHERE mailbox = $2 AND id = $3
 `
 
-func NewTableMails(db *sql.DB, writer *Writer) (*TableMails, error) {
+// A copy refers to the same blob as the original, so the contents aren't
+// read or stored again. It keeps the date and flags of the original.
+const copyMailStmt = `
+	INSERT INTO mails (mailbox, id, blob, datetime, seen, answered, flagged, deleted)
+	SELECT $1, (
+		SELECT IFNULL(MAX(id)+1,1) FROM mails WHERE mailbox = $1
+	), blob, datetime, seen, answered, flagged, deleted FROM mails
+	WHERE mailbox = $2 AND id = $3
+	RETURNING id;
+`
+
+func NewTableMails(db *sql.DB, writer *Writer, crypt *Crypt) (*TableMails, error) {
 	t := &TableMails{
 		db:     db,
 		writer: writer,
+		crypt:  crypt,
 	}
-	_, err := db.Exec(mailsSchema)
-	if err != nil {
-		return nil, fmt.Errorf("db.Exec: %w", err)
-	}
+	var err error
 	t.selectMails, err = db.Prepare(selectMailsStmt)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectMailsStmt): %w", err)
@@ -131,6 +214,26 @@ func NewTableMails(db *sql.DB, writer *Writer) (*TableMails, error) {
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectMailStmt): %w", err)
 	}
+	t.selectMailMeta, err = db.Prepare(selectMailMetaStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectMailMetaStmt): %w", err)
+	}
+	t.selectMailData, err = db.Prepare(selectMailDataStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectMailDataStmt): %w", err)
+	}
+	t.selectMailBlob, err = db.Prepare(selectMailBlobStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectMailBlobStmt): %w", err)
+	}
+	t.selectBlobChunk, err = db.Prepare(selectBlobChunkStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectBlobChunkStmt): %w", err)
+	}
+	t.updateBlobMeta, err = writer.Prepare(updateBlobMetaStmt)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(updateBlobMetaStmt): %w", err)
+	}
 	t.selectMailNextID, err = db.Prepare(selectMailNextID)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectMailNextID): %w", err)
@@ -139,25 +242,41 @@ func NewTableMails(db *sql.DB, writer *Writer) (*TableMails, error) {
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectPIDForIDStmt): %w", err)
 	}
+	t.selectSeqRange, err = db.Prepare(selectSeqRangeStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectSeqRangeStmt): %w", err)
+	}
+	t.selectIDRange, err = db.Prepare(selectIDRangeStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectIDRangeStmt): %w", err)
+	}
+	t.countMailsBefore, err = db.Prepare(selectMailCountBeforeStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectMailCountBeforeStmt): %w", err)
+	}
+	t.selectLastMail, err = db.Prepare(selectLastMailStmt)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(selectLastMailStmt): %w", err)
+	}
 	t.searchMail, err = db.Prepare(searchMailStmt)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectPIDForIDStmt): %w", err)
 	}
-	t.createMail, err = db.Prepare(insertMailStmt)
+	t.createMail, err = writer.Prepare(insertMailStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(insertMailStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(insertMailStmt): %w", err)
 	}
-	t.updateMailFlags, err = db.Prepare(updateMailFlagsStmt)
+	t.updateMailFlags, err = writer.Prepare(updateMailFlagsStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(updateMailSeenStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(updateMailSeenStmt): %w", err)
 	}
-	t.deleteMail, err = db.Prepare(deleteMailStmt)
+	t.deleteMail, err = writer.Prepare(deleteMailStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(deleteMailStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(deleteMailStmt): %w", err)
 	}
-	t.expungeMail, err = db.Prepare(expungeMailStmt)
+	t.expungeMail, err = writer.Prepare(expungeMailStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(expungeMailStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(expungeMailStmt): %w", err)
 	}
 	t.countMails, err = db.Prepare(selectMailCountStmt)
 	if err != nil {
@@ -167,17 +286,47 @@ func NewTableMails(db *sql.DB, writer *Writer) (*TableMails, error) {
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(selectMailUnseenStmt): %w", err)
 	}
-	t.moveMail, err = db.Prepare(moveMailStmt)
+	t.mailboxUsage, err = db.Prepare(selectMailboxUsageStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(moveMailStmt): %w", err)
+		return nil, fmt.Errorf("db.Prepare(selectMailboxUsageStmt): %w", err)
+	}
+	t.moveMail, err = writer.Prepare(moveMailStmt)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(moveMailStmt): %w", err)
+	}
+	t.copyMail, err = writer.Prepare(copyMailStmt)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(copyMailStmt): %w", err)
 	}
 	return t, nil
 }
 
 func (t *TableMails) MailCreate(mailbox string, data []byte) (int, error) {
 	var id int
-	err := t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		return t.createMail.QueryRow(mailbox, data, time.Now().Unix()).Scan(&id)
+	err := t.writer.Do(func(txn *sql.Tx) error {
+		hash, err := storeBlob(txn, t.crypt, data)
+		if err != nil {
+			return err
+		}
+		return txn.Stmt(t.createMail).QueryRow(mailbox, hash, time.Now().Unix()).Scan(&id)
+	})
+	return id, err
+}
+
+// MailImport stores a mail with the given internal date and flags, i.e.
+// when it is imported from another mail store.
+func (t *TableMails) MailImport(mailbox string, data []byte, date time.Time, seen, answered, flagged, deleted bool) (int, error) {
+	var id int
+	err := t.writer.Do(func(txn *sql.Tx) error {
+		hash, err := storeBlob(txn, t.crypt, data)
+		if err != nil {
+			return err
+		}
+		if err := txn.Stmt(t.createMail).QueryRow(mailbox, hash, date.Unix()).Scan(&id); err != nil {
+			return err
+		}
+		_, err = txn.Stmt(t.updateMailFlags).Exec(seen, answered, flagged, deleted, mailbox, id)
+		return err
 	})
 	return id, err
 }
@@ -185,15 +334,77 @@ func (t *TableMails) MailCreate(mailbox string, data []byte) (int, error) {
 func (t *TableMails) MailSelect(mailbox string, id int) (int, *types.Mail, error) {
 	var seq int
 	var datetime int64
+	var compressed bool
 	mail := &types.Mail{}
 	err := t.selectMail.QueryRow(mailbox, id).Scan(
-		&seq, &mail.ID, &mail.Mail, &datetime,
+		&seq, &mail.ID, &mail.Mail, &compressed, &datetime,
 		&mail.Seen, &mail.Answered, &mail.Flagged, &mail.Deleted,
 	)
 	mail.Date = time.Unix(datetime, 0)
+	if err != nil {
+		return seq, mail, err
+	}
+	mail.Mail, err = openBlob(t.crypt, mail.Mail, compressed)
 	return seq, mail, err
 }
 
+// MailSelectMeta returns a mail with its metadata rather than its contents,
+// which is enough for most of what mail clients fetch.
+func (t *TableMails) MailSelectMeta(mailbox string, id int) (*types.Mail, error) {
+	var datetime int64
+	var hash string
+	var meta []byte
+	mail := &types.Mail{}
+	err := t.selectMailMeta.QueryRow(mailbox, id).Scan(
+		&mail.ID, &hash, &meta, &datetime,
+		&mail.Seen, &mail.Answered, &mail.Flagged, &mail.Deleted,
+	)
+	mail.Date = time.Unix(datetime, 0)
+	if err != nil {
+		return mail, err
+	}
+	if meta == nil {
+		mail.Meta, err = t.fillMeta(mailbox, id, hash)
+	} else {
+		mail.Meta, err = decodeMeta(t.crypt, meta)
+	}
+	return mail, err
+}
+
+// fillMeta works out the metadata of a blob that was migrated without it.
+func (t *TableMails) fillMeta(mailbox string, id int, hash string) (*types.MailMeta, error) {
+	var data []byte
+	var compressed bool
+	if err := t.selectMailData.QueryRow(mailbox, id).Scan(&data, &compressed); err != nil {
+		return nil, err
+	}
+	data, err := openBlob(t.crypt, data, compressed)
+	if err != nil {
+		return nil, err
+	}
+	meta := types.ParseMailMeta(data)
+	encoded, err := encodeMeta(t.crypt, meta)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.updateBlobMeta).Exec(encoded, hash)
+		return err
+	})
+	return meta, err
+}
+
+// MailOpen returns a reader for the contents of a mail. The reader must be
+// closed once it is no longer needed.
+func (t *TableMails) MailOpen(mailbox string, id int) (io.ReadCloser, error) {
+	blob := &blobReader{stmt: t.selectBlobChunk}
+	var compressed bool
+	if err := t.selectMailBlob.QueryRow(mailbox, id).Scan(&blob.hash, &compressed, &blob.length); err != nil {
+		return nil, err
+	}
+	return streamBlob(t.crypt, blob, compressed)
+}
+
 func (t *TableMails) MailSearch(mailbox string) ([]uint32, error) {
 	var ids []uint32
 	rows, err := t.searchMail.Query(mailbox)
@@ -223,6 +434,63 @@ func (t *TableMails) MailIDForSeq(mailbox string, seq int) (int, error) {
 	return id, err
 }
 
+// MailRange returns the mails in a range of sequence numbers, or of IDs if
+// uid is set, in a single query. A start of 0 means the last mail and a stop
+// of 0 means up to the last mail, like "*" in IMAP. Numbers in the range that
+// don't refer to a mail are left out.
+func (t *TableMails) MailRange(mailbox string, uid bool, start, stop int) ([]types.MailSeq, error) {
+	var mails []types.MailSeq
+	if start > 0 {
+		var rows *sql.Rows
+		var seq int
+		var err error
+		if uid {
+			last := stop
+			if stop == 0 {
+				last = math.MaxInt64
+			}
+			if err = t.countMailsBefore.QueryRow(mailbox, start).Scan(&seq); err != nil {
+				return nil, fmt.Errorf("t.countMailsBefore.QueryRow: %w", err)
+			}
+			rows, err = t.selectIDRange.Query(mailbox, start, last)
+		} else {
+			limit := stop - start + 1
+			if stop == 0 {
+				limit = -1
+			}
+			seq = start - 1
+			rows, err = t.selectSeqRange.Query(mailbox, limit, start-1)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("t.selectRange.Query: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return nil, fmt.Errorf("rows.Scan: %w", err)
+			}
+			seq++
+			mails = append(mails, types.MailSeq{Seq: seq, ID: id})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("rows.Err: %w", err)
+		}
+	}
+	// "*" always refers to the last mail, so "n:*" includes it even if n is
+	// beyond the end of the mailbox.
+	if len(mails) == 0 && (start == 0 || stop == 0) {
+		var count, id int
+		if err := t.selectLastMail.QueryRow(mailbox).Scan(&count, &id); err != nil {
+			return nil, fmt.Errorf("t.selectLastMail.QueryRow: %w", err)
+		}
+		if count > 0 {
+			mails = append(mails, types.MailSeq{Seq: count, ID: id})
+		}
+	}
+	return mails, nil
+}
+
 func (t *TableMails) MailUnseen(mailbox string) (int, error) {
 	var unseen int
 	err := t.countUnseenMails.QueryRow(mailbox).Scan(&unseen)
@@ -230,22 +498,22 @@ func (t *TableMails) MailUnseen(mailbox string) (int, error) {
 }
 
 func (t *TableMails) MailUpdateFlags(mailbox string, id int, seen, answered, flagged, deleted bool) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.updateMailFlags.Exec(seen, answered, flagged, deleted, mailbox, id)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.updateMailFlags).Exec(seen, answered, flagged, deleted, mailbox, id)
 		return err
 	})
 }
 
 func (t *TableMails) MailDelete(mailbox string, id int) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.deleteMail.Exec(mailbox, id)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.deleteMail).Exec(mailbox, id)
 		return err
 	})
 }
 
 func (t *TableMails) MailExpunge(mailbox string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.expungeMail.Exec(mailbox)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.expungeMail).Exec(mailbox)
 		return err
 	})
 }
@@ -256,9 +524,23 @@ func (t *TableMails) MailCount(mailbox string) (int, error) {
 	return count, err
 }
 
+func (t *TableMails) MailboxUsage(mailbox string) (int64, error) {
+	var usage int64
+	err := t.mailboxUsage.QueryRow(mailbox).Scan(&usage)
+	return usage, err
+}
+
 func (t *TableMails) MailMove(mailbox string, id int, destination string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.moveMail.Exec(destination, mailbox, id)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.moveMail).Exec(destination, mailbox, id)
 		return err
 	})
 }
+
+func (t *TableMails) MailCopy(mailbox string, id int, destination string) (int, error) {
+	var copied int
+	err := t.writer.Do(func(txn *sql.Tx) error {
+		return txn.Stmt(t.copyMail).QueryRow(destination, mailbox, id).Scan(&copied)
+	})
+	return copied, err
+}
@@ -63,10 +63,7 @@ func NewTableQueue(db *sql.DB, writer *Writer) (*TableQueue, error) {
 		db:     db,
 		writer: writer,
 	}
-	_, err := db.Exec(queueSchema)
-	if err != nil {
-		return nil, fmt.Errorf("db.Exec: %w", err)
-	}
+	var err error
 	t.queueSelectDestinations, err = db.Prepare(queueSelectDestinationsStmt)
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(queueSelectDestinationsStmt): %w", err)
@@ -75,13 +72,13 @@ func NewTableQueue(db *sql.DB, writer *Writer) (*TableQueue, error) {
 	if err != nil {
 		return nil, fmt.Errorf("db.Prepare(queueSelectIDsForDestinationStmt): %w", err)
 	}
-	t.queueInsertDestinationForID, err = db.Prepare(queueInsertDestinationForIDStmt)
+	t.queueInsertDestinationForID, err = writer.Prepare(queueInsertDestinationForIDStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(queueInsertDestinationForIDStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(queueInsertDestinationForIDStmt): %w", err)
 	}
-	t.queueDeleteIDForDestination, err = db.Prepare(deleteDestinationForIDStmt)
+	t.queueDeleteIDForDestination, err = writer.Prepare(deleteDestinationForIDStmt)
 	if err != nil {
-		return nil, fmt.Errorf("db.Prepare(deleteDestinationForIDStmt): %w", err)
+		return nil, fmt.Errorf("writer.Prepare(deleteDestinationForIDStmt): %w", err)
 	}
 	t.queueSelectIsMessagePendingSend, err = db.Prepare(queueSelectIsMessagePendingSendStmt)
 	if err != nil {
@@ -136,15 +133,15 @@ func (t *TableQueue) QueueMailIDsForDestination(destination string) ([]types.Que
 }
 
 func (t *TableQueue) QueueInsertDestinationForID(destination string, id int, from, rcpt string) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.queueInsertDestinationForID.Exec(destination, "Outbox", id, from, rcpt)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.queueInsertDestinationForID).Exec(destination, "Outbox", id, from, rcpt)
 		return err
 	})
 }
 
 func (t *TableQueue) QueueDeleteDestinationForID(destination string, id int) error {
-	return t.writer.Do(t.db, nil, func(txn *sql.Tx) error {
-		_, err := t.queueDeleteIDForDestination.Exec(destination, "Outbox", id)
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.queueDeleteIDForDestination).Exec(destination, "Outbox", id)
 		return err
 	})
 }
@@ -0,0 +1,88 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+type TableReceipts struct {
+	db            *sql.DB
+	writer        *Writer
+	insertReceipt *sql.Stmt
+	selectReceipt *sql.Stmt
+}
+
+const receiptsSchema = `
+	CREATE TABLE IF NOT EXISTS receipts (
+		message_id 	TEXT NOT NULL, -- without the angle brackets
+		rcpt 		TEXT NOT NULL,
+		datetime 	INTEGER NOT NULL, -- when the remote node accepted it
+		PRIMARY KEY(message_id, rcpt)
+	);
+`
+
+const receiptsInsert = `
+	INSERT OR REPLACE INTO receipts (message_id, rcpt, datetime) VALUES($1, $2, $3)
+`
+
+const receiptsSelect = `
+	SELECT rcpt, datetime FROM receipts WHERE message_id = $1 ORDER BY datetime, rcpt
+`
+
+func NewTableReceipts(db *sql.DB, writer *Writer) (*TableReceipts, error) {
+	t := &TableReceipts{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.insertReceipt, err = writer.Prepare(receiptsInsert)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(receiptsInsert): %w", err)
+	}
+	t.selectReceipt, err = db.Prepare(receiptsSelect)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(receiptsSelect): %w", err)
+	}
+	return t, nil
+}
+
+// ReceiptInsert records that the mail with the given Message-Id was
+// delivered to the recipient.
+func (t *TableReceipts) ReceiptInsert(messageID, rcpt string, delivered time.Time) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.insertReceipt).Exec(messageID, rcpt, delivered.Unix())
+		return err
+	})
+}
+
+// ReceiptSelect returns the recipients that the mail with the given
+// Message-Id has been delivered to, in the order that they were.
+func (t *TableReceipts) ReceiptSelect(messageID string) ([]types.Receipt, error) {
+	rows, err := t.selectReceipt.Query(messageID)
+	if err != nil {
+		return nil, fmt.Errorf("t.selectReceipt.Query: %w", err)
+	}
+	defer rows.Close()
+	var receipts []types.Receipt
+	for rows.Next() {
+		var datetime int64
+		receipt := types.Receipt{MessageID: messageID}
+		if err := rows.Scan(&receipt.Rcpt, &datetime); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		receipt.Delivered = time.Unix(datetime, 0)
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
@@ -0,0 +1,183 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
+
+type TableSieve struct {
+	db               *sql.DB
+	writer           *Writer
+	listScripts      *sql.Stmt
+	selectScript     *sql.Stmt
+	selectActive     *sql.Stmt
+	putScript        *sql.Stmt
+	deleteScript     *sql.Stmt
+	renameScript     *sql.Stmt
+	deactivateScript *sql.Stmt
+	activateScript   *sql.Stmt
+}
+
+const sieveSchema = `
+	CREATE TABLE IF NOT EXISTS sieve (
+		name 		TEXT NOT NULL,
+		script 		TEXT NOT NULL,
+		active 		BOOLEAN NOT NULL DEFAULT 0, -- at most one script is active at a time
+		PRIMARY KEY(name)
+	);
+`
+
+const sieveList = `
+	SELECT name, active FROM sieve ORDER BY name
+`
+
+const sieveSelect = `
+	SELECT name, script, active FROM sieve WHERE name = $1
+`
+
+const sieveSelectActive = `
+	SELECT name, script, active FROM sieve WHERE active = 1 LIMIT 1
+`
+
+const sievePut = `
+	INSERT INTO sieve (name, script) VALUES($1, $2)
+	ON CONFLICT(name) DO UPDATE SET script = $2
+`
+
+const sieveDelete = `
+	DELETE FROM sieve WHERE name = $1
+`
+
+const sieveRename = `
+	UPDATE sieve SET name = $1 WHERE name = $2
+`
+
+const sieveDeactivate = `
+	UPDATE sieve SET active = 0 WHERE active = 1
+`
+
+const sieveActivate = `
+	UPDATE sieve SET active = 1 WHERE name = $1
+`
+
+func NewTableSieve(db *sql.DB, writer *Writer) (*TableSieve, error) {
+	t := &TableSieve{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.listScripts, err = db.Prepare(sieveList)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(sieveList): %w", err)
+	}
+	t.selectScript, err = db.Prepare(sieveSelect)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(sieveSelect): %w", err)
+	}
+	t.selectActive, err = db.Prepare(sieveSelectActive)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(sieveSelectActive): %w", err)
+	}
+	t.putScript, err = writer.Prepare(sievePut)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(sievePut): %w", err)
+	}
+	t.deleteScript, err = writer.Prepare(sieveDelete)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(sieveDelete): %w", err)
+	}
+	t.renameScript, err = writer.Prepare(sieveRename)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(sieveRename): %w", err)
+	}
+	t.deactivateScript, err = writer.Prepare(sieveDeactivate)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(sieveDeactivate): %w", err)
+	}
+	t.activateScript, err = writer.Prepare(sieveActivate)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(sieveActivate): %w", err)
+	}
+	return t, nil
+}
+
+func (t *TableSieve) SieveList() ([]types.SieveScript, error) {
+	rows, err := t.listScripts.Query()
+	if err != nil {
+		return nil, fmt.Errorf("t.listScripts.Query: %w", err)
+	}
+	defer rows.Close()
+	var scripts []types.SieveScript
+	for rows.Next() {
+		var script types.SieveScript
+		if err := rows.Scan(&script.Name, &script.Active); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+func (t *TableSieve) SieveSelect(name string) (*types.SieveScript, error) {
+	script := &types.SieveScript{}
+	err := t.selectScript.QueryRow(name).Scan(&script.Name, &script.Script, &script.Active)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return script, err
+}
+
+func (t *TableSieve) SieveSelectActive() (*types.SieveScript, error) {
+	script := &types.SieveScript{}
+	err := t.selectActive.QueryRow().Scan(&script.Name, &script.Script, &script.Active)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return script, err
+}
+
+func (t *TableSieve) SievePut(name, script string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.putScript).Exec(name, script)
+		return err
+	})
+}
+
+func (t *TableSieve) SieveDelete(name string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.deleteScript).Exec(name)
+		return err
+	})
+}
+
+func (t *TableSieve) SieveRename(old, new string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		_, err := txn.Stmt(t.renameScript).Exec(new, old)
+		return err
+	})
+}
+
+// SieveSetActive makes the named script the active one, or deactivates
+// all scripts if the name is empty.
+func (t *TableSieve) SieveSetActive(name string) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		if _, err := txn.Stmt(t.deactivateScript).Exec(); err != nil {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		_, err := txn.Stmt(t.activateScript).Exec(name)
+		return err
+	})
+}
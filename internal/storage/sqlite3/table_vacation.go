@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type TableVacation struct {
+	db         *sql.DB
+	writer     *Writer
+	selectSent *sql.Stmt
+	insertSent *sql.Stmt
+	expireSent *sql.Stmt
+}
+
+const vacationSchema = `
+	CREATE TABLE IF NOT EXISTS vacation (
+		handle 		TEXT NOT NULL, -- identifies the automatic reply that was sent
+		sender 		TEXT NOT NULL, -- the sender that was replied to
+		datetime 	INTEGER NOT NULL,
+		PRIMARY KEY(handle, sender)
+	);
+`
+
+const vacationSelectSent = `
+	SELECT datetime FROM vacation WHERE handle = $1 AND sender = $2
+`
+
+const vacationInsertSent = `
+	INSERT OR REPLACE INTO vacation (handle, sender, datetime) VALUES($1, $2, $3)
+`
+
+const vacationExpireSent = `
+	DELETE FROM vacation WHERE datetime < $1
+`
+
+func NewTableVacation(db *sql.DB, writer *Writer) (*TableVacation, error) {
+	t := &TableVacation{
+		db:     db,
+		writer: writer,
+	}
+	var err error
+	t.selectSent, err = db.Prepare(vacationSelectSent)
+	if err != nil {
+		return nil, fmt.Errorf("db.Prepare(vacationSelectSent): %w", err)
+	}
+	t.insertSent, err = writer.Prepare(vacationInsertSent)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(vacationInsertSent): %w", err)
+	}
+	t.expireSent, err = writer.Prepare(vacationExpireSent)
+	if err != nil {
+		return nil, fmt.Errorf("writer.Prepare(vacationExpireSent): %w", err)
+	}
+	return t, nil
+}
+
+// VacationLastSent returns when an automatic reply with the given handle
+// was last sent to the sender, or the zero time if it never was.
+func (t *TableVacation) VacationLastSent(handle, sender string) (time.Time, error) {
+	var datetime int64
+	err := t.selectSent.QueryRow(handle, sender).Scan(&datetime)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(datetime, 0), nil
+}
+
+// VacationRecordSent records that an automatic reply was sent to the sender
+// and forgets about any replies that were sent before the expiry time.
+func (t *TableVacation) VacationRecordSent(handle, sender string, expiry time.Time) error {
+	return t.writer.Do(func(txn *sql.Tx) error {
+		if _, err := txn.Stmt(t.expireSent).Exec(expiry.Unix()); err != nil {
+			return err
+		}
+		_, err := txn.Stmt(t.insertSent).Exec(handle, sender, time.Now().Unix())
+		return err
+	})
+}
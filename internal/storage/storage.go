@@ -8,9 +8,16 @@
 
 package storage
 
-import "github.com/neilalexander/yggmail/internal/storage/types"
+import (
+	"io"
+	"time"
+
+	"github.com/neilalexander/yggmail/internal/storage/types"
+)
 
 type Storage interface {
+	Close() error
+
 	ConfigGet(key string) (string, error)
 	ConfigSet(key, value string) error
 	ConfigSetPassword(password string) error
@@ -19,6 +26,7 @@ type Storage interface {
 	MailboxSelect(mailbox string) (bool, error)
 	MailNextID(mailbox string) (int, error)
 	MailIDForSeq(mailbox string, id int) (int, error)
+	MailRange(mailbox string, uid bool, start, stop int) ([]types.MailSeq, error)
 	MailUnseen(mailbox string) (int, error)
 	MailboxList(onlySubscribed bool) ([]string, error)
 	MailboxCreate(name string) error
@@ -27,17 +35,53 @@ type Storage interface {
 	MailboxSubscribe(name string, subscribed bool) error
 
 	MailCreate(mailbox string, data []byte) (int, error)
+	MailImport(mailbox string, data []byte, date time.Time, seen, answered, flagged, deleted bool) (int, error)
 	MailSelect(mailbox string, id int) (int, *types.Mail, error)
+	MailSelectMeta(mailbox string, id int) (*types.Mail, error)
+	MailOpen(mailbox string, id int) (io.ReadCloser, error)
 	MailSearch(mailbox string) ([]uint32, error)
 	MailUpdateFlags(mailbox string, id int, seen, answered, flagged, deleted bool) error
 	MailDelete(mailbox string, id int) error
 	MailExpunge(mailbox string) error
 	MailCount(mailbox string) (int, error)
+	MailboxUsage(mailbox string) (int64, error)
 	MailMove(mailbox string, id int, destination string) error
+	MailCopy(mailbox string, id int, destination string) (int, error)
 
 	QueueListDestinations() ([]string, error)
 	QueueMailIDsForDestination(destination string) ([]types.QueuedMail, error)
 	QueueInsertDestinationForID(destination string, id int, from, rcpt string) error
 	QueueDeleteDestinationForID(destination string, id int) error
 	QueueSelectIsMessagePendingSend(mailbox string, id int) (bool, error)
+
+	ContactList() ([]types.Contact, error)
+	ContactSelect(name string) (*types.Contact, error)
+	ContactSelectByKey(key string) (*types.Contact, error)
+	ContactSet(name, key, displayName string) error
+	ContactDelete(name string) (int, error) // how many contacts were removed
+
+	SieveList() ([]types.SieveScript, error)
+	SieveSelect(name string) (*types.SieveScript, error)
+	SieveSelectActive() (*types.SieveScript, error)
+	SievePut(name, script string) error
+	SieveDelete(name string) error
+	SieveRename(old, new string) error
+	SieveSetActive(name string) error
+
+	VacationLastSent(handle, sender string) (time.Time, error)
+	VacationRecordSent(handle, sender string, expiry time.Time) error
+
+	ReceiptInsert(messageID, rcpt string, delivered time.Time) error
+	ReceiptSelect(messageID string) ([]types.Receipt, error)
+
+	ListMemberList() ([]types.ListMember, error)
+	ListMemberSelect(key string) (*types.ListMember, error)
+	ListMemberSet(key string, owner bool) error
+	ListMemberDelete(key string) error
+
+	GatewayList() ([]types.GatewayMapping, error)
+	GatewaySelect(address string) (*types.GatewayMapping, error)
+	GatewaySelectByKey(key string) (*types.GatewayMapping, error)
+	GatewaySet(address, key string) error
+	GatewayDelete(address string) error
 }
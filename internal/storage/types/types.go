@@ -8,12 +8,23 @@
 
 package types
 
-import "time"
+import (
+	"bufio"
+	"bytes"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+)
 
 type Mail struct {
 	Mailbox  string
 	ID       int
 	Mail     []byte
+	Meta     *MailMeta
 	Date     time.Time
 	Seen     bool
 	Answered bool
@@ -21,8 +32,120 @@ type Mail struct {
 	Deleted  bool
 }
 
+// MailMeta is what we know about a mail without reading all of it. It is
+// worked out once when the mail is stored, so that mail clients listing a
+// mailbox don't make us parse every mail again.
+type MailMeta struct {
+	Size          int
+	Header        []byte
+	Envelope      *imap.Envelope
+	BodyStructure *imap.BodyStructure
+}
+
+// MailSeq ties the sequence number of a mail, i.e. its position in the
+// mailbox, to its ID.
+type MailSeq struct {
+	Seq int
+	ID  int
+}
+
+// ParseMailMeta works out the metadata of a mail. A mail whose header can't
+// be parsed only gets a size, so that the IMAP server skips the items that
+// it would have failed to fetch from the mail itself.
+func ParseMailMeta(data []byte) *MailMeta {
+	meta := &MailMeta{Size: len(data)}
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return meta
+	}
+	meta.Header = data[:len(data)-r.Len()-br.Buffered()]
+	meta.Envelope, _ = backendutil.FetchEnvelope(hdr)
+	meta.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, br, true)
+	return meta
+}
+
+// ExpiresHeaders are the headers that a sender can give a mail a lifetime
+// with, in order of preference. Expires is from RFC 4021.
+var ExpiresHeaders = []string{"X-Yggmail-Expires", "Expires"}
+
+// ExpiresKeyword is the keyword that mails with a lifetime are fetched with,
+// so that mail clients can show that they will go. It is only a marker, and
+// when they go is in the mailbox metadata.
+const ExpiresKeyword = "$Expires"
+
+// Expires returns when a mail with the header expires, or false if it has
+// no lifetime or the date can't be parsed.
+func Expires(hdr textproto.Header) (time.Time, bool) {
+	for _, key := range ExpiresHeaders {
+		if value := hdr.Get(key); value != "" {
+			if date, err := mail.ParseDate(value); err == nil {
+				return date, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// Expires returns when the mail expires, or false if it has no lifetime.
+func (m *MailMeta) Expires() (time.Time, bool) {
+	if m == nil || m.Header == nil {
+		return time.Time{}, false
+	}
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(m.Header)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return Expires(hdr)
+}
+
 type QueuedMail struct {
 	ID   int
 	From string
 	Rcpt string
 }
+
+type Contact struct {
+	Name        string
+	Key         string
+	DisplayName string
+}
+
+type SieveScript struct {
+	Name   string
+	Script string
+	Active bool
+}
+
+type ListMember struct {
+	Key    string
+	Owner  bool
+	Joined time.Time
+}
+
+// GatewayMapping ties an Internet address to a Yggmail key, for mail that
+// passes through a gateway.
+type GatewayMapping struct {
+	Address string
+	Key     string
+}
+
+// Receipt records that a remote node accepted a mail that we sent to one
+// of its recipients.
+type Receipt struct {
+	MessageID string
+	Rcpt      string
+	Delivered time.Time
+}
+
+// DeliveredKeyword is the keyword that mails which have been delivered to
+// at least one recipient are fetched with, when delivery receipts are on.
+const DeliveredKeyword = "$Delivered"
+
+// MessageID returns the Message-Id without the angle brackets, which is how
+// receipts are stored, since the envelope and the header differ in whether
+// they keep them.
+func MessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
@@ -0,0 +1,46 @@
+/*
+ *  Copyright (c) 2021 Neil Alexander
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package transport
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/neilalexander/yggmail/internal/metrics"
+)
+
+var (
+	peerCount      = metrics.NewGauge("yggmail_yggdrasil_peers", "Configured and connected Yggdrasil peers, by whether they are up.", "state")
+	peerInfo       = metrics.NewGauge("yggmail_yggdrasil_peer_info", "Always 1 for each Yggdrasil peer, with where it is in the spanning tree.", "uri", "key", "coords", "inbound")
+	routingEntries = metrics.NewGauge("yggmail_yggdrasil_routing_entries", "Entries in our Yggdrasil routing table.")
+)
+
+// CollectMetrics sets the Yggdrasil gauges from the node's peers. It is
+// meant to be passed to metrics.Collect.
+func (t *YggdrasilTransport) CollectMetrics() {
+	peerCount.Reset()
+	peerInfo.Reset()
+	up, down := 0, 0
+	for _, p := range t.core.GetPeers() {
+		if !p.Up {
+			down++
+			continue
+		}
+		up++
+		coords := make([]string, len(p.Coords))
+		for i, c := range p.Coords {
+			coords[i] = fmt.Sprint(c)
+		}
+		peerInfo.Set(1, p.URI, hex.EncodeToString(p.Key), "["+strings.Join(coords, " ")+"]", fmt.Sprint(p.Inbound))
+	}
+	peerCount.Set(float64(up), "up")
+	peerCount.Set(float64(down), "down")
+	routingEntries.Set(float64(t.core.GetSelf().RoutingEntries))
+}
@@ -9,15 +9,16 @@
 package transport
 
 import (
+	"context"
 	"crypto/ed25519"
-	"encoding/hex"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"regexp"
+	"strings"
 
-	"github.com/fatih/color"
 	gologme "github.com/gologme/log"
+	"github.com/neilalexander/yggmail/internal/logging"
+	"github.com/neilalexander/yggmail/internal/utils"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
 	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
@@ -26,14 +27,17 @@ import (
 
 type YggdrasilTransport struct {
 	yggquic *yggquic.YggdrasilTransport
+	core    *core.Core
 }
 
-func NewYggdrasilTransport(log *log.Logger, sk ed25519.PrivateKey, pk ed25519.PublicKey, peers []string, mcast bool, mcastregexp string) (*YggdrasilTransport, error) {
-	yellow := color.New(color.FgYellow).SprintfFunc()
-	glog := gologme.New(log.Writer(), fmt.Sprintf("[ %s ] ", yellow("Yggdrasil")), gologme.LstdFlags|gologme.Lmsgprefix)
-	glog.EnableLevel("warn")
-	glog.EnableLevel("error")
-	glog.EnableLevel("info")
+func NewYggdrasilTransport(log *slog.Logger, sk ed25519.PrivateKey, pk ed25519.PublicKey, peers []string, mcast bool, mcastregexp string) (*YggdrasilTransport, error) {
+	// Yggdrasil logs everything, and the transport's level decides what
+	// gets written out.
+	glog := gologme.New(&yggdrasilLog{log: log}, "", 0)
+	glog.EnableFormattedPrefix()
+	for _, level := range logging.Levels {
+		glog.EnableLevel(level)
+	}
 
 	cfg := config.GenerateConfig()
 	copy(cfg.PrivateKey, sk)
@@ -48,7 +52,7 @@ func NewYggdrasilTransport(log *log.Logger, sk ed25519.PrivateKey, pk ed25519.Pu
 	{
 		options := []core.SetupOption{
 			core.NodeInfo(map[string]interface{}{
-				"name": hex.EncodeToString(pk) + "@yggmail",
+				"name": utils.CreateAddress(pk),
 			}),
 			core.NodeInfoPrivacy(true),
 		}
@@ -81,6 +85,7 @@ func NewYggdrasilTransport(log *log.Logger, sk ed25519.PrivateKey, pk ed25519.Pu
 
 	return &YggdrasilTransport{
 		yggquic: yq,
+		core:    ygg,
 	}, nil
 }
 
@@ -97,3 +102,45 @@ func (t *YggdrasilTransport) Dial(host string) (net.Conn, error) {
 func (t *YggdrasilTransport) Listener() net.Listener {
 	return t.yggquic
 }
+
+// Address returns the Yggdrasil IPv6 address of the node.
+func (t *YggdrasilTransport) Address() net.IP {
+	return t.core.Address()
+}
+
+// Subnet returns the Yggdrasil IPv6 subnet of the node.
+func (t *YggdrasilTransport) Subnet() net.IPNet {
+	return t.core.Subnet()
+}
+
+// Peers returns the Yggdrasil peers that the node is configured with or
+// connected to, and their state.
+func (t *YggdrasilTransport) Peers() []core.PeerInfo {
+	return t.core.GetPeers()
+}
+
+// yggdrasilLog passes each line that Yggdrasil logs on to the transport's
+// logger, at the level that Yggdrasil gave it.
+type yggdrasilLog struct {
+	log *slog.Logger
+}
+
+var yggdrasilLevels = map[string]slog.Level{
+	"[ERROR]": slog.LevelError,
+	"[WARN]":  slog.LevelWarn,
+	"[INFO]":  slog.LevelInfo,
+	"[DEBUG]": slog.LevelDebug,
+	"[TRACE]": logging.LevelTrace,
+}
+
+func (y *yggdrasilLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	level := slog.LevelInfo
+	if prefix, msg, ok := strings.Cut(line, " "); ok {
+		if l, ok := yggdrasilLevels[prefix]; ok {
+			level, line = l, strings.TrimSpace(msg)
+		}
+	}
+	y.log.Log(context.Background(), level, line)
+	return len(p), nil
+}
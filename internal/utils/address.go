@@ -9,7 +9,10 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/hex"
 	"fmt"
 	"strings"
@@ -17,26 +20,109 @@ import (
 
 const Domain = "yggmail"
 
+// SubaddressSeparators are all of the separators that may appear between
+// the key and the tag in a sub-address, i.e. key+tag@yggmail.
+const SubaddressSeparators = "+-"
+
+// The short form of an address is the public key followed by a short
+// checksum, encoded as unpadded lowercase base32. The checksum means that
+// typos are caught rather than sending mail to the wrong key.
+const (
+	shortChecksumSize = 3
+	shortKeyLength    = (ed25519.PublicKeySize + shortChecksumSize) * 8 / 5
+	hexKeyLength      = ed25519.PublicKeySize * 2
+)
+
+var shortEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func shortChecksum(pk ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(append([]byte(Domain), pk...))
+	return sum[:shortChecksumSize]
+}
+
+// EncodeKey returns the canonical hex form of the public key, as used on
+// the wire between Yggmail nodes.
+func EncodeKey(pk ed25519.PublicKey) string {
+	return hex.EncodeToString(pk)
+}
+
+// EncodeShortKey returns the shorter checksummed form of the public key.
+func EncodeShortKey(pk ed25519.PublicKey) string {
+	return shortEncoding.EncodeToString(append(append([]byte{}, pk...), shortChecksum(pk)...))
+}
+
 func CreateAddress(pk ed25519.PublicKey) string {
 	return fmt.Sprintf(
 		"%s@%s",
-		pk, Domain,
+		EncodeKey(pk), Domain,
 	)
 }
 
-func ParseAddress(email string) (ed25519.PublicKey, error) {
+func CreateShortAddress(pk ed25519.PublicKey) string {
+	return fmt.Sprintf(
+		"%s@%s",
+		EncodeShortKey(pk), Domain,
+	)
+}
+
+// ParseKey decodes a public key given in either the hex or the short form.
+func ParseKey(key string) (ed25519.PublicKey, error) {
+	key = strings.ToLower(key)
+	switch len(key) {
+	case hexKeyLength:
+		pk, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("hex.DecodeString: %w", err)
+		}
+		return ed25519.PublicKey(pk), nil
+
+	case shortKeyLength:
+		b, err := shortEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("shortEncoding.DecodeString: %w", err)
+		}
+		if len(b) != ed25519.PublicKeySize+shortChecksumSize {
+			return nil, fmt.Errorf("invalid key length")
+		}
+		pk := ed25519.PublicKey(b[:ed25519.PublicKeySize])
+		if !bytes.Equal(b[ed25519.PublicKeySize:], shortChecksum(pk)) {
+			return nil, fmt.Errorf("invalid key checksum, check for typos")
+		}
+		return pk, nil
+
+	default:
+		return nil, fmt.Errorf("invalid key length")
+	}
+}
+
+// ParseAddress parses an address, ignoring any sub-address tag after one
+// of the given separators, which should be the configured separator so
+// that tags aren't stripped when sub-addressing is disabled.
+func ParseAddress(email, separators string) (ed25519.PublicKey, error) {
+	pk, _, err := ParseSubaddress(email, separators)
+	return pk, err
+}
+
+// ParseSubaddress parses an address which may contain a sub-address tag
+// after any one of the given separators. The returned detail is either
+// empty or contains the separator followed by the tag, i.e. "+github".
+func ParseSubaddress(email, separators string) (ed25519.PublicKey, string, error) {
 	at := strings.LastIndex(email, "@")
-	if at == 0 {
-		return nil, fmt.Errorf("invalid email address")
+	if at <= 0 {
+		return nil, "", fmt.Errorf("invalid email address")
 	}
 	if email[at+1:] != Domain {
-		return nil, fmt.Errorf("invalid email domain")
+		return nil, "", fmt.Errorf("invalid email domain")
+	}
+	localpart, detail := email[:at], ""
+	if separators != "" {
+		if sep := strings.IndexAny(localpart, separators); sep >= 0 {
+			localpart, detail = localpart[:sep], localpart[sep:]
+		}
 	}
-	pk, err := hex.DecodeString(email[:at])
+	pk, err := ParseKey(localpart)
 	if err != nil {
-		return nil, fmt.Errorf("hex.DecodeString: %w", err)
+		return nil, "", err
 	}
-	ed := make(ed25519.PublicKey, ed25519.PublicKeySize)
-	copy(ed, pk)
-	return ed, nil
+	return pk, detail, nil
 }